@@ -170,11 +170,14 @@ async function uploadVideoFile(videoID) {
       },
       body: formData,
     });
+    const data = await res.json();
     if (!res.ok) {
-      const data = await res.json();
       throw new Error(`Failed to upload video file. Error: ${data.error}`);
     }
 
+    document.getElementById(uploadBtnSelector).textContent = 'Processing...';
+    await waitForJob(data.id);
+
     console.log('Video uploaded!');
     await getVideo(videoID);
   } catch (error) {
@@ -184,6 +187,28 @@ async function uploadVideoFile(videoID) {
   setUploadButtonState(false, uploadBtnSelector);
 }
 
+async function waitForJob(jobID) {
+  while (true) {
+    const res = await fetch(`/api/jobs/${jobID}`, {
+      method: 'GET',
+      headers: {
+        Authorization: `Bearer ${localStorage.getItem('token')}`,
+      },
+    });
+    const job = await res.json();
+    if (!res.ok) {
+      throw new Error(`Failed to get processing status. Error: ${job.error}`);
+    }
+    if (job.status === 'done') {
+      return;
+    }
+    if (job.status === 'failed') {
+      throw new Error(`Failed to process video. Error: ${job.error}`);
+    }
+    await new Promise((resolve) => setTimeout(resolve, 2000));
+  }
+}
+
 const videoStateHandler = createVideoStateHandler();
 
 async function getVideos() {
@@ -199,7 +224,7 @@ async function getVideos() {
       throw new Error(`Failed to get videos. Error: ${data.error}`);
     }
 
-    const videos = await res.json();
+    const { videos } = await res.json();
     const videoList = document.getElementById('video-list');
     videoList.innerHTML = '';
     for (const video of videos) {
@@ -1,7 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -10,3 +23,254 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	}
 	return nil
 }
+
+// checkTempDir makes sure uploads can be buffered in cfg.tempDir, so a
+// missing or read-only directory fails at startup rather than per upload.
+func (cfg apiConfig) checkTempDir() error {
+	info, err := os.Stat(cfg.tempDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", cfg.tempDir)
+	}
+
+	probe, err := os.CreateTemp(cfg.tempDir, "tubely-probe-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", cfg.tempDir, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// newTempFile creates a temp file in cfg.tempDir, named like
+// os.CreateTemp's pattern. The returned func closes and removes it; call
+// it once, usually deferred, unless the file is handed off to something
+// that removes it later.
+func (cfg apiConfig) newTempFile(pattern string) (*os.File, func(), error) {
+	file, err := os.CreateTemp(cfg.tempDir, pattern)
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+	return file, cleanup, nil
+}
+
+// getAssetKey returns a random 32-byte hex name with the given extension,
+// e.g. 1a2b3c...7890.mp4. Both the server-side and direct-to-S3 upload
+// flows use it so stored keys share one format.
+func getAssetKey(ext string) (string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randomBytes) + ext, nil
+}
+
+// isAssetKey reports whether key has the shape produced by getAssetKey.
+func isAssetKey(key, ext string) bool {
+	if len(key) != 64+len(ext) || key[64:] != ext {
+		return false
+	}
+	_, err := hex.DecodeString(key[:64])
+	return err == nil
+}
+
+// getAssetName returns a random URL-safe filename for a local asset.
+func getAssetName(ext string) (string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes) + ext, nil
+}
+
+func (cfg apiConfig) getAssetDiskPath(name string) string {
+	return filepath.Join(cfg.assetsRoot, name)
+}
+
+// thumbnailKeyPrefix is the S3 folder thumbnails are stored under when
+// S3_THUMBNAILS is enabled.
+const thumbnailKeyPrefix = "thumbnails/"
+
+// normalizeKeyPrefix turns S3_KEY_PREFIX into "" or a folder ending in a
+// single slash, e.g. "/prod/" and "prod" both become "prod/".
+func normalizeKeyPrefix(prefix string) string {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+// prefixedKey puts key under S3_KEY_PREFIX. Stored video URLs include the
+// prefix, so only newly generated keys go through here.
+func (cfg apiConfig) prefixedKey(key string) string {
+	return cfg.keyPrefix + key
+}
+
+func (cfg apiConfig) thumbnailKey(name string) string {
+	return cfg.prefixedKey(thumbnailKeyPrefix + name)
+}
+
+func (cfg apiConfig) getAssetURL(name string) string {
+	if cfg.s3Thumbnails {
+		if cfg.s3CfDistribution != "" {
+			return fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, cfg.thumbnailKey(name))
+		}
+		return cfg.s3ObjectURL(cfg.thumbnailKey(name))
+	}
+	return fmt.Sprintf("%s/assets/%s", cfg.assetsBaseURL, name)
+}
+
+// s3ObjectURL returns the public URL of key in the bucket, honouring
+// S3_ENDPOINT and S3_USE_PATH_STYLE.
+func (cfg apiConfig) s3ObjectURL(key string) string {
+	if cfg.s3Endpoint == "" {
+		if cfg.s3UsePathStyle {
+			return fmt.Sprintf("https://s3.%s.amazonaws.com/%s/%s", cfg.s3Region, cfg.s3Bucket, key)
+		}
+		return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", cfg.s3Bucket, cfg.s3Region, key)
+	}
+	if cfg.s3UsePathStyle {
+		return fmt.Sprintf("%s/%s/%s", cfg.s3Endpoint, cfg.s3Bucket, key)
+	}
+	// The endpoint was validated at startup
+	u, _ := url.Parse(cfg.s3Endpoint)
+	return fmt.Sprintf("%s://%s.%s/%s", u.Scheme, cfg.s3Bucket, u.Host, key)
+}
+
+// saveAsset stores src under name, in S3 when S3_THUMBNAILS is enabled and
+// in the assets directory otherwise. Local writes are atomic: the file
+// either appears complete or not at all.
+func (cfg apiConfig) saveAsset(ctx context.Context, name string, src io.ReadSeeker) error {
+	if cfg.s3Thumbnails {
+		key := cfg.thumbnailKey(name)
+		contentType := mime.TypeByExtension(filepath.Ext(name))
+		err := cfg.putObjectWithRetry(ctx, &s3.PutObjectInput{
+			Bucket:               &cfg.s3Bucket,
+			Key:                  &key,
+			ContentType:          &contentType,
+			CacheControl:         &cfg.s3CacheControl,
+			ServerSideEncryption: cfg.s3SSE,
+			SSEKMSKeyId:          cfg.s3SSEKMSKeyID,
+		}, src)
+		if err != nil {
+			return fmt.Errorf("couldn't upload file to S3: %w", err)
+		}
+		return nil
+	}
+
+	// Write to a temp file in the same directory and rename it into place,
+	// so a crash mid-copy never leaves a truncated asset being served. The
+	// leading dot keeps handlerServeAsset from serving the temp file.
+	filePath := cfg.getAssetDiskPath(name)
+	tempFile, err := os.CreateTemp(filepath.Dir(filePath), "."+name+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("couldn't create file: %w", err)
+	}
+	renamed := false
+	defer func() {
+		if !renamed {
+			tempFile.Close()
+			os.Remove(tempFile.Name())
+		}
+	}()
+
+	_, err = io.Copy(tempFile, src)
+	if err != nil {
+		return fmt.Errorf("couldn't save file: %w", err)
+	}
+	// CreateTemp makes the file readable by its owner only
+	err = tempFile.Chmod(0o644)
+	if err != nil {
+		return fmt.Errorf("couldn't set file permissions: %w", err)
+	}
+	err = tempFile.Sync()
+	if err != nil {
+		return fmt.Errorf("couldn't flush file: %w", err)
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return fmt.Errorf("couldn't close file: %w", err)
+	}
+
+	err = os.Rename(tempFile.Name(), filePath)
+	if err != nil {
+		return fmt.Errorf("couldn't move file into place: %w", err)
+	}
+	renamed = true
+	return nil
+}
+
+// removeAsset deletes an asset saved by saveAsset. It's best effort, as
+// it's only used to clean up after other failures.
+func (cfg apiConfig) removeAsset(ctx context.Context, name string) {
+	if cfg.s3Thumbnails {
+		key := cfg.thumbnailKey(name)
+		_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &cfg.s3Bucket,
+			Key:    &key,
+		})
+		if err != nil && !isS3NotFound(err) {
+			log.Printf("Couldn't delete %s from S3: %v", key, err)
+		}
+		return
+	}
+	os.Remove(cfg.getAssetDiskPath(name))
+}
+
+// getAssetNameFromURL returns the local asset filename a URL built by
+// getAssetURL points at, or false if it points somewhere else.
+func (cfg apiConfig) getAssetNameFromURL(assetURL string) (string, bool) {
+	prefix := cfg.getAssetURL("")
+	if !strings.HasPrefix(assetURL, prefix) {
+		return "", false
+	}
+	name := strings.TrimPrefix(assetURL, prefix)
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return "", false
+	}
+	return name, true
+}
+
+// removeThumbnail deletes a stored thumbnail and any resized variants or
+// WebP copy of it. Thumbnails hosted elsewhere are left alone.
+func (cfg apiConfig) removeThumbnail(ctx context.Context, thumbnailURL string) {
+	name, ok := cfg.getAssetNameFromURL(thumbnailURL)
+	if !ok {
+		return
+	}
+	cfg.removeAsset(ctx, name)
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for _, size := range thumbnailSizes {
+		cfg.removeAsset(ctx, fmt.Sprintf("%s_%s%s", base, size.name, ext))
+	}
+	if ext != ".webp" {
+		cfg.removeAsset(ctx, webpThumbnailName(name))
+	}
+}
+
+// removePreview deletes a stored preview. Previews hosted elsewhere are
+// left alone.
+func (cfg apiConfig) removePreview(ctx context.Context, previewURL string) {
+	name, ok := cfg.getAssetNameFromURL(previewURL)
+	if !ok {
+		return
+	}
+	cfg.removeAsset(ctx, name)
+}
+
+// videoContentDisposition names downloads of a video after its title.
+func videoContentDisposition(title string) string {
+	return mime.FormatMediaType("inline", map[string]string{
+		"filename": title + ".mp4",
+	})
+}
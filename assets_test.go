@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewTempFileCleanup(t *testing.T) {
+	cfg := apiConfig{tempDir: t.TempDir()}
+
+	file, cleanup, err := cfg.newTempFile("tubely-test-*.mp4")
+	if err != nil {
+		t.Fatalf("newTempFile: %v", err)
+	}
+	if filepath.Dir(file.Name()) != cfg.tempDir {
+		t.Errorf("file created in %s, want %s", filepath.Dir(file.Name()), cfg.tempDir)
+	}
+	if !strings.HasSuffix(file.Name(), ".mp4") {
+		t.Errorf("file name %s lost the pattern's extension", file.Name())
+	}
+	if _, err := file.WriteString("data"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	cleanup()
+
+	if _, err := os.Stat(file.Name()); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("file still there after cleanup: %v", err)
+	}
+	if _, err := file.WriteString("more"); err == nil {
+		t.Error("file still open after cleanup")
+	}
+}
+
+func TestNewTempFileCleanupAfterClose(t *testing.T) {
+	cfg := apiConfig{tempDir: t.TempDir()}
+
+	// Handlers that only need the path close the file straight away
+	file, cleanup, err := cfg.newTempFile("tubely-test-*")
+	if err != nil {
+		t.Fatalf("newTempFile: %v", err)
+	}
+	file.Close()
+	cleanup()
+
+	entries, err := os.ReadDir(cfg.tempDir)
+	if err != nil {
+		t.Fatalf("read temp dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("temp dir has %d entries after cleanup, want 0", len(entries))
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+// loudnormFilter is EBU R128 loudness normalization to -16 LUFS, the
+// usual target for web and mobile playback, with peaks kept under -1.5
+// dBTP.
+const loudnormFilter = "loudnorm=I=-16:TP=-1.5:LRA=11"
+
+// loudnormArgs are the ffmpeg options that normalize the audio, added
+// after any other audio options so these win. The audio has to be
+// re-encoded, and loudnorm works at 192kHz internally, so the output is
+// brought back to 48kHz.
+func loudnormArgs() []string {
+	return []string{"-af", loudnormFilter, "-c:a", "aac", "-ar", "48000"}
+}
+
+// hasAudioStream reports whether ffprobe found any audio in the file.
+func (data FFProbeOutput) hasAudioStream() bool {
+	for _, stream := range data.Streams {
+		if stream.CodecType == "audio" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLoudnormInFFmpegArgs(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		normalize bool
+	}{
+		{"remux", fastStartArgs("in.mp4", "out.mp4", true), true},
+		{"remux without normalizing", fastStartArgs("in.mp4", "out.mp4", false), false},
+		{"transcode", transcodeArgs("in.mov", "out.mp4", qualityPresetMedium, true), true},
+		{"transcode without normalizing", transcodeArgs("in.mov", "out.mp4", qualityPresetMedium, false), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			i := slices.Index(args, "-af")
+			if !tt.normalize {
+				if i >= 0 {
+					t.Errorf("args = %q, want no audio filter", args)
+				}
+				return
+			}
+			if i < 0 || i+1 >= len(args) || args[i+1] != loudnormFilter {
+				t.Fatalf("args = %q, want -af %s", args, loudnormFilter)
+			}
+			// The audio must be re-encoded for the filter to apply, so
+			// the last audio codec option has to win over any copy
+			if j := slices.Index(args[i:], "-c:a"); j < 0 || args[i+j+1] != "aac" {
+				t.Errorf("args = %q, want -c:a aac after the filter", args)
+			}
+			if args[len(args)-1] != "out.mp4" {
+				t.Errorf("args = %q, want the output path last", args)
+			}
+		})
+	}
+}
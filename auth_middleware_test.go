@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestWithAuth(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	userID := uuid.New()
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{name: "missing token"},
+		{name: "bad token", token: "not-a-jwt"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reached := false
+			req := newTestRequest(http.MethodGet, "/api/videos", nil, tc.token)
+			rec := serveAuthed(cfg, func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+			}, req)
+			expectErrorCode(t, rec, http.StatusUnauthorized, errCodeUnauthorized)
+			if reached {
+				t.Error("handler ran without a valid token")
+			}
+		})
+	}
+
+	t.Run("invalid video ID", func(t *testing.T) {
+		// The ID is checked before the token, so a bad one is a 400 even
+		// without credentials
+		req := newTestRequest(http.MethodPost, "/api/video_upload/not-a-uuid", nil, "", "videoID", "not-a-uuid")
+		rec := serveAuthed(cfg, func(w http.ResponseWriter, r *http.Request) {
+			t.Error("handler ran with an invalid video ID")
+		}, req)
+		expectErrorCode(t, rec, http.StatusBadRequest, errCodeInvalidID)
+	})
+
+	t.Run("valid token", func(t *testing.T) {
+		var got uuid.UUID
+		req := newTestRequest(http.MethodGet, "/api/videos", nil, testToken(t, cfg, userID))
+		rec := serveAuthed(cfg, func(w http.ResponseWriter, r *http.Request) {
+			got = userIDFromContext(r)
+			w.WriteHeader(http.StatusNoContent)
+		}, req)
+		expectStatus(t, rec, http.StatusNoContent)
+		if got != userID {
+			t.Errorf("user ID in context = %s, want %s", got, userID)
+		}
+	})
+}
@@ -2,9 +2,12 @@ package main
 
 import "net/http"
 
+// noCacheMiddleware makes clients revalidate responses before reusing
+// them. Unlike no-store, this still lets them keep a copy and get a 304
+// back when it hasn't changed.
 func noCacheMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Cache-Control", "no-cache")
 		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/cloudfront/sign"
+)
+
+// newCloudFrontURLSigner loads the PEM private key of a CloudFront key pair
+// so URLs for a private distribution can be signed.
+func newCloudFrontURLSigner(keyPairID, privateKeyPath string) (*sign.URLSigner, error) {
+	privateKey, err := sign.LoadPEMPrivKeyFile(privateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't load CloudFront private key: %w", err)
+	}
+	return sign.NewURLSigner(keyPairID, privateKey), nil
+}
+
+// generateCloudFrontURL returns the distribution URL for key, signed with
+// a canned policy when a key pair is configured.
+func (cfg *apiConfig) generateCloudFrontURL(key string, expireTime time.Duration) (string, error) {
+	cdnURL := fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, key)
+	if cfg.cfURLSigner == nil {
+		return cdnURL, nil
+	}
+	return cfg.cfURLSigner.Sign(cdnURL, time.Now().Add(expireTime))
+}
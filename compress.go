@@ -0,0 +1,174 @@
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const defaultGzipMinBytes = 1024
+
+var gzipWriterPool = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// gzipMiddleware compresses text and JSON responses for clients that accept
+// gzip. Responses shorter than GZIP_MIN_BYTES, already encoded, or of
+// binary types like images and video are sent as they are.
+func (cfg *apiConfig) gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		// Compressing a range would change what the byte offsets refer to
+		if !acceptsGzip(r) || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, minSize: cfg.gzipMinBytes}
+		defer gw.Close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			q := 1.0
+			if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				q, _ = strconv.ParseFloat(value, 64)
+			}
+			return q > 0
+		}
+	}
+	return false
+}
+
+// compressibleTypes are the media types worth compressing, besides text/*.
+var compressibleTypes = map[string]bool{
+	"application/json":       true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+}
+
+func isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType]
+}
+
+// gzipResponseWriter holds back the start of the body until it knows
+// whether the response is big enough to compress, then either compresses
+// everything or passes it through untouched.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (gw *gzipResponseWriter) WriteHeader(code int) {
+	if gw.decided || gw.status != 0 {
+		return
+	}
+	gw.status = code
+	// These responses have no body to compress
+	if code == http.StatusNoContent || code == http.StatusNotModified || code < 200 {
+		gw.start(false)
+	}
+}
+
+func (gw *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !gw.decided {
+		gw.buf = append(gw.buf, b...)
+		if len(gw.buf) >= gw.minSize {
+			if err := gw.start(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(b)
+	}
+	return gw.ResponseWriter.Write(b)
+}
+
+// start sends the headers, compressing the rest of the response if
+// compress is set and the content type allows it, and writes out whatever
+// has been held back so far.
+func (gw *gzipResponseWriter) start(compress bool) error {
+	gw.decided = true
+	h := gw.Header()
+	if h.Get("Content-Type") == "" && len(gw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(gw.buf))
+	}
+	if compress && h.Get("Content-Encoding") == "" && isCompressible(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		gw.gz = gzipWriterPool.Get().(*gzip.Writer)
+		gw.gz.Reset(gw.ResponseWriter)
+	}
+
+	if gw.status == 0 {
+		gw.status = http.StatusOK
+	}
+	gw.ResponseWriter.WriteHeader(gw.status)
+
+	buf := gw.buf
+	gw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if gw.gz != nil {
+		_, err = gw.gz.Write(buf)
+	} else {
+		_, err = gw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush sends what has been written so far, so streamed responses aren't
+// held back waiting for the size threshold.
+func (gw *gzipResponseWriter) Flush() {
+	if !gw.decided {
+		gw.start(true)
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+// Close finishes the response once the handler has returned, sending a
+// body that never reached the threshold uncompressed.
+func (gw *gzipResponseWriter) Close() {
+	if !gw.decided {
+		gw.start(gw.minSize == 0 && len(gw.buf) > 0)
+	}
+	if gw.gz != nil {
+		gw.gz.Close()
+		gzipWriterPool.Put(gw.gz)
+		gw.gz = nil
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// set deadlines on uploads.
+func (gw *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
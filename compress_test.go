@@ -0,0 +1,61 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzipMiddleware(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+
+	tests := []struct {
+		name    string
+		body    string
+		gzipped bool
+	}{
+		{name: "large", body: strings.Repeat("tubely ", cfg.gzipMinBytes), gzipped: true},
+		{name: "small", body: "tubely"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := cfg.gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				respondWithJSON(w, http.StatusOK, map[string]string{"body": tc.body})
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/api/videos", nil)
+			req.Header.Set("Accept-Encoding", "gzip, deflate")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			expectStatus(t, rec, http.StatusOK)
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+			if !tc.gzipped {
+				if got := rec.Header().Get("Content-Encoding"); got != "" {
+					t.Errorf("Content-Encoding = %q for a %d byte response", got, rec.Body.Len())
+				}
+				decodeResponse[map[string]string](t, rec)
+				return
+			}
+
+			if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+				t.Fatalf("Content-Encoding = %q, want gzip", got)
+			}
+			gz, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(gz)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), "tubely tubely") {
+				t.Errorf("decompressed body %.40q... isn't the response", data)
+			}
+		})
+	}
+}
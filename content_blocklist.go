@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// parseContentHash normalizes a hex SHA-256, as stored in content_hash,
+// reporting false if value isn't one.
+func parseContentHash(value string) (string, bool) {
+	hash := strings.ToLower(strings.TrimSpace(value))
+	decoded, err := hex.DecodeString(hash)
+	if err != nil || len(decoded) != 32 {
+		return "", false
+	}
+	return hash, true
+}
+
+// parseBlockedHashes parses BLOCKED_CONTENT_HASHES, a comma-separated list
+// of hex SHA-256 hashes.
+func parseBlockedHashes(value string) ([]string, error) {
+	var hashes []string
+	for _, item := range strings.Split(value, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		hash, ok := parseContentHash(item)
+		if !ok {
+			return nil, fmt.Errorf("%q isn't a hex SHA-256 hash", item)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// respondIfBlockedContent sends a 403 when the uploaded file's hash is on
+// the blocklist, logging the attempt, and reports whether it did.
+func (cfg *apiConfig) respondIfBlockedContent(w http.ResponseWriter, r *http.Request, userID, videoID uuid.UUID, contentHash string) bool {
+	blocked, err := cfg.db.GetBlockedHash(contentHash)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check content blocklist", err)
+		return true
+	}
+	if blocked == nil {
+		return false
+	}
+	slog.Warn("Rejected upload of blocked content",
+		slog.String("request_id", w.Header().Get(requestIDHeader)),
+		slog.String("path", r.URL.Path),
+		slog.String("user_id", userID.String()),
+		slog.String("video_id", videoID.String()),
+		slog.String("content_hash", contentHash),
+		slog.String("reason", blocked.Reason),
+	)
+	respondWithErrorCode(w, http.StatusForbidden, errCodeBlockedContent, "This content can't be uploaded", nil)
+	return true
+}
+
+// handlerBlockContentHash adds a SHA-256 to the content blocklist, so
+// files with that hash are rejected from now on, and purges every video
+// already made from one, deleted or not. Blocking a hash again retries the
+// purge. It requires a token with the admin scope.
+func (cfg *apiConfig) handlerBlockContentHash(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Hash   string `json:"hash"`
+		Reason string `json:"reason"`
+	}
+	type response struct {
+		Hash          string      `json:"hash"`
+		DeletedVideos []uuid.UUID `json:"deleted_videos"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	_, err = auth.ValidateJWTWithScope(token, cfg.jwtTokens, auth.ScopeAdmin)
+	if errors.Is(err, auth.ErrMissingScope) {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	hash, ok := parseContentHash(params.Hash)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "hash must be a hex SHA-256", nil)
+		return
+	}
+
+	err = cfg.db.BlockHash(hash, params.Reason)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't block hash", err)
+		return
+	}
+
+	videos, err := cfg.db.GetVideosByContentHashWithDeleted(hash)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Blocked hash but couldn't find its videos", err)
+		return
+	}
+
+	deleted := []uuid.UUID{}
+	for _, video := range videos {
+		unlock, err := cfg.acquireVideoLock(r.Context(), video.ID)
+		if err != nil {
+			if respondIfVideoBusy(w, err) {
+				return
+			}
+			respondWithError(w, http.StatusInternalServerError, "Couldn't lock video", err)
+			return
+		}
+		err = cfg.purgeVideo(r.Context(), video)
+		unlock()
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Blocked hash but couldn't delete video %s after deleting %d", video.ID, len(deleted)), err)
+			return
+		}
+		slog.Info("Deleted video with blocked content", "video_id", video.ID, "user_id", video.UserID, "content_hash", hash)
+		deleted = append(deleted, video.ID)
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Hash:          hash,
+		DeletedVideos: deleted,
+	})
+}
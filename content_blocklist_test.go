@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+func TestUploadBlockedContent(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "10.0"))
+	useFakeFFmpeg(t, cfg)
+	runTestWorkers(t, cfg)
+	user := createTestUser(t, cfg)
+	token := testToken(t, cfg, user.ID)
+	existing := uploadTestVideo(t, cfg, createTestVideo(t, cfg, user.ID).ID, token, testMP4)
+
+	sum := sha256.Sum256(testMP4)
+	hash := hex.EncodeToString(sum[:])
+	admin := testToken(t, cfg, createTestUser(t, cfg).ID, auth.ScopeAdmin)
+	req := newTestRequest(http.MethodPost, "/admin/blocked_hashes", jsonBody(t, map[string]string{"hash": hash, "reason": "takedown"}), admin)
+	rec := serve(cfg.handlerBlockContentHash, req)
+	expectStatus(t, rec, http.StatusOK)
+	blocked := decodeResponse[struct {
+		DeletedVideos []uuid.UUID `json:"deleted_videos"`
+	}](t, rec)
+	if len(blocked.DeletedVideos) != 1 || blocked.DeletedVideos[0] != existing.ID {
+		t.Errorf("deleted videos = %v, want the existing upload %s", blocked.DeletedVideos, existing.ID)
+	}
+
+	puts := fake.callCount("PutObject")
+	video := createTestVideo(t, cfg, user.ID)
+	body, contentType := videoUploadForm(t, "video/mp4", testMP4, nil)
+	rec = serveAuthed(cfg, cfg.handlerUploadVideo, newVideoUploadRequest(video.ID, token, body, contentType))
+	expectErrorCode(t, rec, http.StatusForbidden, errCodeBlockedContent)
+	if got := fake.callCount("PutObject"); got != puts {
+		t.Errorf("PutObject called %d more times for blocked content", got-puts)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	corsAllowedMethods = "GET, POST, PUT, PATCH, DELETE"
+	corsAllowedHeaders = "Authorization, Content-Type, Idempotency-Key"
+	corsMaxAge         = "600"
+)
+
+// parseCORSOrigins turns a comma-separated origin list into a set.
+func parseCORSOrigins(value string) map[string]bool {
+	origins := map[string]bool{}
+	for _, origin := range strings.Split(value, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin != "" {
+			origins[strings.TrimSuffix(origin, "/")] = true
+		}
+	}
+	return origins
+}
+
+// corsMiddleware lets the origins in CORS_ALLOWED_ORIGINS call the API from
+// a browser. The request's origin is echoed back rather than "*", since
+// requests carry credentials. Preflights from other origins get a 403.
+func (cfg *apiConfig) corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+
+		allowed := cfg.corsOrigins[origin]
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			if !allowed {
+				respondWithError(w, http.StatusForbidden, "Origin not allowed", nil)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Expose-Headers", requestIDHeader+", "+idempotentReplayedHeader)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
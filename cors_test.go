@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.corsOrigins = parseCORSOrigins("https://app.example.com/, https://admin.example.com")
+	handler := cfg.corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("preflight reached the handler")
+	}))
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/api/video_upload/123", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		req.Header.Set("Access-Control-Request-Headers", "authorization, content-type")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("allowed origin", func(t *testing.T) {
+		rec := preflight("https://app.example.com")
+		expectStatus(t, rec, http.StatusNoContent)
+		want := map[string]string{
+			"Access-Control-Allow-Origin":      "https://app.example.com",
+			"Access-Control-Allow-Credentials": "true",
+			"Access-Control-Allow-Methods":     corsAllowedMethods,
+			"Access-Control-Allow-Headers":     corsAllowedHeaders,
+		}
+		for header, value := range want {
+			if got := rec.Header().Get(header); got != value {
+				t.Errorf("%s = %q, want %q", header, got, value)
+			}
+		}
+	})
+
+	t.Run("disallowed origin", func(t *testing.T) {
+		rec := preflight("https://evil.example.com")
+		expectStatus(t, rec, http.StatusForbidden)
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("Access-Control-Allow-Origin = %q for a disallowed origin", got)
+		}
+	})
+}
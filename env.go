@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// getEnvDuration reads an optional duration (e.g. "15m") from the
+// environment, falling back to the default when the variable is unset.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	d := getEnvDurationAllowZero(key, fallback)
+	if d == 0 {
+		log.Fatalf("%s must be positive", key)
+	}
+	return d
+}
+
+// getEnvDurationAllowZero is getEnvDuration for options where 0 turns a
+// limit off, such as MAX_VIDEO_DURATION; only negative values are rejected.
+func getEnvDurationAllowZero(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("%s must be a valid duration: %v", key, err)
+	}
+	if d < 0 {
+		log.Fatalf("%s can't be negative", key)
+	}
+	return d
+}
+
+// getEnvBool reads an optional boolean (e.g. "true", "1") from the
+// environment, falling back to the default when the variable is unset.
+func getEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("%s must be a boolean: %v", key, err)
+	}
+	return b
+}
+
+// getEnvFloat reads an optional number from the environment, falling back
+// to the default when the variable is unset.
+func getEnvFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Fatalf("%s must be a number: %v", key, err)
+	}
+	return f
+}
+
+// getEnvInt reads an optional integer from the environment, falling back to
+// the default when the variable is unset.
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("%s must be an integer: %v", key, err)
+	}
+	return i
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetEnvDurationAllowZero(t *testing.T) {
+	t.Setenv("MAX_VIDEO_DURATION", "0")
+	if got := getEnvDurationAllowZero("MAX_VIDEO_DURATION", 10*time.Minute); got != 0 {
+		t.Errorf("MAX_VIDEO_DURATION=0 read as %s, want 0", got)
+	}
+
+	t.Setenv("MAX_VIDEO_DURATION", "10m")
+	if got := getEnvDurationAllowZero("MAX_VIDEO_DURATION", 0); got != 10*time.Minute {
+		t.Errorf("MAX_VIDEO_DURATION=10m read as %s, want 10m", got)
+	}
+
+	t.Setenv("MAX_VIDEO_DURATION", "")
+	if got := getEnvDurationAllowZero("MAX_VIDEO_DURATION", 5*time.Minute); got != 5*time.Minute {
+		t.Errorf("unset MAX_VIDEO_DURATION read as %s, want the 5m default", got)
+	}
+}
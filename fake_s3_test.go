@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// fakeS3 is an in-memory S3API. Objects are keyed by bucket and key, and
+// every call is counted by operation name so tests can check what was
+// sent. Errors queued with failNext are returned, one per call, before
+// the operation does anything else.
+type fakeS3 struct {
+	mu        sync.Mutex
+	objects   map[string]fakeS3Object
+	uploads   map[string]*fakeS3Upload
+	calls     map[string]int
+	errs      map[string][]error
+	puts      []s3.PutObjectInput
+	putBodies [][]byte
+	completes []s3.CompleteMultipartUploadInput
+	nextID    int
+}
+
+type fakeS3Object struct {
+	body           []byte
+	contentType    string
+	cacheControl   string
+	checksumSHA256 string
+	storageClass   types.StorageClass
+	metadata       map[string]string
+	tags           []types.Tag
+	lastModified   time.Time
+}
+
+type fakeS3Upload struct {
+	bucket      string
+	key         string
+	contentType string
+	parts       map[int32][]byte
+}
+
+var _ S3API = (*fakeS3)(nil)
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: map[string]fakeS3Object{},
+		uploads: map[string]*fakeS3Upload{},
+		calls:   map[string]int{},
+		errs:    map[string][]error{},
+	}
+}
+
+func fakeS3Path(bucket, key string) string {
+	return bucket + "/" + key
+}
+
+// failNext makes the next len(errs) calls to op fail with errs, in order.
+func (f *fakeS3) failNext(op string, errs ...error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs[op] = append(f.errs[op], errs...)
+}
+
+// callCount returns how many times op has been called, failures included.
+func (f *fakeS3) callCount(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// putObject stores an object directly, for tests that need one in place.
+func (f *fakeS3) putObject(bucket, key string, body []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[fakeS3Path(bucket, key)] = fakeS3Object{
+		body:         body,
+		storageClass: types.StorageClassStandard,
+		lastModified: time.Now(),
+	}
+}
+
+func (f *fakeS3) object(bucket, key string) (fakeS3Object, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object, ok := f.objects[fakeS3Path(bucket, key)]
+	return object, ok
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, 0, len(f.objects))
+	for path := range f.objects {
+		keys = append(keys, path)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// start counts a call to op and returns the error queued for it, if any.
+// It must be called with f.mu held.
+func (f *fakeS3) start(op string) error {
+	f.calls[op]++
+	if errs := f.errs[op]; len(errs) > 0 {
+		f.errs[op] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+func fakeETag(body []byte) *string {
+	sum := md5.Sum(body)
+	return aws.String(`"` + hex.EncodeToString(sum[:]) + `"`)
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	var body []byte
+	if params.Body != nil {
+		var err error
+		body, err = io.ReadAll(params.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	input := *params
+	input.Body = nil
+	f.puts = append(f.puts, input)
+	f.putBodies = append(f.putBodies, body)
+	if err := f.start("PutObject"); err != nil {
+		return nil, err
+	}
+
+	storageClass := params.StorageClass
+	if storageClass == "" {
+		storageClass = types.StorageClassStandard
+	}
+	f.objects[fakeS3Path(aws.ToString(params.Bucket), aws.ToString(params.Key))] = fakeS3Object{
+		body:           body,
+		contentType:    aws.ToString(params.ContentType),
+		cacheControl:   aws.ToString(params.CacheControl),
+		checksumSHA256: aws.ToString(params.ChecksumSHA256),
+		storageClass:   storageClass,
+		metadata:       params.Metadata,
+		tags:           parseFakeTagging(aws.ToString(params.Tagging)),
+		lastModified:   time.Now(),
+	}
+	return &s3.PutObjectOutput{ETag: fakeETag(body), ChecksumSHA256: params.ChecksumSHA256}, nil
+}
+
+func parseFakeTagging(tagging string) []types.Tag {
+	values, _ := url.ParseQuery(tagging)
+	var tags []types.Tag
+	for key := range values {
+		tags = append(tags, types.Tag{Key: aws.String(key), Value: aws.String(values.Get(key))})
+	}
+	return tags
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.start("GetObject"); err != nil {
+		return nil, err
+	}
+
+	object, ok := f.objects[fakeS3Path(aws.ToString(params.Bucket), aws.ToString(params.Key))]
+	if !ok {
+		return nil, &types.NoSuchKey{Message: aws.String("The specified key does not exist.")}
+	}
+	body := object.body
+	if value, ok := strings.CutPrefix(aws.ToString(params.Range), "bytes="); ok {
+		startValue, endValue, _ := strings.Cut(value, "-")
+		start, _ := strconv.Atoi(startValue)
+		end := len(body) - 1
+		if endValue != "" {
+			end, _ = strconv.Atoi(endValue)
+		}
+		if start >= len(body) {
+			return nil, &smithy.GenericAPIError{Code: "InvalidRange"}
+		}
+		body = body[start:min(end+1, len(body))]
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: aws.Int64(int64(len(body))),
+		ContentType:   aws.String(object.contentType),
+		ETag:          fakeETag(object.body),
+		LastModified:  aws.Time(object.lastModified),
+		StorageClass:  object.storageClass,
+		Metadata:      object.metadata,
+	}, nil
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.start("HeadObject"); err != nil {
+		return nil, err
+	}
+
+	object, ok := f.objects[fakeS3Path(aws.ToString(params.Bucket), aws.ToString(params.Key))]
+	if !ok {
+		return nil, &types.NotFound{Message: aws.String("Not Found")}
+	}
+	output := &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(object.body))),
+		ContentType:   aws.String(object.contentType),
+		CacheControl:  aws.String(object.cacheControl),
+		ETag:          fakeETag(object.body),
+		LastModified:  aws.Time(object.lastModified),
+		StorageClass:  object.storageClass,
+		Metadata:      object.metadata,
+	}
+	if object.checksumSHA256 != "" {
+		output.ChecksumSHA256 = aws.String(object.checksumSHA256)
+	}
+	return output, nil
+}
+
+func (f *fakeS3) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.start("DeleteObject"); err != nil {
+		return nil, err
+	}
+
+	delete(f.objects, fakeS3Path(aws.ToString(params.Bucket), aws.ToString(params.Key)))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.start("CopyObject"); err != nil {
+		return nil, err
+	}
+
+	source, err := url.PathUnescape(aws.ToString(params.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	object, ok := f.objects[strings.TrimPrefix(source, "/")]
+	if !ok {
+		return nil, &types.NoSuchKey{Message: aws.String("The specified key does not exist.")}
+	}
+	if params.MetadataDirective == types.MetadataDirectiveReplace {
+		object.contentType = aws.ToString(params.ContentType)
+		object.cacheControl = aws.ToString(params.CacheControl)
+		object.metadata = params.Metadata
+	}
+	if params.StorageClass != "" {
+		object.storageClass = params.StorageClass
+	}
+	object.lastModified = time.Now()
+	f.objects[fakeS3Path(aws.ToString(params.Bucket), aws.ToString(params.Key))] = object
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.start("ListObjectsV2"); err != nil {
+		return nil, err
+	}
+
+	prefix := fakeS3Path(aws.ToString(params.Bucket), aws.ToString(params.Prefix))
+	var contents []types.Object
+	for path, object := range f.objects {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		contents = append(contents, types.Object{
+			Key:          aws.String(strings.TrimPrefix(path, aws.ToString(params.Bucket)+"/")),
+			Size:         aws.Int64(int64(len(object.body))),
+			ETag:         fakeETag(object.body),
+			LastModified: aws.Time(object.lastModified),
+			StorageClass: types.ObjectStorageClass(object.storageClass),
+		})
+	}
+	sort.Slice(contents, func(i, j int) bool {
+		return aws.ToString(contents[i].Key) < aws.ToString(contents[j].Key)
+	})
+	return &s3.ListObjectsV2Output{
+		Contents:    contents,
+		KeyCount:    aws.Int32(int32(len(contents))),
+		IsTruncated: aws.Bool(false),
+	}, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.start("CreateMultipartUpload"); err != nil {
+		return nil, err
+	}
+
+	f.nextID++
+	uploadID := fmt.Sprintf("upload-%d", f.nextID)
+	f.uploads[uploadID] = &fakeS3Upload{
+		bucket:      aws.ToString(params.Bucket),
+		key:         aws.ToString(params.Key),
+		contentType: aws.ToString(params.ContentType),
+		parts:       map[int32][]byte{},
+	}
+	return &s3.CreateMultipartUploadOutput{
+		Bucket:   params.Bucket,
+		Key:      params.Key,
+		UploadId: aws.String(uploadID),
+	}, nil
+}
+
+func (f *fakeS3) UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.start("UploadPart"); err != nil {
+		return nil, err
+	}
+
+	upload, ok := f.uploads[aws.ToString(params.UploadId)]
+	if !ok {
+		return nil, &types.NoSuchUpload{Message: aws.String("The specified upload does not exist.")}
+	}
+	upload.parts[aws.ToInt32(params.PartNumber)] = body
+	return &s3.UploadPartOutput{ETag: fakeETag(body)}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.completes = append(f.completes, *params)
+	if err := f.start("CompleteMultipartUpload"); err != nil {
+		return nil, err
+	}
+
+	upload, ok := f.uploads[aws.ToString(params.UploadId)]
+	if !ok {
+		return nil, &types.NoSuchUpload{Message: aws.String("The specified upload does not exist.")}
+	}
+	var body []byte
+	if params.MultipartUpload != nil {
+		for _, part := range params.MultipartUpload.Parts {
+			data, ok := upload.parts[aws.ToInt32(part.PartNumber)]
+			if !ok {
+				return nil, &smithy.GenericAPIError{Code: "InvalidPart"}
+			}
+			body = append(body, data...)
+		}
+	}
+	delete(f.uploads, aws.ToString(params.UploadId))
+	f.objects[fakeS3Path(upload.bucket, upload.key)] = fakeS3Object{
+		body:         body,
+		contentType:  upload.contentType,
+		storageClass: types.StorageClassStandard,
+		lastModified: time.Now(),
+	}
+	return &s3.CompleteMultipartUploadOutput{
+		Bucket: aws.String(upload.bucket),
+		Key:    aws.String(upload.key),
+		ETag:   fakeETag(body),
+	}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.start("AbortMultipartUpload"); err != nil {
+		return nil, err
+	}
+
+	delete(f.uploads, aws.ToString(params.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.start("GetObjectTagging"); err != nil {
+		return nil, err
+	}
+
+	object, ok := f.objects[fakeS3Path(aws.ToString(params.Bucket), aws.ToString(params.Key))]
+	if !ok {
+		return nil, &types.NoSuchKey{Message: aws.String("The specified key does not exist.")}
+	}
+	return &s3.GetObjectTaggingOutput{TagSet: object.tags}, nil
+}
+
+func (f *fakeS3) PutObjectTagging(ctx context.Context, params *s3.PutObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.PutObjectTaggingOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.start("PutObjectTagging"); err != nil {
+		return nil, err
+	}
+
+	path := fakeS3Path(aws.ToString(params.Bucket), aws.ToString(params.Key))
+	object, ok := f.objects[path]
+	if !ok {
+		return nil, &types.NoSuchKey{Message: aws.String("The specified key does not exist.")}
+	}
+	if params.Tagging != nil {
+		object.tags = params.Tagging.TagSet
+	}
+	f.objects[path] = object
+	return &s3.PutObjectTaggingOutput{}, nil
+}
+
+// fakeS3Error is an error like the SDK returns for an S3 error response:
+// an API error code wrapped in the HTTP status it came with.
+func fakeS3Error(status int, code string) error {
+	return &awshttp.ResponseError{
+		ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+			Err:      &smithy.GenericAPIError{Code: code, Message: http.StatusText(status)},
+		},
+	}
+}
+
+// countingPresigner signs URLs offline with a real presign client and
+// fixed credentials, counting how many it signs.
+type countingPresigner struct {
+	presigner *s3.PresignClient
+	mu        sync.Mutex
+	gets      int
+	puts      int
+}
+
+var _ S3PresignAPI = (*countingPresigner)(nil)
+
+func newCountingPresigner(region string) *countingPresigner {
+	client := s3.New(s3.Options{
+		Region: region,
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDTEST", SecretAccessKey: "secret"}, nil
+		}),
+	})
+	return &countingPresigner{presigner: s3.NewPresignClient(client)}
+}
+
+func (p *countingPresigner) PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	p.mu.Lock()
+	p.gets++
+	p.mu.Unlock()
+	return p.presigner.PresignGetObject(ctx, params, optFns...)
+}
+
+func (p *countingPresigner) PresignPutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	p.mu.Lock()
+	p.puts++
+	p.mu.Unlock()
+	return p.presigner.PresignPutObject(ctx, params, optFns...)
+}
+
+func (p *countingPresigner) getCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.gets
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// runFFmpegWithProgress runs ffmpeg with args, reading its -progress
+// output to report how much of input has been processed as a percentage.
+// onProgress is only called when the input's duration is known and ffmpeg
+// reports its position, so callers should treat no calls as indeterminate
+// progress.
+func (cfg *apiConfig) runFFmpegWithProgress(ctx context.Context, input string, onProgress func(percent float64), args ...string) error {
+	var duration float64
+	if onProgress != nil {
+		var err error
+		duration, err = cfg.getVideoDuration(ctx, input)
+		if err != nil || duration <= 0 {
+			onProgress = nil
+		}
+	}
+
+	return cfg.runMediaCommand(ctx, cfg.ffmpegTimeout, func(ctx context.Context) error {
+		cmd := newMediaCommand(ctx, cfg.ffmpegPath, append([]string{"-progress", "pipe:1", "-nostats"}, args...)...)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+
+		parseFFmpegProgress(stdout, duration, onProgress)
+		// Drain anything left so ffmpeg never blocks on a full pipe
+		io.Copy(io.Discard, stdout)
+		return cmd.Wait()
+	})
+}
+
+// parseFFmpegProgress reads ffmpeg's key=value progress blocks, calling
+// onProgress with the position as a percentage of duration at the end of
+// each block and with 100 once ffmpeg reports progress=end.
+func parseFFmpegProgress(r io.Reader, duration float64, onProgress func(percent float64)) {
+	if onProgress == nil {
+		return
+	}
+
+	var position float64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "out_time_ms", "out_time_us":
+			// Despite its name, out_time_ms is in microseconds too
+			us, err := strconv.ParseInt(value, 10, 64)
+			if err == nil && us >= 0 {
+				position = float64(us) / 1e6
+			}
+		case "progress":
+			if value == "end" {
+				onProgress(100)
+				return
+			}
+			onProgress(min(position/duration*100, 100))
+		}
+	}
+}
+
+// jobProgressRecorder returns an onProgress callback that stores a video
+// job's progress, writing only when the whole percentage changes.
+func (cfg *apiConfig) jobProgressRecorder(jobID uuid.UUID) func(percent float64) {
+	last := -1
+	return func(percent float64) {
+		whole := int(percent)
+		if whole == last {
+			return
+		}
+		last = whole
+		err := cfg.db.UpdateProcessingJobProgress(jobID, float64(whole))
+		if err != nil {
+			log.Printf("Couldn't update progress of video job %s: %v", jobID, err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// detectFileType sniffs the media type from the first 512 bytes of file
+// instead of trusting the client-supplied Content-Type. The file is left
+// positioned at the start so it can be read again.
+func detectFileType(file io.ReadSeeker) (string, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("couldn't seek file: %w", err)
+	}
+
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("couldn't read file header: %w", err)
+	}
+	buf = buf[:n]
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("couldn't seek file: %w", err)
+	}
+
+	// http.DetectContentType only recognizes MP4s that list an "mp4*"
+	// brand, so check for the ISO base media ftyp box directly
+	if n >= 12 && string(buf[4:8]) == "ftyp" {
+		if string(buf[8:12]) == "qt  " {
+			return "video/quicktime", nil
+		}
+		return "video/mp4", nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(http.DetectContentType(buf))
+	if err != nil {
+		return "", fmt.Errorf("couldn't parse detected content type: %w", err)
+	}
+	return mediaType, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// writeTestAsset saves data as an asset named name and returns a request
+// for it.
+func writeTestAsset(t *testing.T, cfg *apiConfig, name string, data []byte) *http.Request {
+	t.Helper()
+
+	if err := os.WriteFile(cfg.getAssetDiskPath(name), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return newTestRequest(http.MethodGet, "/assets/"+name, nil, "", "name", name)
+}
+
+func TestServeAssetRange(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	req := writeTestAsset(t, cfg, "clip.mp4", data)
+	req.Header.Set("Range", "bytes=0-99")
+
+	rec := serve(cfg.handlerServeAsset, req)
+	expectStatus(t, rec, http.StatusPartialContent)
+	if got := rec.Header().Get("Content-Range"); got != "bytes 0-99/1000" {
+		t.Errorf("Content-Range = %q, want bytes 0-99/1000", got)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), data[:100]) {
+		t.Errorf("body is %d bytes, want the first 100 of the asset", rec.Body.Len())
+	}
+}
+
+func TestServeAssetIfNoneMatch(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	name := "thumbnail.png"
+	data := testPNG(t, 64, 36)
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		want        int
+	}{
+		{name: "matching", ifNoneMatch: `"` + name + `"`, want: http.StatusNotModified},
+		{name: "not matching", ifNoneMatch: `"other.png"`, want: http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := writeTestAsset(t, cfg, name, data)
+			req.Header.Set("If-None-Match", tc.ifNoneMatch)
+
+			rec := serve(cfg.handlerServeAsset, req)
+			expectStatus(t, rec, tc.want)
+			if got := rec.Header().Get("ETag"); got != `"`+name+`"` {
+				t.Errorf("ETag = %q, want %q", got, `"`+name+`"`)
+			}
+			if tc.want == http.StatusOK && !bytes.Equal(rec.Body.Bytes(), data) {
+				t.Errorf("body is %d bytes, want the %d byte asset", rec.Body.Len(), len(data))
+			}
+		})
+	}
+}
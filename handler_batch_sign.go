@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	maxBatchSignVideos = maxVideoPageSize
+	batchSignWorkers   = 8
+)
+
+// handlerBatchSignURLs signs the video URLs for a JSON array of video IDs
+// in one request, so a listing page doesn't need a round trip per video.
+// IDs that don't exist, belong to someone else or have nothing to play are
+// left out of the result rather than failing the batch.
+func (cfg *apiConfig) handlerBatchSignURLs(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtTokens)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	videoIDs := []uuid.UUID{}
+	err = json.NewDecoder(r.Body).Decode(&videoIDs)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Body must be a JSON array of video IDs", err)
+		return
+	}
+	if len(videoIDs) > maxBatchSignVideos {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Can't sign more than %d videos at once", maxBatchSignVideos), nil)
+		return
+	}
+
+	expireTime, err := cfg.presignExpiryFromRequest(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	videos, err := cfg.db.GetVideosByIDs(videoIDs)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get videos", err)
+		return
+	}
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	signedURLs := map[uuid.UUID]string{}
+	sem := make(chan struct{}, batchSignWorkers)
+	for _, video := range videos {
+		if video.UserID != userID || requiresRestore(video.StorageClass) || video.ModerationStatus != database.ModerationStatusApproved {
+			continue
+		}
+		bucket, key, ok := parseVideoURL(video)
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			signedURL, err := cfg.signObjectURL(r.Context(), bucket, key, expireTime)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			signedURLs[video.ID] = signedURL
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", firstErr)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, signedURLs)
+}
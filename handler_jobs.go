@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerGetJobStatus(w http.ResponseWriter, r *http.Request) {
+	jobIDString := r.PathValue("jobID")
+	jobID, err := uuid.Parse(jobIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid job ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtTokens)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	job, err := cfg.db.GetProcessingJob(jobID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get job", err)
+		return
+	}
+
+	// Report other users' jobs as missing rather than leaking their IDs
+	if job.ID == uuid.Nil || job.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Job not found", nil)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, job)
+}
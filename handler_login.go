@@ -9,6 +9,14 @@ import (
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 )
 
+// userScopes returns the access token scopes granted by the user's role.
+func userScopes(user database.User) []string {
+	if user.Role == database.UserRoleAdmin {
+		return []string{auth.ScopeAdmin}
+	}
+	return nil
+}
+
 func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Password string `json:"password"`
@@ -42,8 +50,9 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 
 	accessToken, err := auth.MakeJWT(
 		user.ID,
-		cfg.jwtSecret,
-		time.Hour*24*30,
+		cfg.jwtTokens,
+		cfg.jwtExpiry,
+		userScopes(user)...,
 	)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
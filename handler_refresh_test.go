@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestRefreshAccessTokenExpiry(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.jwtExpiry = 30 * 24 * time.Hour
+	cfg.jwtRefreshExpiry = time.Hour
+	user := createTestUser(t, cfg)
+	_, err := cfg.db.CreateRefreshToken(database.CreateRefreshTokenParams{
+		Token:     "test-refresh-token",
+		UserID:    user.ID,
+		ExpiresAt: time.Now().UTC().Add(24 * time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(cfg.handlerRefresh, newTestRequest(http.MethodPost, "/api/refresh", nil, "test-refresh-token"))
+	expectStatus(t, rec, http.StatusOK)
+	token := decodeResponse[struct {
+		Token string `json:"token"`
+	}](t, rec).Token
+
+	claims := jwt.RegisteredClaims{}
+	_, err = jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return []byte(cfg.jwtTokens.Secret), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Refreshed tokens get JWT_REFRESH_ACCESS_EXPIRY, not login's JWT_EXPIRY
+	if lifetime := claims.ExpiresAt.Sub(claims.IssuedAt.Time); lifetime != cfg.jwtRefreshExpiry {
+		t.Errorf("refreshed token lasts %s, want %s", lifetime, cfg.jwtRefreshExpiry)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerGenerateThumbnailAtTime replaces the video's thumbnail with the
+// frame at the timestamp query parameter, in seconds. ffmpeg reads the
+// video straight from a signed URL, so only the frames it needs are fetched.
+func (cfg *apiConfig) handlerGenerateThumbnailAtTime(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.Video
+		ThumbnailURLs map[string]string `json:"thumbnail_urls"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtTokens)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	timestamp, err := strconv.ParseFloat(r.URL.Query().Get("timestamp"), 64)
+	if err != nil || timestamp < 0 || math.IsNaN(timestamp) || math.IsInf(timestamp, 0) {
+		respondWithError(w, http.StatusBadRequest, "timestamp must be a non-negative number of seconds", err)
+		return
+	}
+
+	// Hold the video's lock before reading it, so the video can't change
+	// under us
+	unlock, err := cfg.acquireVideoLock(r.Context(), videoID)
+	if err != nil {
+		if respondIfVideoBusy(w, err) {
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't lock video", err)
+		return
+	}
+	defer unlock()
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You don't own this video", nil)
+		return
+	}
+
+	bucket, key, ok := parseVideoURL(video)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Video has no uploaded file yet", nil)
+		return
+	}
+	if requiresRestore(video.StorageClass) {
+		respondWithError(w, http.StatusConflict, "Video is archived and must be restored first", nil)
+		return
+	}
+
+	videoURL, err := cfg.signObjectURL(r.Context(), bucket, key, cfg.s3PresignExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+		return
+	}
+
+	duration, err := cfg.getVideoDuration(r.Context(), videoURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't determine video duration", err)
+		return
+	}
+	if timestamp >= duration {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("timestamp is past the end of the video (%.2f seconds)", duration), nil)
+		return
+	}
+
+	frameFile, cleanupFrameFile, err := cfg.newTempFile("tubely-frame-*.jpg")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create temporary file", err)
+		return
+	}
+	frameFile.Close()
+	defer cleanupFrameFile()
+
+	err = cfg.extractFrame(r.Context(), videoURL, timestamp, frameFile.Name())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't extract frame", err)
+		return
+	}
+
+	frame, err := os.Open(frameFile.Name())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open extracted frame", err)
+		return
+	}
+	defer frame.Close()
+
+	filename, err := getAssetName(".jpg")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random filename", err)
+		return
+	}
+
+	err = cfg.saveAsset(r.Context(), filename, frame)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save file", err)
+		return
+	}
+
+	variants, err := cfg.saveThumbnailVariants(r.Context(), frame, filename, "image/jpeg")
+	if err != nil {
+		cfg.removeAsset(r.Context(), filename)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't resize thumbnail", err)
+		return
+	}
+
+	thumbnailURLs := map[string]string{}
+	for size, name := range variants {
+		thumbnailURLs[size] = cfg.getAssetURL(name)
+	}
+
+	thumbnailURL := cfg.getAssetURL(filename)
+	video.ThumbnailURL = &thumbnailURL
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		cfg.removeThumbnailVariants(r.Context(), variants)
+		cfg.removeAsset(r.Context(), filename)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Video:         signedVideo,
+		ThumbnailURLs: thumbnailURLs,
+	})
+}
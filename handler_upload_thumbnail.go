@@ -1,124 +1,219 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
+	"mime/multipart"
 	"net/http"
-	"os"
-	"path/filepath"
 
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
-	videoIDString := r.PathValue("videoID")
-	videoID, err := uuid.Parse(videoIDString)
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
-		return
+	type response struct {
+		database.Video
+		ThumbnailURLs map[string]string `json:"thumbnail_urls"`
 	}
 
-	token, err := auth.GetBearerToken(r.Header)
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
-		return
-	}
+	userID := userIDFromContext(r)
 
-	// Parse the multipart form with max 10MB
+	// Parse the multipart form, keeping up to 10MB in memory
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxThumbnailBytes)
 	const maxMemory = 10 << 20 // 10MB
 	err = r.ParseMultipartForm(maxMemory)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Error parsing multipart form", err)
+		if respondIfTooLarge(w, err) {
+			return
+		}
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Error parsing multipart form", err)
 		return
 	}
 
 	// Get the file from form data
 	file, fileHeader, err := r.FormFile("thumbnail")
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Error getting thumbnail from form", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Error getting thumbnail from form", err)
 		return
 	}
 	defer file.Close()
 
-	// Parse and validate the Content-Type
-	mediaType, _, err := mime.ParseMediaType(fileHeader.Header.Get("Content-Type"))
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type header", err)
+	mediaType, ext, ok := cfg.validateThumbnailFile(w, file, fileHeader)
+	if !ok {
 		return
 	}
 
-	// Only allow jpeg and png files
-	ext := ""
-	switch mediaType {
-	case "image/jpeg":
-		ext = ".jpg"
-	case "image/png":
-		ext = ".png"
-	default:
-		respondWithError(w, http.StatusBadRequest, "File type not allowed. Only JPEG and PNG images are supported.", nil)
+	// Hold the video's lock before reading it, so a processing job can't
+	// change the video under us
+	unlock, err := cfg.acquireVideoLock(r.Context(), videoID)
+	if err != nil {
+		if respondIfVideoBusy(w, err) {
+			return
+		}
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't lock video", err)
 		return
 	}
+	defer unlock()
 
 	// Get video metadata and check ownership
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Couldn't get video", err)
 		return
 	}
 
 	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "You don't own this video", nil)
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotOwner, "You don't own this video", nil)
 		return
 	}
 
-	// Generate random filename
-	randomBytes := make([]byte, 32)
-	_, err = rand.Read(randomBytes)
+	thumbnail, err := cfg.saveThumbnail(r.Context(), file, mediaType, ext)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random filename", err)
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save thumbnail", err)
 		return
 	}
-	filename := base64.RawURLEncoding.EncodeToString(randomBytes) + ext
-	filePath := filepath.Join(cfg.assetsRoot, filename)
 
-	// Create the destination file
-	destFile, err := os.Create(filePath)
+	// Update the video metadata with new thumbnail URL
+	oldThumbnailURL := video.ThumbnailURL
+	thumbnailURL := cfg.getAssetURL(thumbnail.filename)
+	video.ThumbnailURL = &thumbnailURL
+
+	err = cfg.db.UpdateVideoThumbnail(video.ID, thumbnailURL)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create file", err)
+		// Try to cleanup the files if database update fails
+		cfg.removeSavedThumbnail(r.Context(), thumbnail)
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
 		return
 	}
-	defer destFile.Close()
+	if oldThumbnailURL != nil {
+		cfg.removeThumbnail(r.Context(), *oldThumbnailURL)
+	}
 
-	// Copy the uploaded file to destination
-	_, err = io.Copy(destFile, file)
+	// Respond with the updated video metadata and every thumbnail size
+	respondWithJSON(w, http.StatusOK, response{
+		Video:         video,
+		ThumbnailURLs: cfg.savedThumbnailURLs(thumbnail),
+	})
+}
+
+// validateThumbnailFile checks an uploaded thumbnail's declared type
+// against THUMBNAIL_FORMATS and its contents, and rejects images too large
+// to decode safely. It writes the error response itself and returns false
+// when the file is rejected.
+func (cfg *apiConfig) validateThumbnailFile(w http.ResponseWriter, file io.ReadSeeker, fileHeader *multipart.FileHeader) (string, string, bool) {
+	// Parse and validate the Content-Type
+	mediaType, _, err := mime.ParseMediaType(fileHeader.Header.Get("Content-Type"))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save file", err)
-		return
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "Invalid Content-Type header", err)
+		return "", "", false
 	}
 
-	// Update the video metadata with new thumbnail URL
-	thumbnailURL := fmt.Sprintf("http://localhost:%s/assets/%s", cfg.port, filename)
-	video.ThumbnailURL = &thumbnailURL
+	ext, ok := cfg.thumbnailTypes[mediaType]
+	if !ok {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeUnsupportedMediaType, cfg.thumbnailTypesMessage(), nil)
+		return "", "", false
+	}
 
-	// Save the updated video metadata
-	err = cfg.db.UpdateVideo(video)
+	// Verify the file contents match the declared type
+	detectedType, err := detectFileType(file)
 	if err != nil {
-		// Try to cleanup the file if database update fails
-		os.Remove(filePath)
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
-		return
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't read uploaded file", err)
+		return "", "", false
+	}
+	if detectedType != mediaType {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "File contents don't match the declared image type", nil)
+		return "", "", false
+	}
+
+	// Reject decompression bombs before anything decodes the pixels
+	err = checkImageDimensions(file, cfg.maxThumbnailSize)
+	if err != nil {
+		var tooLarge imageTooLargeError
+		if errors.As(err, &tooLarge) {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeImageTooLarge, tooLarge.Error(), err)
+			return "", "", false
+		}
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Couldn't read image dimensions", err)
+		return "", "", false
+	}
+	return mediaType, ext, true
+}
+
+// savedThumbnail is the set of assets stored for one uploaded thumbnail.
+type savedThumbnail struct {
+	filename string
+	variants map[string]string
+	// webpName is "" when no WebP copy was made
+	webpName string
+}
+
+// saveThumbnail stores a validated thumbnail under a random name, along
+// with its resized copies and, if enabled, a WebP copy. On error nothing
+// is left behind.
+func (cfg *apiConfig) saveThumbnail(ctx context.Context, file io.ReadSeeker, mediaType, ext string) (savedThumbnail, error) {
+	// Generate random filename
+	filename, err := getAssetName(ext)
+	if err != nil {
+		return savedThumbnail{}, fmt.Errorf("couldn't generate random filename: %w", err)
+	}
+
+	// Copy the uploaded file into the assets directory
+	err = cfg.saveAsset(ctx, filename, file)
+	if err != nil {
+		return savedThumbnail{}, fmt.Errorf("couldn't save file: %w", err)
 	}
 
-	// Respond with the updated video metadata
-	respondWithJSON(w, http.StatusOK, video)
+	// Store smaller copies for grid views
+	variants, err := cfg.saveThumbnailVariants(ctx, file, filename, mediaType)
+	if err != nil {
+		cfg.removeAsset(ctx, filename)
+		return savedThumbnail{}, fmt.Errorf("couldn't resize thumbnail: %w", err)
+	}
+
+	// Store a WebP copy too if enabled, so clients can offer it with the
+	// original as a fallback
+	webpName, err := cfg.saveWebPThumbnail(ctx, file, filename, mediaType)
+	if err != nil {
+		cfg.removeThumbnailVariants(ctx, variants)
+		cfg.removeAsset(ctx, filename)
+		return savedThumbnail{}, fmt.Errorf("couldn't create WebP thumbnail: %w", err)
+	}
+
+	return savedThumbnail{
+		filename: filename,
+		variants: variants,
+		webpName: webpName,
+	}, nil
+}
+
+// removeSavedThumbnail deletes every asset saveThumbnail stored.
+func (cfg *apiConfig) removeSavedThumbnail(ctx context.Context, thumbnail savedThumbnail) {
+	cfg.removeThumbnailVariants(ctx, thumbnail.variants)
+	if thumbnail.webpName != "" {
+		cfg.removeAsset(ctx, thumbnail.webpName)
+	}
+	cfg.removeAsset(ctx, thumbnail.filename)
+}
+
+// savedThumbnailURLs maps each size of the thumbnail, plus "webp" when
+// there is a WebP copy, to its URL.
+func (cfg *apiConfig) savedThumbnailURLs(thumbnail savedThumbnail) map[string]string {
+	thumbnailURLs := map[string]string{}
+	for size, name := range thumbnail.variants {
+		thumbnailURLs[size] = cfg.getAssetURL(name)
+	}
+	if thumbnail.webpName != "" {
+		thumbnailURLs["webp"] = cfg.getAssetURL(thumbnail.webpName)
+	}
+	return thumbnailURLs
 }
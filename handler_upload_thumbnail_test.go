@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// testPNG encodes a blank image of the given size.
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pngDeclaring returns a tiny PNG whose header claims the given size, as a
+// decompression bomb's would. Only the header is valid.
+func pngDeclaring(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+
+	data := testPNG(t, 1, 1)
+	// The IHDR chunk follows the 8-byte signature: length, type, then
+	// width and height, with a CRC of type and data after it
+	ihdr := data[8 : 8+8+13+4]
+	binary.BigEndian.PutUint32(ihdr[8:], width)
+	binary.BigEndian.PutUint32(ihdr[12:], height)
+	binary.BigEndian.PutUint32(ihdr[21:], crc32.ChecksumIEEE(ihdr[4:21]))
+	return data
+}
+
+// newThumbnailRequest builds a thumbnail upload of body, declared as
+// mediaType, for the video.
+func newThumbnailRequest(t *testing.T, token, videoID, mediaType string, body []byte) *http.Request {
+	t.Helper()
+
+	var buf bytes.Buffer
+	form := multipart.NewWriter(&buf)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="thumbnail"; filename="thumbnail"`)
+	header.Set("Content-Type", mediaType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(body)
+	form.Close()
+
+	req := newTestRequest(http.MethodPost, "/api/thumbnail_upload/"+videoID, &buf, token, "videoID", videoID)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+func TestUploadThumbnailReplacesOld(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	user := createTestUser(t, cfg)
+	token := testToken(t, cfg, user.ID)
+	video := storeTestVideo(t, cfg, fake, createTestVideo(t, cfg, user.ID), testMP4)
+	videoID := video.ID.String()
+
+	rec := serveAuthed(cfg, cfg.handlerUploadThumbnail, newThumbnailRequest(t, token, videoID, "image/png", testPNG(t, 64, 36)))
+	expectStatus(t, rec, http.StatusOK)
+	first := getTestVideo(t, cfg, video.ID)
+	firstName, ok := cfg.getAssetNameFromURL(*first.ThumbnailURL)
+	if !ok {
+		t.Fatalf("thumbnail URL %s isn't a local asset", *first.ThumbnailURL)
+	}
+
+	// Stand in for a job that finished after the thumbnail handler read
+	// the video
+	if err := cfg.db.UpdateVideoModerationStatus(video.ID, database.ModerationStatusRejected); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = serveAuthed(cfg, cfg.handlerUploadThumbnail, newThumbnailRequest(t, token, videoID, "image/png", testPNG(t, 64, 36)))
+	expectStatus(t, rec, http.StatusOK)
+	second := getTestVideo(t, cfg, video.ID)
+	if *second.ThumbnailURL == *first.ThumbnailURL {
+		t.Fatal("thumbnail URL didn't change")
+	}
+	if *second.VideoURL != *video.VideoURL || second.ModerationStatus != database.ModerationStatusRejected {
+		t.Errorf("thumbnail upload overwrote other fields: %+v", second)
+	}
+	if _, err := os.Stat(cfg.getAssetDiskPath(firstName)); !os.IsNotExist(err) {
+		t.Errorf("replaced thumbnail %s wasn't deleted: %v", firstName, err)
+	}
+}
+
+func TestUploadThumbnailHugeDimensions(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, user.ID)
+	bomb := pngDeclaring(t, 20000, 20000)
+
+	rec := serveAuthed(cfg, cfg.handlerUploadThumbnail, newThumbnailRequest(t, testToken(t, cfg, user.ID), video.ID.String(), "image/png", bomb))
+	expectErrorCode(t, rec, http.StatusBadRequest, errCodeImageTooLarge)
+	if got := getTestVideo(t, cfg, video.ID); got.ThumbnailURL != nil {
+		t.Errorf("thumbnail saved for a %d byte file declaring 20000x20000: %s", len(bomb), *got.ThumbnailURL)
+	}
+}
+
+func TestUploadThumbnailAssetsBaseURL(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.assetsBaseURL = "https://cdn.example.com"
+	user := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, user.ID)
+
+	rec := serveAuthed(cfg, cfg.handlerUploadThumbnail, newThumbnailRequest(t, testToken(t, cfg, user.ID), video.ID.String(), "image/png", testPNG(t, 64, 36)))
+	expectStatus(t, rec, http.StatusOK)
+
+	got := getTestVideo(t, cfg, video.ID)
+	if got.ThumbnailURL == nil || !strings.HasPrefix(*got.ThumbnailURL, "https://cdn.example.com/assets/") {
+		t.Errorf("thumbnail URL = %v, want it under https://cdn.example.com/assets/", got.ThumbnailURL)
+	}
+}
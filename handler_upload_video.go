@@ -2,39 +2,78 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
 	"os"
-	"os/exec"
+	"strconv"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 	"github.com/google/uuid"
 )
 
 // processVideoForFastStart takes a file path as input and processes the video
 // to enable "fast start" for better streaming. It returns the path to the processed file.
-func processVideoForFastStart(filePath string) (string, error) {
+// Progress is reported to onProgress as ffmpeg works through the file.
+// The streams are copied as they are, except that normalizeAudio
+// re-encodes the audio through loudnorm.
+func (cfg *apiConfig) processVideoForFastStart(ctx context.Context, filePath string, normalizeAudio bool, onProgress func(percent float64)) (string, error) {
 	outputPath := filePath + ".processing"
 
-	cmd := exec.Command("ffmpeg",
-		"-i", filePath,
-		"-c", "copy",
-		"-movflags", "faststart",
-		"-f", "mp4",
-		outputPath)
+	err := cfg.runFFmpegWithProgress(ctx, filePath, onProgress,
+		fastStartArgs(filePath, outputPath, normalizeAudio)...)
 
-	if err := cmd.Run(); err != nil {
+	if err != nil {
+		os.Remove(outputPath)
 		return "", fmt.Errorf("failed to process video: %w", err)
 	}
 
 	return outputPath, nil
 }
 
+// transcodeToMP4 converts a video in another container or codec to an H.264
+// MP4 with fast start enabled, so stored assets share a single format. The
+// video is encoded with the named quality preset. It returns the path to the
+// transcoded file, reporting progress as it goes.
+func (cfg *apiConfig) transcodeToMP4(ctx context.Context, filePath, qualityPreset string, normalizeAudio bool, onProgress func(percent float64)) (string, error) {
+	outputPath := filePath + ".processing"
+
+	err := cfg.runFFmpegWithProgress(ctx, filePath, onProgress,
+		transcodeArgs(filePath, outputPath, qualityPreset, normalizeAudio)...)
+
+	if err != nil {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("failed to transcode video: %w", err)
+	}
+
+	return outputPath, nil
+}
+
+// fastStartArgs are the ffmpeg arguments processVideoForFastStart runs.
+func fastStartArgs(inputPath, outputPath string, normalizeAudio bool) []string {
+	args := []string{"-i", inputPath, "-c", "copy"}
+	if normalizeAudio {
+		args = append(args, loudnormArgs()...)
+	}
+	return append(args, "-movflags", "faststart", "-f", "mp4", outputPath)
+}
+
+// transcodeArgs are the ffmpeg arguments transcodeToMP4 runs.
+func transcodeArgs(inputPath, outputPath, qualityPreset string, normalizeAudio bool) []string {
+	args := append([]string{"-i", inputPath}, videoEncoderArgs(qualityPreset)...)
+	args = append(args, "-c:a", "aac")
+	if normalizeAudio {
+		args = append(args, loudnormArgs()...)
+	}
+	return append(args, "-movflags", "faststart", "-f", "mp4", outputPath)
+}
+
 /*
 Complete the (currently empty) handlerUploadVideo handler to store video files in S3. Images will stay on the local file system for now. I recommend using the image upload handler as a reference.
 - Set an upload limit of 1 GB (1 << 30 bytes) using http.MaxBytesReader.
@@ -67,141 +106,393 @@ Complete the (currently empty) handlerUploadVideo handler to store video files i
   - The video_url in your database is updated with the S3 bucket and key (and thus shows up in the web UI)
 */
 func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request) {
-	// Set 1GB upload limit
-	r.Body = http.MaxBytesReader(w, r.Body, 1<<30)
+	cfg.uploadVideo(w, r, false)
+}
+
+// handlerReplaceVideo uploads a corrected file for a video that already
+// has one. The video keeps its ID, title, description and thumbnail; the
+// new file gets a new key, and the old file and its renditions are deleted
+// once it has been stored. Until then, and if processing fails, the old
+// file stays in place.
+func (cfg *apiConfig) handlerReplaceVideo(w http.ResponseWriter, r *http.Request) {
+	cfg.uploadVideo(w, r, true)
+}
+
+// uploadVideo handles a multipart video upload, replacing the video's
+// stored file if replace is set.
+func (cfg *apiConfig) uploadVideo(w http.ResponseWriter, r *http.Request, replace bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.maxVideoBytes)
 
 	// Extract and validate video ID
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
 		return
 	}
 
-	// Authenticate user
-	token, err := auth.GetBearerToken(r.Header)
+	userID := userIDFromContext(r)
+
+	// Get video metadata and check ownership
+	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Couldn't get video", err)
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotOwner, "You don't own this video", nil)
+		return
+	}
+	if replace && video.VideoURL == nil {
+		respondWithErrorCode(w, http.StatusConflict, errCodeConflict, "Video has no file to replace yet; upload one first", nil)
 		return
 	}
 
-	// Get video metadata and check ownership
-	video, err := cfg.db.GetVideo(videoID)
+	idempotencyKey, err := idempotencyKeyFromRequest(r)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error(), err)
 		return
 	}
 
-	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "You don't own this video", nil)
+	// Publish bytes received to any progress stream watching this upload
+	finishProgress, err := cfg.trackUploadProgress(r, userID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Couldn't track upload progress", err)
 		return
 	}
+	// Only the first call counts, so this marks early failures
+	defer finishProgress(false)
 
-	// Parse the multipart form to get the file
+	// Parse the multipart form to get the file. This reads the whole body,
+	// so it's where an oversized or interrupted upload shows up
 	file, fileHeader, err := r.FormFile("video")
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Error getting video from form", err)
+		if respondIfTooLarge(w, err) || respondIfTimedOut(w, err) || respondIfClientGone(w, r, err) {
+			return
+		}
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Error getting video from form", err)
 		return
 	}
 	defer file.Close()
+	finishProgress(true)
+
+	// Check the quota before spending time on the file; the worker checks
+	// again with the size of the processed file
+	err = cfg.checkStorageQuota(video, fileHeader.Size)
+	if err != nil {
+		if respondIfOverQuota(w, err) {
+			return
+		}
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check storage quota", err)
+		return
+	}
 
 	// Validate file type
 	mediaType, _, err := mime.ParseMediaType(fileHeader.Header.Get("Content-Type"))
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid Content-Type header", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "Invalid Content-Type header", err)
 		return
 	}
 
-	if mediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "File type not allowed. Only MP4 videos are supported.", nil)
+	ext, ok := cfg.videoTypes[mediaType]
+	if !ok {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeUnsupportedMediaType, cfg.videoTypesMessage(), nil)
 		return
 	}
 
-	// Create temporary file
-	tempFile, err := os.CreateTemp("", "tubely-upload-*.mp4")
+	storageClass := cfg.s3StorageClass
+	if value := r.FormValue("storage_class"); value != "" {
+		storageClass = types.StorageClass(value)
+		if !allowedStorageClasses[storageClass] {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidStorageClass, allowedStorageClassesMessage, nil)
+			return
+		}
+	}
+
+	// quality_preset overrides QUALITY_PRESET for this upload
+	qualityPreset := cfg.qualityPreset
+	if value := r.FormValue("quality_preset"); value != "" {
+		if _, ok := qualityPresets[value]; !ok {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidQualityPreset, allowedQualityPresetsMessage, nil)
+			return
+		}
+		qualityPreset = value
+	}
+
+	// With validate_only=true the file is checked as usual but not stored
+	validateOnly := false
+	if value := r.FormValue("validate_only"); value != "" {
+		validateOnly, err = strconv.ParseBool(value)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "validate_only must be true or false", err)
+			return
+		}
+	}
+
+	// normalize_audio overrides NORMALIZE_AUDIO for this upload
+	normalizeAudio := cfg.normalizeAudio
+	if value := r.FormValue("normalize_audio"); value != "" {
+		normalizeAudio, err = strconv.ParseBool(value)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "normalize_audio must be true or false", err)
+			return
+		}
+	}
+
+	// Create temporary file, keeping the extension so ffmpeg demuxes it
+	// correctly
+	tempFile, cleanupTempFile, err := cfg.newTempFile("tubely-upload-*" + ext)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create temporary file", err)
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create temporary file", err)
 		return
 	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
+	// Remove the temp file when we're done, unless it has been handed off
+	// to a processing job
+	keepTempFile := false
+	defer func() {
+		if keepTempFile {
+			tempFile.Close()
+			return
+		}
+		cleanupTempFile()
+	}()
 
-	// Copy uploaded file to temporary file
-	_, err = io.Copy(tempFile, file)
+	// Copy uploaded file to temporary file, hashing it on the way so
+	// identical uploads can be recognized. Nothing has been sent to S3
+	// yet, so a failed copy leaves only the temp file to remove
+	hasher := sha256.New()
+	_, err = io.Copy(tempFile, io.TeeReader(file, hasher))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save file", err)
+		if respondIfTooLarge(w, err) || respondIfTimedOut(w, err) || respondIfClientGone(w, r, err) {
+			return
+		}
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save file", err)
 		return
 	}
 
-	// Get video aspect ratio
-	aspectRatio, err := getVideoAspectRatio(tempFile.Name())
+	// Verify the file contents really are a supported video, and process
+	// it according to what it actually contains
+	detectedType, err := detectFileType(tempFile)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't determine video aspect ratio", err)
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't read uploaded file", err)
+		return
+	}
+	if _, ok := cfg.videoTypes[detectedType]; !ok {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "File contents are not a supported video. "+cfg.videoTypesMessage(), nil)
 		return
 	}
 
-	// Process video for fast start
-	processedVideoPath, err := processVideoForFastStart(tempFile.Name())
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't process video for fast start", err)
+	// A thumbnail may come in the same request, and is stored with the
+	// video once it has been processed
+	var thumbnail jobThumbnail
+	thumbnailHash := ""
+	thumbnailFile, thumbnailHeader, err := r.FormFile("thumbnail")
+	if err != nil && !errors.Is(err, http.ErrMissingFile) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Error getting thumbnail from form", err)
 		return
 	}
-	defer os.Remove(processedVideoPath) // Clean up the processed file when we're done
+	if err == nil {
+		defer thumbnailFile.Close()
+		if thumbnailHeader.Size > cfg.maxThumbnailBytes {
+			msg := fmt.Sprintf("Thumbnail exceeds the maximum size of %d bytes", cfg.maxThumbnailBytes)
+			respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, msg, nil)
+			return
+		}
+		thumbnailType, thumbnailExt, ok := cfg.validateThumbnailFile(w, thumbnailFile, thumbnailHeader)
+		if !ok {
+			return
+		}
 
-	// Open the processed file for uploading
-	processedFile, err := os.Open(processedVideoPath)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't open processed video file", err)
+		// The form's copy is gone once the request ends, so the job gets
+		// its own
+		thumbnailTemp, cleanupThumbnailTemp, err := cfg.newTempFile("tubely-upload-thumbnail-*" + thumbnailExt)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create temporary file", err)
+			return
+		}
+		defer func() {
+			if keepTempFile {
+				thumbnailTemp.Close()
+				return
+			}
+			cleanupThumbnailTemp()
+		}()
+
+		thumbnailHasher := sha256.New()
+		_, err = io.Copy(thumbnailTemp, io.TeeReader(thumbnailFile, thumbnailHasher))
+		if err != nil {
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save thumbnail", err)
+			return
+		}
+		thumbnail = jobThumbnail{
+			path:      thumbnailTemp.Name(),
+			mediaType: thumbnailType,
+			ext:       thumbnailExt,
+		}
+		thumbnailHash = hex.EncodeToString(thumbnailHasher.Sum(nil))
+	}
+
+	// Blocked content is rejected even when only validating
+	contentHash := hex.EncodeToString(hasher.Sum(nil))
+	if cfg.respondIfBlockedContent(w, r, userID, videoID, contentHash) {
 		return
 	}
-	defer processedFile.Close()
 
-	// Generate random filename for S3
-	randomBytes := make([]byte, 32)
-	_, err = rand.Read(randomBytes)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random filename", err)
+	if validateOnly {
+		probe, ok := cfg.validateVideoFile(w, r, tempFile.Name(), true)
+		if !ok {
+			return
+		}
+		respondWithJSON(w, http.StatusOK, uploadValidationResponse{
+			Valid:           true,
+			MediaType:       detectedType,
+			SizeBytes:       fileHeader.Size,
+			AspectRatio:     probe.aspectRatio,
+			DurationSeconds: probe.duration.Seconds(),
+			StorageClass:    storageClass,
+			ThumbnailType:   thumbnail.mediaType,
+		})
 		return
 	}
 
-	// Add orientation prefix based on aspect ratio
-	prefix := "other"
-	switch aspectRatio {
-	case "16:9":
-		prefix = "landscape"
-	case "9:16":
-		prefix = "portrait"
+	// A client retrying an upload that already went through gets the
+	// original job back instead of a second copy
+	if idempotencyKey != "" {
+		requestHash := idempotentUploadHash(videoID, contentHash, storageClass, thumbnailHash, qualityPreset, normalizeAudio)
+		if !cfg.reserveIdempotencyKey(w, userID, videoID, idempotencyKey, requestHash) {
+			return
+		}
+		// Release the key if no job gets queued, so the retry can go ahead
+		defer func() {
+			if !keepTempFile {
+				cfg.db.DeleteIdempotencyKey(userID, idempotencyKey)
+			}
+		}()
+	}
+
+	keepTempFile = cfg.queueVideoJob(w, r, video, videoJob{
+		filePath:      tempFile.Name(),
+		mediaType:     detectedType,
+		contentHash:   contentHash,
+		storageClass:  storageClass,
+		thumbnail:     thumbnail,
+		replace:       replace,
+		normalize:     normalizeAudio,
+		qualityPreset: qualityPreset,
+	}, idempotencyKey)
+}
+
+// uploadValidationResponse reports on a file sent with validate_only=true.
+// Files that would be rejected get the same error response as an upload.
+type uploadValidationResponse struct {
+	Valid           bool               `json:"valid"`
+	MediaType       string             `json:"media_type"`
+	SizeBytes       int64              `json:"size_bytes"`
+	AspectRatio     string             `json:"aspect_ratio"`
+	DurationSeconds float64            `json:"duration_seconds"`
+	StorageClass    types.StorageClass `json:"storage_class"`
+	// ThumbnailType is only set when a thumbnail was sent too
+	ThumbnailType string `json:"thumbnail_media_type,omitempty"`
+}
+
+// videoProbe is what validateVideoFile learned about an uploaded file.
+type videoProbe struct {
+	aspectRatio string
+	// duration is only measured when it's needed
+	duration time.Duration
+}
+
+// validateVideoFile probes a video saved to filePath, rejecting corrupt
+// files and ones longer than MAX_VIDEO_DURATION. The duration is measured
+// when there is a limit or measureDuration is set. It writes the error
+// response itself and returns false when the file is rejected.
+func (cfg *apiConfig) validateVideoFile(w http.ResponseWriter, r *http.Request, filePath string, measureDuration bool) (videoProbe, bool) {
+	// Probe the file, rejecting corrupt uploads before they reach S3
+	aspectRatio, err := cfg.getVideoAspectRatio(r.Context(), filePath, cfg.aspectTolerance)
+	if errors.Is(err, errInvalidVideo) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidVideo, "Not a valid video: the file is corrupt or truncated", err)
+		return videoProbe{}, false
+	}
+	if errors.Is(err, errNoVideoStream) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeNoVideoStream, "File has no video stream", err)
+		return videoProbe{}, false
+	}
+	if errors.Is(err, errMediaCommandTimeout) {
+		respondWithErrorCode(w, http.StatusUnprocessableEntity, errCodeMediaTimeout, "Timed out inspecting the video; the file may be malformed", err)
+		return videoProbe{}, false
+	}
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Upload failed: couldn't inspect video", err)
+		return videoProbe{}, false
+	}
+	probe := videoProbe{aspectRatio: aspectRatio}
+
+	// Reject videos longer than the plan allows before spending storage
+	// and bandwidth on them
+	if cfg.maxVideoDuration > 0 || measureDuration {
+		seconds, err := cfg.getVideoDuration(r.Context(), filePath)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Upload failed: couldn't read video duration", err)
+			return videoProbe{}, false
+		}
+		probe.duration = time.Duration(seconds * float64(time.Second))
+		if cfg.maxVideoDuration > 0 && probe.duration > cfg.maxVideoDuration {
+			msg := fmt.Sprintf("Video is %s long, longer than the maximum of %s", probe.duration.Round(time.Second), cfg.maxVideoDuration)
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeVideoTooLong, msg, nil)
+			return videoProbe{}, false
+		}
 	}
-	filename := fmt.Sprintf("%s/%s.mp4", prefix, hex.EncodeToString(randomBytes))
+	return probe, true
+}
 
-	// Upload to S3
-	_, err = cfg.s3Client.PutObject(context.Background(), &s3.PutObjectInput{
-		Bucket:      &cfg.s3Bucket,
-		Key:         &filename,
-		Body:        processedFile,
-		ContentType: &mediaType,
-	})
+// queueVideoJob validates the video saved to job.filePath and hands job
+// to a worker for processing and storage, responding with the job. The
+// caller describes the upload in job; the IDs, aspect ratio and bucket are
+// filled in here. The job is recorded against idempotencyKey when one is
+// given. It reports whether the worker took ownership of the job's files;
+// if not, the caller removes them.
+func (cfg *apiConfig) queueVideoJob(w http.ResponseWriter, r *http.Request, video database.Video, job videoJob, idempotencyKey string) bool {
+	probe, ok := cfg.validateVideoFile(w, r, job.filePath, false)
+	if !ok {
+		return false
+	}
+
+	// Hand the file to a worker; it owns the temp file from here on
+	processingJob, err := cfg.db.CreateProcessingJob(video.ID, video.UserID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't upload file to S3", err)
-		return
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create processing job", err)
+		return false
+	}
+	if idempotencyKey != "" {
+		err = cfg.db.SetIdempotencyKeyJob(video.UserID, idempotencyKey, processingJob.ID)
+		if err != nil {
+			cfg.db.UpdateProcessingJobStatus(processingJob.ID, database.JobStatusFailed, "Couldn't save idempotency key")
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save idempotency key", err)
+			return false
+		}
 	}
 
-	// Construct the CloudFront URL
-	videoURL := fmt.Sprintf("https://%s/%s", cfg.s3CfDistribution, filename)
-	video.VideoURL = &videoURL
+	err = cfg.db.UpdateVideoStatus(video.ID, database.VideoStatusProcessing)
+	if err != nil {
+		cfg.db.UpdateProcessingJobStatus(processingJob.ID, database.JobStatusFailed, "Couldn't update video status")
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video status", err)
+		return false
+	}
 
-	// Update video metadata in database
-	err = cfg.db.UpdateVideo(video)
+	job.jobID = processingJob.ID
+	job.videoID = video.ID
+	job.userID = video.UserID
+	job.aspectRatio = probe.aspectRatio
+	job.bucket = cfg.uploadBucket(r, video.UserID).name
+	err = cfg.videoJobs.enqueue(job)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video metadata", err)
-		return
+		cfg.db.UpdateProcessingJobStatus(processingJob.ID, database.JobStatusFailed, "Processing queue is full")
+		cfg.db.UpdateVideoStatus(video.ID, video.Status)
+		respondWithErrorCode(w, http.StatusServiceUnavailable, errCodeServerBusy, "Too many videos are being processed, try again later", err)
+		return false
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	respondWithJSON(w, http.StatusAccepted, processingJob)
+	return true
 }
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// videoUploadForm builds the multipart form the web UI sends for an
+// upload, returning the body and its Content-Type.
+func videoUploadForm(t *testing.T, contentType string, data []byte, fields map[string]string) ([]byte, string) {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="video"; filename="video.mp4"`)
+	header.Set("Content-Type", contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body.Bytes(), form.FormDataContentType()
+}
+
+func newVideoUploadRequest(videoID uuid.UUID, token string, body []byte, contentType string) *http.Request {
+	req := newTestRequest(http.MethodPost, "/api/video_upload/"+videoID.String(), bytes.NewReader(body), token, "videoID", videoID.String())
+	req.Header.Set("Content-Type", contentType)
+	return req
+}
+
+// uploadTestVideo uploads data as the video's file through the handler
+// and waits for the job to store it and moderation to decide on it.
+func uploadTestVideo(t *testing.T, cfg *apiConfig, videoID uuid.UUID, token string, data []byte) database.Video {
+	t.Helper()
+
+	body, contentType := videoUploadForm(t, "video/mp4", data, nil)
+	rec := serveAuthed(cfg, cfg.handlerUploadVideo, newVideoUploadRequest(videoID, token, body, contentType))
+	expectStatus(t, rec, http.StatusAccepted)
+	waitForJob(t, cfg, decodeResponse[database.ProcessingJob](t, rec).ID)
+
+	// The job is done before moderation runs
+	var video database.Video
+	waitFor(t, "moderation", func() bool {
+		video = getTestVideo(t, cfg, videoID)
+		return video.ModerationStatus != database.ModerationStatusPendingReview
+	})
+	return video
+}
+
+func TestUploadVideoSignedURL(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "10.0"))
+	useFakeFFmpeg(t, cfg)
+	runTestWorkers(t, cfg)
+	user := createTestUser(t, cfg)
+	token := testToken(t, cfg, user.ID)
+	video := createTestVideo(t, cfg, user.ID)
+
+	stored := uploadTestVideo(t, cfg, video.ID, token, testMP4)
+
+	// The record holds the bucket and key, not a URL
+	bucket, key, ok := parseVideoURL(stored)
+	if !ok || bucket != testBucket {
+		t.Fatalf("stored VideoURL = %q, want %s,<key>", aws.ToString(stored.VideoURL), testBucket)
+	}
+	if object, ok := fake.object(bucket, key); !ok || !bytes.Equal(object.body, testMP4) {
+		t.Fatalf("uploaded file not stored at %s", key)
+	}
+
+	req := newTestRequest(http.MethodGet, "/api/videos/"+video.ID.String(), nil, token, "videoID", video.ID.String())
+	rec := serve(cfg.handlerGetVideo, req)
+	expectStatus(t, rec, http.StatusOK)
+	videoURL := aws.ToString(decodeResponse[database.Video](t, rec).VideoURL)
+	if !strings.HasPrefix(videoURL, "https://") || !strings.Contains(videoURL, "X-Amz-Signature=") {
+		t.Errorf("VideoURL = %q, want a presigned https URL", videoURL)
+	}
+	if !strings.Contains(videoURL, key) {
+		t.Errorf("VideoURL = %q, want it to point at %s", videoURL, key)
+	}
+}
+
+func TestUploadVideoTruncatedBody(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	user := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, user.ID)
+
+	body, contentType := videoUploadForm(t, "video/mp4", testMP4, nil)
+	// Drop the closing boundary and the end of the file, as a client that
+	// disconnects partway would
+	truncated := body[:bytes.LastIndex(body, []byte("\r\n--"))-4]
+
+	rec := serveAuthed(cfg, cfg.handlerUploadVideo, newVideoUploadRequest(video.ID, testToken(t, cfg, user.ID), truncated, contentType))
+	expectErrorCode(t, rec, statusClientClosedRequest, errCodeUploadInterrupted)
+	if got := fake.callCount("PutObject"); got != 0 {
+		t.Errorf("PutObject called %d times for an interrupted upload", got)
+	}
+}
+
+func TestUploadVideoOverLimit(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	cfg.maxVideoBytes = 1 << 10
+	user := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, user.ID)
+
+	data := append(bytes.Clone(testMP4), make([]byte, 2<<10)...)
+	body, contentType := videoUploadForm(t, "video/mp4", data, nil)
+
+	rec := serveAuthed(cfg, cfg.handlerUploadVideo, newVideoUploadRequest(video.ID, testToken(t, cfg, user.ID), body, contentType))
+	expectErrorCode(t, rec, http.StatusRequestEntityTooLarge, errCodeFileTooLarge)
+	if got := fake.callCount("PutObject"); got != 0 {
+		t.Errorf("PutObject called %d times for an oversized upload", got)
+	}
+}
+
+func TestUploadVideoPortraitKey(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	useFakeFFprobe(t, cfg, probeJSON(1080, 1920, "10.0"))
+	useFakeFFmpeg(t, cfg)
+	runTestWorkers(t, cfg)
+	user := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, user.ID)
+
+	stored := uploadTestVideo(t, cfg, video.ID, testToken(t, cfg, user.ID), testMP4)
+
+	_, key, ok := parseVideoURL(stored)
+	if !ok || !strings.HasPrefix(key, "portrait/") {
+		t.Fatalf("stored key = %q, want it under portrait/", key)
+	}
+	if _, ok := fake.object(testBucket, key); !ok {
+		t.Errorf("uploaded file not stored at %s", key)
+	}
+}
+
+func TestUploadVideoDuplicateStoredOnce(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "10.0"))
+	useFakeFFmpeg(t, cfg)
+	runTestWorkers(t, cfg)
+	user := createTestUser(t, cfg)
+	token := testToken(t, cfg, user.ID)
+
+	first := uploadTestVideo(t, cfg, createTestVideo(t, cfg, user.ID).ID, token, testMP4)
+	second := uploadTestVideo(t, cfg, createTestVideo(t, cfg, user.ID).ID, token, testMP4)
+
+	if aws.ToString(second.VideoURL) != aws.ToString(first.VideoURL) {
+		t.Errorf("duplicate stored at %q, want it to share %q", aws.ToString(second.VideoURL), aws.ToString(first.VideoURL))
+	}
+	if got := fake.callCount("PutObject"); got != 1 {
+		t.Errorf("PutObject called %d times for the same bytes uploaded twice, want 1", got)
+	}
+}
+
+func TestUploadVideoTruncatedMP4(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	// What ffprobe reports for an MP4 cut off before its moov box
+	cfg.ffprobePath = writeTestScript(t, "ffprobe", "echo 'moov atom not found' >&2\nexit 1\n")
+	user := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, user.ID)
+
+	// The ftyp box passes content sniffing, but the file ends there
+	body, contentType := videoUploadForm(t, "video/mp4", testMP4[:32], nil)
+
+	rec := serveAuthed(cfg, cfg.handlerUploadVideo, newVideoUploadRequest(video.ID, testToken(t, cfg, user.ID), body, contentType))
+	expectErrorCode(t, rec, http.StatusBadRequest, errCodeInvalidVideo)
+	if got := fake.callCount("PutObject"); got != 0 {
+		t.Errorf("PutObject called %d times for a truncated video", got)
+	}
+}
+
+func TestUploadVideoTooLong(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "95.0"))
+	cfg.maxVideoDuration = time.Minute
+	user := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, user.ID)
+
+	body, contentType := videoUploadForm(t, "video/mp4", testMP4, nil)
+	rec := serveAuthed(cfg, cfg.handlerUploadVideo, newVideoUploadRequest(video.ID, testToken(t, cfg, user.ID), body, contentType))
+	expectStatus(t, rec, http.StatusBadRequest)
+	resp := decodeResponse[errorResponse](t, rec)
+	if resp.Code != errCodeVideoTooLong {
+		t.Fatalf("error code = %s, want %s", resp.Code, errCodeVideoTooLong)
+	}
+	// The message tells the user how far over the limit they are
+	for _, want := range []string{"1m35s", "1m0s"} {
+		if !strings.Contains(resp.Error, want) {
+			t.Errorf("error %q doesn't mention %s", resp.Error, want)
+		}
+	}
+	if got := fake.callCount("PutObject"); got != 0 {
+		t.Errorf("PutObject called %d times for a video over the duration limit", got)
+	}
+}
+
+func TestUploadVideoOverQuota(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "10.0"))
+	useFakeFFmpeg(t, cfg)
+	runTestWorkers(t, cfg)
+	cfg.userStorageQuota = int64(len(testMP4)) * 3 / 2
+	user := createTestUser(t, cfg)
+	token := testToken(t, cfg, user.ID)
+
+	uploadTestVideo(t, cfg, createTestVideo(t, cfg, user.ID).ID, token, testMP4)
+	puts := fake.callCount("PutObject")
+
+	// Different bytes, so the upload can't share the first one's object
+	data := append(bytes.Clone(testMP4), 1)
+	body, contentType := videoUploadForm(t, "video/mp4", data, nil)
+	rec := serveAuthed(cfg, cfg.handlerUploadVideo, newVideoUploadRequest(createTestVideo(t, cfg, user.ID).ID, token, body, contentType))
+	expectErrorCode(t, rec, http.StatusRequestEntityTooLarge, errCodeQuotaExceeded)
+	if got := fake.callCount("PutObject"); got != puts {
+		t.Errorf("PutObject called %d more times for an upload over quota", got-puts)
+	}
+}
+
+func TestUploadVideoQuotaCountsSharedFilesOnce(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "10.0"))
+	useFakeFFmpeg(t, cfg)
+	runTestWorkers(t, cfg)
+	// Room for two distinct files
+	cfg.userStorageQuota = int64(len(testMP4))*2 + 1
+	user := createTestUser(t, cfg)
+	token := testToken(t, cfg, user.ID)
+
+	first := uploadTestVideo(t, cfg, createTestVideo(t, cfg, user.ID).ID, token, testMP4)
+	second := uploadTestVideo(t, cfg, createTestVideo(t, cfg, user.ID).ID, token, testMP4)
+	if aws.ToString(second.VideoURL) != aws.ToString(first.VideoURL) {
+		t.Fatalf("duplicate upload stored at %q, want the first's %q", aws.ToString(second.VideoURL), aws.ToString(first.VideoURL))
+	}
+
+	// The duplicate shares the first's object, so one file's worth of the
+	// quota is still free
+	data := append(bytes.Clone(testMP4), 1)
+	uploadTestVideo(t, cfg, createTestVideo(t, cfg, user.ID).ID, token, data)
+}
+
+func TestUploadVideoKeyPrefix(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	cfg.keyPrefix = normalizeKeyPrefix(" /prod/ ")
+	useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "10.0"))
+	useFakeFFmpeg(t, cfg)
+	runTestWorkers(t, cfg)
+	user := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, user.ID)
+
+	stored := uploadTestVideo(t, cfg, video.ID, testToken(t, cfg, user.ID), testMP4)
+
+	_, key, _ := parseVideoURL(stored)
+	if !strings.HasPrefix(key, "prod/landscape/") {
+		t.Fatalf("stored key = %q, want it under prod/landscape/", key)
+	}
+	if _, ok := fake.object(testBucket, key); !ok {
+		t.Fatalf("uploaded file not stored at %s", key)
+	}
+
+	signed, err := cfg.dbVideoToSignedVideo(context.Background(), stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedURL, err := url.Parse(aws.ToString(signed.VideoURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signedURL.Path != "/"+key {
+		t.Errorf("signed URL path = %q, want /%s", signedURL.Path, key)
+	}
+}
+
+func TestUploadVideoIdempotencyKey(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "10.0"))
+	user := createTestUser(t, cfg)
+	token := testToken(t, cfg, user.ID)
+	video := createTestVideo(t, cfg, user.ID)
+
+	upload := func(data []byte) *httptest.ResponseRecorder {
+		body, contentType := videoUploadForm(t, "video/mp4", data, nil)
+		req := newVideoUploadRequest(video.ID, token, body, contentType)
+		req.Header.Set(idempotencyKeyHeader, "upload-1")
+		return serveAuthed(cfg, cfg.handlerUploadVideo, req)
+	}
+
+	rec := upload(testMP4)
+	expectStatus(t, rec, http.StatusAccepted)
+	first := decodeResponse[database.ProcessingJob](t, rec)
+
+	// A client retrying after a timeout gets the job the first request made
+	rec = upload(testMP4)
+	expectStatus(t, rec, http.StatusAccepted)
+	if got := rec.Header().Get(idempotentReplayedHeader); got != "true" {
+		t.Errorf("%s = %q on a retry, want true", idempotentReplayedHeader, got)
+	}
+	if retried := decodeResponse[database.ProcessingJob](t, rec); retried.ID != first.ID {
+		t.Errorf("retry got job %s, want the original %s", retried.ID, first.ID)
+	}
+
+	rec = upload(append(bytes.Clone(testMP4), 1))
+	expectErrorCode(t, rec, http.StatusConflict, errCodeIdempotencyKeyReused)
+}
+
+func TestUploadVideoChecksum(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "10.0"))
+	useFakeFFmpeg(t, cfg)
+	runTestWorkers(t, cfg)
+	user := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, user.ID)
+
+	stored := uploadTestVideo(t, cfg, video.ID, testToken(t, cfg, user.ID), testMP4)
+
+	sum := sha256.Sum256(testMP4)
+	want := base64.StdEncoding.EncodeToString(sum[:])
+	if len(fake.puts) != 1 {
+		t.Fatalf("PutObject called %d times, want 1", len(fake.puts))
+	}
+	if fake.puts[0].ChecksumAlgorithm != types.ChecksumAlgorithmSha256 {
+		t.Errorf("ChecksumAlgorithm = %q, want %q", fake.puts[0].ChecksumAlgorithm, types.ChecksumAlgorithmSha256)
+	}
+	_, key, _ := parseVideoURL(stored)
+	if object, _ := fake.object(testBucket, key); object.checksumSHA256 != want {
+		t.Errorf("stored checksum = %q, want %q", object.checksumSHA256, want)
+	}
+}
+
+func TestUploadVideoDuplicateNormalizedStoredAgain(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "10.0"))
+	useFakeFFmpeg(t, cfg)
+	runTestWorkers(t, cfg)
+	user := createTestUser(t, cfg)
+	token := testToken(t, cfg, user.ID)
+
+	first := uploadTestVideo(t, cfg, createTestVideo(t, cfg, user.ID).ID, token, testMP4)
+
+	// The same bytes, but asking for the audio the first upload kept as it
+	// was to be normalized
+	video := createTestVideo(t, cfg, user.ID)
+	body, contentType := videoUploadForm(t, "video/mp4", testMP4, map[string]string{"normalize_audio": "true"})
+	rec := serveAuthed(cfg, cfg.handlerUploadVideo, newVideoUploadRequest(video.ID, token, body, contentType))
+	expectStatus(t, rec, http.StatusAccepted)
+	waitForJob(t, cfg, decodeResponse[database.ProcessingJob](t, rec).ID)
+
+	second := getTestVideo(t, cfg, video.ID)
+	if aws.ToString(second.VideoURL) == aws.ToString(first.VideoURL) {
+		t.Errorf("normalized upload shares %q with the unnormalized one", aws.ToString(first.VideoURL))
+	}
+	if !second.NormalizeAudio || first.NormalizeAudio {
+		t.Errorf("NormalizeAudio = %v then %v, want false then true", first.NormalizeAudio, second.NormalizeAudio)
+	}
+	if got := fake.callCount("PutObject"); got != 2 {
+		t.Errorf("PutObject called %d times, want 2", got)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultBulkUploadMaxEntries = 50
+	defaultBulkUploadMaxBytes   = 4 << 30 // 4GB
+)
+
+// bulkUploadResult is the outcome for one file in a bulk upload. Files
+// that were queued have a video and job; the rest have the error an
+// upload of that file alone would have got.
+type bulkUploadResult struct {
+	File    string     `json:"file"`
+	Status  int        `json:"status"`
+	VideoID *uuid.UUID `json:"video_id,omitempty"`
+	JobID   *uuid.UUID `json:"job_id,omitempty"`
+	Error   string     `json:"error,omitempty"`
+	Code    errorCode  `json:"code,omitempty"`
+}
+
+// bulkEntryRecorder captures the response the upload helpers write for
+// one archive entry, so it can go in the results instead of being sent.
+type bulkEntryRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBulkEntryRecorder(w http.ResponseWriter) *bulkEntryRecorder {
+	rec := &bulkEntryRecorder{header: http.Header{}}
+	// Keep the request ID on logged errors and error bodies
+	rec.header.Set(requestIDHeader, w.Header().Get(requestIDHeader))
+	return rec
+}
+
+func (rec *bulkEntryRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *bulkEntryRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+}
+
+func (rec *bulkEntryRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+// result turns the recorded response into the entry's result.
+func (rec *bulkEntryRecorder) result(file string) bulkUploadResult {
+	result := bulkUploadResult{File: file, Status: rec.status}
+	if rec.status == http.StatusAccepted {
+		var job database.ProcessingJob
+		if err := json.Unmarshal(rec.body.Bytes(), &job); err == nil {
+			result.VideoID = &job.VideoID
+			result.JobID = &job.ID
+		}
+		return result
+	}
+	var errResp errorResponse
+	if err := json.Unmarshal(rec.body.Bytes(), &errResp); err == nil {
+		result.Error = errResp.Error
+		result.Code = errResp.Code
+	}
+	return result
+}
+
+// isBulkUploadEntry reports whether an archive entry should be uploaded.
+// Directories and the metadata files zip tools leave behind are skipped.
+func isBulkUploadEntry(file *zip.File) bool {
+	if file.FileInfo().IsDir() {
+		return false
+	}
+	if strings.HasPrefix(file.Name, "__MACOSX/") {
+		return false
+	}
+	return !strings.HasPrefix(path.Base(file.Name), ".")
+}
+
+// bulkUploadTitle makes a video title from an archive entry's file name.
+func (cfg *apiConfig) bulkUploadTitle(name string) string {
+	base := path.Base(name)
+	title := strings.TrimSpace(sanitizeText(cfg.metadataHTML, strings.TrimSuffix(base, path.Ext(base)), false))
+	if runes := []rune(title); len(runes) > maxVideoTitleLength {
+		title = strings.TrimSpace(string(runes[:maxVideoTitleLength]))
+	}
+	return title
+}
+
+// handlerBulkUploadVideos creates a video for each file in a zip archive
+// sent as the archive form field, titled after the file name. Entries are
+// read one at a time into a temp file and checked like a single upload;
+// those that pass are queued for processing. Archives with more than
+// BULK_UPLOAD_MAX_ENTRIES files or BULK_UPLOAD_MAX_BYTES uncompressed are
+// rejected before anything is read. The response lists the result for
+// every file, so one bad file doesn't fail the rest.
+func (cfg *apiConfig) handlerBulkUploadVideos(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Results []bulkUploadResult `json:"results"`
+		Queued  int                `json:"queued"`
+		Failed  int                `json:"failed"`
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.bulkMaxBytes)
+
+	userID := userIDFromContext(r)
+
+	archive, archiveHeader, err := r.FormFile("archive")
+	if err != nil {
+		if respondIfTooLarge(w, err) || respondIfTimedOut(w, err) || respondIfClientGone(w, r, err) {
+			return
+		}
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Error getting archive from form", err)
+		return
+	}
+	defer archive.Close()
+
+	storageClass := cfg.s3StorageClass
+	if value := r.FormValue("storage_class"); value != "" {
+		storageClass = types.StorageClass(value)
+		if !allowedStorageClasses[storageClass] {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidStorageClass, allowedStorageClassesMessage, nil)
+			return
+		}
+	}
+	normalizeAudio := cfg.normalizeAudio
+	if value := r.FormValue("normalize_audio"); value != "" {
+		normalizeAudio, err = strconv.ParseBool(value)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "normalize_audio must be true or false", err)
+			return
+		}
+	}
+
+	qualityPreset := cfg.qualityPreset
+	if value := r.FormValue("quality_preset"); value != "" {
+		if _, ok := qualityPresets[value]; !ok {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidQualityPreset, allowedQualityPresetsMessage, nil)
+			return
+		}
+		qualityPreset = value
+	}
+
+	zipReader, err := zip.NewReader(archive, archiveHeader.Size)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Archive isn't a valid zip file", err)
+		return
+	}
+
+	// Check the listed sizes up front; reading an entry fails if it holds
+	// more than its listed size, so these limits can't be got around
+	var entries []*zip.File
+	var totalBytes uint64
+	for _, file := range zipReader.File {
+		if !isBulkUploadEntry(file) {
+			continue
+		}
+		entries = append(entries, file)
+		totalBytes += file.UncompressedSize64
+	}
+	if len(entries) == 0 {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Archive has no files", nil)
+		return
+	}
+	if len(entries) > cfg.bulkMaxEntries {
+		msg := fmt.Sprintf("Archive has %d files, more than the maximum of %d", len(entries), cfg.bulkMaxEntries)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, msg, nil)
+		return
+	}
+	if totalBytes > uint64(cfg.bulkMaxBytes) {
+		msg := fmt.Sprintf("Archive holds %d bytes uncompressed, more than the maximum of %d", totalBytes, cfg.bulkMaxBytes)
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, msg, nil)
+		return
+	}
+
+	resp := response{Results: []bulkUploadResult{}}
+	// Files queued earlier aren't stored yet, so they're counted against
+	// the quota here
+	var queuedBytes int64
+	for _, file := range entries {
+		rec := newBulkEntryRecorder(w)
+		queued := cfg.bulkUploadEntry(rec, r, userID, file, queuedBytes, videoJob{
+			storageClass:  storageClass,
+			normalize:     normalizeAudio,
+			qualityPreset: qualityPreset,
+		})
+		result := rec.result(file.Name)
+		if queued {
+			queuedBytes += int64(file.UncompressedSize64)
+			resp.Queued++
+		} else {
+			resp.Failed++
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// bulkUploadEntry copies one archive entry to a temp file, checks it and
+// queues it as a new video, writing the outcome to w like a single upload
+// would. It reports whether the entry was queued. job carries the options
+// shared by every entry.
+func (cfg *apiConfig) bulkUploadEntry(w http.ResponseWriter, r *http.Request, userID uuid.UUID, file *zip.File, queuedBytes int64, job videoJob) bool {
+	// Once the client has gone or the deadline has passed, the remaining
+	// entries all fail the same way
+	if err := r.Context().Err(); err != nil {
+		if !respondIfTimedOut(w, err) && !respondIfClientGone(w, r, err) {
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Upload was cancelled", err)
+		}
+		return false
+	}
+
+	if file.UncompressedSize64 > uint64(cfg.maxVideoBytes) {
+		msg := fmt.Sprintf("File exceeds the maximum size of %d bytes", cfg.maxVideoBytes)
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, msg, nil)
+		return false
+	}
+	size := int64(file.UncompressedSize64)
+
+	entry, err := file.Open()
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Couldn't read file from archive", err)
+		return false
+	}
+	defer entry.Close()
+
+	// Sniff the type from the first bytes, so the temp file can be given
+	// the extension ffmpeg needs to demux it
+	reader := bufio.NewReaderSize(entry, 512)
+	head, err := reader.Peek(512)
+	if err != nil && !errors.Is(err, io.EOF) {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Couldn't read file from archive", err)
+		return false
+	}
+	detectedType, err := detectFileType(bytes.NewReader(head))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't read uploaded file", err)
+		return false
+	}
+	ext, ok := cfg.videoTypes[detectedType]
+	if !ok {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "File contents are not a supported video. "+cfg.videoTypesMessage(), nil)
+		return false
+	}
+
+	// Check the quota before spending time on the file; the worker checks
+	// again with the size of the processed file
+	err = cfg.checkStorageQuota(database.Video{CreateVideoParams: database.CreateVideoParams{UserID: userID}}, queuedBytes+size)
+	if err != nil {
+		if respondIfOverQuota(w, err) {
+			return false
+		}
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check storage quota", err)
+		return false
+	}
+
+	tempFile, cleanupTempFile, err := cfg.newTempFile("tubely-bulk-*" + ext)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create temporary file", err)
+		return false
+	}
+	// Remove the temp file unless it has been handed off to a processing
+	// job
+	keepTempFile := false
+	defer func() {
+		if keepTempFile {
+			tempFile.Close()
+			return
+		}
+		cleanupTempFile()
+	}()
+
+	hasher := sha256.New()
+	_, err = io.Copy(tempFile, io.TeeReader(reader, hasher))
+	if err != nil {
+		if errors.Is(err, zip.ErrFormat) || errors.Is(err, zip.ErrChecksum) {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "File in archive is corrupt", err)
+			return false
+		}
+		if respondIfTimedOut(w, err) || respondIfClientGone(w, r, err) {
+			return false
+		}
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save file", err)
+		return false
+	}
+
+	contentHash := hex.EncodeToString(hasher.Sum(nil))
+	if cfg.respondIfBlockedContent(w, r, userID, uuid.Nil, contentHash) {
+		return false
+	}
+
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:  cfg.bulkUploadTitle(file.Name),
+		UserID: userID,
+	})
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create video", err)
+		return false
+	}
+
+	job.filePath = tempFile.Name()
+	job.mediaType = detectedType
+	job.contentHash = contentHash
+	keepTempFile = cfg.queueVideoJob(w, r, video, job, "")
+	if !keepTempFile {
+		// Nothing references a video whose file was rejected
+		err = cfg.db.PurgeVideo(video.ID)
+		if err != nil {
+			log.Printf("Couldn't remove video %s for rejected bulk upload file: %v", video.ID, err)
+		}
+	}
+	return keepTempFile
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// handlerVideoDownloadURL returns a presigned URL that makes the browser
+// save the original file as "<title>.mp4" instead of playing it. It always
+// signs against S3, because S3 only honours response-content-disposition
+// on its own signed URLs.
+func (cfg *apiConfig) handlerVideoDownloadURL(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		DownloadURL string `json:"download_url"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtTokens)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	expireTime, err := cfg.presignExpiryFromRequest(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You don't own this video", nil)
+		return
+	}
+
+	bucket, key, ok := parseVideoURL(video)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Video has no uploaded file yet", nil)
+		return
+	}
+	if requiresRestore(video.StorageClass) {
+		respondWithError(w, http.StatusConflict, "Video is archived and must be restored first", nil)
+		return
+	}
+
+	downloadURL, err := generatePresignedURL(r.Context(), cfg.bucketByName(bucket).presigner, bucket, key, expireTime, cfg.videoResponseType, attachmentDisposition(sanitizeFilename(video.Title)+".mp4"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{DownloadURL: downloadURL})
+}
+
+// handlerStreamVideo proxies the video's file from S3, for clients that
+// can't use presigned URLs, e.g. behind proxies that strip query strings.
+// A Range header is passed on to S3, so players can seek, and the S3
+// request is cancelled along with the client's.
+func (cfg *apiConfig) handlerStreamVideo(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtTokens)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You don't own this video", nil)
+		return
+	}
+
+	bucket, key, ok := parseVideoURL(video)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Video has no uploaded file yet", nil)
+		return
+	}
+	if requiresRestore(video.StorageClass) {
+		respondWithError(w, http.StatusConflict, "Video is archived and must be restored first", nil)
+		return
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+	// S3 ignores ranges it can't parse and sends the whole object, which is
+	// what an HTTP server should do too
+	if rangeHeader := r.Header.Get("Range"); strings.HasPrefix(rangeHeader, "bytes=") {
+		input.Range = &rangeHeader
+	}
+	object, err := cfg.bucketByName(bucket).client.GetObject(r.Context(), input)
+	if err != nil {
+		if isS3InvalidRange(err) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", video.SizeBytes))
+			respondWithError(w, http.StatusRequestedRangeNotSatisfiable, "Range isn't satisfiable", nil)
+			return
+		}
+		if isS3NotFound(err) {
+			respondWithError(w, http.StatusNotFound, "Video file not found", err)
+			return
+		}
+		respondWithError(w, http.StatusBadGateway, "Couldn't get video from storage", err)
+		return
+	}
+	defer object.Body.Close()
+
+	contentType := cfg.videoResponseType
+	if contentType == "" {
+		contentType = aws.ToString(object.ContentType)
+	}
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("Cache-Control", "private, no-store")
+	if object.ContentLength != nil {
+		header.Set("Content-Length", strconv.FormatInt(*object.ContentLength, 10))
+	}
+	if object.ETag != nil {
+		header.Set("ETag", *object.ETag)
+	}
+	if object.LastModified != nil {
+		header.Set("Last-Modified", object.LastModified.UTC().Format(http.TimeFormat))
+	}
+
+	status := http.StatusOK
+	if object.ContentRange != nil {
+		header.Set("Content-Range", *object.ContentRange)
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	// The status is already sent, so a failed copy can only be logged;
+	// clients going away are expected while seeking
+	_, err = io.Copy(w, object.Body)
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("Couldn't stream video %s: %v", video.ID, err)
+	}
+}
+
+// attachmentDisposition builds a Content-Disposition header value that
+// downloads the file as filename. The quoted filename is an ASCII-only
+// fallback; filename* carries the full UTF-8 name for browsers that read it.
+func attachmentDisposition(filename string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII {
+			return '_'
+		}
+		return r
+	}, filename)
+
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback, strings.ReplaceAll(url.QueryEscape(filename), "+", "%20"))
+}
+
+// sanitizeFilename strips characters from a video title that could break
+// out of a quoted header value or be read as a path, falling back to
+// "video" when nothing usable is left.
+func sanitizeFilename(filename string) string {
+	filename = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/', r == '\\', r == '"', unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, filename)
+
+	// A leading dot would make the download a hidden file
+	filename = strings.TrimLeft(strings.TrimSpace(filename), ".")
+	if filename == "" {
+		return "video"
+	}
+	return filename
+}
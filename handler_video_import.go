@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/google/uuid"
+)
+
+// handlerImportVideoFromURL downloads an MP4 hosted elsewhere and stores it
+// like an upload through handlerUploadVideo. The download is capped at
+// MAX_VIDEO_BYTES and UPLOAD_TIMEOUT_MAX, and may only reach public
+// addresses.
+func (cfg *apiConfig) handlerImportVideoFromURL(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		URL string `json:"url"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	userID := userIDFromContext(r)
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Couldn't decode parameters", err)
+		return
+	}
+	sourceURL, err := url.Parse(params.URL)
+	if err != nil || (sourceURL.Scheme != "http" && sourceURL.Scheme != "https") || sourceURL.Host == "" {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "url must be an absolute http or https URL", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotOwner, "You don't own this video", nil)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, sourceURL.String(), nil)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid url", err)
+		return
+	}
+	resp, err := newRemoteFetchClient(cfg.uploadTimeouts.max).Do(req)
+	if err != nil {
+		if errors.Is(err, errBlockedAddress) {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeBlockedURL, "url must point to a public address", err)
+			return
+		}
+		respondWithErrorCode(w, http.StatusBadGateway, errCodeImportFailed, "Couldn't download video", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respondWithErrorCode(w, http.StatusBadGateway, errCodeImportFailed, fmt.Sprintf("Downloading video failed with status %d", resp.StatusCode), nil)
+		return
+	}
+	if resp.ContentLength > cfg.maxVideoBytes {
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Video exceeds the maximum size of %d bytes", cfg.maxVideoBytes), nil)
+		return
+	}
+	if resp.ContentLength >= 0 {
+		err = cfg.checkStorageQuota(video, resp.ContentLength)
+		if err != nil {
+			if respondIfOverQuota(w, err) {
+				return
+			}
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check storage quota", err)
+			return
+		}
+	}
+
+	tempFile, cleanupTempFile, err := cfg.newTempFile("tubely-import-*.mp4")
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create temporary file", err)
+		return
+	}
+	// Remove the temp file when we're done, unless it has been handed off
+	// to a processing job
+	keepTempFile := false
+	defer func() {
+		if keepTempFile {
+			tempFile.Close()
+			return
+		}
+		cleanupTempFile()
+	}()
+
+	// Read one byte past the limit to tell a body that's exactly at it from
+	// one that's over
+	hasher := sha256.New()
+	n, err := io.Copy(tempFile, io.TeeReader(io.LimitReader(resp.Body, cfg.maxVideoBytes+1), hasher))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadGateway, errCodeImportFailed, "Couldn't download video", err)
+		return
+	}
+	if n > cfg.maxVideoBytes {
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, fmt.Sprintf("Video exceeds the maximum size of %d bytes", cfg.maxVideoBytes), nil)
+		return
+	}
+
+	detectedType, err := detectFileType(tempFile)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't read downloaded file", err)
+		return
+	}
+	if detectedType != "video/mp4" {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "Only MP4 videos can be imported", nil)
+		return
+	}
+
+	contentHash := hex.EncodeToString(hasher.Sum(nil))
+	if cfg.respondIfBlockedContent(w, r, userID, videoID, contentHash) {
+		return
+	}
+
+	keepTempFile = cfg.queueVideoJob(w, r, video, videoJob{
+		filePath:      tempFile.Name(),
+		mediaType:     detectedType,
+		contentHash:   contentHash,
+		storageClass:  cfg.s3StorageClass,
+		normalize:     cfg.normalizeAudio,
+		qualityPreset: cfg.qualityPreset,
+	}, "")
+}
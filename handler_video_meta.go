@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
@@ -19,7 +27,7 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtTokens)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
@@ -34,6 +42,19 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 	}
 	params.UserID = userID
 
+	// Held to the same rules as handlerUpdateVideoMetadata, except that
+	// the title may be left empty
+	params.Title = strings.TrimSpace(sanitizeText(cfg.metadataHTML, params.Title, false))
+	if utf8.RuneCountInString(params.Title) > maxVideoTitleLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Title can't be longer than %d characters", maxVideoTitleLength), nil)
+		return
+	}
+	params.Description = strings.TrimSpace(sanitizeText(cfg.metadataHTML, params.Description, true))
+	if utf8.RuneCountInString(params.Description) > maxVideoDescriptionLength {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Description can't be longer than %d characters", maxVideoDescriptionLength), nil)
+		return
+	}
+
 	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
@@ -43,7 +64,120 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 	respondWithJSON(w, http.StatusCreated, video)
 }
 
-func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
+const (
+	maxVideoTitleLength       = 100
+	maxVideoDescriptionLength = 5000
+)
+
+func (cfg *apiConfig) handlerUpdateVideoMetadata(w http.ResponseWriter, r *http.Request) {
+	// Pointers distinguish a field left out of the body from one set to ""
+	type parameters struct {
+		Title       *string `json:"title"`
+		Description *string `json:"description"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtTokens)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	// Hold the video's lock before reading it, so the video can't change
+	// under us
+	unlock, err := cfg.acquireVideoLock(r.Context(), videoID)
+	if err != nil {
+		if respondIfVideoBusy(w, err) {
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't lock video", err)
+		return
+	}
+	defer unlock()
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't edit this video", nil)
+		return
+	}
+
+	// The frontend may render these as HTML, so markup is neutralized
+	// before they're stored
+	if params.Title != nil {
+		title := strings.TrimSpace(sanitizeText(cfg.metadataHTML, *params.Title, false))
+		if title == "" {
+			respondWithError(w, http.StatusBadRequest, "Title can't be empty", nil)
+			return
+		}
+		if utf8.RuneCountInString(title) > maxVideoTitleLength {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Title can't be longer than %d characters", maxVideoTitleLength), nil)
+			return
+		}
+		video.Title = title
+	}
+	if params.Description != nil {
+		description := strings.TrimSpace(sanitizeText(cfg.metadataHTML, *params.Description, true))
+		if utf8.RuneCountInString(description) > maxVideoDescriptionLength {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Description can't be longer than %d characters", maxVideoDescriptionLength), nil)
+			return
+		}
+		video.Description = description
+	}
+
+	err = cfg.db.UpdateVideoDetails(video.ID, video.Title, video.Description)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	// Reread it, so the response has whatever background work changed
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
+
+// handlerDeleteVideo moves the video to the trash. It disappears from
+// listings straight away but keeps its files, which still count against
+// the quota, until it is restored or VIDEO_RECOVERY_WINDOW passes and the
+// purger removes it.
+func (cfg *apiConfig) handlerDeleteVideo(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
@@ -56,23 +190,155 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtTokens)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
+	// Wait for a job still storing the video, so it doesn't finish writing
+	// to a record that's already in the trash
+	unlock, err := cfg.acquireVideoLock(r.Context(), videoID)
+	if err != nil {
+		if respondIfVideoBusy(w, err) {
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't lock video", err)
+		return
+	}
+	defer unlock()
+
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
 	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
 	if video.UserID != userID {
 		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	err = cfg.db.DeleteVideo(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerRestoreVideo takes a deleted video out of the trash, as long as
+// it was deleted within VIDEO_RECOVERY_WINDOW.
+func (cfg *apiConfig) handlerRestoreVideo(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtTokens)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideoWithDeleted(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't restore this video", nil)
+		return
+	}
+	if video.DeletedAt == nil {
+		respondWithError(w, http.StatusConflict, "Video isn't deleted", nil)
+		return
+	}
+
+	restored, err := cfg.db.RestoreVideo(video.ID, time.Now().Add(-cfg.recoveryWindow))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't restore video", err)
+		return
+	}
+	if !restored {
+		msg := fmt.Sprintf("Video was deleted more than %s ago and can't be restored", cfg.recoveryWindow)
+		respondWithErrorCode(w, http.StatusGone, errCodeRecoveryExpired, msg, nil)
+		return
+	}
+	video.DeletedAt = nil
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
+
+// handlerAdminDeleteVideo purges any user's video at once, deleted or
+// not, skipping the recovery window. It requires a token with the admin
+// scope.
+func (cfg *apiConfig) handlerAdminDeleteVideo(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	_, err = auth.ValidateJWTWithScope(token, cfg.jwtTokens, auth.ScopeAdmin)
+	if errors.Is(err, auth.ErrMissingScope) {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	// Wait for anything still working on the video's objects, so nothing
+	// writes to the record or stores objects after it's purged
+	unlock, err := cfg.acquireVideoLock(r.Context(), videoID)
+	if err != nil {
+		if respondIfVideoBusy(w, err) {
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't lock video", err)
+		return
+	}
+	defer unlock()
+
+	video, err := cfg.db.GetVideoWithDeleted(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+
+	err = cfg.purgeVideo(r.Context(), video)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
@@ -81,40 +347,265 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
+// purgeVideo removes the video's stored files and then its record, so a
+// failure leaves the record in place to retry against.
+func (cfg *apiConfig) purgeVideo(ctx context.Context, video database.Video) error {
+	err := cfg.deleteVideoObjects(ctx, video)
+	if err != nil {
+		return err
+	}
+
+	if video.ThumbnailURL != nil {
+		cfg.removeThumbnail(ctx, *video.ThumbnailURL)
+	}
+	if video.PreviewURL != nil {
+		cfg.removePreview(ctx, *video.PreviewURL)
+	}
+
+	return cfg.db.PurgeVideo(video.ID)
+}
+
+// handlerGetVideo returns one video with freshly signed URLs, for its
+// detail page. Unlisted and public videos can be fetched by anyone with
+// the ID, so the token is optional; private videos need one belonging to
+// the owner or carrying the admin scope.
+func (cfg *apiConfig) handlerGetVideo(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	// A token that's sent must be valid, even for videos that don't need
+	// one
+	token := ""
+	userID := uuid.Nil
+	if r.Header.Get("Authorization") != "" {
+		token, err = auth.GetBearerToken(r.Header)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusUnauthorized, errCodeUnauthorized, "Couldn't find JWT", err)
+			return
+		}
+		userID, err = auth.ValidateJWT(token, cfg.jwtTokens)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusUnauthorized, errCodeUnauthorized, "Couldn't validate JWT", err)
+			return
+		}
+	}
+
+	expireTime, err := cfg.presignExpiryFromRequest(r)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error(), err)
 		return
 	}
 
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Video not found", nil)
+		return
+	}
+	if video.Visibility == database.VisibilityPrivate && video.UserID != userID {
+		if token == "" {
+			respondWithErrorCode(w, http.StatusForbidden, errCodeForbidden, "This video is private", nil)
+			return
+		}
+		_, err := auth.ValidateJWTWithScope(token, cfg.jwtTokens, auth.ScopeAdmin)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusForbidden, errCodeForbidden, "This video is private", err)
+			return
+		}
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideoWithExpiry(r.Context(), video, expireTime)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't generate presigned URL", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
+
+func (cfg *apiConfig) handlerVideosSearch(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtTokens)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing search query", nil)
+		return
+	}
+
+	videos, err := cfg.db.SearchVideos(userID, query)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't search videos", err)
+		return
+	}
+
+	for i, video := range videos {
+		videos[i], err = cfg.dbVideoToSignedVideo(r.Context(), video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, videos)
+}
+
+const (
+	defaultVideoPageSize = 20
+	maxVideoPageSize     = 100
+)
+
+// paginationFromRequest reads the limit and offset query parameters,
+// capping limit at maxVideoPageSize.
+func paginationFromRequest(r *http.Request) (limit, offset int, err error) {
+	query := r.URL.Query()
+
+	limit = defaultVideoPageSize
+	if limitString := query.Get("limit"); limitString != "" {
+		limit, err = strconv.Atoi(limitString)
+		if err != nil || limit < 1 {
+			return 0, 0, errors.New("limit must be a positive integer")
+		}
+		limit = min(limit, maxVideoPageSize)
+	}
+
+	if offsetString := query.Get("offset"); offsetString != "" {
+		offset, err = strconv.Atoi(offsetString)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
 }
 
+// handlerVideosRetrieve lists the user's videos a page at a time, either
+// by limit and offset or, when sorted by created_at, by passing the
+// previous page's next_cursor as cursor. next_cursor is empty on the last
+// page and for other sort orders. status limits the list to videos with
+// that status, and status_counts counts all the user's videos by status.
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Videos       []database.Video `json:"videos"`
+		Total        int              `json:"total"`
+		Limit        int              `json:"limit"`
+		Offset       int              `json:"offset"`
+		NextCursor   string           `json:"next_cursor"`
+		StatusCounts map[string]int   `json:"status_counts"`
+	}
+
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtTokens)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	limit, offset, err := paginationFromRequest(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	sortBy := r.URL.Query().Get("sort")
+	if sortBy == "" {
+		sortBy = "-created_at"
+	}
+	if _, ok := database.VideoSortOrders[sortBy]; !ok {
+		respondWithError(w, http.StatusBadRequest, "sort must be one of created_at, -created_at, title, -title", nil)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status != "" && !slices.Contains(database.VideoStatuses, status) {
+		respondWithError(w, http.StatusBadRequest, "status must be one of "+strings.Join(database.VideoStatuses, ", "), nil)
+		return
+	}
+
+	expireTime, err := cfg.presignExpiryFromRequest(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	byCreatedAt := sortBy == "created_at" || sortBy == "-created_at"
+	var cursor *database.VideoCursor
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		if !byCreatedAt || offset != 0 {
+			respondWithError(w, http.StatusBadRequest, "cursor can only be used when sorting by created_at, without an offset", nil)
+			return
+		}
+		cursor, err = decodeVideoCursor(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error(), err)
+			return
+		}
+	}
+
+	// Fetch one extra video to tell whether there's another page
+	var videos []database.Video
+	if byCreatedAt && offset == 0 {
+		videos, err = cfg.db.GetVideosAfter(userID, status, cursor, limit+1, sortBy == "-created_at")
+	} else {
+		videos, err = cfg.db.GetVideosPaginated(userID, status, limit+1, offset, sortBy)
+	}
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
 	}
+	nextCursor := ""
+	if len(videos) > limit {
+		videos = videos[:limit]
+		if byCreatedAt {
+			nextCursor = encodeVideoCursor(videos[limit-1])
+		}
+	}
 
-	respondWithJSON(w, http.StatusOK, videos)
+	statusCounts, err := cfg.db.CountVideosByStatus(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't count videos", err)
+		return
+	}
+	total := statusCounts[status]
+	if status == "" {
+		total = 0
+		for _, count := range statusCounts {
+			total += count
+		}
+	}
+
+	for i, video := range videos {
+		videos[i], err = cfg.dbVideoToSignedVideoWithExpiry(r.Context(), video, expireTime)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Videos:       videos,
+		Total:        total,
+		Limit:        limit,
+		Offset:       offset,
+		NextCursor:   nextCursor,
+		StatusCounts: statusCounts,
+	})
 }
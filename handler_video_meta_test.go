@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestAdminDeleteVideo(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	owner := createTestUser(t, cfg)
+	admin := createTestUser(t, cfg)
+	video := storeTestVideo(t, cfg, fake, createTestVideo(t, cfg, owner.ID), testMP4)
+	_, key, _ := parseVideoURL(video)
+
+	adminDelete := func(token string) int {
+		req := newTestRequest(http.MethodDelete, "/admin/videos/"+video.ID.String(), nil, token, "videoID", video.ID.String())
+		return serve(cfg.handlerAdminDeleteVideo, req).Code
+	}
+
+	// Owning the video isn't enough without the admin scope
+	if got := adminDelete(testToken(t, cfg, owner.ID)); got != http.StatusForbidden {
+		t.Fatalf("regular token status = %d, want %d", got, http.StatusForbidden)
+	}
+	if got := adminDelete(""); got != http.StatusUnauthorized {
+		t.Fatalf("no token status = %d, want %d", got, http.StatusUnauthorized)
+	}
+	if getTestVideo(t, cfg, video.ID).ID == uuid.Nil {
+		t.Fatal("video deleted without the admin scope")
+	}
+
+	if got := adminDelete(testToken(t, cfg, admin.ID, auth.ScopeAdmin)); got != http.StatusNoContent {
+		t.Fatalf("admin token status = %d, want %d", got, http.StatusNoContent)
+	}
+	deleted, err := cfg.db.GetVideoWithDeleted(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.ID != uuid.Nil {
+		t.Error("video record still there after an admin delete")
+	}
+	if _, ok := fake.object(testBucket, key); ok {
+		t.Error("video file still there after an admin delete")
+	}
+}
+
+func TestGetVideoVisibility(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	owner := createTestUser(t, cfg)
+	other := createTestUser(t, cfg)
+	video := storeTestVideo(t, cfg, fake, createTestVideo(t, cfg, owner.ID), testMP4)
+
+	tests := []struct {
+		name       string
+		visibility string
+		token      string
+		want       int
+		wantCode   errorCode
+	}{
+		{"private, owner", database.VisibilityPrivate, testToken(t, cfg, owner.ID), http.StatusOK, ""},
+		{"private, other user", database.VisibilityPrivate, testToken(t, cfg, other.ID), http.StatusForbidden, errCodeForbidden},
+		{"private, no token", database.VisibilityPrivate, "", http.StatusForbidden, errCodeForbidden},
+		{"private, admin", database.VisibilityPrivate, testToken(t, cfg, other.ID, auth.ScopeAdmin), http.StatusOK, ""},
+		{"private, invalid token", database.VisibilityPrivate, "not-a-jwt", http.StatusUnauthorized, errCodeUnauthorized},
+		{"unlisted, no token", database.VisibilityUnlisted, "", http.StatusOK, ""},
+		{"public, other user", database.VisibilityPublic, testToken(t, cfg, other.ID), http.StatusOK, ""},
+		{"public, no token", database.VisibilityPublic, "", http.StatusOK, ""},
+		// A bad token is refused even where none is needed
+		{"public, invalid token", database.VisibilityPublic, "not-a-jwt", http.StatusUnauthorized, errCodeUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestVisibility(t, cfg, video.ID, tt.visibility)
+
+			req := newTestRequest(http.MethodGet, "/api/videos/"+video.ID.String(), nil, tt.token, "videoID", video.ID.String())
+			rec := serve(cfg.handlerGetVideo, req)
+			if tt.wantCode != "" {
+				expectErrorCode(t, rec, tt.want, tt.wantCode)
+				return
+			}
+			expectStatus(t, rec, tt.want)
+			got := decodeResponse[database.Video](t, rec)
+			if got.ID != video.ID {
+				t.Errorf("got video %s, want %s", got.ID, video.ID)
+			}
+		})
+	}
+}
+
+func TestGetVideoNotFound(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user := createTestUser(t, cfg)
+
+	videoID := uuid.NewString()
+	req := newTestRequest(http.MethodGet, "/api/videos/"+videoID, nil, testToken(t, cfg, user.ID), "videoID", videoID)
+	rec := serve(cfg.handlerGetVideo, req)
+	expectErrorCode(t, rec, http.StatusNotFound, errCodeNotFound)
+}
+
+func TestRestoreVideo(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user := createTestUser(t, cfg)
+	token := testToken(t, cfg, user.ID)
+
+	restore := func(videoID uuid.UUID) *httptest.ResponseRecorder {
+		req := newTestRequest(http.MethodPost, "/api/videos/"+videoID.String()+"/restore", nil, token, "videoID", videoID.String())
+		return serve(cfg.handlerRestoreVideo, req)
+	}
+
+	video := createTestVideo(t, cfg, user.ID)
+	if err := cfg.db.DeleteVideo(video.ID); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, restore(video.ID), http.StatusOK)
+	if getTestVideo(t, cfg, video.ID).ID != video.ID {
+		t.Fatal("video still deleted after a restore")
+	}
+	expectStatus(t, restore(video.ID), http.StatusConflict)
+
+	// Past VIDEO_RECOVERY_WINDOW the video can only be purged
+	expired := createTestVideo(t, cfg, user.ID)
+	if err := cfg.db.DeleteVideo(expired.ID); err != nil {
+		t.Fatal(err)
+	}
+	cfg.recoveryWindow = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	expectErrorCode(t, restore(expired.ID), http.StatusGone, errCodeRecoveryExpired)
+	if getTestVideo(t, cfg, expired.ID).ID != uuid.Nil {
+		t.Error("video restored after the recovery window")
+	}
+}
+
+func TestVideosRetrieveStatusFilter(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user := createTestUser(t, cfg)
+	token := testToken(t, cfg, user.ID)
+
+	// Two ready videos, so the counts tell the statuses apart
+	want := map[string][]uuid.UUID{}
+	for _, status := range append(slices.Clone(database.VideoStatuses), database.VideoStatusReady) {
+		video := createTestVideo(t, cfg, user.ID)
+		if status != database.VideoStatusDraft {
+			if err := cfg.db.UpdateVideoStatus(video.ID, status); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want[status] = append(want[status], video.ID)
+	}
+	// Another user's videos never show up
+	createTestVideo(t, cfg, createTestUser(t, cfg).ID)
+
+	for _, status := range database.VideoStatuses {
+		t.Run(status, func(t *testing.T) {
+			req := newTestRequest(http.MethodGet, "/api/videos?status="+status, nil, token)
+			rec := serve(cfg.handlerVideosRetrieve, req)
+			expectStatus(t, rec, http.StatusOK)
+			got := decodeResponse[struct {
+				Videos       []database.Video `json:"videos"`
+				Total        int              `json:"total"`
+				StatusCounts map[string]int   `json:"status_counts"`
+			}](t, rec)
+
+			if len(got.Videos) != len(want[status]) || got.Total != len(want[status]) {
+				t.Fatalf("got %d videos (total %d), want %d", len(got.Videos), got.Total, len(want[status]))
+			}
+			for _, video := range got.Videos {
+				if video.Status != status || !slices.Contains(want[status], video.ID) {
+					t.Errorf("video %s (%s) listed for status %s", video.ID, video.Status, status)
+				}
+			}
+			for s, ids := range want {
+				if got.StatusCounts[s] != len(ids) {
+					t.Errorf("status_counts[%s] = %d, want %d", s, got.StatusCounts[s], len(ids))
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateVideoMetadataNeutralizesHTML(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, user.ID)
+	videoID := video.ID.String()
+
+	body := jsonBody(t, map[string]string{
+		"title":       `My <script>alert("xss")</script>video`,
+		"description": "<b>Loud</b> & clear\n<img src=x onerror=alert(1)>1 < 2",
+	})
+	req := newTestRequest(http.MethodPatch, "/api/videos/"+videoID, body, testToken(t, cfg, user.ID), "videoID", videoID)
+	rec := serve(cfg.handlerUpdateVideoMetadata, req)
+	expectStatus(t, rec, http.StatusOK)
+
+	got := getTestVideo(t, cfg, video.ID)
+	if got.Title != "My video" {
+		t.Errorf("title = %q, want %q", got.Title, "My video")
+	}
+	if want := "Loud & clear\n1 < 2"; got.Description != want {
+		t.Errorf("description = %q, want %q", got.Description, want)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultPreviewDuration = 3 * time.Second
+	defaultPreviewMaxBytes = 2 << 20 // 2MB
+	// previewStartFraction is how far into the video previews start when
+	// no start is given, past most intros and title cards
+	previewStartFraction = 0.1
+)
+
+// previewFormats maps the accepted format query values to the file
+// extension and the ffmpeg output options for it. GIFs get a palette made
+// from their own frames, which looks far better than the default one.
+var previewFormats = map[string]struct {
+	ext     string
+	filter  string
+	options []string
+}{
+	"gif": {
+		ext:    ".gif",
+		filter: "fps=10,scale=320:-1:flags=lanczos,split[a][b];[a]palettegen[p];[b][p]paletteuse",
+	},
+	"webp": {
+		ext:     ".webp",
+		filter:  "fps=10,scale=320:-1:flags=lanczos",
+		options: []string{"-c:v", "libwebp", "-quality", "60"},
+	},
+}
+
+// extractPreview writes a short, small, looping animation of the input,
+// which can be a local path or a URL ffmpeg can read, starting at start
+// seconds, to outputPath.
+func (cfg *apiConfig) extractPreview(ctx context.Context, input string, start, duration float64, format string, outputPath string) error {
+	previewFormat := previewFormats[format]
+	args := []string{
+		"-ss", strconv.FormatFloat(start, 'f', -1, 64),
+		"-t", strconv.FormatFloat(duration, 'f', -1, 64),
+		"-i", input,
+		"-vf", previewFormat.filter,
+		"-an",
+		"-loop", "0",
+	}
+	args = append(args, previewFormat.options...)
+	args = append(args, "-y", outputPath)
+
+	var stderr bytes.Buffer
+	err := cfg.runMediaCommand(ctx, cfg.ffmpegTimeout, func(ctx context.Context) error {
+		stderr.Reset()
+		cmd := newMediaCommand(ctx, cfg.ffmpegPath, args...)
+		cmd.Stderr = &stderr
+		return cmd.Run()
+	})
+	if err != nil {
+		os.Remove(outputPath)
+		return fmt.Errorf("failed to extract preview: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return fmt.Errorf("no preview extracted: %w", err)
+	}
+	if info.Size() == 0 {
+		os.Remove(outputPath)
+		return errors.New("no preview extracted")
+	}
+	return nil
+}
+
+// handlerGenerateVideoPreview makes a short animated preview of the video
+// for showing on hover and stores it as the video's preview_url. It starts
+// at the start query parameter, in seconds, or 10% into the video, and
+// lasts PREVIEW_DURATION seconds at most. format may be gif (the default)
+// or webp. Previews larger than PREVIEW_MAX_BYTES are rejected.
+func (cfg *apiConfig) handlerGenerateVideoPreview(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtTokens)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "gif"
+	}
+	previewFormat, ok := previewFormats[format]
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "format must be gif or webp", nil)
+		return
+	}
+
+	start := -1.0
+	if value := r.URL.Query().Get("start"); value != "" {
+		start, err = strconv.ParseFloat(value, 64)
+		if err != nil || start < 0 || math.IsNaN(start) || math.IsInf(start, 0) {
+			respondWithError(w, http.StatusBadRequest, "start must be a non-negative number of seconds", err)
+			return
+		}
+	}
+
+	// Hold the video's lock before reading it, so the video can't change
+	// under us
+	unlock, err := cfg.acquireVideoLock(r.Context(), videoID)
+	if err != nil {
+		if respondIfVideoBusy(w, err) {
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't lock video", err)
+		return
+	}
+	defer unlock()
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, "You don't own this video", nil)
+		return
+	}
+
+	bucket, key, ok := parseVideoURL(video)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Video has no uploaded file yet", nil)
+		return
+	}
+	if requiresRestore(video.StorageClass) {
+		respondWithError(w, http.StatusConflict, "Video is archived and must be restored first", nil)
+		return
+	}
+
+	videoURL, err := cfg.signObjectURL(r.Context(), bucket, key, cfg.s3PresignExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+		return
+	}
+
+	duration, err := cfg.getVideoDuration(r.Context(), videoURL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't determine video duration", err)
+		return
+	}
+	if start < 0 {
+		start = duration * previewStartFraction
+	}
+	if start >= duration {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("start is past the end of the video (%.2f seconds)", duration), nil)
+		return
+	}
+	length := min(cfg.previewDuration.Seconds(), duration-start)
+
+	previewFile, cleanupPreviewFile, err := cfg.newTempFile("tubely-preview-*" + previewFormat.ext)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create temporary file", err)
+		return
+	}
+	previewFile.Close()
+	defer cleanupPreviewFile()
+
+	err = cfg.extractPreview(r.Context(), videoURL, start, length, format, previewFile.Name())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't extract preview", err)
+		return
+	}
+
+	preview, err := os.Open(previewFile.Name())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open extracted preview", err)
+		return
+	}
+	defer preview.Close()
+
+	info, err := preview.Stat()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't stat extracted preview", err)
+		return
+	}
+	if info.Size() > cfg.previewMaxBytes {
+		msg := fmt.Sprintf("Preview came out at %d bytes, over the maximum of %d; try a shorter or simpler section", info.Size(), cfg.previewMaxBytes)
+		respondWithError(w, http.StatusUnprocessableEntity, msg, nil)
+		return
+	}
+
+	filename, err := getAssetName(previewFormat.ext)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random filename", err)
+		return
+	}
+
+	err = cfg.saveAsset(r.Context(), filename, preview)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save file", err)
+		return
+	}
+
+	oldPreviewURL := video.PreviewURL
+	previewURL := cfg.getAssetURL(filename)
+	video.PreviewURL = &previewURL
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		cfg.removeAsset(r.Context(), filename)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	if oldPreviewURL != nil {
+		cfg.removePreview(r.Context(), *oldPreviewURL)
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
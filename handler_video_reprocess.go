@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// Where an MP4's moov atom sits relative to its media data. Players can
+// only start a "start" file before it has fully downloaded.
+const (
+	moovAtStart = "start"
+	moovAtEnd   = "end"
+	moovUnknown = "unknown"
+)
+
+// findMoovPosition walks the top-level MP4 boxes to see whether moov comes
+// before mdat. Files it can't make sense of are reported as unknown.
+func findMoovPosition(r io.ReadSeeker) (string, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return moovUnknown, err
+	}
+	defer r.Seek(0, io.SeekStart)
+
+	header := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, header[:8]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return moovUnknown, nil
+			}
+			return moovUnknown, err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		headerSize := int64(8)
+		if size == 1 {
+			if _, err := io.ReadFull(r, header[8:16]); err != nil {
+				return moovUnknown, nil
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+
+		switch boxType {
+		case "moov":
+			return moovAtStart, nil
+		case "mdat":
+			return moovAtEnd, nil
+		}
+
+		// A size of 0 runs to the end of the file
+		if size == 0 || size < headerSize {
+			return moovUnknown, nil
+		}
+		if _, err := r.Seek(size-headerSize, io.SeekCurrent); err != nil {
+			return moovUnknown, err
+		}
+	}
+}
+
+// handlerReprocessVideo rewrites a stored video with fast start enabled,
+// for files uploaded before uploads were processed. The video is
+// downloaded, remuxed so the moov atom comes first, checked with ffprobe,
+// and uploaded over the same key. Videos that already start with moov are
+// left alone, so it's safe to call again. Owners and admins may call it.
+func (cfg *apiConfig) handlerReprocessVideo(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Key         string `json:"key"`
+		Reprocessed bool   `json:"reprocessed"`
+		MoovBefore  string `json:"moov_before"`
+		MoovAfter   string `json:"moov_after"`
+		SizeBytes   int64  `json:"size_bytes"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtTokens)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	// Hold the video's lock before reading it, so the video can't change
+	// under us
+	unlock, err := cfg.acquireVideoLock(r.Context(), videoID)
+	if err != nil {
+		if respondIfVideoBusy(w, err) {
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't lock video", err)
+		return
+	}
+	defer unlock()
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		_, err := auth.ValidateJWTWithScope(token, cfg.jwtTokens, auth.ScopeAdmin)
+		if err != nil {
+			respondWithError(w, http.StatusForbidden, "You can't reprocess this video", err)
+			return
+		}
+	}
+
+	bucket, key, ok := parseVideoURL(video)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Video has no uploaded file yet", nil)
+		return
+	}
+	if requiresRestore(video.StorageClass) {
+		respondWithError(w, http.StatusConflict, "Video is archived and must be restored first", nil)
+		return
+	}
+
+	// Download the stored file
+	tempFile, cleanupTempFile, err := cfg.newTempFile("tubely-reprocess-*.mp4")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create temporary file", err)
+		return
+	}
+	defer cleanupTempFile()
+
+	object, err := cfg.bucketByName(bucket).client.GetObject(r.Context(), &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't download video", err)
+		return
+	}
+	_, err = io.Copy(tempFile, object.Body)
+	object.Body.Close()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't download video", err)
+		return
+	}
+
+	before, err := findMoovPosition(tempFile)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read downloaded video", err)
+		return
+	}
+	if before == moovAtStart {
+		respondWithJSON(w, http.StatusOK, response{
+			Key:        key,
+			MoovBefore: before,
+			MoovAfter:  before,
+			SizeBytes:  video.SizeBytes,
+		})
+		return
+	}
+
+	processedPath, err := cfg.processVideoForFastStart(r.Context(), tempFile.Name(), false, nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't process video for fast start", err)
+		return
+	}
+	defer os.Remove(processedPath)
+
+	// Make sure the output is still a playable video before it replaces
+	// the only copy
+	_, err = cfg.runFFProbe(r.Context(), processedPath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Processed video failed verification", err)
+		return
+	}
+
+	processedFile, err := os.Open(processedPath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't open processed video", err)
+		return
+	}
+	defer processedFile.Close()
+
+	after, err := findMoovPosition(processedFile)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read processed video", err)
+		return
+	}
+	info, err := processedFile.Stat()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't stat processed video", err)
+		return
+	}
+
+	contentType := "video/mp4"
+	contentDisposition := videoContentDisposition(video.Title)
+	input := &s3.PutObjectInput{
+		Bucket:               &bucket,
+		Key:                  &key,
+		ContentType:          &contentType,
+		CacheControl:         &cfg.s3CacheControl,
+		ContentDisposition:   &contentDisposition,
+		ServerSideEncryption: cfg.s3SSE,
+		SSEKMSKeyId:          cfg.s3SSEKMSKeyID,
+		StorageClass:         types.StorageClass(video.StorageClass),
+		Tagging:              cfg.videoObjectTagging(video),
+	}
+	err = setSHA256Checksum(input, processedFile)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't checksum processed video", err)
+		return
+	}
+	err = cfg.putObjectWithRetry(r.Context(), input, processedFile)
+	if err != nil {
+		if respondIfChecksumMismatch(w, err) {
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't upload processed video", err)
+		return
+	}
+
+	video.SizeBytes = info.Size()
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Reprocessed %s but couldn't update its size", key), err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Key:         key,
+		Reprocessed: true,
+		MoovBefore:  before,
+		MoovAfter:   after,
+		SizeBytes:   video.SizeBytes,
+	})
+}
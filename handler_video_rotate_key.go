@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerRotateVideoKey moves the video's file, renditions and HLS
+// objects to a new random key, so links made from the old key stop working. The old objects
+// are deleted once the database points at the new ones; if that fails
+// they're left behind and logged, as the video itself is already
+// consistent. Objects still shared with a duplicate upload are kept.
+func (cfg *apiConfig) handlerRotateVideoKey(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtTokens)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	unlock, err := cfg.acquireVideoLock(r.Context(), videoID)
+	if err != nil {
+		if respondIfVideoBusy(w, err) {
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't lock video", err)
+		return
+	}
+	defer unlock()
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotOwner, "You don't own this video", nil)
+		return
+	}
+
+	bucket, oldKey, ok := parseVideoURL(video)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Video has no uploaded file yet", nil)
+		return
+	}
+	if requiresRestore(video.StorageClass) {
+		respondWithError(w, http.StatusConflict, "Video is archived and must be restored first", nil)
+		return
+	}
+
+	name, err := getAssetKey(path.Ext(oldKey))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate random filename", err)
+		return
+	}
+	newKey := path.Join(path.Dir(oldKey), name)
+
+	// Copy everything first, so a failure part way leaves the video as it was
+	oldKeys := []string{oldKey}
+	newKeys := []string{newKey}
+	renditions := make([]database.Rendition, len(video.Renditions))
+	for i, rendition := range video.Renditions {
+		oldKeys = append(oldKeys, rendition.Key)
+		rendition.Key = renditionKey(newKey, rendition.Height)
+		newKeys = append(newKeys, rendition.Key)
+		renditions[i] = rendition
+	}
+	var oldHLSPrefix, newPlaylistKey string
+	if video.HLSPlaylistKey != nil {
+		oldHLSPrefix = path.Dir(*video.HLSPlaylistKey) + "/"
+		newHLSPrefix := hlsPlaylistPrefix(newKey)
+		newPlaylistKey = newHLSPrefix + strings.TrimPrefix(*video.HLSPlaylistKey, oldHLSPrefix)
+		hlsKeys, err := cfg.listObjectKeys(r.Context(), bucket, oldHLSPrefix)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't list HLS objects", err)
+			return
+		}
+		for _, key := range hlsKeys {
+			oldKeys = append(oldKeys, key)
+			newKeys = append(newKeys, newHLSPrefix+strings.TrimPrefix(key, oldHLSPrefix))
+		}
+	}
+	for i := range oldKeys {
+		err = cfg.copyObject(r.Context(), bucket, oldKeys[i], newKeys[i], types.StorageClass(video.StorageClass))
+		if err != nil {
+			for _, key := range newKeys[:i] {
+				cfg.deleteObject(r.Context(), bucket, key)
+			}
+			respondWithError(w, http.StatusInternalServerError, "Couldn't copy video to its new key", err)
+			return
+		}
+	}
+
+	oldVideoURL := *video.VideoURL
+	newVideoURL := fmt.Sprintf("%s,%s", bucket, newKey)
+	video.VideoURL = &newVideoURL
+	video.Renditions = renditions
+	err = cfg.db.UpdateVideo(video)
+	if err == nil && len(renditions) > 0 {
+		err = cfg.db.UpdateVideoRenditions(video.ID, video.RenditionsStatus, renditions)
+	}
+	if err == nil && video.HLSPlaylistKey != nil {
+		video.HLSPlaylistKey = &newPlaylistKey
+		err = cfg.db.UpdateVideoHLS(video.ID, video.HLSStatus, video.HLSPlaylistKey)
+	}
+	if err != nil {
+		for _, key := range newKeys {
+			cfg.deleteObject(r.Context(), bucket, key)
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	sharedWith, err := cfg.db.CountVideosByVideoURL(oldVideoURL)
+	if err != nil {
+		log.Printf("Couldn't check for videos sharing %s, keeping it: %v", oldKey, err)
+	} else if sharedWith == 0 {
+		for _, key := range oldKeys {
+			cfg.deleteObject(r.Context(), bucket, key)
+		}
+	}
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
+
+// copyObject copies an object within the bucket, keeping its metadata and
+// applying the configured encryption. The storage class is set explicitly
+// because S3 would otherwise default the copy to STANDARD.
+func (cfg *apiConfig) copyObject(ctx context.Context, bucket, srcKey, dstKey string, storageClass types.StorageClass) error {
+	copySource := bucket + "/" + srcKey
+	_, err := cfg.bucketByName(bucket).client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:               &bucket,
+		Key:                  &dstKey,
+		CopySource:           &copySource,
+		StorageClass:         storageClass,
+		ServerSideEncryption: cfg.s3SSE,
+		SSEKMSKeyId:          cfg.s3SSEKMSKeyID,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't copy %s to %s: %w", srcKey, dstKey, err)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// rotateTestVideoKey rotates the video's key and returns it as stored
+// afterwards.
+func rotateTestVideoKey(t *testing.T, cfg *apiConfig, token string, video database.Video) database.Video {
+	t.Helper()
+
+	req := newTestRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/rotate_key", nil, token, "videoID", video.ID.String())
+	rec := serveAuthed(cfg, cfg.handlerRotateVideoKey, req)
+	expectStatus(t, rec, http.StatusOK)
+	return getTestVideo(t, cfg, video.ID)
+}
+
+func TestRotateVideoKey(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	user := createTestUser(t, cfg)
+	token := testToken(t, cfg, user.ID)
+	video := storeTestVideo(t, cfg, fake, createTestVideo(t, cfg, user.ID), testMP4)
+	_, oldKey, _ := parseVideoURL(video)
+	oldRendition := renditionKey(oldKey, 480)
+	fake.putObject(testBucket, oldRendition, testMP4)
+	if err := cfg.db.UpdateVideoRenditions(video.ID, database.RenditionsStatusDone, []database.Rendition{{Height: 480, Key: oldRendition}}); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := rotateTestVideoKey(t, cfg, token, video)
+
+	_, newKey, ok := parseVideoURL(rotated)
+	if !ok || newKey == oldKey {
+		t.Fatalf("video key = %q after rotating %q", newKey, oldKey)
+	}
+	if object, ok := fake.object(testBucket, newKey); !ok || !bytes.Equal(object.body, testMP4) {
+		t.Errorf("video not copied to %s", newKey)
+	}
+	if len(rotated.Renditions) != 1 || rotated.Renditions[0].Key != renditionKey(newKey, 480) {
+		t.Errorf("renditions = %+v, want one at %s", rotated.Renditions, renditionKey(newKey, 480))
+	}
+	for _, key := range []string{oldKey, oldRendition} {
+		if _, ok := fake.object(testBucket, key); ok {
+			t.Errorf("old object %s wasn't deleted", key)
+		}
+	}
+
+	req := newTestRequest(http.MethodGet, "/api/videos/"+video.ID.String(), nil, token, "videoID", video.ID.String())
+	rec := serve(cfg.handlerGetVideo, req)
+	expectStatus(t, rec, http.StatusOK)
+	if videoURL := aws.ToString(decodeResponse[database.Video](t, rec).VideoURL); !strings.Contains(videoURL, newKey) {
+		t.Errorf("VideoURL = %q, want it to point at %s", videoURL, newKey)
+	}
+}
+
+func TestRotateVideoKeyKeepsSharedObjects(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	user := createTestUser(t, cfg)
+	token := testToken(t, cfg, user.ID)
+	video := storeTestVideo(t, cfg, fake, createTestVideo(t, cfg, user.ID), testMP4)
+	_, oldKey, _ := parseVideoURL(video)
+
+	// A duplicate upload shares the stored object
+	duplicate := createTestVideo(t, cfg, user.ID)
+	duplicate.VideoURL = video.VideoURL
+	if err := cfg.db.UpdateVideo(duplicate); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := rotateTestVideoKey(t, cfg, token, video)
+
+	if *rotated.VideoURL == *video.VideoURL {
+		t.Fatal("video key didn't change")
+	}
+	if _, ok := fake.object(testBucket, oldKey); !ok {
+		t.Errorf("%s was deleted while another video still uses it", oldKey)
+	}
+	if got := getTestVideo(t, cfg, duplicate.ID); *got.VideoURL != *video.VideoURL {
+		t.Errorf("duplicate's VideoURL = %q, want it unchanged", *got.VideoURL)
+	}
+}
+
+func TestRotateVideoKeyMovesHLS(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	user := createTestUser(t, cfg)
+	token := testToken(t, cfg, user.ID)
+	video := storeTestVideo(t, cfg, fake, createTestVideo(t, cfg, user.ID), testMP4)
+	_, oldKey, _ := parseVideoURL(video)
+
+	oldPrefix := hlsPlaylistPrefix(oldKey)
+	oldPlaylistKey := oldPrefix + hlsMasterPlaylist
+	oldSegmentKey := oldPrefix + "360/segment0.ts"
+	fake.putObject(testBucket, oldPlaylistKey, []byte("#EXTM3U\n"))
+	fake.putObject(testBucket, oldSegmentKey, []byte("segment"))
+	if err := cfg.db.UpdateVideoHLS(video.ID, database.RenditionsStatusDone, &oldPlaylistKey); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := rotateTestVideoKey(t, cfg, token, video)
+	_, newKey, _ := parseVideoURL(rotated)
+	newPrefix := hlsPlaylistPrefix(newKey)
+	if rotated.HLSPlaylistKey == nil || *rotated.HLSPlaylistKey != newPrefix+hlsMasterPlaylist {
+		t.Fatalf("HLS playlist key = %v, want %s", rotated.HLSPlaylistKey, newPrefix+hlsMasterPlaylist)
+	}
+	if rotated.HLSStatus != database.RenditionsStatusDone {
+		t.Errorf("HLS status = %q, want %q", rotated.HLSStatus, database.RenditionsStatusDone)
+	}
+	for _, key := range []string{newPrefix + hlsMasterPlaylist, newPrefix + "360/segment0.ts"} {
+		if _, ok := fake.object(testBucket, key); !ok {
+			t.Errorf("%s wasn't copied", key)
+		}
+	}
+	for _, key := range fake.keys() {
+		if strings.HasPrefix(key, fakeS3Path(testBucket, oldPrefix)) {
+			t.Errorf("old HLS object %s wasn't deleted", key)
+		}
+	}
+}
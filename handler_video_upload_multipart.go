@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// maxMultipartPartSize caps a single part; S3 itself requires every
+	// part but the last to be at least 5MB
+	maxMultipartPartSize = 100 << 20
+	maxMultipartParts    = 10000
+)
+
+// handlerCreateMultipartUpload starts a resumable upload for the video. The
+// client sends numbered parts, then completes or aborts the upload. The
+// bucket is chosen here and kept for the rest of the upload.
+func (cfg *apiConfig) handlerCreateMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	userID := userIDFromContext(r)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Couldn't get video", err)
+		return
+	}
+
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotOwner, "You don't own this video", nil)
+		return
+	}
+
+	name, err := getAssetKey(".mp4")
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't generate random filename", err)
+		return
+	}
+	key := cfg.prefixedKey(name)
+
+	bucket := cfg.uploadBucket(r, userID)
+	contentType := "video/mp4"
+	contentDisposition := videoContentDisposition(video.Title)
+	output, err := bucket.client.CreateMultipartUpload(r.Context(), &s3.CreateMultipartUploadInput{
+		Bucket:               &bucket.name,
+		Key:                  &key,
+		ContentType:          &contentType,
+		CacheControl:         &cfg.s3CacheControl,
+		ContentDisposition:   &contentDisposition,
+		ServerSideEncryption: cfg.s3SSE,
+		SSEKMSKeyId:          cfg.s3SSEKMSKeyID,
+	})
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't start multipart upload", err)
+		return
+	}
+
+	upload, err := cfg.db.CreateMultipartUpload(database.CreateMultipartUploadParams{
+		UploadID: *output.UploadId,
+		VideoID:  videoID,
+		UserID:   userID,
+		Key:      key,
+		Bucket:   bucket.name,
+	})
+	if err != nil {
+		cfg.abortMultipartUpload(r.Context(), bucket.name, key, *output.UploadId)
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save multipart upload", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, upload)
+}
+
+// handlerGetMultipartUpload lists the parts received so far, so a client
+// that lost its connection knows which parts to resend.
+func (cfg *apiConfig) handlerGetMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.getOwnedMultipartUpload(w, r)
+	if !ok {
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, upload)
+}
+
+func (cfg *apiConfig) handlerUploadMultipartPart(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxMultipartPartSize)
+
+	partNumber, err := strconv.Atoi(r.PathValue("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > maxMultipartParts {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Part number must be between 1 and %d", maxMultipartParts), err)
+		return
+	}
+
+	upload, ok := cfg.getOwnedMultipartUpload(w, r)
+	if !ok {
+		return
+	}
+
+	// Buffer the part on disk so the SDK gets a seekable body it can sign
+	tempFile, cleanupTempFile, err := cfg.newTempFile("tubely-part-*")
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create temporary file", err)
+		return
+	}
+	defer cleanupTempFile()
+
+	size, err := io.Copy(tempFile, r.Body)
+	if err != nil {
+		if respondIfTooLarge(w, err) {
+			return
+		}
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Couldn't read part", err)
+		return
+	}
+	if size == 0 {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Part is empty", nil)
+		return
+	}
+
+	// Refuse parts that would take the whole upload over MAX_VIDEO_BYTES,
+	// rather than finding out once it's complete
+	total := size
+	for _, part := range upload.Parts {
+		if part.PartNumber != int32(partNumber) {
+			total += part.Size
+		}
+	}
+	if total > cfg.maxVideoBytes {
+		msg := fmt.Sprintf("Upload exceeds the maximum size of %d bytes", cfg.maxVideoBytes)
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, msg, nil)
+		return
+	}
+
+	_, err = tempFile.Seek(0, io.SeekStart)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't read part", err)
+		return
+	}
+
+	s3PartNumber := int32(partNumber)
+	bucket := cfg.bucketByName(upload.Bucket)
+	output, err := bucket.client.UploadPart(r.Context(), &s3.UploadPartInput{
+		Bucket:        &bucket.name,
+		Key:           &upload.Key,
+		UploadId:      &upload.UploadID,
+		PartNumber:    &s3PartNumber,
+		Body:          tempFile,
+		ContentLength: &size,
+	})
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't upload part to S3", err)
+		return
+	}
+
+	part := database.MultipartPart{
+		PartNumber: s3PartNumber,
+		ETag:       *output.ETag,
+		Size:       size,
+	}
+	err = cfg.db.SaveMultipartPart(upload.UploadID, part)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save part", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, part)
+}
+
+func (cfg *apiConfig) handlerCompleteMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.getOwnedMultipartUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if len(upload.Parts) == 0 {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "No parts have been uploaded", nil)
+		return
+	}
+
+	// Hold the video's lock before reading it, so the video can't change
+	// under us
+	unlock, err := cfg.acquireVideoLock(r.Context(), upload.VideoID)
+	if err != nil {
+		if respondIfVideoBusy(w, err) {
+			return
+		}
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't lock video", err)
+		return
+	}
+	defer unlock()
+
+	video, err := cfg.db.GetVideo(upload.VideoID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	// The video was deleted since the upload started, so its parts are of
+	// no use
+	if video.ID == uuid.Nil {
+		err = cfg.abortMultipartUpload(r.Context(), upload.Bucket, upload.Key, upload.UploadID)
+		if err == nil {
+			err = cfg.db.DeleteMultipartUpload(upload.UploadID)
+		}
+		if err != nil {
+			log.Printf("Couldn't abort multipart upload %s of deleted video %s: %v", upload.UploadID, upload.VideoID, err)
+		}
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Video not found", nil)
+		return
+	}
+
+	completedParts := make([]types.CompletedPart, len(upload.Parts))
+	for i, part := range upload.Parts {
+		completedParts[i] = types.CompletedPart{
+			PartNumber: &part.PartNumber,
+			ETag:       &part.ETag,
+		}
+	}
+
+	bucket := cfg.bucketByName(upload.Bucket)
+	_, err = bucket.client.CompleteMultipartUpload(r.Context(), &s3.CompleteMultipartUploadInput{
+		Bucket:   &bucket.name,
+		Key:      &upload.Key,
+		UploadId: &upload.UploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{
+			Parts: completedParts,
+		},
+	})
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Couldn't complete multipart upload", err)
+		return
+	}
+
+	err = cfg.db.DeleteMultipartUpload(upload.UploadID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't delete multipart upload", err)
+		return
+	}
+
+	head, err := bucket.client.HeadObject(r.Context(), &s3.HeadObjectInput{
+		Bucket: &bucket.name,
+		Key:    &upload.Key,
+	})
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't find completed upload", err)
+		return
+	}
+	cfg.acceptDirectUpload(w, r, video, bucket, upload.Key, aws.ToInt64(head.ContentLength))
+}
+
+// handlerAbortMultipartUpload discards the upload so S3 stops storing (and
+// charging for) the parts received so far.
+func (cfg *apiConfig) handlerAbortMultipartUpload(w http.ResponseWriter, r *http.Request) {
+	upload, ok := cfg.getOwnedMultipartUpload(w, r)
+	if !ok {
+		return
+	}
+
+	err := cfg.abortMultipartUpload(r.Context(), upload.Bucket, upload.Key, upload.UploadID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't abort multipart upload", err)
+		return
+	}
+
+	err = cfg.db.DeleteMultipartUpload(upload.UploadID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't delete multipart upload", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) abortMultipartUpload(ctx context.Context, bucketName, key, uploadID string) error {
+	bucket := cfg.bucketByName(bucketName)
+	_, err := bucket.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &bucket.name,
+		Key:      &key,
+		UploadId: &uploadID,
+	})
+	return err
+}
+
+// getOwnedMultipartUpload loads the upload named in the path and checks it
+// belongs to the authenticated user. It writes the error response itself
+// and returns false when the request can't proceed.
+func (cfg *apiConfig) getOwnedMultipartUpload(w http.ResponseWriter, r *http.Request) (database.MultipartUpload, bool) {
+	userID := userIDFromContext(r)
+
+	upload, err := cfg.db.GetMultipartUpload(r.PathValue("uploadID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get multipart upload", err)
+		return database.MultipartUpload{}, false
+	}
+
+	if upload.UploadID == "" || upload.UserID != userID {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Multipart upload not found", nil)
+		return database.MultipartUpload{}, false
+	}
+
+	return upload, true
+}
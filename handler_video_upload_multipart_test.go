@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// uploadTestMultipart runs a multipart upload of body, in one part, through
+// the handlers up to completion and returns the completion response.
+func uploadTestMultipart(t *testing.T, cfg *apiConfig, videoID, token string, body []byte) (database.MultipartUpload, int) {
+	t.Helper()
+
+	upload, rec := startTestMultipart(t, cfg, videoID, token, body)
+	expectStatus(t, rec, http.StatusOK)
+	return upload, completeTestMultipart(t, cfg, upload, token).Code
+}
+
+func TestCompleteMultipartUpload(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "10.0"))
+	user := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, user.ID)
+
+	upload, status := uploadTestMultipart(t, cfg, video.ID.String(), testToken(t, cfg, user.ID), testMP4)
+	if status != http.StatusOK {
+		t.Fatalf("complete status = %d, want %d", status, http.StatusOK)
+	}
+
+	object, ok := fake.object(testBucket, upload.Key)
+	if !ok || !bytes.Equal(object.body, testMP4) {
+		t.Fatalf("completed object = %q, want the uploaded part", object.body)
+	}
+	stored := getTestVideo(t, cfg, video.ID)
+	if want := testBucket + "," + upload.Key; aws.ToString(stored.VideoURL) != want {
+		t.Errorf("video_url = %q, want %q", aws.ToString(stored.VideoURL), want)
+	}
+	waitFor(t, "moderation", func() bool {
+		return getTestVideo(t, cfg, video.ID).ModerationStatus == database.ModerationStatusApproved
+	})
+}
+
+func TestCompleteMultipartUploadReplacesFile(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	cfg.enableHLS = true
+	useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "10.0"))
+	user := createTestUser(t, cfg)
+	old := storeTestVideo(t, cfg, fake, createTestVideo(t, cfg, user.ID), testMP4)
+	old = storeTestDerivatives(t, cfg, fake, old)
+
+	upload, status := uploadTestMultipart(t, cfg, old.ID.String(), testToken(t, cfg, user.ID), testMP4)
+	if status != http.StatusOK {
+		t.Fatalf("complete status = %d, want %d", status, http.StatusOK)
+	}
+
+	waitFor(t, "moderation", func() bool {
+		return getTestVideo(t, cfg, old.ID).ModerationStatus == database.ModerationStatusApproved
+	})
+	expectDerivativesReset(t, fake, old, getTestVideo(t, cfg, old.ID))
+	if _, ok := fake.object(testBucket, upload.Key); !ok {
+		t.Error("new upload was deleted")
+	}
+}
+
+// startTestMultipart starts a multipart upload for the video and sends
+// body as its first part.
+func startTestMultipart(t *testing.T, cfg *apiConfig, videoID, token string, body []byte) (database.MultipartUpload, *httptest.ResponseRecorder) {
+	t.Helper()
+
+	req := newTestRequest(http.MethodPost, "/api/video_upload/"+videoID+"/multipart", nil, token, "videoID", videoID)
+	rec := serveAuthed(cfg, cfg.handlerCreateMultipartUpload, req)
+	expectStatus(t, rec, http.StatusCreated)
+	upload := decodeResponse[database.MultipartUpload](t, rec)
+
+	req = newTestRequest(http.MethodPut, "/api/multipart_uploads/"+upload.UploadID+"/parts/1", bytes.NewReader(body), token,
+		"uploadID", upload.UploadID, "partNumber", "1")
+	return upload, serveAuthed(cfg, cfg.handlerUploadMultipartPart, req)
+}
+
+func completeTestMultipart(t *testing.T, cfg *apiConfig, upload database.MultipartUpload, token string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := newTestRequest(http.MethodPost, "/api/multipart_uploads/"+upload.UploadID+"/complete", nil, token, "uploadID", upload.UploadID)
+	return serveAuthed(cfg, cfg.handlerCompleteMultipartUpload, req)
+}
+
+func TestUploadMultipartPartOverLimit(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	cfg.maxVideoBytes = int64(len(testMP4)) - 1
+	user := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, user.ID)
+
+	_, rec := startTestMultipart(t, cfg, video.ID.String(), testToken(t, cfg, user.ID), testMP4)
+	expectErrorCode(t, rec, http.StatusRequestEntityTooLarge, errCodeFileTooLarge)
+	if got := fake.callCount("UploadPart"); got != 0 {
+		t.Errorf("UploadPart called %d times for a part over the limit", got)
+	}
+}
+
+func TestCompleteMultipartUploadOverLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		maxDur   time.Duration
+		status   int
+		code     errorCode
+	}{
+		// MAX_VIDEO_BYTES lowered while the upload was in progress
+		{"too large", int64(len(testMP4)) - 1, 0, http.StatusRequestEntityTooLarge, errCodeFileTooLarge},
+		{"too long", defaultMaxVideoBytes, 5 * time.Second, http.StatusBadRequest, errCodeVideoTooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, fake := newTestConfig(t)
+			useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "10.0"))
+			user := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, user.ID)
+			token := testToken(t, cfg, user.ID)
+
+			upload, rec := startTestMultipart(t, cfg, video.ID.String(), token, testMP4)
+			expectStatus(t, rec, http.StatusOK)
+			cfg.maxVideoBytes = tt.maxBytes
+			cfg.maxVideoDuration = tt.maxDur
+
+			rec = completeTestMultipart(t, cfg, upload, token)
+			expectErrorCode(t, rec, tt.status, tt.code)
+			if getTestVideo(t, cfg, video.ID).VideoURL != nil {
+				t.Error("video_url set for a rejected upload")
+			}
+			if _, ok := fake.object(testBucket, upload.Key); ok {
+				t.Error("rejected upload wasn't deleted")
+			}
+		})
+	}
+}
+
+func TestCompleteMultipartUploadDeletedVideo(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	user := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, user.ID)
+	token := testToken(t, cfg, user.ID)
+
+	upload, rec := startTestMultipart(t, cfg, video.ID.String(), token, testMP4)
+	expectStatus(t, rec, http.StatusOK)
+	if err := cfg.db.DeleteVideo(video.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = completeTestMultipart(t, cfg, upload, token)
+	expectErrorCode(t, rec, http.StatusNotFound, errCodeNotFound)
+	if got := fake.callCount("CompleteMultipartUpload"); got != 0 {
+		t.Errorf("CompleteMultipartUpload called %d times for a deleted video", got)
+	}
+	if got := fake.callCount("AbortMultipartUpload"); got != 1 {
+		t.Errorf("AbortMultipartUpload called %d times, want 1", got)
+	}
+	if remaining, err := cfg.db.GetMultipartUpload(upload.UploadID); err != nil || remaining.UploadID != "" {
+		t.Errorf("multipart upload still recorded: %+v, %v", remaining, err)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerCreateVideoUpload hands the client a presigned PUT URL so it can
+// upload the MP4 straight to S3, then call handlerConfirmVideoUpload with
+// the key. The key and its bucket are recorded against the video, so only
+// this video can be pointed at it.
+func (cfg *apiConfig) handlerCreateVideoUpload(w http.ResponseWriter, r *http.Request) {
+	cfg.createVideoUpload(w, r, false)
+}
+
+// handlerCreateVideoUploadAndDownload is handlerCreateVideoUpload plus a
+// presigned GET URL for the same key, so a client knows where the video
+// will play from before uploading it. The GET URL stays valid for
+// expires_in seconds, or S3_PRESIGN_EXPIRY, after the PUT URL expires.
+// Once it expires, GET /api/videos/{videoID} signs a fresh one.
+func (cfg *apiConfig) handlerCreateVideoUploadAndDownload(w http.ResponseWriter, r *http.Request) {
+	cfg.createVideoUpload(w, r, true)
+}
+
+// createVideoUpload presigns a PUT URL for a new key for the video, and a
+// GET URL for it too if withDownload is set.
+func (cfg *apiConfig) createVideoUpload(w http.ResponseWriter, r *http.Request, withDownload bool) {
+	type response struct {
+		UploadURL string            `json:"upload_url"`
+		Headers   map[string]string `json:"headers"`
+		Key       string            `json:"key"`
+		Region    string            `json:"region"`
+		// These are only included along with a download URL
+		UploadExpiresAt   *time.Time `json:"upload_expires_at,omitempty"`
+		DownloadURL       string     `json:"download_url,omitempty"`
+		DownloadExpiresAt *time.Time `json:"download_expires_at,omitempty"`
+	}
+
+	// Read the playback lifetime up front, before any work is done
+	downloadExpiry := time.Duration(0)
+	if withDownload {
+		expiry, err := cfg.presignExpiryFromRequest(r)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error(), err)
+			return
+		}
+		downloadExpiry = min(cfg.s3UploadURLExpiry+expiry, maxPresignExpiry)
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	userID := userIDFromContext(r)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Couldn't get video", err)
+		return
+	}
+
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotOwner, "You don't own this video", nil)
+		return
+	}
+
+	name, err := getAssetKey(".mp4")
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't generate random filename", err)
+		return
+	}
+	key := cfg.prefixedKey(name)
+
+	bucket := cfg.uploadBucket(r, userID)
+	uploadURL, headers, err := generatePresignedPutURL(r.Context(), bucket.presigner, bucket.name, key, cfg.s3UploadURLExpiry, cfg.s3SSE, cfg.s3SSEKMSKeyID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create upload URL", err)
+		return
+	}
+
+	err = cfg.db.CreateUploadKey(database.CreateUploadKeyParams{
+		Key:     key,
+		VideoID: videoID,
+		UserID:  userID,
+		Bucket:  bucket.name,
+	})
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save upload key", err)
+		return
+	}
+
+	resp := response{
+		UploadURL: uploadURL,
+		Headers:   headers,
+		Key:       key,
+		Region:    bucket.region,
+	}
+	if withDownload {
+		downloadURL, err := cfg.signObjectURL(r.Context(), bucket.name, key, downloadExpiry)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create download URL", err)
+			return
+		}
+		now := time.Now().UTC()
+		uploadExpiresAt := now.Add(cfg.s3UploadURLExpiry)
+		downloadExpiresAt := now.Add(downloadExpiry)
+		resp.UploadExpiresAt = &uploadExpiresAt
+		resp.DownloadURL = downloadURL
+		resp.DownloadExpiresAt = &downloadExpiresAt
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handlerConfirmVideoUpload records a key the client has finished uploading
+// via the presigned PUT URL, once verifyUploadedVideo has checked it's an
+// MP4.
+func (cfg *apiConfig) handlerConfirmVideoUpload(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Key string `json:"key"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	userID := userIDFromContext(r)
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	// Hold the video's lock before reading it, so the video can't change
+	// under us
+	unlock, err := cfg.acquireVideoLock(r.Context(), videoID)
+	if err != nil {
+		if respondIfVideoBusy(w, err) {
+			return
+		}
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't lock video", err)
+		return
+	}
+	defer unlock()
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Couldn't get video", err)
+		return
+	}
+
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Video not found", nil)
+		return
+	}
+
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeNotOwner, "You don't own this video", nil)
+		return
+	}
+
+	// Only accept a key handed out for this video, so a client can't point
+	// its video at another object in the bucket, such as someone else's
+	// upload
+	uploadKey, err := cfg.db.GetUploadKey(params.Key)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get upload key", err)
+		return
+	}
+	if uploadKey.Key == "" || uploadKey.VideoID != video.ID || uploadKey.UserID != userID {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Invalid upload key", nil)
+		return
+	}
+
+	bucket := cfg.bucketByName(uploadKey.Bucket)
+	head, err := bucket.client.HeadObject(r.Context(), &s3.HeadObjectInput{
+		Bucket: &bucket.name,
+		Key:    &params.Key,
+	})
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Uploaded video not found", err)
+		return
+	}
+
+	if !cfg.acceptDirectUpload(w, r, video, bucket, params.Key, aws.ToInt64(head.ContentLength)) {
+		return
+	}
+	err = cfg.db.DeleteUploadKey(params.Key)
+	if err != nil {
+		log.Printf("Couldn't delete confirmed upload key %s: %v", params.Key, err)
+	}
+}
+
+// acceptDirectUpload finishes an upload the client sent straight to S3,
+// by a presigned PUT or a multipart upload, once the object is at key:
+// it checks the size limit and quota, verifies the file and its duration,
+// points the video at it and resets everything derived from the previous
+// file. It writes the response itself, the signed video on success, and
+// reports whether the upload was accepted. The caller must hold the
+// video's lock.
+func (cfg *apiConfig) acceptDirectUpload(w http.ResponseWriter, r *http.Request, video database.Video, bucket regionBucket, key string, size int64) bool {
+	// The bytes are already in S3, so an upload over a limit is deleted
+	if size > cfg.maxVideoBytes {
+		cfg.deleteObject(r.Context(), bucket.name, key)
+		msg := fmt.Sprintf("Video exceeds the maximum size of %d bytes", cfg.maxVideoBytes)
+		respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, msg, nil)
+		return false
+	}
+	err := cfg.checkStorageQuota(video, size)
+	if err != nil {
+		cfg.deleteObject(r.Context(), bucket.name, key)
+		if respondIfOverQuota(w, err) {
+			return false
+		}
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check storage quota", err)
+		return false
+	}
+	data, ok := cfg.verifyUploadedVideo(w, r, bucket, key)
+	if !ok {
+		return false
+	}
+	if cfg.maxVideoDuration > 0 {
+		seconds, err := strconv.ParseFloat(data.Format.Duration, 64)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't read video duration", err)
+			return false
+		}
+		duration := time.Duration(seconds * float64(time.Second))
+		if duration > cfg.maxVideoDuration {
+			cfg.deleteObject(r.Context(), bucket.name, key)
+			msg := fmt.Sprintf("Video is %s long, longer than the maximum of %s", duration.Round(time.Second), cfg.maxVideoDuration)
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeVideoTooLong, msg, nil)
+			return false
+		}
+	}
+
+	replaced := video
+	videoURL := fmt.Sprintf("%s,%s", bucket.name, key)
+	video.VideoURL = &videoURL
+	// The bytes never pass through the server, so there is no hash to
+	// deduplicate against
+	video.ContentHash = nil
+	video.StorageClass = ""
+	video.SizeBytes = size
+	video.ModerationStatus = database.ModerationStatusPendingReview
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video metadata", err)
+		return false
+	}
+	err = cfg.db.UpdateVideoStatus(video.ID, database.VideoStatusReady)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video status", err)
+		return false
+	}
+	video.Status = database.VideoStatusReady
+	// The new file is probed when its metadata is first asked for
+	err = cfg.db.UpdateVideoMetadata(video.ID, nil)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video metadata", err)
+		return false
+	}
+	// Renditions of a previously uploaded file no longer apply
+	video.RenditionsStatus = ""
+	if cfg.enableRenditions {
+		video.RenditionsStatus = database.RenditionsStatusPending
+	}
+	video.Renditions = []database.Rendition{}
+	err = cfg.db.UpdateVideoRenditions(video.ID, video.RenditionsStatus, video.Renditions)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video metadata", err)
+		return false
+	}
+	video.HLSStatus = ""
+	if cfg.enableHLS {
+		video.HLSStatus = database.RenditionsStatusPending
+	}
+	video.HLSPlaylistKey = nil
+	err = cfg.db.UpdateVideoHLS(video.ID, video.HLSStatus, nil)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video metadata", err)
+		return false
+	}
+	if aws.ToString(replaced.VideoURL) != videoURL {
+		cfg.deleteReplacedObjects(r.Context(), replaced)
+	}
+	go cfg.moderateAndNotify(video)
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't generate presigned URL", err)
+		return false
+	}
+
+	respondWithJSON(w, http.StatusOK, signedVideo)
+	return true
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// issueTestUploadKey asks for a presigned PUT URL for the video, as a
+// client would before uploading, and returns the key it was given.
+func issueTestUploadKey(t *testing.T, cfg *apiConfig, videoID, token string) string {
+	t.Helper()
+
+	req := newTestRequest(http.MethodPost, "/api/video_upload/"+videoID+"/url", nil, token, "videoID", videoID)
+	rec := serveAuthed(cfg, cfg.handlerCreateVideoUpload, req)
+	expectStatus(t, rec, http.StatusOK)
+	return decodeResponse[struct {
+		Key string `json:"key"`
+	}](t, rec).Key
+}
+
+// confirmTestUpload confirms an upload of key to the video.
+func confirmTestUpload(t *testing.T, cfg *apiConfig, videoID, token, key string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := newTestRequest(http.MethodPost, "/api/video_upload/"+videoID+"/confirm",
+		jsonBody(t, map[string]string{"key": key}), token, "videoID", videoID)
+	return serveAuthed(cfg, cfg.handlerConfirmVideoUpload, req)
+}
+
+func TestConfirmVideoUpload(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	user := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, user.ID)
+
+	token := testToken(t, cfg, user.ID)
+
+	useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "10.0"))
+
+	key := issueTestUploadKey(t, cfg, video.ID.String(), token)
+	fake.putObject(testBucket, key, testMP4)
+
+	rec := confirmTestUpload(t, cfg, video.ID.String(), token, key)
+	expectStatus(t, rec, http.StatusOK)
+
+	if got := fake.callCount("HeadObject"); got != 1 {
+		t.Errorf("HeadObject called %d times, want 1", got)
+	}
+	stored := getTestVideo(t, cfg, video.ID)
+	if want := testBucket + "," + key; aws.ToString(stored.VideoURL) != want {
+		t.Errorf("video_url = %q, want %q", aws.ToString(stored.VideoURL), want)
+	}
+	if stored.SizeBytes != int64(len(testMP4)) {
+		t.Errorf("size_bytes = %d, want the object's size", stored.SizeBytes)
+	}
+	if stored.Status != database.VideoStatusReady {
+		t.Errorf("status = %q, want %q", stored.Status, database.VideoStatusReady)
+	}
+	waitFor(t, "moderation", func() bool {
+		return getTestVideo(t, cfg, video.ID).ModerationStatus == database.ModerationStatusApproved
+	})
+
+	// A confirmed key can't be confirmed again
+	rec = confirmTestUpload(t, cfg, video.ID.String(), token, key)
+	expectErrorCode(t, rec, http.StatusBadRequest, errCodeInvalidRequest)
+}
+
+func TestConfirmVideoUploadMissingObject(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, user.ID)
+
+	token := testToken(t, cfg, user.ID)
+
+	key := issueTestUploadKey(t, cfg, video.ID.String(), token)
+	rec := confirmTestUpload(t, cfg, video.ID.String(), token, key)
+	expectErrorCode(t, rec, http.StatusBadRequest, errCodeInvalidRequest)
+
+	if getTestVideo(t, cfg, video.ID).VideoURL != nil {
+		t.Error("video_url set for an object that doesn't exist")
+	}
+}
+
+func TestConfirmVideoUploadNotOwner(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	owner := createTestUser(t, cfg)
+	other := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, owner.ID)
+
+	key := issueTestUploadKey(t, cfg, video.ID.String(), testToken(t, cfg, owner.ID))
+	fake.putObject(testBucket, key, testMP4)
+
+	rec := confirmTestUpload(t, cfg, video.ID.String(), testToken(t, cfg, other.ID), key)
+	expectErrorCode(t, rec, http.StatusUnauthorized, errCodeNotOwner)
+
+	if got := fake.callCount("HeadObject"); got != 0 {
+		t.Errorf("HeadObject called %d times for a video the user doesn't own", got)
+	}
+}
+
+func TestConfirmVideoUploadReplacesFile(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	cfg.enableHLS = true
+	useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "10.0"))
+	user := createTestUser(t, cfg)
+	old := storeTestVideo(t, cfg, fake, createTestVideo(t, cfg, user.ID), testMP4)
+	old = storeTestDerivatives(t, cfg, fake, old)
+
+	token := testToken(t, cfg, user.ID)
+	key := issueTestUploadKey(t, cfg, old.ID.String(), token)
+	fake.putObject(testBucket, key, testMP4)
+
+	rec := confirmTestUpload(t, cfg, old.ID.String(), token, key)
+	expectStatus(t, rec, http.StatusOK)
+
+	waitFor(t, "moderation", func() bool {
+		return getTestVideo(t, cfg, old.ID).ModerationStatus == database.ModerationStatusApproved
+	})
+	expectDerivativesReset(t, fake, old, getTestVideo(t, cfg, old.ID))
+	if _, ok := fake.object(testBucket, key); !ok {
+		t.Error("new upload was deleted")
+	}
+}
+
+func TestConfirmVideoUploadOtherVideosKey(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "10.0"))
+	victim := createTestUser(t, cfg)
+	attacker := createTestUser(t, cfg)
+	victimVideo := createTestVideo(t, cfg, victim.ID)
+	attackerToken := testToken(t, cfg, attacker.ID)
+	attackerVideo := createTestVideo(t, cfg, attacker.ID)
+
+	// The victim's upload key shows up in their signed URLs
+	victimKey := issueTestUploadKey(t, cfg, victimVideo.ID.String(), testToken(t, cfg, victim.ID))
+	fake.putObject(testBucket, victimKey, testMP4)
+
+	rec := confirmTestUpload(t, cfg, attackerVideo.ID.String(), attackerToken, victimKey)
+	expectErrorCode(t, rec, http.StatusBadRequest, errCodeInvalidRequest)
+
+	// A key shaped like an issued one, but never issued, is refused too
+	unissued := testVideoKey(t, "")
+	fake.putObject(testBucket, unissued, testMP4)
+	rec = confirmTestUpload(t, cfg, attackerVideo.ID.String(), attackerToken, unissued)
+	expectErrorCode(t, rec, http.StatusBadRequest, errCodeInvalidRequest)
+
+	if getTestVideo(t, cfg, attackerVideo.ID).VideoURL != nil {
+		t.Error("video pointed at a key issued for another video")
+	}
+	if _, ok := fake.object(testBucket, victimKey); !ok {
+		t.Error("other video's upload was deleted")
+	}
+}
+
+func TestConfirmVideoUploadOverLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		maxDur   time.Duration
+		status   int
+		code     errorCode
+	}{
+		{"too large", int64(len(testMP4)) - 1, 0, http.StatusRequestEntityTooLarge, errCodeFileTooLarge},
+		{"too long", defaultMaxVideoBytes, 5 * time.Second, http.StatusBadRequest, errCodeVideoTooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, fake := newTestConfig(t)
+			cfg.maxVideoBytes = tt.maxBytes
+			cfg.maxVideoDuration = tt.maxDur
+			useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "10.0"))
+			user := createTestUser(t, cfg)
+			video := createTestVideo(t, cfg, user.ID)
+			token := testToken(t, cfg, user.ID)
+
+			key := issueTestUploadKey(t, cfg, video.ID.String(), token)
+			fake.putObject(testBucket, key, testMP4)
+
+			rec := confirmTestUpload(t, cfg, video.ID.String(), token, key)
+			expectErrorCode(t, rec, tt.status, tt.code)
+			if getTestVideo(t, cfg, video.ID).VideoURL != nil {
+				t.Error("video_url set for a rejected upload")
+			}
+			if _, ok := fake.object(testBucket, key); ok {
+				t.Error("rejected upload wasn't deleted")
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerUpdateVideoVisibility(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Visibility string `json:"visibility"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtTokens)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Couldn't decode parameters", err)
+		return
+	}
+	switch params.Visibility {
+	case database.VisibilityPrivate, database.VisibilityUnlisted, database.VisibilityPublic:
+	default:
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "visibility must be one of private, unlisted, public", nil)
+		return
+	}
+
+	// Hold the video's lock before reading it, so the video can't change
+	// under us
+	unlock, err := cfg.acquireVideoLock(r.Context(), videoID)
+	if err != nil {
+		if respondIfVideoBusy(w, err) {
+			return
+		}
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't lock video", err)
+		return
+	}
+	defer unlock()
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusForbidden, errCodeNotOwner, "You can't edit this video", nil)
+		return
+	}
+
+	err = cfg.db.UpdateVideoVisibility(video.ID, params.Visibility)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
+		return
+	}
+	video.Visibility = params.Visibility
+	cfg.refreshVideoObjectTags(r.Context(), video)
+
+	signedVideo, err := cfg.dbVideoToSignedVideo(r.Context(), video)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't generate presigned URL", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, signedVideo)
+}
+
+// handlerPublicFeed lists every user's public videos. It needs no
+// authentication, so only videos marked public are ever returned.
+func (cfg *apiConfig) handlerPublicFeed(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Videos []database.Video `json:"videos"`
+		Limit  int              `json:"limit"`
+		Offset int              `json:"offset"`
+	}
+
+	limit, offset, err := paginationFromRequest(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	videos, err := cfg.db.GetPublicVideos(limit, offset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	for i, video := range videos {
+		videos[i], err = cfg.dbVideoToSignedVideo(r.Context(), video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Videos: videos,
+		Limit:  limit,
+		Offset: offset,
+	})
+}
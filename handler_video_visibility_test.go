@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestPublicFeed(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	owner := createTestUser(t, cfg)
+	other := createTestUser(t, cfg)
+	token := testToken(t, cfg, owner.ID)
+
+	videos := map[string]database.Video{}
+	for _, visibility := range []string{database.VisibilityPrivate, database.VisibilityUnlisted, database.VisibilityPublic} {
+		video := storeTestVideo(t, cfg, fake, createTestVideo(t, cfg, owner.ID), testMP4)
+		videoID := video.ID.String()
+		req := newTestRequest(http.MethodPut, "/api/videos/"+videoID+"/visibility", jsonBody(t, map[string]string{"visibility": visibility}), token, "videoID", videoID)
+		rec := serve(cfg.handlerUpdateVideoVisibility, req)
+		expectStatus(t, rec, http.StatusOK)
+		if got := decodeResponse[database.Video](t, rec).Visibility; got != visibility {
+			t.Fatalf("visibility = %q, want %q", got, visibility)
+		}
+		videos[visibility] = video
+	}
+
+	// Only the owner can change it
+	publicID := videos[database.VisibilityPublic].ID.String()
+	req := newTestRequest(http.MethodPut, "/api/videos/"+publicID+"/visibility", jsonBody(t, map[string]string{"visibility": database.VisibilityPrivate}),
+		testToken(t, cfg, other.ID), "videoID", publicID)
+	expectErrorCode(t, serve(cfg.handlerUpdateVideoVisibility, req), http.StatusForbidden, errCodeNotOwner)
+
+	rec := serve(cfg.handlerPublicFeed, newTestRequest(http.MethodGet, "/api/videos/public", nil, ""))
+	expectStatus(t, rec, http.StatusOK)
+	feed := decodeResponse[struct {
+		Videos []database.Video `json:"videos"`
+	}](t, rec)
+	if len(feed.Videos) != 1 || feed.Videos[0].ID != videos[database.VisibilityPublic].ID {
+		t.Fatalf("public feed = %+v, want only the public video", feed.Videos)
+	}
+	if feed.Videos[0].VideoURL == nil || *feed.Videos[0].VideoURL == *videos[database.VisibilityPublic].VideoURL {
+		t.Errorf("public feed video URL = %v, want a signed URL", feed.Videos[0].VideoURL)
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultHLSSegmentDuration = 6 * time.Second
+	hlsMasterPlaylist         = "master.m3u8"
+	hlsAudioKbps              = 128
+	// maxHLSPlaylistBytes bounds what's read of a stored playlist; a VOD
+	// playlist lists one line pair per segment, so even hours of video
+	// stay well under it
+	maxHLSPlaylistBytes = 1 << 20 // 1MB
+)
+
+// hlsVariant is one bitrate of an HLS stream.
+type hlsVariant struct {
+	height    int
+	videoKbps int
+}
+
+// hlsLadder are the variants packaged for adaptive streaming. Variants
+// taller than the source are skipped, except that a short source still
+// gets the smallest one at its own height.
+var hlsLadder = []hlsVariant{
+	{height: 360, videoKbps: 800},
+	{height: 720, videoKbps: 2800},
+	{height: 1080, videoKbps: 5000},
+}
+
+// hlsContentTypes are the content types HLS objects are stored with.
+var hlsContentTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".ts":   "video/mp2t",
+}
+
+// hlsVariantsFor picks the variants of hlsLadder to package for a source
+// of the given height.
+func hlsVariantsFor(sourceHeight int) []hlsVariant {
+	variants := []hlsVariant{}
+	for _, variant := range hlsLadder {
+		if variant.height <= sourceHeight {
+			variants = append(variants, variant)
+		}
+	}
+	if len(variants) == 0 {
+		variants = append(variants, hlsVariant{height: sourceHeight, videoKbps: hlsLadder[0].videoKbps})
+	}
+	return variants
+}
+
+// hlsPlaylistPrefix derives where a video's HLS objects are stored from
+// its key, e.g. landscape/<hex>.mp4 gets landscape/<hex>_hls/.
+func hlsPlaylistPrefix(key string) string {
+	return strings.TrimSuffix(key, path.Ext(key)) + "_hls/"
+}
+
+// packageHLSVariant segments the video at filePath into dir/<height>/,
+// writing index.m3u8 and its .ts segments. Keyframes are forced at every
+// segment boundary so the variants line up and players can switch
+// between them cleanly.
+func (cfg *apiConfig) packageHLSVariant(ctx context.Context, filePath, dir string, variant hlsVariant) error {
+	variantDir := filepath.Join(dir, strconv.Itoa(variant.height))
+	err := os.MkdirAll(variantDir, 0o755)
+	if err != nil {
+		return fmt.Errorf("couldn't create %dp variant directory: %w", variant.height, err)
+	}
+
+	segmentSeconds := strconv.FormatFloat(cfg.hlsSegmentLength.Seconds(), 'f', -1, 64)
+	bitrate := fmt.Sprintf("%dk", variant.videoKbps)
+	var stderr bytes.Buffer
+	err = cfg.runMediaCommand(ctx, cfg.ffmpegTimeout, func(ctx context.Context) error {
+		stderr.Reset()
+		cmd := newMediaCommand(ctx, cfg.ffmpegPath,
+			"-i", filePath,
+			"-map", "0:v:0",
+			"-map", "0:a:0?",
+			"-vf", fmt.Sprintf("scale=-2:%d", variant.height),
+			"-c:v", "libx264",
+			"-preset", "fast",
+			"-b:v", bitrate,
+			"-maxrate", bitrate,
+			"-bufsize", fmt.Sprintf("%dk", variant.videoKbps*2),
+			"-force_key_frames", "expr:gte(t,n_forced*"+segmentSeconds+")",
+			"-c:a", "aac",
+			"-b:a", fmt.Sprintf("%dk", hlsAudioKbps),
+			"-ac", "2",
+			"-f", "hls",
+			"-hls_time", segmentSeconds,
+			"-hls_playlist_type", "vod",
+			"-hls_segment_type", "mpegts",
+			"-hls_segment_filename", filepath.Join(variantDir, "segment_%05d.ts"),
+			"-y",
+			filepath.Join(variantDir, "index.m3u8"))
+		cmd.Stderr = &stderr
+		return cmd.Run()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to package %dp HLS variant: %w: %s", variant.height, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// hlsMasterPlaylistFor lists the variants for players to choose from.
+// Their playlists are referenced relative to the master playlist.
+func hlsMasterPlaylistFor(variants []hlsVariant, sourceWidth, sourceHeight int) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, variant := range variants {
+		// Matches the even width scale=-2 picks
+		width := int(math.Round(float64(sourceWidth)*float64(variant.height)/float64(sourceHeight)/2)) * 2
+		bandwidth := (variant.videoKbps + hlsAudioKbps) * 1000
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d\n", bandwidth, width, variant.height)
+		fmt.Fprintf(&b, "%d/index.m3u8\n", variant.height)
+	}
+	return b.String()
+}
+
+// generateHLS packages the processed video at filePath as HLS, uploads the
+// playlists and segments under the video's HLS prefix, and records the
+// master playlist on the video. It runs in the background after an upload
+// has been accepted and leaves filePath in place.
+func (cfg *apiConfig) generateHLS(ctx context.Context, video database.Video, filePath, bucket, key string) {
+	err := cfg.db.UpdateVideoHLS(video.ID, database.RenditionsStatusProcessing, nil)
+	if err != nil {
+		log.Printf("Couldn't update HLS status for video %s: %v", video.ID, err)
+	}
+
+	playlistKey, err := cfg.uploadHLS(ctx, video, filePath, bucket, key)
+	if err != nil {
+		log.Printf("Couldn't package HLS for video %s: %v", video.ID, err)
+		err = cfg.db.UpdateVideoHLS(video.ID, database.RenditionsStatusFailed, nil)
+		if err != nil {
+			log.Printf("Couldn't update HLS status for video %s: %v", video.ID, err)
+		}
+		return
+	}
+
+	err = cfg.db.UpdateVideoHLS(video.ID, database.RenditionsStatusDone, &playlistKey)
+	if err != nil {
+		log.Printf("Couldn't save HLS playlist for video %s: %v", video.ID, err)
+		cfg.deleteHLSObjects(ctx, bucket, hlsPlaylistPrefix(key))
+	}
+}
+
+// uploadHLS packages every variant into a temp directory and uploads it,
+// returning the master playlist's key. Nothing is left in S3 if any part
+// fails.
+func (cfg *apiConfig) uploadHLS(ctx context.Context, video database.Video, filePath, bucket, key string) (string, error) {
+	data, err := cfg.runFFProbe(ctx, filePath)
+	if err != nil {
+		return "", err
+	}
+	stream, err := data.videoStream()
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := os.MkdirTemp(cfg.tempDir, "tubely-hls-*")
+	if err != nil {
+		return "", fmt.Errorf("couldn't create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	variants := hlsVariantsFor(stream.Height)
+	for _, variant := range variants {
+		err = cfg.packageHLSVariant(ctx, filePath, dir, variant)
+		if err != nil {
+			return "", err
+		}
+	}
+	master := hlsMasterPlaylistFor(variants, stream.Width, stream.Height)
+	err = os.WriteFile(filepath.Join(dir, hlsMasterPlaylist), []byte(master), 0o644)
+	if err != nil {
+		return "", fmt.Errorf("couldn't write master playlist: %w", err)
+	}
+
+	prefix := hlsPlaylistPrefix(key)
+	err = filepath.WalkDir(dir, func(packagedPath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, packagedPath)
+		if err != nil {
+			return err
+		}
+		return cfg.uploadHLSObject(ctx, video, packagedPath, bucket, prefix+filepath.ToSlash(rel))
+	})
+	if err != nil {
+		cfg.deleteHLSObjects(ctx, bucket, prefix)
+		return "", err
+	}
+	return prefix + hlsMasterPlaylist, nil
+}
+
+func (cfg *apiConfig) uploadHLSObject(ctx context.Context, video database.Video, filePath, bucket, key string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("couldn't open %s: %w", path.Base(key), err)
+	}
+	defer file.Close()
+
+	contentType, ok := hlsContentTypes[path.Ext(key)]
+	if !ok {
+		return fmt.Errorf("ffmpeg wrote unexpected file %s", path.Base(key))
+	}
+	err = cfg.putObjectWithRetry(ctx, &s3.PutObjectInput{
+		Bucket:               &bucket,
+		Key:                  &key,
+		ContentType:          &contentType,
+		CacheControl:         &cfg.s3CacheControl,
+		ServerSideEncryption: cfg.s3SSE,
+		SSEKMSKeyId:          cfg.s3SSEKMSKeyID,
+		Tagging:              cfg.videoObjectTagging(video),
+	}, file)
+	if err != nil {
+		return fmt.Errorf("couldn't upload %s: %w", key, err)
+	}
+	return nil
+}
+
+// deleteHLSObjects removes every object under a video's HLS prefix. It's
+// best effort, like deleteObject.
+func (cfg *apiConfig) deleteHLSObjects(ctx context.Context, bucket, prefix string) {
+	err := cfg.deleteObjectsWithPrefix(ctx, bucket, prefix)
+	if err != nil {
+		log.Printf("Couldn't delete HLS objects under %s: %v", prefix, err)
+	}
+}
+
+// deleteObjectsWithPrefix removes every object whose key starts with
+// prefix. Objects that are already gone count as deleted.
+func (cfg *apiConfig) deleteObjectsWithPrefix(ctx context.Context, bucket, prefix string) error {
+	client := cfg.bucketByName(bucket).client
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("couldn't list objects under %s: %w", prefix, err)
+		}
+		for _, object := range page.Contents {
+			_, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: &bucket,
+				Key:    object.Key,
+			})
+			if err != nil && !isS3NotFound(err) {
+				return fmt.Errorf("couldn't delete %s: %w", aws.ToString(object.Key), err)
+			}
+		}
+	}
+	return nil
+}
+
+// listObjectKeys returns the key of every object whose key starts with
+// prefix.
+func (cfg *apiConfig) listObjectKeys(ctx context.Context, bucket, prefix string) ([]string, error) {
+	keys := []string{}
+	paginator := s3.NewListObjectsV2Paginator(cfg.bucketByName(bucket).client, &s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't list objects under %s: %w", prefix, err)
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+	}
+	return keys, nil
+}
+
+// hlsPlaylistPath is where a video's master playlist is served.
+func hlsPlaylistPath(videoID uuid.UUID) string {
+	return fmt.Sprintf("/api/videos/%s/hls/%s", videoID, hlsMasterPlaylist)
+}
+
+// handlerGetHLSPlaylist serves a video's HLS playlists. Stored playlists
+// refer to everything relative to themselves, which a private bucket
+// won't serve, so segment references are replaced with signed URLs as the
+// playlist goes out. Variant playlists stay relative and so come back here
+// too. The expires_in query parameter sets how long the segment URLs last
+// and is passed on to the variant playlists. Private videos' playlists
+// need the same token fetching the video itself does.
+func (cfg *apiConfig) handlerGetHLSPlaylist(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	name := r.PathValue("name")
+	if path.Clean(name) != name || strings.HasPrefix(name, "/") || strings.HasPrefix(name, "..") || path.Ext(name) != ".m3u8" {
+		respondWithError(w, http.StatusBadRequest, "Invalid playlist name", nil)
+		return
+	}
+
+	// A token that's sent must be valid, even for videos that don't need
+	// one
+	token := ""
+	userID := uuid.Nil
+	if r.Header.Get("Authorization") != "" {
+		token, err = auth.GetBearerToken(r.Header)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+			return
+		}
+		userID, err = auth.ValidateJWT(token, cfg.jwtTokens)
+		if err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+			return
+		}
+	}
+
+	expireTime, err := cfg.presignExpiryFromRequest(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Video not found", nil)
+		return
+	}
+	if video.Visibility == database.VisibilityPrivate && video.UserID != userID {
+		if token == "" {
+			respondWithError(w, http.StatusForbidden, "This video is private", nil)
+			return
+		}
+		_, err := auth.ValidateJWTWithScope(token, cfg.jwtTokens, auth.ScopeAdmin)
+		if err != nil {
+			respondWithError(w, http.StatusForbidden, "This video is private", err)
+			return
+		}
+	}
+	bucket, _, ok := parseVideoURL(video)
+	// Held back for the same reasons as the video's own URL
+	if !ok || video.ModerationStatus != database.ModerationStatusApproved || video.HLSPlaylistKey == nil || video.HLSStatus != database.RenditionsStatusDone {
+		respondWithError(w, http.StatusNotFound, "Video has no HLS stream", nil)
+		return
+	}
+	if requiresRestore(video.StorageClass) {
+		respondWithError(w, http.StatusConflict, "Video is archived and must be restored first", nil)
+		return
+	}
+
+	key := path.Join(path.Dir(*video.HLSPlaylistKey), name)
+	object, err := cfg.bucketByName(bucket).client.GetObject(r.Context(), &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		if isS3NotFound(err) {
+			respondWithError(w, http.StatusNotFound, "Playlist not found", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get playlist", err)
+		return
+	}
+	defer object.Body.Close()
+
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(io.LimitReader(object.Body, maxHLSPlaylistBytes))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.Contains(line, "://"):
+		case path.Ext(line) == ".m3u8":
+			if r.URL.RawQuery != "" {
+				line += "?" + r.URL.RawQuery
+			}
+		default:
+			line, err = cfg.signObjectURL(r.Context(), bucket, path.Join(path.Dir(key), line), expireTime)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+				return
+			}
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't read playlist", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", hlsContentTypes[".m3u8"])
+	// The signed segment URLs expire, so playlists mustn't outlive them
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(out.Bytes())
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// storeTestHLS gives a stored video a finished HLS stream with one
+// segment.
+func storeTestHLS(t *testing.T, cfg *apiConfig, fake *fakeS3, video database.Video) {
+	t.Helper()
+
+	playlistKey := path.Join("hls", video.ID.String(), hlsMasterPlaylist)
+	fake.putObject(testBucket, playlistKey, []byte("#EXTM3U\n#EXTINF:6.0,\nsegment0.ts\n#EXT-X-ENDLIST\n"))
+	if err := cfg.db.UpdateVideoHLS(video.ID, database.RenditionsStatusDone, &playlistKey); err != nil {
+		t.Fatalf("Couldn't update video HLS: %v", err)
+	}
+}
+
+func TestGetHLSPlaylistVisibility(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	owner := createTestUser(t, cfg)
+	other := createTestUser(t, cfg)
+	video := storeTestVideo(t, cfg, fake, createTestVideo(t, cfg, owner.ID), testMP4)
+	storeTestHLS(t, cfg, fake, video)
+
+	tests := []struct {
+		name       string
+		visibility string
+		token      string
+		want       int
+	}{
+		{"private, owner", database.VisibilityPrivate, testToken(t, cfg, owner.ID), http.StatusOK},
+		{"private, other user", database.VisibilityPrivate, testToken(t, cfg, other.ID), http.StatusForbidden},
+		{"private, no token", database.VisibilityPrivate, "", http.StatusForbidden},
+		{"private, admin", database.VisibilityPrivate, testToken(t, cfg, other.ID, auth.ScopeAdmin), http.StatusOK},
+		{"private, invalid token", database.VisibilityPrivate, "not-a-jwt", http.StatusUnauthorized},
+		{"public, other user", database.VisibilityPublic, testToken(t, cfg, other.ID), http.StatusOK},
+		{"public, no token", database.VisibilityPublic, "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestVisibility(t, cfg, video.ID, tt.visibility)
+
+			req := newTestRequest(http.MethodGet, hlsPlaylistPath(video.ID), nil, tt.token,
+				"videoID", video.ID.String(), "name", hlsMasterPlaylist)
+			rec := serve(cfg.handlerGetHLSPlaylist, req)
+			expectStatus(t, rec, tt.want)
+
+			body := rec.Body.String()
+			if tt.want == http.StatusOK && !strings.Contains(body, "X-Amz-Signature=") {
+				t.Errorf("segment isn't signed in playlist:\n%s", body)
+			}
+			if tt.want != http.StatusOK && strings.Contains(body, "segment0.ts") {
+				t.Errorf("playlist leaked in a %d response", tt.want)
+			}
+		})
+	}
+}
+
+func TestGetHLSPlaylistMissingVideo(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+
+	videoID := uuid.New()
+	req := newTestRequest(http.MethodGet, hlsPlaylistPath(videoID), nil, "",
+		"videoID", videoID.String(), "name", hlsMasterPlaylist)
+	rec := serve(cfg.handlerGetHLSPlaylist, req)
+	expectStatus(t, rec, http.StatusNotFound)
+}
+
+func TestGetHLSPlaylistSegmentContentType(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	owner := createTestUser(t, cfg)
+	video := storeTestVideo(t, cfg, fake, createTestVideo(t, cfg, owner.ID), testMP4)
+	storeTestHLS(t, cfg, fake, video)
+
+	req := newTestRequest(http.MethodGet, hlsPlaylistPath(video.ID), nil, testToken(t, cfg, owner.ID),
+		"videoID", video.ID.String(), "name", hlsMasterPlaylist)
+	rec := serve(cfg.handlerGetHLSPlaylist, req)
+	expectStatus(t, rec, http.StatusOK)
+
+	var segmentURL string
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.Contains(line, "segment0.ts") {
+			segmentURL = line
+		}
+	}
+	u, err := url.Parse(segmentURL)
+	if err != nil || segmentURL == "" {
+		t.Fatalf("no segment URL in playlist:\n%s", rec.Body.String())
+	}
+	if got := u.Query().Get("response-content-type"); got != hlsContentTypes[".ts"] {
+		t.Errorf("segment URL response-content-type = %q, want %q", got, hlsContentTypes[".ts"])
+	}
+}
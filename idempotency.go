@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	idempotencyKeyTTL        = 24 * time.Hour
+	maxIdempotencyKeyLength  = 255
+)
+
+// idempotencyKeyFromRequest returns the request's Idempotency-Key header,
+// or "" if it wasn't sent. Keys must be printable ASCII.
+func idempotencyKeyFromRequest(r *http.Request) (string, error) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength {
+		return "", fmt.Errorf("%s can't be longer than %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength)
+	}
+	for _, c := range []byte(key) {
+		if c < 0x20 || c > 0x7e {
+			return "", fmt.Errorf("%s must be printable ASCII", idempotencyKeyHeader)
+		}
+	}
+	return key, nil
+}
+
+// idempotentUploadHash identifies what an upload asked for, so a key
+// reused for a different file, video, storage class or preset can be told
+// apart from a retry.
+func idempotentUploadHash(videoID uuid.UUID, contentHash string, storageClass types.StorageClass, thumbnailHash, qualityPreset string, normalizeAudio bool) string {
+	request := fmt.Sprintf("%s,%s,%s", videoID, contentHash, storageClass)
+	if thumbnailHash != "" {
+		request += "," + thumbnailHash
+	}
+	if qualityPreset != "" {
+		request += ",quality_preset=" + qualityPreset
+	}
+	if normalizeAudio {
+		request += ",normalize_audio"
+	}
+	sum := sha256.Sum256([]byte(request))
+	return hex.EncodeToString(sum[:])
+}
+
+// reserveIdempotencyKey claims key for the user's request. If an earlier
+// request already claimed it, the earlier job is sent back for a retry of
+// the same request, or a 409 for a different or unfinished one. It
+// reports whether the caller should go on handling the request.
+func (cfg *apiConfig) reserveIdempotencyKey(w http.ResponseWriter, userID, videoID uuid.UUID, key, requestHash string) bool {
+	created, err := cfg.db.CreateIdempotencyKey(database.IdempotencyKey{
+		UserID:      userID,
+		Key:         key,
+		RequestHash: requestHash,
+		VideoID:     videoID,
+		ExpiresAt:   time.Now().UTC().Add(idempotencyKeyTTL),
+	})
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save idempotency key", err)
+		return false
+	}
+	if created {
+		return true
+	}
+
+	existing, err := cfg.db.GetIdempotencyKey(userID, key)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get idempotency key", err)
+		return false
+	}
+	if existing.RequestHash != requestHash {
+		respondWithErrorCode(w, http.StatusConflict, errCodeIdempotencyKeyReused, "Idempotency-Key was already used for a different request", nil)
+		return false
+	}
+	if existing.JobID == nil {
+		respondWithErrorCode(w, http.StatusConflict, errCodeConflict, "A request with this Idempotency-Key is still in progress", nil)
+		return false
+	}
+
+	job, err := cfg.db.GetProcessingJob(*existing.JobID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get processing job", err)
+		return false
+	}
+	if job.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get processing job", errors.New("job for idempotency key not found"))
+		return false
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	respondWithJSON(w, http.StatusAccepted, job)
+	return false
+}
@@ -20,8 +20,35 @@ const (
 	TokenTypeAccess TokenType = "tubely-access"
 )
 
+// DefaultAudience is the audience access tokens are minted for and checked
+// against when none is configured.
+const DefaultAudience = "tubely"
+
+// TokenConfig is what access tokens are signed and checked with. Tokens
+// must carry the same issuer and audience to validate, so environments
+// that share a secret can't use each other's tokens.
+type TokenConfig struct {
+	Secret   string
+	Issuer   string
+	Audience string
+}
+
+// ScopeAdmin lets a token act on every user's videos, not just its own.
+const ScopeAdmin = "admin"
+
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
 
+// ErrMissingScope is returned by ValidateJWTWithScope for a valid token that
+// wasn't granted the required scope.
+var ErrMissingScope = errors.New("token is missing the required scope")
+
+// accessClaims are the claims in an access token. Scope is a
+// space-separated list, as in OAuth 2.0.
+type accessClaims struct {
+	Scope string `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
 func HashPassword(password string) (string, error) {
 	dat, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -36,48 +63,74 @@ func CheckPasswordHash(password, hash string) error {
 
 func MakeJWT(
 	userID uuid.UUID,
-	tokenSecret string,
+	tokens TokenConfig,
 	expiresIn time.Duration,
+	scopes ...string,
 ) (string, error) {
-	signingKey := []byte(tokenSecret)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    string(TokenTypeAccess),
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
-		Subject:   userID.String(),
+	signingKey := []byte(tokens.Secret)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims{
+		Scope: strings.Join(scopes, " "),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokens.Issuer,
+			Audience:  jwt.ClaimStrings{tokens.Audience},
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+			Subject:   userID.String(),
+		},
 	})
 	return token.SignedString(signingKey)
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
-	claimsStruct := jwt.RegisteredClaims{}
+// ValidateJWT checks the token's signature, expiry, issuer, and audience,
+// and returns the user ID it was issued to.
+func ValidateJWT(tokenString string, tokens TokenConfig) (uuid.UUID, error) {
+	id, _, err := parseJWT(tokenString, tokens)
+	return id, err
+}
+
+// ValidateJWTWithScope validates the token like ValidateJWT and also
+// requires it to carry scope, returning ErrMissingScope if it doesn't.
+func ValidateJWTWithScope(tokenString string, tokens TokenConfig, scope string) (uuid.UUID, error) {
+	id, claims, err := parseJWT(tokenString, tokens)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	for _, granted := range strings.Fields(claims.Scope) {
+		if granted == scope {
+			return id, nil
+		}
+	}
+	return uuid.Nil, ErrMissingScope
+}
+
+func parseJWT(tokenString string, tokens TokenConfig) (uuid.UUID, accessClaims, error) {
+	if tokens.Issuer == "" || tokens.Audience == "" {
+		return uuid.Nil, accessClaims{}, errors.New("token issuer and audience must be configured")
+	}
+
+	claimsStruct := accessClaims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		func(token *jwt.Token) (interface{}, error) { return []byte(tokens.Secret), nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(tokens.Issuer),
+		jwt.WithAudience(tokens.Audience),
 	)
 	if err != nil {
-		return uuid.Nil, err
+		return uuid.Nil, accessClaims{}, err
 	}
 
 	userIDString, err := token.Claims.GetSubject()
 	if err != nil {
-		return uuid.Nil, err
-	}
-
-	issuer, err := token.Claims.GetIssuer()
-	if err != nil {
-		return uuid.Nil, err
-	}
-	if issuer != string(TokenTypeAccess) {
-		return uuid.Nil, errors.New("invalid issuer")
+		return uuid.Nil, accessClaims{}, err
 	}
 
 	id, err := uuid.Parse(userIDString)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("invalid user ID: %w", err)
+		return uuid.Nil, accessClaims{}, fmt.Errorf("invalid user ID: %w", err)
 	}
-	return id, nil
+	return id, claimsStruct, nil
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+var testTokens = TokenConfig{
+	Secret:   "test-secret",
+	Issuer:   string(TokenTypeAccess),
+	Audience: DefaultAudience,
+}
+
+func TestMakeAndValidateJWT(t *testing.T) {
+	userID := uuid.New()
+
+	token, err := MakeJWT(userID, testTokens, time.Hour)
+	if err != nil {
+		t.Fatalf("MakeJWT: %v", err)
+	}
+	got, err := ValidateJWT(token, testTokens)
+	if err != nil {
+		t.Fatalf("ValidateJWT: %v", err)
+	}
+	if got != userID {
+		t.Errorf("ValidateJWT = %s, want %s", got, userID)
+	}
+}
+
+func TestValidateJWTWithScope(t *testing.T) {
+	userID := uuid.New()
+
+	tests := []struct {
+		name    string
+		scopes  []string
+		wantErr error
+	}{
+		{"admin", []string{ScopeAdmin}, nil},
+		{"admin among others", []string{"videos:read", ScopeAdmin}, nil},
+		{"no scopes", nil, ErrMissingScope},
+		{"other scope", []string{"videos:read"}, ErrMissingScope},
+		{"scope containing admin", []string{"superadmin"}, ErrMissingScope},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := MakeJWT(userID, testTokens, time.Hour, tt.scopes...)
+			if err != nil {
+				t.Fatalf("MakeJWT: %v", err)
+			}
+
+			got, err := ValidateJWTWithScope(token, testTokens, ScopeAdmin)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ValidateJWTWithScope error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && got != userID {
+				t.Errorf("ValidateJWTWithScope = %s, want %s", got, userID)
+			}
+			if tt.wantErr != nil && got != uuid.Nil {
+				t.Errorf("ValidateJWTWithScope = %s for a rejected token, want uuid.Nil", got)
+			}
+		})
+	}
+}
+
+func TestValidateJWTWithScopeInvalidToken(t *testing.T) {
+	token, err := MakeJWT(uuid.New(), TokenConfig{Secret: "other-secret", Issuer: testTokens.Issuer, Audience: testTokens.Audience}, time.Hour, ScopeAdmin)
+	if err != nil {
+		t.Fatalf("MakeJWT: %v", err)
+	}
+
+	_, err = ValidateJWTWithScope(token, testTokens, ScopeAdmin)
+	if err == nil || errors.Is(err, ErrMissingScope) {
+		t.Errorf("ValidateJWTWithScope with the wrong secret = %v, want a validation error", err)
+	}
+}
+
+func TestParseJWTRejects(t *testing.T) {
+	userID := uuid.New()
+
+	tests := []struct {
+		name    string
+		minted  TokenConfig
+		expires time.Duration
+		wantErr error
+	}{
+		{"wrong issuer", TokenConfig{Secret: testTokens.Secret, Issuer: "tubely-staging", Audience: testTokens.Audience}, time.Hour, jwt.ErrTokenInvalidIssuer},
+		{"wrong audience", TokenConfig{Secret: testTokens.Secret, Issuer: testTokens.Issuer, Audience: "tubely-staging"}, time.Hour, jwt.ErrTokenInvalidAudience},
+		{"wrong secret", TokenConfig{Secret: "other-secret", Issuer: testTokens.Issuer, Audience: testTokens.Audience}, time.Hour, jwt.ErrTokenSignatureInvalid},
+		{"expired", testTokens, -time.Minute, jwt.ErrTokenExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := MakeJWT(userID, tt.minted, tt.expires)
+			if err != nil {
+				t.Fatalf("MakeJWT: %v", err)
+			}
+
+			got, _, err := parseJWT(token, testTokens)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("parseJWT error = %v, want %v", err, tt.wantErr)
+			}
+			if got != uuid.Nil {
+				t.Errorf("parseJWT = %s for a rejected token, want uuid.Nil", got)
+			}
+		})
+	}
+}
+
+func TestParseJWTRequiresIssuerAndAudience(t *testing.T) {
+	token, err := MakeJWT(uuid.New(), testTokens, time.Hour)
+	if err != nil {
+		t.Fatalf("MakeJWT: %v", err)
+	}
+
+	for _, tokens := range []TokenConfig{
+		{Secret: testTokens.Secret, Audience: testTokens.Audience},
+		{Secret: testTokens.Secret, Issuer: testTokens.Issuer},
+	} {
+		if _, _, err := parseJWT(token, tokens); err == nil {
+			t.Errorf("parseJWT with %+v accepted the token", tokens)
+		}
+	}
+}
+
+func TestGetBearerToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{"valid", "Bearer abc.def.ghi", "abc.def.ghi", false},
+		{"missing", "", "", true},
+		{"wrong scheme", "ApiKey abc", "", true},
+		{"no token", "Bearer", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{}
+			if tt.header != "" {
+				headers.Set("Authorization", tt.header)
+			}
+			got, err := GetBearerToken(headers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetBearerToken error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("GetBearerToken = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
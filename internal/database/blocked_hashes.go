@@ -0,0 +1,45 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// BlockedHash is the SHA-256 of a file that may never be uploaded again,
+// e.g. because of a takedown request.
+type BlockedHash struct {
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+	Reason    string    `json:"reason"`
+}
+
+// BlockHash adds the hash to the blocklist. Blocking a hash again keeps
+// its original reason.
+func (c Client) BlockHash(hash, reason string) error {
+	query := `
+	INSERT OR IGNORE INTO blocked_hashes (hash, reason)
+	VALUES (?, ?)
+	`
+	_, err := c.db.Exec(query, hash, reason)
+	return err
+}
+
+// GetBlockedHash returns the blocklist entry for hash, or nil if it isn't
+// blocked.
+func (c Client) GetBlockedHash(hash string) (*BlockedHash, error) {
+	query := `
+	SELECT hash, created_at, reason
+	FROM blocked_hashes
+	WHERE hash = ?
+	`
+	var blocked BlockedHash
+	err := c.db.QueryRow(query, hash).Scan(&blocked.Hash, &blocked.CreatedAt, &blocked.Reason)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &blocked, nil
+}
@@ -32,7 +32,9 @@ func (c *Client) autoMigrate() error {
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		password TEXT NOT NULL,
-		email TEXT UNIQUE NOT NULL
+		email TEXT UNIQUE NOT NULL,
+		role TEXT NOT NULL DEFAULT 'user',
+		region TEXT NOT NULL DEFAULT ''
 	);
 	`
 	_, err := c.db.Exec(userTable)
@@ -65,6 +67,21 @@ func (c *Client) autoMigrate() error {
 		thumbnail_url TEXT,
 		video_url TEXT TEXT,
 		user_id INTEGER,
+		renditions TEXT,
+		renditions_status TEXT,
+		content_hash TEXT,
+		storage_class TEXT,
+		visibility TEXT NOT NULL DEFAULT 'private',
+		size_bytes INTEGER NOT NULL DEFAULT 0,
+		moderation_status TEXT NOT NULL DEFAULT 'approved',
+		preview_url TEXT,
+		status TEXT NOT NULL DEFAULT 'draft',
+		metadata TEXT,
+		deleted_at TIMESTAMP,
+		hls_playlist_key TEXT,
+		hls_status TEXT,
+		quality_preset TEXT,
+		normalize_audio BOOLEAN NOT NULL DEFAULT FALSE,
 		FOREIGN KEY(user_id) REFERENCES users(id)
 	);
 	`
@@ -72,10 +89,206 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+
+	processingJobTable := `
+	CREATE TABLE IF NOT EXISTS processing_jobs (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		error TEXT,
+		progress REAL,
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(processingJobTable)
+	if err != nil {
+		return err
+	}
+
+	multipartUploadTable := `
+	CREATE TABLE IF NOT EXISTS multipart_uploads (
+		upload_id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		bucket TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(multipartUploadTable)
+	if err != nil {
+		return err
+	}
+
+	multipartUploadPartTable := `
+	CREATE TABLE IF NOT EXISTS multipart_upload_parts (
+		upload_id TEXT NOT NULL,
+		part_number INTEGER NOT NULL,
+		etag TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		PRIMARY KEY(upload_id, part_number),
+		FOREIGN KEY(upload_id) REFERENCES multipart_uploads(upload_id)
+	);
+	`
+	_, err = c.db.Exec(multipartUploadPartTable)
+	if err != nil {
+		return err
+	}
+
+	uploadKeyTable := `
+	CREATE TABLE IF NOT EXISTS upload_keys (
+		key TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		bucket TEXT NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(uploadKeyTable)
+	if err != nil {
+		return err
+	}
+
+	idempotencyKeyTable := `
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_id TEXT NOT NULL,
+		key TEXT NOT NULL,
+		request_hash TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		job_id TEXT,
+		expires_at TIMESTAMP NOT NULL,
+		PRIMARY KEY(user_id, key),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(idempotencyKeyTable)
+	if err != nil {
+		return err
+	}
+
+	blockedHashTable := `
+	CREATE TABLE IF NOT EXISTS blocked_hashes (
+		hash TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		reason TEXT NOT NULL DEFAULT ''
+	);
+	`
+	_, err = c.db.Exec(blockedHashTable)
+	if err != nil {
+		return err
+	}
+
+	// Columns added after the initial schema, for databases created
+	// before they existed
+	videoColumns := []struct {
+		name       string
+		definition string
+	}{
+		{"renditions", "TEXT"},
+		{"renditions_status", "TEXT"},
+		{"content_hash", "TEXT"},
+		{"storage_class", "TEXT"},
+		{"visibility", "TEXT NOT NULL DEFAULT 'private'"},
+		{"size_bytes", "INTEGER NOT NULL DEFAULT 0"},
+		{"moderation_status", "TEXT NOT NULL DEFAULT 'approved'"},
+		{"preview_url", "TEXT"},
+		{"status", "TEXT NOT NULL DEFAULT 'draft'"},
+		{"metadata", "TEXT"},
+		{"deleted_at", "TIMESTAMP"},
+		{"hls_playlist_key", "TEXT"},
+		{"hls_status", "TEXT"},
+		{"quality_preset", "TEXT"},
+		{"normalize_audio", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	}
+	for _, col := range videoColumns {
+		err = c.addColumnIfNotExists("videos", col.name, col.definition)
+		if err != nil {
+			return err
+		}
+	}
+	// Videos from before status was tracked got the draft default; the
+	// ones with a file are ready
+	_, err = c.db.Exec("UPDATE videos SET status = 'ready' WHERE status = 'draft' AND video_url IS NOT NULL")
+	if err != nil {
+		return fmt.Errorf("failed to backfill video status: %w", err)
+	}
+	err = c.addColumnIfNotExists("users", "role", "TEXT NOT NULL DEFAULT 'user'")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "region", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("processing_jobs", "progress", "REAL")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("multipart_uploads", "bucket", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *Client) addColumnIfNotExists(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
 func (c Client) Reset() error {
+	if _, err := c.db.Exec("DELETE FROM idempotency_keys"); err != nil {
+		return fmt.Errorf("failed to reset table idempotency_keys: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM upload_keys"); err != nil {
+		return fmt.Errorf("failed to reset table upload_keys: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM multipart_upload_parts"); err != nil {
+		return fmt.Errorf("failed to reset table multipart_upload_parts: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM multipart_uploads"); err != nil {
+		return fmt.Errorf("failed to reset table multipart_uploads: %w", err)
+	}
+	if _, err := c.db.Exec("DELETE FROM processing_jobs"); err != nil {
+		return fmt.Errorf("failed to reset table processing_jobs: %w", err)
+	}
 	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
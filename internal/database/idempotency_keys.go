@@ -0,0 +1,97 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IdempotencyKey remembers the outcome of a request sent with an
+// Idempotency-Key header, so a client retrying it gets the same result.
+type IdempotencyKey struct {
+	UserID      uuid.UUID
+	Key         string
+	RequestHash string
+	VideoID     uuid.UUID
+	// JobID is nil while the first request is still being handled
+	JobID     *uuid.UUID
+	ExpiresAt time.Time
+}
+
+// CreateIdempotencyKey reserves the key for the user, reporting false if
+// an unexpired reservation already exists. Expired keys are dropped first.
+func (c Client) CreateIdempotencyKey(params IdempotencyKey) (bool, error) {
+	_, err := c.db.Exec("DELETE FROM idempotency_keys WHERE expires_at <= ?", time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+
+	query := `
+	INSERT OR IGNORE INTO idempotency_keys (
+		user_id,
+		key,
+		request_hash,
+		video_id,
+		expires_at
+	) VALUES (?, ?, ?, ?, ?)
+	`
+	result, err := c.db.Exec(query, params.UserID, params.Key, params.RequestHash, params.VideoID, params.ExpiresAt)
+	if err != nil {
+		return false, err
+	}
+	created, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return created == 1, nil
+}
+
+// GetIdempotencyKey returns the user's unexpired reservation of key, or a
+// zero value if there is none.
+func (c Client) GetIdempotencyKey(userID uuid.UUID, key string) (IdempotencyKey, error) {
+	query := `
+	SELECT user_id, key, request_hash, video_id, job_id, expires_at
+	FROM idempotency_keys
+	WHERE user_id = ? AND key = ? AND expires_at > ?
+	`
+	var idempotencyKey IdempotencyKey
+	var jobID uuid.NullUUID
+	err := c.db.QueryRow(query, userID, key, time.Now().UTC()).Scan(
+		&idempotencyKey.UserID,
+		&idempotencyKey.Key,
+		&idempotencyKey.RequestHash,
+		&idempotencyKey.VideoID,
+		&jobID,
+		&idempotencyKey.ExpiresAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return IdempotencyKey{}, nil
+		}
+		return IdempotencyKey{}, err
+	}
+	if jobID.Valid {
+		idempotencyKey.JobID = &jobID.UUID
+	}
+	return idempotencyKey, nil
+}
+
+// SetIdempotencyKeyJob records the job the key's request created.
+func (c Client) SetIdempotencyKeyJob(userID uuid.UUID, key string, jobID uuid.UUID) error {
+	query := `
+	UPDATE idempotency_keys
+	SET job_id = ?
+	WHERE user_id = ? AND key = ?
+	`
+	_, err := c.db.Exec(query, jobID, userID, key)
+	return err
+}
+
+// DeleteIdempotencyKey releases a reservation whose request failed, so the
+// client can retry with the same key.
+func (c Client) DeleteIdempotencyKey(userID uuid.UUID, key string) error {
+	_, err := c.db.Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND key = ?", userID, key)
+	return err
+}
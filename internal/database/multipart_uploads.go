@@ -0,0 +1,125 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MultipartUpload tracks an in-progress S3 multipart upload so a client can
+// resume it after reconnecting.
+type MultipartUpload struct {
+	UploadID  string          `json:"upload_id"`
+	VideoID   uuid.UUID       `json:"video_id"`
+	UserID    uuid.UUID       `json:"user_id"`
+	Key       string          `json:"key"`
+	Bucket    string          `json:"bucket"`
+	CreatedAt time.Time       `json:"created_at"`
+	Parts     []MultipartPart `json:"parts"`
+}
+
+type MultipartPart struct {
+	PartNumber int32  `json:"part_number"`
+	ETag       string `json:"etag"`
+	Size       int64  `json:"size"`
+}
+
+type CreateMultipartUploadParams struct {
+	UploadID string
+	VideoID  uuid.UUID
+	UserID   uuid.UUID
+	Key      string
+	Bucket   string
+}
+
+func (c Client) CreateMultipartUpload(params CreateMultipartUploadParams) (MultipartUpload, error) {
+	query := `
+	INSERT INTO multipart_uploads (
+		upload_id,
+		created_at,
+		video_id,
+		user_id,
+		key,
+		bucket
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, params.UploadID, params.VideoID, params.UserID, params.Key, params.Bucket)
+	if err != nil {
+		return MultipartUpload{}, err
+	}
+
+	return c.GetMultipartUpload(params.UploadID)
+}
+
+// GetMultipartUpload returns the upload with its received parts ordered by
+// part number.
+func (c Client) GetMultipartUpload(uploadID string) (MultipartUpload, error) {
+	query := `
+	SELECT upload_id, created_at, video_id, user_id, key, bucket
+	FROM multipart_uploads
+	WHERE upload_id = ?
+	`
+	var upload MultipartUpload
+	err := c.db.QueryRow(query, uploadID).Scan(
+		&upload.UploadID,
+		&upload.CreatedAt,
+		&upload.VideoID,
+		&upload.UserID,
+		&upload.Key,
+		&upload.Bucket,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return MultipartUpload{}, nil
+		}
+		return MultipartUpload{}, err
+	}
+
+	partsQuery := `
+	SELECT part_number, etag, size
+	FROM multipart_upload_parts
+	WHERE upload_id = ?
+	ORDER BY part_number
+	`
+	rows, err := c.db.Query(partsQuery, uploadID)
+	if err != nil {
+		return MultipartUpload{}, err
+	}
+	defer rows.Close()
+
+	upload.Parts = []MultipartPart{}
+	for rows.Next() {
+		var part MultipartPart
+		if err := rows.Scan(&part.PartNumber, &part.ETag, &part.Size); err != nil {
+			return MultipartUpload{}, err
+		}
+		upload.Parts = append(upload.Parts, part)
+	}
+
+	return upload, rows.Err()
+}
+
+// SaveMultipartPart records a received part, replacing any earlier upload
+// of the same part number.
+func (c Client) SaveMultipartPart(uploadID string, part MultipartPart) error {
+	query := `
+	INSERT OR REPLACE INTO multipart_upload_parts (
+		upload_id,
+		part_number,
+		etag,
+		size
+	) VALUES (?, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, uploadID, part.PartNumber, part.ETag, part.Size)
+	return err
+}
+
+func (c Client) DeleteMultipartUpload(uploadID string) error {
+	if _, err := c.db.Exec("DELETE FROM multipart_upload_parts WHERE upload_id = ?", uploadID); err != nil {
+		return err
+	}
+	_, err := c.db.Exec("DELETE FROM multipart_uploads WHERE upload_id = ?", uploadID)
+	return err
+}
@@ -0,0 +1,126 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ProcessingJob struct {
+	ID        uuid.UUID `json:"id"`
+	VideoID   uuid.UUID `json:"video_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Progress is the percentage of the video processed so far, or nil
+	// while it can't be told, e.g. before processing starts
+	Progress *float64 `json:"progress"`
+}
+
+const (
+	JobStatusPending    = "pending"
+	JobStatusProcessing = "processing"
+	JobStatusDone       = "done"
+	JobStatusFailed     = "failed"
+)
+
+func (c Client) CreateProcessingJob(videoID, userID uuid.UUID) (ProcessingJob, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO processing_jobs (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		status
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, id, videoID, userID, JobStatusPending)
+	if err != nil {
+		return ProcessingJob{}, err
+	}
+
+	return c.GetProcessingJob(id)
+}
+
+func (c Client) GetProcessingJob(id uuid.UUID) (ProcessingJob, error) {
+	query := `
+	SELECT id, created_at, updated_at, video_id, user_id, status, error, progress
+	FROM processing_jobs
+	WHERE id = ?
+	`
+	var job ProcessingJob
+	var jobError sql.NullString
+	var progress sql.NullFloat64
+	err := c.db.QueryRow(query, id).Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.VideoID,
+		&job.UserID,
+		&job.Status,
+		&jobError,
+		&progress,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ProcessingJob{}, nil
+		}
+		return ProcessingJob{}, err
+	}
+	job.Error = jobError.String
+	if progress.Valid {
+		job.Progress = &progress.Float64
+	}
+	return job, nil
+}
+
+func (c Client) UpdateProcessingJobStatus(id uuid.UUID, status, jobError string) error {
+	query := `
+	UPDATE processing_jobs
+	SET
+		status = ?,
+		error = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, status, jobError, id)
+	return err
+}
+
+// UpdateProcessingJobProgress records how far along the job is, as a
+// percentage.
+func (c Client) UpdateProcessingJobProgress(id uuid.UUID, progress float64) error {
+	query := `
+	UPDATE processing_jobs
+	SET
+		progress = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, progress, id)
+	return err
+}
+
+// FailUnfinishedProcessingJobs marks every pending or processing job as
+// failed. Jobs don't survive a restart, since their input files are gone.
+func (c Client) FailUnfinishedProcessingJobs(jobError string) (int64, error) {
+	query := `
+	UPDATE processing_jobs
+	SET
+		status = ?,
+		error = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE status IN (?, ?)
+	`
+	result, err := c.db.Exec(query, JobStatusFailed, jobError, JobStatusPending, JobStatusProcessing)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
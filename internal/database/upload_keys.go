@@ -0,0 +1,70 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UploadKey is a key handed out with a presigned PUT URL. Only the video
+// and user it was issued for can confirm an upload to it.
+type UploadKey struct {
+	Key       string    `json:"key"`
+	VideoID   uuid.UUID `json:"video_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Bucket    string    `json:"bucket"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreateUploadKeyParams struct {
+	Key     string
+	VideoID uuid.UUID
+	UserID  uuid.UUID
+	Bucket  string
+}
+
+func (c Client) CreateUploadKey(params CreateUploadKeyParams) error {
+	query := `
+	INSERT INTO upload_keys (
+		key,
+		created_at,
+		video_id,
+		user_id,
+		bucket
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?)
+	`
+	_, err := c.db.Exec(query, params.Key, params.VideoID, params.UserID, params.Bucket)
+	return err
+}
+
+// GetUploadKey returns the record of an issued key, or a zero value if the
+// key was never issued or has been confirmed.
+func (c Client) GetUploadKey(key string) (UploadKey, error) {
+	query := `
+	SELECT key, created_at, video_id, user_id, bucket
+	FROM upload_keys
+	WHERE key = ?
+	`
+	var uploadKey UploadKey
+	err := c.db.QueryRow(query, key).Scan(
+		&uploadKey.Key,
+		&uploadKey.CreatedAt,
+		&uploadKey.VideoID,
+		&uploadKey.UserID,
+		&uploadKey.Bucket,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UploadKey{}, nil
+		}
+		return UploadKey{}, err
+	}
+	return uploadKey, nil
+}
+
+func (c Client) DeleteUploadKey(key string) error {
+	_, err := c.db.Exec("DELETE FROM upload_keys WHERE key = ?", key)
+	return err
+}
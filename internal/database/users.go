@@ -12,12 +12,23 @@ type User struct {
 	ID        uuid.UUID `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	Role      string    `json:"role"`
 	CreateUserParams
 }
 
+const (
+	UserRoleUser = "user"
+	// UserRoleAdmin users can manage every user's videos. There's no API
+	// for granting it; set users.role directly.
+	UserRoleAdmin = "admin"
+)
+
 type CreateUserParams struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// Region is the S3 region the user's videos are stored in; empty or
+	// unconfigured regions use the default bucket
+	Region string `json:"region"`
 }
 
 func (c Client) GetUsers() ([]User, error) {
@@ -53,13 +64,13 @@ func (c Client) GetUsers() ([]User, error) {
 
 func (c Client) GetUserByEmail(email string) (User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
+		SELECT id, created_at, updated_at, email, password, role, region
 		FROM users
 		WHERE email = ?
 	`
 	var user User
 	var id string
-	err := c.db.QueryRow(query, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	err := c.db.QueryRow(query, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password, &user.Role, &user.Region)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return User{}, nil
@@ -73,17 +84,21 @@ func (c Client) GetUserByEmail(email string) (User, error) {
 	return user, nil
 }
 
+// GetUserByRefreshToken returns the owner of a refresh token, or nil if the
+// token doesn't exist, has been revoked, or has expired.
 func (c Client) GetUserByRefreshToken(token string) (*User, error) {
 	query := `
-		SELECT u.id, u.email, u.created_at, u.updated_at, u.password
+		SELECT u.id, u.email, u.created_at, u.updated_at, u.password, u.role, u.region
 		FROM users u
 		JOIN refresh_tokens rt ON u.id = rt.user_id
 		WHERE rt.token = ?
+		AND rt.revoked_at IS NULL
+		AND rt.expires_at > ?
 	`
 
 	var user User
 	var id string
-	err := c.db.QueryRow(query, token).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password)
+	err := c.db.QueryRow(query, token, time.Now().UTC()).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password, &user.Role, &user.Region)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -103,11 +118,11 @@ func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 
 	query := `
 		INSERT INTO users
-		    (id, created_at, updated_at, email, password)
+		    (id, created_at, updated_at, email, password, region)
 		VALUES
-		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
+		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id.String(), params.Email, params.Password)
+	_, err := c.db.Exec(query, id.String(), params.Email, params.Password, params.Region)
 	if err != nil {
 		return nil, err
 	}
@@ -117,13 +132,13 @@ func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 
 func (c Client) GetUser(id uuid.UUID) (*User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
+		SELECT id, created_at, updated_at, email, password, role, region
 		FROM users
 		WHERE id = ?
 	`
 	var user User
 	var idStr string
-	err := c.db.QueryRow(query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	err := c.db.QueryRow(query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password, &user.Role, &user.Region)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -2,18 +2,58 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type Video struct {
-	ID           uuid.UUID `json:"id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
-	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	ID               uuid.UUID   `json:"id"`
+	CreatedAt        time.Time   `json:"created_at"`
+	UpdatedAt        time.Time   `json:"updated_at"`
+	ThumbnailURL     *string     `json:"thumbnail_url"`
+	PreviewURL       *string     `json:"preview_url"`
+	VideoURL         *string     `json:"video_url"`
+	Renditions       []Rendition `json:"renditions"`
+	RenditionsStatus string      `json:"renditions_status"`
+	ContentHash      *string     `json:"content_hash"`
+	StorageClass     string      `json:"storage_class"`
+	Visibility       string      `json:"visibility"`
+	// QualityPreset is the preset the video was encoded with, empty if
+	// the file was stored without re-encoding
+	QualityPreset string `json:"quality_preset"`
+	// NormalizeAudio is whether the upload asked for the audio to be
+	// loudness normalized
+	NormalizeAudio bool `json:"normalize_audio"`
+	// SizeBytes is the size of the stored video file, counted against the
+	// owner's storage quota
+	SizeBytes        int64  `json:"size_bytes"`
+	ModerationStatus string `json:"moderation_status"`
+	// Status is where the video's upload is up to, one of the
+	// VideoStatus constants
+	Status string `json:"status"`
+	// Metadata describes the stored file, and is nil until it has been
+	// probed. It has its own endpoint rather than being sent with every
+	// video.
+	Metadata *VideoMetadata `json:"-"`
+	// DeletedAt is set once the owner deletes the video. It's kept, files
+	// and all, until the recovery window runs out.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// HLSPlaylistKey is the key of the video's HLS master playlist, in the
+	// same bucket as the video. The segments are stored under the same
+	// prefix.
+	HLSPlaylistKey *string `json:"-"`
+	// HLSStatus takes the same values as RenditionsStatus
+	HLSStatus string `json:"hls_status"`
+	// HLSURL is set on read to where the master playlist can be fetched
+	HLSURL string `json:"hls_url,omitempty"`
+	// RestoreRequired is set on read for archived videos, which have no
+	// playable URL until they are restored
+	RestoreRequired bool `json:"restore_required,omitempty"`
 	CreateVideoParams
 }
 
@@ -23,9 +63,72 @@ type CreateVideoParams struct {
 	UserID      uuid.UUID `json:"user_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+// VideoMetadata is what ffprobe reported about a stored video file.
+type VideoMetadata struct {
+	// Format is ffprobe's name for the container, e.g. "mov,mp4,m4a,3gp"
+	Format          string  `json:"format"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	// BitRate is the overall bit rate in bits per second
+	BitRate    int64   `json:"bit_rate"`
+	VideoCodec string  `json:"video_codec"`
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	FrameRate  float64 `json:"frame_rate"`
+	// AudioCodec is empty for videos without sound
+	AudioCodec string `json:"audio_codec,omitempty"`
+}
+
+// Rendition is a lower resolution transcode of a video, stored next to the
+// original in the same bucket.
+type Rendition struct {
+	Height int    `json:"height"`
+	Key    string `json:"key"`
+	URL    string `json:"url,omitempty"`
+}
+
+const (
+	// VisibilityPrivate videos are only shown to their owner
+	VisibilityPrivate = "private"
+	// VisibilityUnlisted videos can be shared by link but aren't in the
+	// public feed
+	VisibilityUnlisted = "unlisted"
+	VisibilityPublic   = "public"
+)
+
+const (
+	// VideoStatusDraft videos have had nothing uploaded yet
+	VideoStatusDraft = "draft"
+	// VideoStatusProcessing videos have an upload waiting for or going
+	// through processing; any earlier file is still served meanwhile
+	VideoStatusProcessing = "processing"
+	VideoStatusReady      = "ready"
+	// VideoStatusFailed videos have no file, because processing failed or
+	// moderation rejected it
+	VideoStatusFailed = "failed"
+)
+
+// VideoStatuses are the values Status can take.
+var VideoStatuses = []string{VideoStatusDraft, VideoStatusProcessing, VideoStatusReady, VideoStatusFailed}
+
+const (
+	RenditionsStatusPending    = "pending"
+	RenditionsStatusProcessing = "processing"
+	RenditionsStatusDone       = "done"
+	RenditionsStatusFailed     = "failed"
+)
+
+const (
+	// ModerationStatusPendingReview videos have a file that hasn't been
+	// approved yet, so it isn't shown to anyone
+	ModerationStatusPendingReview = "pending_review"
+	ModerationStatusApproved      = "approved"
+	// ModerationStatusRejected videos have had their file removed
+	ModerationStatusRejected = "rejected"
+)
+
+// videoColumns is the column list every video query selects, in the order
+// scanVideo expects.
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
@@ -33,9 +136,93 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 		description,
 		thumbnail_url,
 		video_url,
-		user_id
+		user_id,
+		renditions,
+		renditions_status,
+		content_hash,
+		storage_class,
+		visibility,
+		size_bytes,
+		moderation_status,
+		preview_url,
+		status,
+		metadata,
+		deleted_at,
+		hls_playlist_key,
+		hls_status,
+		quality_preset,
+		normalize_audio`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	var renditions, renditionsStatus, storageClass, metadata, hlsStatus, qualityPreset sql.NullString
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.VideoURL,
+		&video.UserID,
+		&renditions,
+		&renditionsStatus,
+		&video.ContentHash,
+		&storageClass,
+		&video.Visibility,
+		&video.SizeBytes,
+		&video.ModerationStatus,
+		&video.PreviewURL,
+		&video.Status,
+		&metadata,
+		&video.DeletedAt,
+		&video.HLSPlaylistKey,
+		&hlsStatus,
+		&qualityPreset,
+		&video.NormalizeAudio,
+	)
+	if err != nil {
+		return Video{}, err
+	}
+	if renditions.Valid && renditions.String != "" {
+		if err := json.Unmarshal([]byte(renditions.String), &video.Renditions); err != nil {
+			return Video{}, fmt.Errorf("couldn't decode renditions: %w", err)
+		}
+	}
+	if metadata.Valid && metadata.String != "" {
+		video.Metadata = &VideoMetadata{}
+		if err := json.Unmarshal([]byte(metadata.String), video.Metadata); err != nil {
+			return Video{}, fmt.Errorf("couldn't decode metadata: %w", err)
+		}
+	}
+	video.RenditionsStatus = renditionsStatus.String
+	video.StorageClass = storageClass.String
+	video.HLSStatus = hlsStatus.String
+	video.QualityPreset = qualityPreset.String
+	return video, nil
+}
+
+func scanVideos(rows *sql.Rows) ([]Video, error) {
+	videos := []Video{}
+	for rows.Next() {
+		video, err := scanVideo(rows)
+		if err != nil {
+			return nil, err
+		}
+		videos = append(videos, video)
+	}
+	return videos, rows.Err()
+}
+
+func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
-	WHERE user_id = ?
+	WHERE user_id = ? AND deleted_at IS NULL
 	ORDER BY created_at DESC
 	`
 
@@ -45,25 +232,294 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 	}
 	defer rows.Close()
 
-	videos := []Video{}
+	return scanVideos(rows)
+}
+
+// ErrInvalidSort is returned when a listing is requested with a sort key
+// that isn't in VideoSortOrders.
+var ErrInvalidSort = errors.New("invalid sort column")
+
+// VideoSortOrders maps the accepted sort keys to their ORDER BY clauses.
+// A leading "-" sorts descending. Ties are broken by ID, in the same
+// direction for created_at so pages line up with GetVideosAfter.
+var VideoSortOrders = map[string]string{
+	"created_at":  "created_at ASC, id ASC",
+	"-created_at": "created_at DESC, id DESC",
+	"title":       "title ASC, id",
+	"-title":      "title DESC, id",
+}
+
+// GetVideosPaginated returns a page of the user's videos, only those with
+// the given status unless it's empty.
+func (c Client) GetVideosPaginated(userID uuid.UUID, status string, limit, offset int, sortBy string) ([]Video, error) {
+	orderBy, ok := VideoSortOrders[sortBy]
+	if !ok {
+		return nil, ErrInvalidSort
+	}
+
+	where, args := videoListFilter(userID, status)
+	args = append(args, limit, offset)
+	query := fmt.Sprintf(`
+	SELECT`+videoColumns+`
+	FROM videos
+	WHERE %s
+	ORDER BY %s
+	LIMIT ? OFFSET ?
+	`, where, orderBy)
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanVideos(rows)
+}
+
+// VideoCursor is the position after the last video of a page, for keyset
+// pagination by created_at.
+type VideoCursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+// sqliteTimestampLayout is how CURRENT_TIMESTAMP stores created_at, which
+// cursor values must match to compare correctly.
+const sqliteTimestampLayout = "2006-01-02 15:04:05"
+
+// GetVideosAfter returns up to limit of the user's videos that come after
+// the cursor in created_at order, newest first if descending, only those
+// with the given status unless it's empty. A nil cursor starts from the
+// beginning. Unlike an offset, the cursor keeps its place when videos are
+// added while paging.
+func (c Client) GetVideosAfter(userID uuid.UUID, status string, cursor *VideoCursor, limit int, descending bool) ([]Video, error) {
+	comparison, direction := ">", "ASC"
+	if descending {
+		comparison, direction = "<", "DESC"
+	}
+
+	where, args := videoListFilter(userID, status)
+	if cursor != nil {
+		where += fmt.Sprintf(" AND (created_at, id) %s (?, ?)", comparison)
+		args = append(args, cursor.CreatedAt.UTC().Format(sqliteTimestampLayout), cursor.ID.String())
+	}
+	args = append(args, limit)
+
+	query := fmt.Sprintf(`
+	SELECT`+videoColumns+`
+	FROM videos
+	WHERE %s
+	ORDER BY created_at %s, id %s
+	LIMIT ?
+	`, where, direction, direction)
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanVideos(rows)
+}
+
+// videoListFilter is the WHERE clause selecting the user's videos for a
+// listing, narrowed to one status unless status is empty. Deleted videos
+// are never listed.
+func videoListFilter(userID uuid.UUID, status string) (string, []any) {
+	if status == "" {
+		return "user_id = ? AND deleted_at IS NULL", []any{userID}
+	}
+	return "user_id = ? AND deleted_at IS NULL AND status = ?", []any{userID, status}
+}
+
+// likeEscaper escapes LIKE wildcards so user input only matches literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchVideos returns the user's videos whose title or description
+// contains the query, ignoring case.
+func (c Client) SearchVideos(userID uuid.UUID, query string) ([]Video, error) {
+	pattern := "%" + likeEscaper.Replace(query) + "%"
+	sqlQuery := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ? AND deleted_at IS NULL
+		AND (title LIKE ? ESCAPE '\' OR description LIKE ? ESCAPE '\')
+	ORDER BY created_at DESC
+	`
+
+	rows, err := c.db.Query(sqlQuery, userID, pattern, pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanVideos(rows)
+}
+
+// GetVideosByIDs returns the videos with the given IDs that exist and
+// aren't deleted, in no particular order.
+func (c Client) GetVideosByIDs(ids []uuid.UUID) ([]Video, error) {
+	if len(ids) == 0 {
+		return []Video{}, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE id IN (` + placeholders + `) AND deleted_at IS NULL
+	`
+
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanVideos(rows)
+}
+
+// GetVideoByContentHash returns the user's oldest stored video whose
+// upload had the given SHA-256, so identical uploads can share its objects.
+func (c Client) GetVideoByContentHash(userID uuid.UUID, contentHash string) (Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ? AND content_hash = ? AND video_url IS NOT NULL AND deleted_at IS NULL
+	ORDER BY created_at
+	LIMIT 1
+	`
+
+	video, err := scanVideo(c.db.QueryRow(query, userID, contentHash))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Video{}, nil
+		}
+		return Video{}, err
+	}
+	return video, nil
+}
+
+// GetVideosByContentHashWithDeleted returns every user's videos made from
+// a file with the hash, deleted ones included.
+func (c Client) GetVideosByContentHashWithDeleted(contentHash string) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE content_hash = ?
+	`
+
+	rows, err := c.db.Query(query, contentHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanVideos(rows)
+}
+
+// GetVideosWithFiles returns every user's videos that have a stored file,
+// including deleted ones whose file is kept for recovery.
+func (c Client) GetVideosWithFiles() ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE video_url IS NOT NULL
+	`
+
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanVideos(rows)
+}
+
+// CountVideosByVideoURL returns how many videos point at the stored object.
+func (c Client) CountVideosByVideoURL(videoURL string) (int, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM videos
+	WHERE video_url = ?
+	`
+	var count int
+	err := c.db.QueryRow(query, videoURL).Scan(&count)
+	return count, err
+}
+
+// GetUserStorageBytes returns the total size of the user's stored videos,
+// leaving out excludeID. Videos sharing a file through deduplication count
+// it once. Deleted videos count until they are purged, as their files are
+// kept.
+func (c Client) GetUserStorageBytes(userID, excludeID uuid.UUID) (int64, error) {
+	query := `
+	SELECT COALESCE(SUM(size_bytes), 0)
+	FROM (
+		SELECT MAX(size_bytes) AS size_bytes
+		FROM videos
+		WHERE user_id = ? AND id != ?
+		GROUP BY COALESCE(video_url, id)
+	)
+	`
+	var total int64
+	err := c.db.QueryRow(query, userID, excludeID).Scan(&total)
+	return total, err
+}
+
+// GetPublicVideos returns a page of every user's public videos, newest
+// first.
+func (c Client) GetPublicVideos(limit, offset int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE visibility = ? AND moderation_status = ? AND deleted_at IS NULL
+	ORDER BY created_at DESC, id
+	LIMIT ? OFFSET ?
+	`
+
+	rows, err := c.db.Query(query, VisibilityPublic, ModerationStatusApproved, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanVideos(rows)
+}
+
+// CountVideosByStatus returns how many videos the user has with each
+// status, including statuses they have none of.
+func (c Client) CountVideosByStatus(userID uuid.UUID) (map[string]int, error) {
+	query := `
+	SELECT status, COUNT(*)
+	FROM videos
+	WHERE user_id = ? AND deleted_at IS NULL
+	GROUP BY status
+	`
+	rows, err := c.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for _, status := range VideoStatuses {
+		counts[status] = 0
+	}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
 			return nil, err
 		}
-		videos = append(videos, video)
+		counts[status] = count
 	}
-
-	return videos, nil
+	return counts, rows.Err()
 }
 
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
@@ -86,31 +542,36 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 	return c.GetVideo(id)
 }
 
+// GetVideo returns the video, or a zero value if there is none or it has
+// been deleted.
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE id = ? AND deleted_at IS NULL
+	`
+
+	video, err := scanVideo(c.db.QueryRow(query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Video{}, nil
+		}
+		return Video{}, err
+	}
+
+	return video, nil
+}
+
+// GetVideoWithDeleted is GetVideo including deleted videos, for restoring
+// and purging them.
+func (c Client) GetVideoWithDeleted(id uuid.UUID) (Video, error) {
+	query := `
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRow(query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -129,7 +590,15 @@ func (c Client) UpdateVideo(video Video) error {
 		description = ?,
 		thumbnail_url = ?,
 		video_url = ?,
-		user_id = ?
+		user_id = ?,
+		content_hash = ?,
+		storage_class = ?,
+		visibility = ?,
+		size_bytes = ?,
+		moderation_status = ?,
+		preview_url = ?,
+		quality_preset = ?,
+		normalize_audio = ?
 	WHERE id = ?
 	`
 
@@ -140,12 +609,201 @@ func (c Client) UpdateVideo(video Video) error {
 		&video.ThumbnailURL,
 		&video.VideoURL,
 		video.UserID,
+		&video.ContentHash,
+		video.StorageClass,
+		video.Visibility,
+		video.SizeBytes,
+		video.ModerationStatus,
+		&video.PreviewURL,
+		video.QualityPreset,
+		video.NormalizeAudio,
 		video.ID,
 	)
 	return err
 }
 
+// UpdateVideoDetails sets the title and description the owner edits,
+// without touching fields background work may have changed since the
+// video was read.
+func (c Client) UpdateVideoDetails(id uuid.UUID, title, description string) error {
+	query := `
+	UPDATE videos
+	SET
+		title = ?,
+		description = ?,
+		updated_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, title, description, time.Now().UTC(), id)
+	return err
+}
+
+// UpdateVideoThumbnail points the video at a new thumbnail without
+// touching fields background work may have changed since the video was
+// read.
+func (c Client) UpdateVideoThumbnail(id uuid.UUID, thumbnailURL string) error {
+	query := `
+	UPDATE videos
+	SET
+		thumbnail_url = ?,
+		updated_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, thumbnailURL, time.Now().UTC(), id)
+	return err
+}
+
+// UpdateVideoVisibility sets who can see the video without touching
+// fields background work may have changed since the video was read.
+func (c Client) UpdateVideoVisibility(id uuid.UUID, visibility string) error {
+	query := `
+	UPDATE videos
+	SET
+		visibility = ?,
+		updated_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, visibility, time.Now().UTC(), id)
+	return err
+}
+
+// UpdateVideoRenditions records the outcome of background transcoding
+// without touching fields the owner may have edited in the meantime.
+func (c Client) UpdateVideoRenditions(id uuid.UUID, status string, renditions []Rendition) error {
+	var encoded *string
+	if renditions != nil {
+		dat, err := json.Marshal(renditions)
+		if err != nil {
+			return err
+		}
+		s := string(dat)
+		encoded = &s
+	}
+
+	query := `
+	UPDATE videos
+	SET
+		renditions = COALESCE(?, renditions),
+		renditions_status = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, encoded, status, id)
+	return err
+}
+
+// UpdateVideoHLS records the outcome of background HLS packaging without
+// touching fields the owner may have edited in the meantime. A nil
+// playlistKey clears the stored playlist.
+func (c Client) UpdateVideoHLS(id uuid.UUID, status string, playlistKey *string) error {
+	query := `
+	UPDATE videos
+	SET
+		hls_playlist_key = ?,
+		hls_status = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, playlistKey, status, id)
+	return err
+}
+
+// UpdateVideoModerationStatus records a moderation decision without
+// touching fields the owner may have edited in the meantime.
+func (c Client) UpdateVideoModerationStatus(id uuid.UUID, status string) error {
+	query := `
+	UPDATE videos
+	SET moderation_status = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, status, id)
+	return err
+}
+
+// UpdateVideoStatus records where the video's upload is up to without
+// touching fields the owner may have edited in the meantime.
+func (c Client) UpdateVideoStatus(id uuid.UUID, status string) error {
+	query := `
+	UPDATE videos
+	SET status = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, status, id)
+	return err
+}
+
+// UpdateVideoMetadata records what was probed from the video's stored
+// file. A nil metadata clears it, for files that couldn't be probed.
+func (c Client) UpdateVideoMetadata(id uuid.UUID, metadata *VideoMetadata) error {
+	var encoded *string
+	if metadata != nil {
+		dat, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		s := string(dat)
+		encoded = &s
+	}
+
+	query := `
+	UPDATE videos
+	SET metadata = ?
+	WHERE id = ?
+	`
+	_, err := c.db.Exec(query, encoded, id)
+	return err
+}
+
+// DeleteVideo marks the video deleted, hiding it everywhere but leaving
+// the record and its files for RestoreVideo or PurgeVideo.
 func (c Client) DeleteVideo(id uuid.UUID) error {
+	query := `
+	UPDATE videos
+	SET deleted_at = ?
+	WHERE id = ? AND deleted_at IS NULL
+	`
+	_, err := c.db.Exec(query, time.Now().UTC(), id)
+	return err
+}
+
+// RestoreVideo undeletes a video deleted after deletedAfter, reporting
+// false if it wasn't deleted or was deleted too long ago.
+func (c Client) RestoreVideo(id uuid.UUID, deletedAfter time.Time) (bool, error) {
+	query := `
+	UPDATE videos
+	SET deleted_at = NULL
+	WHERE id = ? AND deleted_at > ?
+	`
+	result, err := c.db.Exec(query, id, deletedAfter.UTC())
+	if err != nil {
+		return false, err
+	}
+	restored, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return restored == 1, nil
+}
+
+// GetVideosDeletedBefore returns every video deleted before cutoff, oldest
+// deletion first.
+func (c Client) GetVideosDeletedBefore(cutoff time.Time) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE deleted_at IS NOT NULL AND deleted_at <= ?
+	ORDER BY deleted_at
+	`
+
+	rows, err := c.db.Query(query, cutoff.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanVideos(rows)
+}
+
+// PurgeVideo removes the video's record for good.
+func (c Client) PurgeVideo(id uuid.UUID) error {
 	query := `
 	DELETE FROM videos
 	WHERE id = ?
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func newTestClient(t *testing.T) Client {
+	t.Helper()
+
+	c, err := NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { c.db.Close() })
+	return c
+}
+
+func newTestVideo(t *testing.T, c Client) Video {
+	t.Helper()
+
+	user, err := c.CreateUser(CreateUserParams{Email: uuid.NewString() + "@example.com", Password: "not-a-real-hash"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	video, err := c.CreateVideo(CreateVideoParams{Title: "Test video", UserID: user.ID})
+	if err != nil {
+		t.Fatalf("CreateVideo: %v", err)
+	}
+	return video
+}
+
+// backdateDeletion moves a deleted video's deleted_at into the past.
+func backdateDeletion(t *testing.T, c Client, id uuid.UUID, by time.Duration) {
+	t.Helper()
+
+	if _, err := c.db.Exec(`UPDATE videos SET deleted_at = ? WHERE id = ?`, time.Now().UTC().Add(-by), id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteAndRestoreVideo(t *testing.T) {
+	c := newTestClient(t)
+	video := newTestVideo(t, c)
+
+	if err := c.DeleteVideo(video.ID); err != nil {
+		t.Fatalf("DeleteVideo: %v", err)
+	}
+	if got, err := c.GetVideo(video.ID); err != nil || got.ID != uuid.Nil {
+		t.Fatalf("GetVideo after delete = %v, %v, want no video", got.ID, err)
+	}
+	deleted, err := c.GetVideoWithDeleted(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.DeletedAt == nil {
+		t.Fatal("deleted video has no DeletedAt")
+	}
+
+	restored, err := c.RestoreVideo(video.ID, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("RestoreVideo: %v", err)
+	}
+	if !restored {
+		t.Fatal("RestoreVideo = false within the recovery window")
+	}
+	got, err := c.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != video.ID || got.DeletedAt != nil {
+		t.Errorf("GetVideo after restore = %+v, want the undeleted video", got)
+	}
+
+	// Restoring a video that isn't deleted changes nothing
+	if restored, err := c.RestoreVideo(video.ID, time.Now().Add(-time.Hour)); err != nil || restored {
+		t.Errorf("RestoreVideo on a live video = %v, %v, want false", restored, err)
+	}
+}
+
+func TestRestoreVideoAfterWindow(t *testing.T) {
+	c := newTestClient(t)
+	video := newTestVideo(t, c)
+
+	if err := c.DeleteVideo(video.ID); err != nil {
+		t.Fatal(err)
+	}
+	backdateDeletion(t, c, video.ID, 2*time.Hour)
+
+	restored, err := c.RestoreVideo(video.ID, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("RestoreVideo: %v", err)
+	}
+	if restored {
+		t.Fatal("RestoreVideo = true for a video deleted before the window")
+	}
+	if got, err := c.GetVideo(video.ID); err != nil || got.ID != uuid.Nil {
+		t.Errorf("GetVideo = %v, %v, want the video to stay deleted", got.ID, err)
+	}
+}
+
+func TestDeleteAndPurgeVideo(t *testing.T) {
+	c := newTestClient(t)
+	expired := newTestVideo(t, c)
+	recent := newTestVideo(t, c)
+	live := newTestVideo(t, c)
+
+	for _, id := range []uuid.UUID{expired.ID, recent.ID} {
+		if err := c.DeleteVideo(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backdateDeletion(t, c, expired.ID, 2*time.Hour)
+
+	due, err := c.GetVideosDeletedBefore(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("GetVideosDeletedBefore: %v", err)
+	}
+	if len(due) != 1 || due[0].ID != expired.ID {
+		t.Fatalf("GetVideosDeletedBefore = %d videos, want only the one deleted before the window", len(due))
+	}
+
+	if err := c.PurgeVideo(expired.ID); err != nil {
+		t.Fatalf("PurgeVideo: %v", err)
+	}
+	if got, err := c.GetVideoWithDeleted(expired.ID); err != nil || got.ID != uuid.Nil {
+		t.Errorf("GetVideoWithDeleted after purge = %v, %v, want no record", got.ID, err)
+	}
+	if restored, err := c.RestoreVideo(expired.ID, time.Time{}); err != nil || restored {
+		t.Errorf("RestoreVideo after purge = %v, %v, want false", restored, err)
+	}
+
+	for _, id := range []uuid.UUID{recent.ID, live.ID} {
+		if got, err := c.GetVideoWithDeleted(id); err != nil || got.ID != id {
+			t.Errorf("video %s lost by another video's purge: %v", id, err)
+		}
+	}
+}
@@ -3,32 +3,106 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"log/slog"
 	"net/http"
 )
 
+// errorCode is a stable, machine-readable reason for an error response.
+// Clients should branch on it rather than on the message, which may change.
+type errorCode string
+
+const (
+	errCodeInvalidRequest       errorCode = "INVALID_REQUEST"
+	errCodeInvalidID            errorCode = "INVALID_ID"
+	errCodeUnauthorized         errorCode = "UNAUTHORIZED"
+	errCodeForbidden            errorCode = "FORBIDDEN"
+	errCodeNotOwner             errorCode = "NOT_OWNER"
+	errCodeNotFound             errorCode = "NOT_FOUND"
+	errCodeConflict             errorCode = "CONFLICT"
+	errCodeVideoBusy            errorCode = "VIDEO_BUSY"
+	errCodeIdempotencyKeyReused errorCode = "IDEMPOTENCY_KEY_REUSED"
+	errCodeUnsupportedMediaType errorCode = "UNSUPPORTED_MEDIA_TYPE"
+	errCodeInvalidVideo         errorCode = "INVALID_VIDEO"
+	errCodeNoVideoStream        errorCode = "NO_VIDEO_STREAM"
+	errCodeMediaTimeout         errorCode = "MEDIA_TIMEOUT"
+	errCodeVideoTooLong         errorCode = "VIDEO_TOO_LONG"
+	errCodeInvalidStorageClass  errorCode = "INVALID_STORAGE_CLASS"
+	errCodeInvalidQualityPreset errorCode = "INVALID_QUALITY_PRESET"
+	errCodeFileTooLarge         errorCode = "FILE_TOO_LARGE"
+	errCodeImageTooLarge        errorCode = "IMAGE_TOO_LARGE"
+	errCodeQuotaExceeded        errorCode = "QUOTA_EXCEEDED"
+	errCodeUploadTimeout        errorCode = "UPLOAD_TIMEOUT"
+	errCodeUploadInterrupted    errorCode = "UPLOAD_INTERRUPTED"
+	errCodeServerBusy           errorCode = "SERVER_BUSY"
+	errCodeBlockedURL           errorCode = "BLOCKED_URL"
+	errCodeBlockedContent       errorCode = "BLOCKED_CONTENT"
+	errCodeImportFailed         errorCode = "IMPORT_FAILED"
+	errCodeChecksumMismatch     errorCode = "CHECKSUM_MISMATCH"
+	errCodeRecoveryExpired      errorCode = "RECOVERY_WINDOW_EXPIRED"
+	errCodeInternal             errorCode = "INTERNAL_ERROR"
+)
+
+// errorResponse is the body of every error response. Error is the human
+// readable message; Code is one of the errCode constants above.
+type errorResponse struct {
+	Error     string    `json:"error"`
+	Code      errorCode `json:"code"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// respondWithError responds with the generic error code for the status.
+// Use respondWithErrorCode when a more specific code applies.
 func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
+	respondWithErrorCode(w, code, defaultErrorCode(code), msg, err)
+}
+
+// respondWithErrorCode includes the request ID set by
+// requestLoggingMiddleware so users can quote it in bug reports.
+func respondWithErrorCode(w http.ResponseWriter, status int, code errorCode, msg string, err error) {
+	requestID := w.Header().Get(requestIDHeader)
 	if err != nil {
-		log.Println(err)
+		slog.Error(msg, slog.String("request_id", requestID), slog.Int("status", status), slog.String("code", string(code)), slog.Any("error", err))
+	} else if status > 499 {
+		slog.Error(msg, slog.String("request_id", requestID), slog.Int("status", status), slog.String("code", string(code)))
 	}
-	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
+	respondWithJSON(w, status, errorResponse{
+		Error:     msg,
+		Code:      code,
+		RequestID: requestID,
+	})
+}
+
+func defaultErrorCode(status int) errorCode {
+	switch status {
+	case http.StatusUnauthorized:
+		return errCodeUnauthorized
+	case http.StatusForbidden:
+		return errCodeForbidden
+	case http.StatusNotFound:
+		return errCodeNotFound
+	case http.StatusConflict:
+		return errCodeConflict
+	case http.StatusRequestTimeout:
+		return errCodeUploadTimeout
+	case http.StatusRequestEntityTooLarge:
+		return errCodeFileTooLarge
+	case http.StatusServiceUnavailable:
+		return errCodeServerBusy
 	}
-	type errorResponse struct {
-		Error string `json:"error"`
+	if status > 499 {
+		return errCodeInternal
 	}
-	respondWithJSON(w, code, errorResponse{
-		Error: msg,
-	})
+	return errCodeInvalidRequest
 }
 
+// respondWithJSON encodes payload straight onto the response rather than
+// into an intermediate slice. The status has been sent by the time an
+// encoding error shows up, so those are only logged.
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
-	dat, err := json.Marshal(payload)
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(payload)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
-		w.WriteHeader(500)
-		return
+		log.Printf("Error encoding JSON response: %s", err)
 	}
-	w.WriteHeader(code)
-	w.Write(dat)
 }
@@ -0,0 +1,89 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+// defaultLocalStackEndpoint is where LocalStack listens when started with
+// its defaults.
+const defaultLocalStackEndpoint = "http://localhost:4566"
+
+// useLocalStack points cfg at a fresh bucket in the LocalStack at
+// S3_ENDPOINT, or defaultLocalStackEndpoint, through the same client
+// options main sets for S3_ENDPOINT and S3_USE_PATH_STYLE.
+func useLocalStack(t *testing.T, cfg *apiConfig) {
+	t.Helper()
+
+	endpoint := os.Getenv("S3_ENDPOINT")
+	if endpoint == "" {
+		endpoint = defaultLocalStackEndpoint
+	}
+	client := s3.New(s3.Options{
+		Region:       testRegion,
+		BaseEndpoint: aws.String(endpoint),
+		UsePathStyle: true,
+		// LocalStack accepts any credentials
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+	})
+
+	bucket := "tubely-it-" + uuid.NewString()
+	_, err := client.CreateBucket(context.Background(), &s3.CreateBucketInput{Bucket: &bucket})
+	if err != nil {
+		t.Fatalf("Couldn't create bucket at %s, is LocalStack running? %v", endpoint, err)
+	}
+	t.Cleanup(func() {
+		cfg.deleteObjectsWithPrefix(context.Background(), bucket, "")
+		client.DeleteBucket(context.Background(), &s3.DeleteBucketInput{Bucket: &bucket})
+	})
+
+	cfg.s3Client = client
+	cfg.s3Presigner = s3.NewPresignClient(client)
+	cfg.s3Bucket = bucket
+	cfg.s3Endpoint = endpoint
+	cfg.s3UsePathStyle = true
+}
+
+func TestLocalStackUploadAndDownload(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	useLocalStack(t, cfg)
+	useFakeFFprobe(t, cfg, probeJSON(1920, 1080, "10.0"))
+	useFakeFFmpeg(t, cfg)
+	runTestWorkers(t, cfg)
+	user := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, user.ID)
+
+	stored := uploadTestVideo(t, cfg, video.ID, testToken(t, cfg, user.ID), testMP4)
+
+	signed, err := cfg.dbVideoToSignedVideo(context.Background(), stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(aws.ToString(signed.VideoURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET presigned URL: status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, testMP4) {
+		t.Errorf("downloaded %d bytes, want the %d uploaded", len(body), len(testMP4))
+	}
+}
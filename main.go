@@ -2,34 +2,113 @@ package main
 
 import (
 	"context"
+	"image"
 	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/cloudfront/sign"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 )
 
 type apiConfig struct {
-	db               database.Client
-	s3Client         *s3.Client
-	jwtSecret        string
-	platform         string
-	filepathRoot     string
-	assetsRoot       string
-	s3Bucket         string
-	s3Region         string
-	s3CfDistribution string
-	port             string
+	db                database.Client
+	s3Client          S3API
+	s3Presigner       S3PresignAPI
+	jwtTokens         auth.TokenConfig
+	jwtExpiry         time.Duration
+	jwtRefreshExpiry  time.Duration
+	platform          string
+	filepathRoot      string
+	assetsRoot        string
+	s3Bucket          string
+	s3Region          string
+	s3RegionBuckets   map[string]regionBucket
+	s3Endpoint        string
+	s3UsePathStyle    bool
+	keyPrefix         string
+	s3CfDistribution  string
+	cfURLSigner       *sign.URLSigner
+	s3UploadURLExpiry time.Duration
+	s3PresignExpiry   time.Duration
+	s3CacheControl    string
+	s3SSE             types.ServerSideEncryption
+	s3SSEKMSKeyID     *string
+	s3StorageClass    types.StorageClass
+	s3Thumbnails      bool
+	s3VerifyUploads   bool
+	videoResponseType string
+	tempDir           string
+	corsOrigins       map[string]bool
+	webhookURL        string
+	webhookSecret     string
+	presignCache      *presignCache
+	enableRenditions  bool
+	enableHLS         bool
+	hlsSegmentLength  time.Duration
+	videoWorkers      int
+	aspectTolerance   float64
+	maxVideoBytes     int64
+	maxVideoDuration  time.Duration
+	previewDuration   time.Duration
+	previewMaxBytes   int64
+	uploadTimeouts    uploadTimeouts
+	userStorageQuota  int64
+	thumbnailTypes    map[string]string
+	videoTypes        map[string]string
+	thumbnailWebP     bool
+	moderator         videoModerator
+	gzipMinBytes      int
+	ffmpegPath        string
+	ffprobePath       string
+	ffprobeTimeout    time.Duration
+	ffprobeURLTimeout time.Duration
+	ffmpegTimeout     time.Duration
+	mediaRetry        bool
+	maxThumbnailBytes int64
+	maxThumbnailSize  image.Point
+	s3MaxAttempts     int
+	s3PartSize        int64
+	s3PartConcurrency int
+	videoJobs         *videoJobQueue
+	uploadProgress    *uploadProgressTracker
+	orphanGrace       time.Duration
+	videoLocks        *videoLocks
+	videoLockWait     time.Duration
+	assetsBaseURL     string
+	uploadSlots       chan struct{}
+	uploadSlotWait    time.Duration
+	recoveryWindow    time.Duration
+	purgeInterval     time.Duration
+	uploadSniffBytes  int64
+	normalizeAudio    bool
+	qualityPreset     string
+	metadataHTML      string
+	bulkMaxEntries    int
+	bulkMaxBytes      int64
 }
 
 func main() {
 	godotenv.Load(".env")
 
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)))
+
 	pathToDB := os.Getenv("DB_PATH")
 	if pathToDB == "" {
 		log.Fatal("DB_URL must be set")
@@ -40,11 +119,44 @@ func main() {
 		log.Fatalf("Couldn't connect to database: %v", err)
 	}
 
+	// Hashes from the environment join any blocked through the admin
+	// endpoint; removing one here doesn't unblock it
+	blockedHashes, err := parseBlockedHashes(os.Getenv("BLOCKED_CONTENT_HASHES"))
+	if err != nil {
+		log.Fatalf("Invalid BLOCKED_CONTENT_HASHES: %v", err)
+	}
+	for _, hash := range blockedHashes {
+		err = db.BlockHash(hash, "BLOCKED_CONTENT_HASHES")
+		if err != nil {
+			log.Fatalf("Couldn't block content hash %s: %v", hash, err)
+		}
+	}
+
 	jwtSecret := os.Getenv("JWT_SECRET")
 	if jwtSecret == "" {
 		log.Fatal("JWT_SECRET environment variable is not set")
 	}
 
+	// Give each environment its own issuer or audience so tokens minted
+	// by one aren't accepted by another that shares the secret
+	jwtIssuer := os.Getenv("JWT_ISSUER")
+	if jwtIssuer == "" {
+		jwtIssuer = string(auth.TokenTypeAccess)
+	}
+	jwtAudience := os.Getenv("JWT_AUDIENCE")
+	if jwtAudience == "" {
+		jwtAudience = auth.DefaultAudience
+	}
+	jwtTokens := auth.TokenConfig{
+		Secret:   jwtSecret,
+		Issuer:   jwtIssuer,
+		Audience: jwtAudience,
+	}
+	jwtExpiry := getEnvDuration("JWT_EXPIRY", 30*24*time.Hour)
+	// Tokens from a refresh stay short-lived, since the refresh token can
+	// always get another
+	jwtRefreshExpiry := getEnvDuration("JWT_REFRESH_ACCESS_EXPIRY", time.Hour)
+
 	platform := os.Getenv("PLATFORM")
 	if platform == "" {
 		log.Fatal("PLATFORM environment variable is not set")
@@ -70,16 +182,264 @@ func main() {
 		log.Fatal("S3_REGION environment variable is not set")
 	}
 
+	// Optional: store videos in a bucket near each uploader, chosen from
+	// the user's region or a ?region= hint. Other regions use S3_BUCKET.
+	regionBucketNames, err := parseRegionBuckets(os.Getenv("S3_REGION_BUCKETS"))
+	if err != nil {
+		log.Fatalf("Invalid S3_REGION_BUCKETS: %v", err)
+	}
+	if bucket, ok := regionBucketNames[s3Region]; ok && bucket != s3Bucket {
+		log.Fatalf("S3_REGION_BUCKETS gives %s a bucket other than S3_BUCKET", s3Region)
+	}
+	delete(regionBucketNames, s3Region)
+
+	// Optional: talk to an S3-compatible service such as MinIO or LocalStack
+	// instead of AWS. Those usually need path-style addressing too.
+	s3Endpoint := strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/")
+	if s3Endpoint != "" {
+		if u, err := url.Parse(s3Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			log.Fatalf("S3_ENDPOINT must be an absolute URL, got %q", s3Endpoint)
+		}
+	}
+	s3UsePathStyle := getEnvBool("S3_USE_PATH_STYLE", false)
+
+	// Optional: serve videos through a CloudFront distribution instead of
+	// presigned S3 URLs, signing them when a key pair is configured
 	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+
+	var cfURLSigner *sign.URLSigner
+	cfKeyPairID := os.Getenv("S3_CF_KEY_PAIR_ID")
+	cfPrivateKeyPath := os.Getenv("S3_CF_PRIVATE_KEY_PATH")
+	if cfKeyPairID != "" || cfPrivateKeyPath != "" {
+		if s3CfDistribution == "" || cfKeyPairID == "" || cfPrivateKeyPath == "" {
+			log.Fatal("S3_CF_DISTRO, S3_CF_KEY_PAIR_ID and S3_CF_PRIVATE_KEY_PATH must all be set to sign CloudFront URLs")
+		}
+		cfURLSigner, err = newCloudFrontURLSigner(cfKeyPairID, cfPrivateKeyPath)
+		if err != nil {
+			log.Fatalf("Couldn't configure CloudFront signing: %v", err)
+		}
+	}
+
+	s3UploadURLExpiry := getEnvDuration("S3_UPLOAD_URL_EXPIRY", 15*time.Minute)
+
+	s3PresignExpiry := getEnvDuration("S3_PRESIGN_EXPIRY", time.Hour)
+	if s3PresignExpiry > maxPresignExpiry {
+		log.Fatalf("S3_PRESIGN_EXPIRY can't be longer than %s", maxPresignExpiry)
+	}
+
+	// Keys are random and never reused, so stored objects can be cached
+	// forever by default
+	s3CacheControl := os.Getenv("S3_CACHE_CONTROL")
+	if s3CacheControl == "" {
+		s3CacheControl = "public, max-age=31536000, immutable"
+	}
+
+	// Optional: encrypt uploads with SSE-S3 (AES256) or SSE-KMS (aws:kms)
+	// instead of relying on the bucket default
+	s3SSE := types.ServerSideEncryption(os.Getenv("S3_SSE"))
+	switch s3SSE {
+	case "", types.ServerSideEncryptionAes256, types.ServerSideEncryptionAwsKms, types.ServerSideEncryptionAwsKmsDsse:
+	default:
+		log.Fatalf("S3_SSE must be one of %s, %s or %s", types.ServerSideEncryptionAes256, types.ServerSideEncryptionAwsKms, types.ServerSideEncryptionAwsKmsDsse)
+	}
+
+	s3StorageClass := types.StorageClassStandard
+	if value := os.Getenv("S3_STORAGE_CLASS"); value != "" {
+		s3StorageClass = types.StorageClass(value)
+		if !allowedStorageClasses[s3StorageClass] {
+			log.Fatal("S3_STORAGE_CLASS must be one of STANDARD, STANDARD_IA, GLACIER or INTELLIGENT_TIERING")
+		}
+	}
+
+	qualityPreset := os.Getenv("QUALITY_PRESET")
+	if _, ok := qualityPresets[qualityPreset]; qualityPreset != "" && !ok {
+		log.Fatal("QUALITY_PRESET must be one of low, medium or high")
 	}
 
+	var s3SSEKMSKeyID *string
+	if keyID := os.Getenv("S3_SSE_KMS_KEY_ID"); keyID != "" {
+		if s3SSE != types.ServerSideEncryptionAwsKms && s3SSE != types.ServerSideEncryptionAwsKmsDsse {
+			log.Fatal("S3_SSE_KMS_KEY_ID requires S3_SSE to be a KMS option")
+		}
+		s3SSEKMSKeyID = &keyID
+	}
+
+	presignCacheRefreshWindow := getEnvDuration("S3_PRESIGN_CACHE_REFRESH_WINDOW", 5*time.Minute)
+
+	s3Thumbnails := getEnvBool("S3_THUMBNAILS", false)
+	s3VerifyUploads := getEnvBool("S3_VERIFY_UPLOADS", false)
+
+	// Every stored video is an MP4, but objects uploaded before ContentType
+	// was set would otherwise download instead of playing inline
+	videoResponseType := ""
+	if getEnvBool("S3_FORCE_VIDEO_CONTENT_TYPE", true) {
+		videoResponseType = "video/mp4"
+	}
+
+	enableRenditions := getEnvBool("VIDEO_RENDITIONS", false)
+
+	videoWorkers := getEnvInt("VIDEO_WORKERS", 2)
+	if videoWorkers < 1 {
+		log.Fatal("VIDEO_WORKERS must be at least 1")
+	}
+
+	aspectTolerance := getEnvFloat("VIDEO_ASPECT_TOLERANCE", defaultAspectRatioTolerance)
+	if aspectTolerance <= 0 {
+		log.Fatal("VIDEO_ASPECT_TOLERANCE must be positive")
+	}
+
+	maxVideoBytes := int64(getEnvInt("MAX_VIDEO_BYTES", defaultMaxVideoBytes))
+	if maxVideoBytes < 1 {
+		log.Fatal("MAX_VIDEO_BYTES must be positive")
+	}
+	// A nil channel means uploads aren't limited
+	var uploadSlots chan struct{}
+	maxConcurrentUploads := getEnvInt("MAX_CONCURRENT_UPLOADS", defaultMaxConcurrentUploads)
+	if maxConcurrentUploads < 0 {
+		log.Fatal("MAX_CONCURRENT_UPLOADS can't be negative")
+	}
+	if maxConcurrentUploads > 0 {
+		uploadSlots = make(chan struct{}, maxConcurrentUploads)
+	}
+	// 0 means unlimited
+	maxVideoDuration := getEnvDurationAllowZero("MAX_VIDEO_DURATION", 0)
+	previewDuration := getEnvDuration("PREVIEW_DURATION", defaultPreviewDuration)
+	if previewDuration <= 0 {
+		log.Fatal("PREVIEW_DURATION must be positive")
+	}
+	previewMaxBytes := int64(getEnvInt("PREVIEW_MAX_BYTES", defaultPreviewMaxBytes))
+	if previewMaxBytes < 1 {
+		log.Fatal("PREVIEW_MAX_BYTES must be positive")
+	}
+	maxThumbnailBytes := int64(getEnvInt("MAX_THUMBNAIL_BYTES", defaultMaxThumbnailBytes))
+	if maxThumbnailBytes < 1 {
+		log.Fatal("MAX_THUMBNAIL_BYTES must be positive")
+	}
+	maxThumbnailSize := image.Pt(
+		getEnvInt("MAX_THUMBNAIL_WIDTH", defaultMaxThumbnailWidth),
+		getEnvInt("MAX_THUMBNAIL_HEIGHT", defaultMaxThumbnailHeight),
+	)
+	if maxThumbnailSize.X < 1 || maxThumbnailSize.Y < 1 {
+		log.Fatal("MAX_THUMBNAIL_WIDTH and MAX_THUMBNAIL_HEIGHT must be positive")
+	}
+
+	uploadSniffBytes := int64(getEnvInt("UPLOAD_SNIFF_BYTES", defaultUploadSniffBytes))
+	if uploadSniffBytes < minUploadSniffBytes {
+		log.Fatalf("UPLOAD_SNIFF_BYTES must be at least %d", minUploadSniffBytes)
+	}
+
+	bulkMaxEntries := getEnvInt("BULK_UPLOAD_MAX_ENTRIES", defaultBulkUploadMaxEntries)
+	if bulkMaxEntries < 1 {
+		log.Fatal("BULK_UPLOAD_MAX_ENTRIES must be positive")
+	}
+	bulkMaxBytes := int64(getEnvInt("BULK_UPLOAD_MAX_BYTES", defaultBulkUploadMaxBytes))
+	if bulkMaxBytes < 1 {
+		log.Fatal("BULK_UPLOAD_MAX_BYTES must be positive")
+	}
+
+	// 0 means unlimited
+	userStorageQuota := int64(getEnvInt("USER_STORAGE_QUOTA_BYTES", 0))
+	if userStorageQuota < 0 {
+		log.Fatal("USER_STORAGE_QUOTA_BYTES can't be negative")
+	}
+
+	thumbnailFormats := os.Getenv("THUMBNAIL_FORMATS")
+	if thumbnailFormats == "" {
+		thumbnailFormats = defaultThumbnailFormats
+	}
+	thumbnailTypes, err := parseThumbnailFormats(thumbnailFormats)
+	if err != nil {
+		log.Fatalf("Invalid THUMBNAIL_FORMATS: %v", err)
+	}
+	metadataHTML := os.Getenv("METADATA_HTML")
+	if metadataHTML == "" {
+		metadataHTML = htmlModeStrip
+	}
+	metadataHTML, err = parseHTMLMode(metadataHTML)
+	if err != nil {
+		log.Fatalf("Invalid METADATA_HTML: %v", err)
+	}
+	videoTypesValue := os.Getenv("VIDEO_TYPES")
+	if videoTypesValue == "" {
+		videoTypesValue = defaultVideoTypes
+	}
+	videoTypes, err := parseVideoTypes(videoTypesValue)
+	if err != nil {
+		log.Fatalf("Invalid VIDEO_TYPES: %v", err)
+	}
+
+	ffmpegPath, ffmpegVersion, err := resolveMediaTool("FFMPEG_PATH", "ffmpeg")
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Using ffmpeg", "path", ffmpegPath, "version", ffmpegVersion)
+	ffprobePath, ffprobeVersion, err := resolveMediaTool("FFPROBE_PATH", "ffprobe")
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.Info("Using ffprobe", "path", ffprobePath, "version", ffprobeVersion)
+
+	// ffmpeg and ffprobe are killed if they run longer than this, e.g. on a
+	// malformed file; 0 means no limit
+	ffprobeTimeout := getEnvDurationAllowZero("FFPROBE_TIMEOUT", defaultFFprobeTimeout)
+	ffmpegTimeout := getEnvDurationAllowZero("FFMPEG_TIMEOUT", defaultFFmpegTimeout)
+	ffprobeURLTimeout := getEnvDuration("FFPROBE_URL_TIMEOUT", defaultFFprobeURLTimeout)
+
+	gzipMinBytes := getEnvInt("GZIP_MIN_BYTES", defaultGzipMinBytes)
+	if gzipMinBytes < 0 {
+		log.Fatal("GZIP_MIN_BYTES can't be negative")
+	}
+
+	uploadTimeouts := uploadTimeouts{
+		base:  getEnvDuration("UPLOAD_TIMEOUT_BASE", defaultUploadTimeoutBase),
+		perMB: getEnvDuration("UPLOAD_TIMEOUT_PER_MB", defaultUploadTimeoutPerMB),
+		max:   getEnvDuration("UPLOAD_TIMEOUT_MAX", defaultUploadTimeoutMax),
+	}
+	if uploadTimeouts.base <= 0 || uploadTimeouts.perMB < 0 || uploadTimeouts.max < uploadTimeouts.base {
+		log.Fatal("UPLOAD_TIMEOUT_BASE must be positive, UPLOAD_TIMEOUT_PER_MB non-negative and UPLOAD_TIMEOUT_MAX at least the base")
+	}
+
+	s3MaxAttempts := getEnvInt("S3_MAX_ATTEMPTS", defaultS3MaxAttempts)
+	if s3MaxAttempts < 1 {
+		log.Fatal("S3_MAX_ATTEMPTS must be at least 1")
+	}
+	s3PartSize := int64(getEnvInt("S3_UPLOAD_PART_SIZE", defaultS3UploadPartSize))
+	if s3PartSize < manager.MinUploadPartSize {
+		log.Fatalf("S3_UPLOAD_PART_SIZE must be at least %d bytes", manager.MinUploadPartSize)
+	}
+	s3PartConcurrency := getEnvInt("S3_UPLOAD_CONCURRENCY", defaultS3UploadConcurrency)
+	if s3PartConcurrency < 1 {
+		log.Fatal("S3_UPLOAD_CONCURRENCY must be at least 1")
+	}
+
+	tempDir := os.Getenv("TEMP_DIR")
+	if tempDir == "" {
+		tempDir = os.TempDir()
+	}
+
+	webhookURL := os.Getenv("WEBHOOK_URL")
+	webhookSecret := os.Getenv("WEBHOOK_SECRET")
+	if webhookURL != "" && webhookSecret == "" {
+		log.Fatal("WEBHOOK_SECRET must be set when WEBHOOK_URL is")
+	}
+
+	shutdownTimeout := getEnvDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout)
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		log.Fatal("PORT environment variable is not set")
 	}
 
+	// Local asset URLs are built on this, so it must be where clients can
+	// reach the server, not just where it listens
+	assetsBaseURL := strings.TrimRight(os.Getenv("ASSETS_BASE_URL"), "/")
+	if assetsBaseURL == "" {
+		assetsBaseURL = "http://localhost:" + port
+	}
+	if u, err := url.Parse(assetsBaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		log.Fatalf("ASSETS_BASE_URL must be an absolute URL, got %q", assetsBaseURL)
+	}
+
 	// Configure AWS SDK and create S3 client
 	awsCfg, err := config.LoadDefaultConfig(
 		context.Background(),
@@ -89,19 +449,103 @@ func main() {
 		log.Fatalf("Unable to load AWS SDK config: %v", err)
 	}
 
-	s3Client := s3.NewFromConfig(awsCfg)
+	newS3Client := func(region string) *s3.Client {
+		return s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+			o.Region = region
+			if s3Endpoint != "" {
+				o.BaseEndpoint = aws.String(s3Endpoint)
+			}
+			o.UsePathStyle = s3UsePathStyle
+		})
+	}
+	s3Client := newS3Client(s3Region)
+
+	s3RegionBuckets := map[string]regionBucket{}
+	for region, name := range regionBucketNames {
+		client := newS3Client(region)
+		s3RegionBuckets[region] = regionBucket{
+			region:    region,
+			name:      name,
+			client:    client,
+			presigner: s3.NewPresignClient(client),
+		}
+	}
 
 	cfg := apiConfig{
-		db:               db,
-		s3Client:         s3Client,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
+		db:                db,
+		s3Client:          s3Client,
+		s3Presigner:       s3.NewPresignClient(s3Client),
+		jwtTokens:         jwtTokens,
+		jwtExpiry:         jwtExpiry,
+		jwtRefreshExpiry:  jwtRefreshExpiry,
+		platform:          platform,
+		filepathRoot:      filepathRoot,
+		assetsRoot:        assetsRoot,
+		s3Bucket:          s3Bucket,
+		s3Region:          s3Region,
+		s3RegionBuckets:   s3RegionBuckets,
+		s3Endpoint:        s3Endpoint,
+		s3UsePathStyle:    s3UsePathStyle,
+		keyPrefix:         normalizeKeyPrefix(os.Getenv("S3_KEY_PREFIX")),
+		s3CfDistribution:  s3CfDistribution,
+		cfURLSigner:       cfURLSigner,
+		presignCache:      newPresignCache(presignCacheRefreshWindow),
+		enableRenditions:  enableRenditions,
+		enableHLS:         getEnvBool("VIDEO_HLS", false),
+		hlsSegmentLength:  getEnvDuration("HLS_SEGMENT_DURATION", defaultHLSSegmentDuration),
+		videoWorkers:      videoWorkers,
+		aspectTolerance:   aspectTolerance,
+		maxVideoBytes:     maxVideoBytes,
+		maxVideoDuration:  maxVideoDuration,
+		previewDuration:   previewDuration,
+		previewMaxBytes:   previewMaxBytes,
+		uploadTimeouts:    uploadTimeouts,
+		userStorageQuota:  userStorageQuota,
+		thumbnailTypes:    thumbnailTypes,
+		videoTypes:        videoTypes,
+		moderator:         autoApproveModerator{},
+		gzipMinBytes:      gzipMinBytes,
+		ffmpegPath:        ffmpegPath,
+		ffprobePath:       ffprobePath,
+		ffprobeTimeout:    ffprobeTimeout,
+		ffprobeURLTimeout: ffprobeURLTimeout,
+		ffmpegTimeout:     ffmpegTimeout,
+		mediaRetry:        getEnvBool("MEDIA_COMMAND_RETRY", false),
+		maxThumbnailBytes: maxThumbnailBytes,
+		maxThumbnailSize:  maxThumbnailSize,
+		s3MaxAttempts:     s3MaxAttempts,
+		s3PartSize:        s3PartSize,
+		s3PartConcurrency: s3PartConcurrency,
+		videoJobs:         newVideoJobQueue(),
+		uploadProgress:    newUploadProgressTracker(),
+		orphanGrace:       getEnvDuration("ORPHAN_GRACE_PERIOD", defaultOrphanGracePeriod),
+		videoLocks:        newVideoLocks(),
+		videoLockWait:     getEnvDurationAllowZero("VIDEO_LOCK_WAIT", 0),
+		s3UploadURLExpiry: s3UploadURLExpiry,
+		s3PresignExpiry:   s3PresignExpiry,
+		s3CacheControl:    s3CacheControl,
+		s3SSE:             s3SSE,
+		s3StorageClass:    s3StorageClass,
+		s3Thumbnails:      s3Thumbnails,
+		thumbnailWebP:     getEnvBool("THUMBNAIL_WEBP", false),
+		s3VerifyUploads:   s3VerifyUploads,
+		videoResponseType: videoResponseType,
+		tempDir:           tempDir,
+		corsOrigins:       parseCORSOrigins(os.Getenv("CORS_ALLOWED_ORIGINS")),
+		webhookURL:        webhookURL,
+		webhookSecret:     webhookSecret,
+		s3SSEKMSKeyID:     s3SSEKMSKeyID,
+		assetsBaseURL:     assetsBaseURL,
+		uploadSlots:       uploadSlots,
+		uploadSlotWait:    getEnvDuration("UPLOAD_SLOT_WAIT", defaultUploadSlotWait),
+		recoveryWindow:    getEnvDuration("VIDEO_RECOVERY_WINDOW", defaultVideoRecoveryWindow),
+		purgeInterval:     getEnvDuration("VIDEO_PURGE_INTERVAL", defaultVideoPurgeInterval),
+		uploadSniffBytes:  uploadSniffBytes,
+		normalizeAudio:    getEnvBool("NORMALIZE_AUDIO", false),
+		qualityPreset:     qualityPreset,
+		metadataHTML:      metadataHTML,
+		bulkMaxEntries:    bulkMaxEntries,
+		bulkMaxBytes:      bulkMaxBytes,
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -109,12 +553,30 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	err = cfg.checkTempDir()
+	if err != nil {
+		log.Fatalf("TEMP_DIR can't be used for uploads: %v", err)
+	}
+
+	// Queued jobs are held in memory, so any left unfinished by a previous
+	// run can never complete
+	abandonedJobs, err := db.FailUnfinishedProcessingJobs("Server restarted before processing finished")
+	if err != nil {
+		log.Fatalf("Couldn't clean up processing jobs: %v", err)
+	}
+	if abandonedJobs > 0 {
+		log.Printf("Marked %d unfinished processing jobs as failed", abandonedJobs)
+	}
+	workerCtx, cancelWorkers := context.WithCancel(context.Background())
+	defer cancelWorkers()
+	workers := cfg.startVideoWorkers(workerCtx)
+	go cfg.runVideoPurger(workerCtx)
+
 	mux := http.NewServeMux()
 	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+	mux.Handle("GET /assets/{name}", noCacheMiddleware(http.HandlerFunc(cfg.handlerServeAsset)))
 
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
@@ -123,19 +585,91 @@ func main() {
 	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
 
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
-	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
-	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", metricsMiddleware("upload_thumbnail", cfg.withAuth(cfg.handlerUploadThumbnail)))
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail", cfg.handlerGenerateThumbnailAtTime)
+	mux.HandleFunc("POST /api/videos/{videoID}/preview", cfg.handlerGenerateVideoPreview)
+	mux.HandleFunc("POST /api/video_upload/{videoID}", metricsMiddleware("upload_video", cfg.withAuth(cfg.withUploadSlot(cfg.withUploadTimeout(cfg.handlerUploadVideo)))))
+	mux.HandleFunc("PUT /api/videos/{videoID}/file", metricsMiddleware("replace_video", cfg.withAuth(cfg.withUploadSlot(cfg.withUploadTimeout(cfg.handlerReplaceVideo)))))
+	mux.HandleFunc("GET /api/upload_progress/{sessionID}", cfg.handlerUploadProgress)
+	mux.HandleFunc("POST /api/video_upload/bulk", metricsMiddleware("bulk_upload_videos", cfg.withAuth(cfg.withUploadSlot(cfg.withUploadTimeout(cfg.handlerBulkUploadVideos)))))
+	mux.HandleFunc("POST /api/video_upload/{videoID}/url", metricsMiddleware("presign_video_upload", cfg.withAuth(cfg.handlerCreateVideoUpload)))
+	mux.HandleFunc("POST /api/video_upload/{videoID}/urls", metricsMiddleware("presign_video_upload_download", cfg.withAuth(cfg.handlerCreateVideoUploadAndDownload)))
+	mux.HandleFunc("POST /api/video_upload/{videoID}/import", metricsMiddleware("import_video", cfg.withAuth(cfg.withUploadSlot(cfg.handlerImportVideoFromURL))))
+	mux.HandleFunc("POST /api/video_upload/{videoID}/confirm", cfg.withAuth(cfg.handlerConfirmVideoUpload))
+	mux.HandleFunc("POST /api/video_upload/{videoID}/multipart", cfg.withAuth(cfg.handlerCreateMultipartUpload))
+	mux.HandleFunc("GET /api/multipart_uploads/{uploadID}", cfg.withAuth(cfg.handlerGetMultipartUpload))
+	mux.HandleFunc("PUT /api/multipart_uploads/{uploadID}/parts/{partNumber}", metricsMiddleware("upload_multipart_part", cfg.withAuth(cfg.withUploadSlot(cfg.handlerUploadMultipartPart))))
+	mux.HandleFunc("POST /api/multipart_uploads/{uploadID}/complete", cfg.withAuth(cfg.handlerCompleteMultipartUpload))
+	mux.HandleFunc("DELETE /api/multipart_uploads/{uploadID}", cfg.withAuth(cfg.handlerAbortMultipartUpload))
+	mux.HandleFunc("GET /api/jobs/{jobID}", cfg.handlerGetJobStatus)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
-	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
-	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("GET /api/videos/search", cfg.handlerVideosSearch)
+	mux.HandleFunc("GET /api/videos/public", cfg.handlerPublicFeed)
+	mux.HandleFunc("PUT /api/videos/{videoID}/visibility", cfg.handlerUpdateVideoVisibility)
+	mux.HandleFunc("PUT /api/videos/{videoID}/tags", cfg.withAuth(cfg.handlerUpdateVideoTags))
+	mux.HandleFunc("POST /api/videos/signed_urls", cfg.handlerBatchSignURLs)
+	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerGetVideo)
+	mux.HandleFunc("GET /api/videos/{videoID}/download", cfg.handlerVideoDownloadURL)
+	mux.HandleFunc("GET /api/videos/{videoID}/stream", cfg.handlerStreamVideo)
+	mux.HandleFunc("GET /api/videos/{videoID}/hls/{name...}", cfg.handlerGetHLSPlaylist)
+	mux.HandleFunc("GET /api/videos/{videoID}/metadata", cfg.handlerGetVideoMetadata)
+	mux.HandleFunc("PATCH /api/videos/{videoID}", cfg.handlerUpdateVideoMetadata)
+	mux.HandleFunc("POST /api/videos/{videoID}/rotate_key", cfg.handlerRotateVideoKey)
+	mux.HandleFunc("POST /api/videos/{videoID}/reprocess", cfg.handlerReprocessVideo)
+	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerDeleteVideo)
+	mux.HandleFunc("POST /api/videos/{videoID}/restore", cfg.handlerRestoreVideo)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	mux.HandleFunc("DELETE /admin/videos/{videoID}", cfg.handlerAdminDeleteVideo)
+	mux.HandleFunc("POST /admin/cleanup_orphans", cfg.handlerCleanupOrphanedObjects)
+	mux.HandleFunc("POST /admin/blocked_hashes", cfg.handlerBlockContentHash)
+
+	mux.Handle("GET /metrics", promhttp.Handler())
 
+	requests := &requestTracker{}
 	srv := &http.Server{
 		Addr:    ":" + port,
-		Handler: mux,
+		Handler: requests.middleware(cfg.requestLoggingMiddleware(cfg.corsMiddleware(cfg.gzipMiddleware(mux)))),
 	}
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	go func() {
+		log.Printf("Serving on: http://localhost:%s/app/\n", port)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stopCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-stopCtx.Done()
+	stop()
+
+	inFlight := requests.active.Load()
+	log.Printf("Shutting down, draining %d in-flight requests (timeout %s)", inFlight, shutdownTimeout)
+	deadline := time.Now().Add(shutdownTimeout)
+	shutdownCtx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		// Cut the remaining connections so their handlers unwind and
+		// remove their temp files before we exit
+		interrupted := requests.active.Load()
+		log.Printf("Drain timed out, interrupting %d requests", interrupted)
+		srv.Close()
+		requests.wait(forcedShutdownGrace)
+		log.Printf("Drained %d of %d in-flight requests", inFlight-interrupted, inFlight)
+	} else {
+		log.Printf("Drained %d in-flight requests", inFlight)
+	}
+
+	// Let queued uploads finish within what's left of the timeout, then
+	// cancel the rest; their jobs are marked failed and temp files removed
+	cfg.videoJobs.close()
+	if !waitTimeout(workers, time.Until(deadline)) {
+		log.Print("Video processing didn't finish in time, cancelling remaining jobs")
+		cancelWorkers()
+		workers.Wait()
+	}
+	log.Print("Shutdown complete")
 }
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	testBucket = "tubely-test"
+	testRegion = "us-east-1"
+)
+
+// newTestConfig returns a config with every default main would apply, a
+// fresh SQLite database and an in-memory S3. ffmpeg and ffprobe aren't
+// set; tests that need them point them at writeTestScript scripts.
+func newTestConfig(t *testing.T) (*apiConfig, *fakeS3) {
+	t.Helper()
+
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatalf("Couldn't create database: %v", err)
+	}
+	thumbnailTypes, err := parseThumbnailFormats(defaultThumbnailFormats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	videoTypes, err := parseVideoTypes(defaultVideoTypes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeS3()
+	cfg := &apiConfig{
+		db:          db,
+		s3Client:    fake,
+		s3Presigner: newCountingPresigner(testRegion),
+		jwtTokens: auth.TokenConfig{
+			Secret:   "test-secret",
+			Issuer:   string(auth.TokenTypeAccess),
+			Audience: auth.DefaultAudience,
+		},
+		jwtExpiry:         time.Hour,
+		jwtRefreshExpiry:  time.Hour,
+		platform:          "dev",
+		filepathRoot:      t.TempDir(),
+		assetsRoot:        t.TempDir(),
+		s3Bucket:          testBucket,
+		s3Region:          testRegion,
+		s3RegionBuckets:   map[string]regionBucket{},
+		presignCache:      newPresignCache(5 * time.Minute),
+		hlsSegmentLength:  defaultHLSSegmentDuration,
+		videoWorkers:      1,
+		aspectTolerance:   defaultAspectRatioTolerance,
+		maxVideoBytes:     defaultMaxVideoBytes,
+		previewDuration:   defaultPreviewDuration,
+		previewMaxBytes:   defaultPreviewMaxBytes,
+		uploadTimeouts:    uploadTimeouts{base: defaultUploadTimeoutBase, perMB: defaultUploadTimeoutPerMB, max: defaultUploadTimeoutMax},
+		thumbnailTypes:    thumbnailTypes,
+		videoTypes:        videoTypes,
+		moderator:         autoApproveModerator{},
+		gzipMinBytes:      defaultGzipMinBytes,
+		ffprobeTimeout:    defaultFFprobeTimeout,
+		ffprobeURLTimeout: defaultFFprobeURLTimeout,
+		ffmpegTimeout:     defaultFFmpegTimeout,
+		maxThumbnailBytes: defaultMaxThumbnailBytes,
+		maxThumbnailSize:  image.Pt(defaultMaxThumbnailWidth, defaultMaxThumbnailHeight),
+		s3MaxAttempts:     defaultS3MaxAttempts,
+		s3PartSize:        manager.MinUploadPartSize,
+		s3PartConcurrency: defaultS3UploadConcurrency,
+		videoJobs:         newVideoJobQueue(),
+		uploadProgress:    newUploadProgressTracker(),
+		orphanGrace:       defaultOrphanGracePeriod,
+		videoLocks:        newVideoLocks(),
+		s3UploadURLExpiry: 15 * time.Minute,
+		s3PresignExpiry:   time.Hour,
+		s3CacheControl:    "public, max-age=31536000, immutable",
+		s3StorageClass:    types.StorageClassStandard,
+		videoResponseType: "video/mp4",
+		tempDir:           t.TempDir(),
+		corsOrigins:       map[string]bool{},
+		assetsBaseURL:     "http://localhost:8091",
+		uploadSlotWait:    defaultUploadSlotWait,
+		recoveryWindow:    defaultVideoRecoveryWindow,
+		purgeInterval:     defaultVideoPurgeInterval,
+		uploadSniffBytes:  defaultUploadSniffBytes,
+		metadataHTML:      htmlModeStrip,
+		bulkMaxEntries:    defaultBulkUploadMaxEntries,
+		bulkMaxBytes:      defaultBulkUploadMaxBytes,
+	}
+	return cfg, fake
+}
+
+func createTestUser(t *testing.T, cfg *apiConfig) database.User {
+	t.Helper()
+
+	user, err := cfg.db.CreateUser(database.CreateUserParams{
+		Email:    uuid.NewString() + "@example.com",
+		Password: "not-a-real-hash",
+	})
+	if err != nil {
+		t.Fatalf("Couldn't create user: %v", err)
+	}
+	return *user
+}
+
+func testToken(t *testing.T, cfg *apiConfig, userID uuid.UUID, scopes ...string) string {
+	t.Helper()
+
+	token, err := auth.MakeJWT(userID, cfg.jwtTokens, time.Hour, scopes...)
+	if err != nil {
+		t.Fatalf("Couldn't make JWT: %v", err)
+	}
+	return token
+}
+
+func createTestVideo(t *testing.T, cfg *apiConfig, userID uuid.UUID) database.Video {
+	t.Helper()
+
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{
+		Title:       "Test video",
+		Description: "A video made by a test",
+		UserID:      userID,
+	})
+	if err != nil {
+		t.Fatalf("Couldn't create video: %v", err)
+	}
+	return video
+}
+
+// testVideoKey returns a random key shaped like the ones uploads get.
+func testVideoKey(t *testing.T, prefix string) string {
+	t.Helper()
+
+	name := make([]byte, 32)
+	if _, err := rand.Read(name); err != nil {
+		t.Fatal(err)
+	}
+	return prefix + hex.EncodeToString(name) + ".mp4"
+}
+
+// storeTestVideo gives video an approved file in the fake bucket.
+func storeTestVideo(t *testing.T, cfg *apiConfig, fake *fakeS3, video database.Video, body []byte) database.Video {
+	t.Helper()
+
+	key := testVideoKey(t, "landscape/")
+	fake.putObject(testBucket, key, body)
+	videoURL := fmt.Sprintf("%s,%s", testBucket, key)
+	video.VideoURL = &videoURL
+	video.SizeBytes = int64(len(body))
+	video.StorageClass = string(types.StorageClassStandard)
+	video.ModerationStatus = database.ModerationStatusApproved
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatalf("Couldn't update video: %v", err)
+	}
+	if err := cfg.db.UpdateVideoStatus(video.ID, database.VideoStatusReady); err != nil {
+		t.Fatalf("Couldn't update video status: %v", err)
+	}
+	return getTestVideo(t, cfg, video.ID)
+}
+
+func getTestVideo(t *testing.T, cfg *apiConfig, videoID uuid.UUID) database.Video {
+	t.Helper()
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		t.Fatalf("Couldn't get video: %v", err)
+	}
+	return video
+}
+
+func setTestVisibility(t *testing.T, cfg *apiConfig, videoID uuid.UUID, visibility string) {
+	t.Helper()
+
+	video := getTestVideo(t, cfg, videoID)
+	video.Visibility = visibility
+	if err := cfg.db.UpdateVideo(video); err != nil {
+		t.Fatalf("Couldn't update video: %v", err)
+	}
+}
+
+// newTestRequest builds a request with the path values the mux would have
+// set, given as name, value pairs, and a bearer token unless token is
+// empty.
+func newTestRequest(method, target string, body io.Reader, token string, pathValues ...string) *http.Request {
+	req := httptest.NewRequest(method, target, body)
+	for i := 0; i+1 < len(pathValues); i += 2 {
+		req.SetPathValue(pathValues[i], pathValues[i+1])
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req
+}
+
+// serveAuthed runs handler behind withAuth, as the mux does for protected
+// routes.
+func serveAuthed(cfg *apiConfig, handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	cfg.withAuth(handler)(rec, req)
+	return rec
+}
+
+func serve(handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func jsonBody(t *testing.T, v any) io.Reader {
+	t.Helper()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.NewReader(string(data))
+}
+
+func decodeResponse[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("Couldn't decode response %q: %v", rec.Body.String(), err)
+	}
+	return v
+}
+
+// expectErrorCode checks the response failed with status and code.
+func expectErrorCode(t *testing.T, rec *httptest.ResponseRecorder, status int, code errorCode) {
+	t.Helper()
+
+	expectStatus(t, rec, status)
+	if got := decodeResponse[errorResponse](t, rec).Code; got != code {
+		t.Fatalf("error code = %s, want %s", got, code)
+	}
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, want int) {
+	t.Helper()
+
+	if rec.Code != want {
+		t.Fatalf("status = %d, want %d; body: %s", rec.Code, want, rec.Body.String())
+	}
+}
+
+// writeTestScript writes an executable shell script standing in for a
+// media tool and returns its path.
+func writeTestScript(t *testing.T, name, script string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// waitFor polls until cond holds, for work handlers leave running in the
+// background.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testMP4 is just enough of an MP4 for content sniffing: an ftyp box.
+var testMP4 = append([]byte("\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00mp42isom"), make([]byte, 64)...)
+
+// probeJSON is what ffprobe prints for a file with one video stream.
+func probeJSON(width, height int, duration string) string {
+	return fmt.Sprintf(`{
+	"streams": [
+		{"codec_type": "video", "codec_name": "h264", "width": %d, "height": %d, "avg_frame_rate": "30/1"},
+		{"codec_type": "audio", "codec_name": "aac"}
+	],
+	"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": %q, "bit_rate": "1000000"}
+}`, width, height, duration)
+}
+
+// useFakeFFprobe points cfg at a script that prints output whatever it's
+// asked to probe.
+func useFakeFFprobe(t *testing.T, cfg *apiConfig, output string) {
+	t.Helper()
+
+	cfg.ffprobePath = writeTestScript(t, "ffprobe", "cat <<'EOF'\n"+output+"\nEOF\n")
+}
+
+// useFakeFFmpeg points cfg at a script that copies its input to the
+// processed output path unchanged, and fails anything else, such as
+// thumbnail extraction.
+func useFakeFFmpeg(t *testing.T, cfg *apiConfig) {
+	t.Helper()
+
+	cfg.ffmpegPath = writeTestScript(t, "ffmpeg", `prev=""
+for arg in "$@"; do
+	[ "$prev" = "-i" ] && in="$arg"
+	prev="$arg"
+done
+case "$prev" in
+*.processing) cp "$in" "$prev" ;;
+*) exit 1 ;;
+esac
+`)
+}
+
+// runTestWorkers starts the video workers for the rest of the test.
+func runTestWorkers(t *testing.T, cfg *apiConfig) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := cfg.startVideoWorkers(ctx)
+	t.Cleanup(func() {
+		cfg.videoJobs.close()
+		wg.Wait()
+		cancel()
+	})
+}
+
+// waitForJob waits for a processing job to finish, failing the test if
+// it didn't succeed.
+func waitForJob(t *testing.T, cfg *apiConfig, jobID uuid.UUID) {
+	t.Helper()
+
+	var job database.ProcessingJob
+	waitFor(t, "processing job", func() bool {
+		var err error
+		job, err = cfg.db.GetProcessingJob(jobID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return job.Status == database.JobStatusDone || job.Status == database.JobStatusFailed
+	})
+	if job.Status != database.JobStatusDone {
+		t.Fatalf("processing job %s: %s", job.Status, job.Error)
+	}
+}
+
+// storeTestDerivatives gives a stored video a finished rendition and HLS
+// stream, so tests can check what happens to them when the file changes.
+func storeTestDerivatives(t *testing.T, cfg *apiConfig, fake *fakeS3, video database.Video) database.Video {
+	t.Helper()
+
+	rendition := database.Rendition{Height: 480, Key: testVideoKey(t, "renditions/")}
+	fake.putObject(testBucket, rendition.Key, testMP4)
+	if err := cfg.db.UpdateVideoRenditions(video.ID, database.RenditionsStatusDone, []database.Rendition{rendition}); err != nil {
+		t.Fatalf("Couldn't update video renditions: %v", err)
+	}
+	playlistKey := "hls/" + video.ID.String() + "/" + hlsMasterPlaylist
+	fake.putObject(testBucket, playlistKey, []byte("#EXTM3U\n"))
+	if err := cfg.db.UpdateVideoHLS(video.ID, database.RenditionsStatusDone, &playlistKey); err != nil {
+		t.Fatalf("Couldn't update video HLS: %v", err)
+	}
+	return getTestVideo(t, cfg, video.ID)
+}
+
+// expectDerivativesReset checks that replacing old's file, with HLS enabled
+// and renditions not, reset both and deleted the old objects.
+func expectDerivativesReset(t *testing.T, fake *fakeS3, old, video database.Video) {
+	t.Helper()
+
+	if len(video.Renditions) != 0 || video.RenditionsStatus != "" {
+		t.Errorf("renditions = %v (%q), want none", video.Renditions, video.RenditionsStatus)
+	}
+	if video.HLSPlaylistKey != nil || video.HLSStatus != database.RenditionsStatusPending {
+		t.Errorf("HLS = %v (%q), want no playlist, pending", video.HLSPlaylistKey, video.HLSStatus)
+	}
+	_, oldKey, _ := parseVideoURL(old)
+	if _, ok := fake.object(testBucket, oldKey); ok {
+		t.Errorf("replaced file %s wasn't deleted", oldKey)
+	}
+	if _, ok := fake.object(testBucket, old.Renditions[0].Key); ok {
+		t.Errorf("replaced rendition %s wasn't deleted", old.Renditions[0].Key)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const (
+	defaultFFprobeTimeout = 30 * time.Second
+	defaultFFmpegTimeout  = 30 * time.Minute
+	// mediaCommandWaitDelay is how long to wait for a killed command's
+	// output to close, in case a child process still holds it open
+	mediaCommandWaitDelay = 5 * time.Second
+)
+
+// errMediaCommandTimeout is returned when ffmpeg or ffprobe runs past its
+// FFMPEG_TIMEOUT or FFPROBE_TIMEOUT and is killed.
+var errMediaCommandTimeout = errors.New("media command timed out")
+
+// newMediaCommand is exec.CommandContext for ffmpeg and ffprobe, which
+// stops waiting on the command's output soon after it's killed.
+func newMediaCommand(ctx context.Context, path string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.WaitDelay = mediaCommandWaitDelay
+	return cmd
+}
+
+// runMediaCommand calls run with a context that kills the command after
+// timeout, or never if timeout is 0, reporting that as
+// errMediaCommandTimeout rather than the command's own failure. With
+// MEDIA_COMMAND_RETRY set, a command that timed out is run once more; run
+// must build a new exec.Cmd each time, as a Cmd can only be run once.
+func (cfg *apiConfig) runMediaCommand(ctx context.Context, timeout time.Duration, run func(ctx context.Context) error) error {
+	attempts := 1
+	if cfg.mediaRetry {
+		attempts = 2
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		err = runWithTimeout(ctx, timeout, run)
+		if !errors.Is(err, errMediaCommandTimeout) {
+			return err
+		}
+	}
+	return err
+}
+
+func runWithTimeout(ctx context.Context, timeout time.Duration, run func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		return run(ctx)
+	}
+
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := run(attemptCtx)
+	// Only our own deadline counts; the request's ending is reported as is
+	if err != nil && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s: %v", errMediaCommandTimeout, timeout, err)
+	}
+	return err
+}
+
+// resolveMediaTool finds the ffmpeg or ffprobe binary named by the env
+// variable, or by name on PATH when it's unset, and returns its path and
+// the first line of its -version output. Every video upload goes through
+// both tools, so the server checks for them at startup rather than
+// failing on the first upload.
+func resolveMediaTool(envName, name string) (path, version string, err error) {
+	if value := os.Getenv(envName); value != "" {
+		name = value
+	}
+
+	path, err = exec.LookPath(name)
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't find %s (set %s to its path): %w", name, envName, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "-version").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't run %s -version: %w", path, err)
+	}
+	firstLine, _, _ := bytes.Cut(out, []byte("\n"))
+	return path, string(bytes.TrimSpace(firstLine)), nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	uploadRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tubely_upload_requests_total",
+		Help: "Upload and presign requests by handler and response status.",
+	}, []string{"handler", "status"})
+
+	uploadRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tubely_upload_request_duration_seconds",
+		Help:    "Time spent handling upload and presign requests.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 8), // 10ms to ~2.7m
+	}, []string{"handler", "status"})
+
+	uploadRequestSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tubely_upload_request_size_bytes",
+		Help:    "Size of upload request bodies.",
+		Buckets: prometheus.ExponentialBuckets(1<<10, 4, 11), // 1KB to 1GB
+	}, []string{"handler"})
+
+	uploadsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tubely_uploads_in_flight",
+		Help: "Upload and presign requests currently being handled.",
+	}, []string{"handler"})
+
+	uploadSlotsInUse = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tubely_upload_slots_in_use",
+		Help: "Upload slots held, out of MAX_CONCURRENT_UPLOADS.",
+	})
+
+	videoJobsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tubely_video_jobs_total",
+		Help: "Finished background video processing jobs by outcome.",
+	}, []string{"status"})
+)
+
+// metricsMiddleware records request counts, latency, body size and
+// concurrency for an upload handler under the given name.
+func metricsMiddleware(handler string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inFlight := uploadsInFlight.WithLabelValues(handler)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		status := strconv.Itoa(rec.status)
+		uploadRequestsTotal.WithLabelValues(handler, status).Inc()
+		uploadRequestDuration.WithLabelValues(handler, status).Observe(time.Since(start).Seconds())
+		if r.ContentLength > 0 {
+			uploadRequestSize.WithLabelValues(handler).Observe(float64(r.ContentLength))
+		}
+	}
+}
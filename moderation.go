@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// videoModerator decides whether an uploaded video may be shown. videoURL
+// is a signed URL the backend can fetch the file from; the video's
+// VideoURL still holds the bucket and key for backends that read S3
+// directly, like Rekognition.
+type videoModerator interface {
+	ModerateVideo(ctx context.Context, video database.Video, videoURL string) (moderationDecision, error)
+}
+
+type moderationDecision struct {
+	Approved bool
+	// Reason explains a rejection, for the logs
+	Reason string
+}
+
+// autoApproveModerator is the default videoModerator, for deployments
+// without a moderation service.
+type autoApproveModerator struct{}
+
+func (autoApproveModerator) ModerateVideo(ctx context.Context, video database.Video, videoURL string) (moderationDecision, error) {
+	return moderationDecision{Approved: true}, nil
+}
+
+// moderateAndNotify moderates a video stored outside the job queue, by a
+// presigned or multipart upload, then sends the upload webhook if it was
+// approved. It runs after the response has been sent.
+func (cfg *apiConfig) moderateAndNotify(video database.Video) {
+	// A rejection deletes the file, so wait out anything else rewriting it
+	unlock, err := cfg.videoLocks.lock(context.Background(), video.ID)
+	if err != nil {
+		log.Printf("Couldn't lock video %s for moderation: %v", video.ID, err)
+		return
+	}
+	defer unlock()
+
+	if cfg.moderateVideo(context.Background(), video.ID) {
+		cfg.notifyVideoUploaded(video)
+	}
+}
+
+// moderateVideo runs a video whose file was just stored, and marked
+// pending review, past cfg.moderator. Rejected videos have their file
+// deleted. It reports whether the video was approved; if moderation
+// fails, the video stays pending.
+func (cfg *apiConfig) moderateVideo(ctx context.Context, videoID uuid.UUID) bool {
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		log.Printf("Couldn't get video %s for moderation: %v", videoID, err)
+		return false
+	}
+	bucket, key, ok := parseVideoURL(video)
+	if !ok {
+		return false
+	}
+
+	videoURL, err := cfg.signObjectURL(ctx, bucket, key, cfg.s3PresignExpiry)
+	if err != nil {
+		log.Printf("Couldn't sign URL to moderate video %s: %v", videoID, err)
+		return false
+	}
+
+	decision, err := cfg.moderator.ModerateVideo(ctx, video, videoURL)
+	if err != nil {
+		log.Printf("Couldn't moderate video %s, leaving it pending review: %v", videoID, err)
+		return false
+	}
+
+	if decision.Approved {
+		err = cfg.db.UpdateVideoModerationStatus(videoID, database.ModerationStatusApproved)
+		if err != nil {
+			log.Printf("Couldn't approve video %s: %v", videoID, err)
+			return false
+		}
+		return true
+	}
+
+	log.Printf("Video %s rejected by moderation: %s", videoID, decision.Reason)
+	err = cfg.deleteVideoObjects(ctx, video)
+	if err != nil {
+		log.Printf("Couldn't delete rejected video %s: %v", videoID, err)
+	}
+	video.VideoURL = nil
+	video.ContentHash = nil
+	video.SizeBytes = 0
+	video.ModerationStatus = database.ModerationStatusRejected
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		log.Printf("Couldn't mark video %s rejected: %v", videoID, err)
+		return false
+	}
+	err = cfg.db.UpdateVideoRenditions(videoID, "", []database.Rendition{})
+	if err != nil {
+		log.Printf("Couldn't clear renditions of rejected video %s: %v", videoID, err)
+	}
+	err = cfg.db.UpdateVideoHLS(videoID, "", nil)
+	if err != nil {
+		log.Printf("Couldn't clear HLS stream of rejected video %s: %v", videoID, err)
+	}
+	err = cfg.db.UpdateVideoStatus(videoID, database.VideoStatusFailed)
+	if err != nil {
+		log.Printf("Couldn't update status of rejected video %s: %v", videoID, err)
+	}
+	err = cfg.db.UpdateVideoMetadata(videoID, nil)
+	if err != nil {
+		log.Printf("Couldn't clear metadata of rejected video %s: %v", videoID, err)
+	}
+	return false
+}
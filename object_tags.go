@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Tags every stored video object carries, so lifecycle rules and cost
+// allocation reports can tell objects apart. They're kept in step with the
+// video and can't be set by hand.
+const (
+	objectTagUserID     = "userId"
+	objectTagVisibility = "visibility"
+	objectTagEnv        = "env"
+)
+
+// S3's limits on object tags
+const (
+	maxObjectTags           = 10
+	maxObjectTagKeyLength   = 128
+	maxObjectTagValueLength = 256
+)
+
+// errTooManyObjectTags is returned when merging tags would take an object
+// over maxObjectTags.
+var errTooManyObjectTags = fmt.Errorf("objects can have at most %d tags", maxObjectTags)
+
+// objectTagPattern is the characters S3 allows in tag keys and values.
+var objectTagPattern = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+// videoObjectTags returns the tags derived from a video and the server's
+// environment.
+func (cfg *apiConfig) videoObjectTags(video database.Video) map[string]string {
+	return map[string]string{
+		objectTagUserID:     video.UserID.String(),
+		objectTagVisibility: video.Visibility,
+		objectTagEnv:        cfg.platform,
+	}
+}
+
+// encodeObjectTags formats tags for PutObjectInput.Tagging, which takes
+// them URL-encoded like a query string, e.g. "env=dev&userId=...".
+func encodeObjectTags(tags map[string]string) string {
+	values := url.Values{}
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+	return values.Encode()
+}
+
+// videoObjectTagging is the Tagging to store a video's file with.
+func (cfg *apiConfig) videoObjectTagging(video database.Video) *string {
+	tagging := encodeObjectTags(cfg.videoObjectTags(video))
+	return &tagging
+}
+
+// validateObjectTags checks tags set by a client against S3's rules. The
+// derived tags are reserved.
+func validateObjectTags(tags map[string]string) error {
+	for key, value := range tags {
+		switch key {
+		case objectTagUserID, objectTagVisibility, objectTagEnv:
+			return fmt.Errorf("tag %s is set by the server", key)
+		}
+		if key == "" || len(key) > maxObjectTagKeyLength {
+			return fmt.Errorf("tag keys must be 1 to %d characters", maxObjectTagKeyLength)
+		}
+		if len(value) > maxObjectTagValueLength {
+			return fmt.Errorf("tag %s: values can't be longer than %d characters", key, maxObjectTagValueLength)
+		}
+		if strings.HasPrefix(strings.ToLower(key), "aws:") {
+			return fmt.Errorf("tag %s: the aws: prefix is reserved", key)
+		}
+		if !objectTagPattern.MatchString(key) || !objectTagPattern.MatchString(value) {
+			return fmt.Errorf("tag %s: only letters, numbers, spaces and _ . : / = + - @ are allowed", key)
+		}
+	}
+	return nil
+}
+
+// syncVideoObjectTags rewrites the tags on a video's stored file. Tags
+// the client set before are kept unless replaced by custom, and the
+// derived tags are brought up to date. It returns the tags now on the
+// object.
+func (cfg *apiConfig) syncVideoObjectTags(ctx context.Context, video database.Video, custom map[string]string) (map[string]string, error) {
+	bucket, key, ok := parseVideoURL(video)
+	if !ok {
+		return nil, errors.New("video has no uploaded file")
+	}
+	client := cfg.bucketByName(bucket).client
+
+	existing, err := client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for _, tag := range existing.TagSet {
+		if tag.Key != nil && tag.Value != nil {
+			tags[*tag.Key] = *tag.Value
+		}
+	}
+	for tagKey, value := range custom {
+		tags[tagKey] = value
+	}
+	for tagKey, value := range cfg.videoObjectTags(video) {
+		tags[tagKey] = value
+	}
+	if len(tags) > maxObjectTags {
+		return nil, fmt.Errorf("%w, %d given including those already on it", errTooManyObjectTags, len(tags))
+	}
+
+	tagSet := make([]types.Tag, 0, len(tags))
+	for tagKey, value := range tags {
+		tagSet = append(tagSet, types.Tag{Key: &tagKey, Value: &value})
+	}
+	sort.Slice(tagSet, func(i, j int) bool {
+		return *tagSet[i].Key < *tagSet[j].Key
+	})
+	_, err = client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  &bucket,
+		Key:     &key,
+		Tagging: &types.Tagging{TagSet: tagSet},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// handlerUpdateVideoTags sets tags on a video's stored file, for objects
+// stored before tagging or to add custom tags for lifecycle rules. The
+// body's tags are merged into those already on the object; the derived
+// userId, visibility and env tags are always refreshed and can't be set.
+func (cfg *apiConfig) handlerUpdateVideoTags(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Tags map[string]string `json:"tags"`
+	}
+	type response struct {
+		Key  string            `json:"key"`
+		Tags map[string]string `json:"tags"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+	userID := userIDFromContext(r)
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, "Couldn't decode parameters", err)
+		return
+	}
+	err = validateObjectTags(params.Tags)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error(), err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithErrorCode(w, http.StatusForbidden, errCodeNotOwner, "You can't edit this video", nil)
+		return
+	}
+	_, key, ok := parseVideoURL(video)
+	if !ok {
+		respondWithErrorCode(w, http.StatusConflict, errCodeConflict, "Video has no uploaded file yet", nil)
+		return
+	}
+
+	tags, err := cfg.syncVideoObjectTags(r.Context(), video, params.Tags)
+	if err != nil {
+		if errors.Is(err, errTooManyObjectTags) {
+			msg := fmt.Sprintf("Objects can have at most %d tags, %d of them set by the server", maxObjectTags, len(cfg.videoObjectTags(video)))
+			respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidRequest, msg, err)
+			return
+		}
+		if isS3NotFound(err) {
+			respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Video file not found in storage", err)
+			return
+		}
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update object tags", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{Key: key, Tags: tags})
+}
+
+// refreshVideoObjectTags updates the derived tags after the video changes,
+// e.g. its visibility. Failures are only logged; the tags endpoint can put
+// them right later.
+func (cfg *apiConfig) refreshVideoObjectTags(ctx context.Context, video database.Video) {
+	if _, _, ok := parseVideoURL(video); !ok {
+		return
+	}
+	_, err := cfg.syncVideoObjectTags(ctx, video, nil)
+	if err != nil {
+		log.Printf("Couldn't update object tags of video %s: %v", video.ID, err)
+	}
+}
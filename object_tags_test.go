@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestEncodeObjectTags(t *testing.T) {
+	tests := []struct {
+		name string
+		tags map[string]string
+		want string
+	}{
+		{"empty", map[string]string{}, ""},
+		{"sorted by key", map[string]string{"visibility": "public", "env": "dev"}, "env=dev&visibility=public"},
+		{"values escaped", map[string]string{"team": "video ops", "path": "a/b=c&d"}, "path=a%2Fb%3Dc%26d&team=video+ops"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := encodeObjectTags(tt.tags); got != tt.want {
+				t.Errorf("encodeObjectTags(%v) = %q, want %q", tt.tags, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVideoObjectTagging(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	userID := uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	video := database.Video{Visibility: database.VisibilityUnlisted}
+	video.UserID = userID
+
+	want := "env=dev&userId=6ba7b810-9dad-11d1-80b4-00c04fd430c8&visibility=unlisted"
+	if got := *cfg.videoObjectTagging(video); got != want {
+		t.Errorf("videoObjectTagging = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+const defaultOrphanGracePeriod = 24 * time.Hour
+
+// videoKeyFolders are the folders under S3_KEY_PREFIX that video objects
+// are stored in: the root for direct uploads and one per orientation for
+// processed uploads.
+var videoKeyFolders = map[string]bool{
+	"":           true,
+	"landscape/": true,
+	"portrait/":  true,
+	"other/":     true,
+}
+
+type orphanedObject struct {
+	Bucket       string    `json:"bucket"`
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// isVideoObjectKey reports whether key looks like a video file or
+// rendition this server stored. Anything else under the prefix, such as
+// thumbnails or another environment's objects, is never treated as an
+// orphan.
+func (cfg *apiConfig) isVideoObjectKey(key string) bool {
+	rel, ok := strings.CutPrefix(key, cfg.keyPrefix)
+	if !ok {
+		return false
+	}
+	dir, name := path.Split(rel)
+	if !videoKeyFolders[dir] {
+		return false
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if stem, height, found := strings.Cut(base, "_"); found {
+		if _, err := strconv.Atoi(height); err != nil {
+			return false
+		}
+		base = stem
+	}
+	return isAssetKey(base+ext, ext)
+}
+
+// findOrphanedObjects lists the video objects under S3_KEY_PREFIX, in
+// every configured bucket, that no video record refers to and that are
+// older than grace. The grace period leaves room for uploads whose record
+// hasn't been updated yet.
+func (cfg *apiConfig) findOrphanedObjects(ctx context.Context, grace time.Duration) ([]orphanedObject, error) {
+	videos, err := cfg.db.GetVideosWithFiles()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get videos: %w", err)
+	}
+	// Keyed by "bucket,key", the stored video URL format
+	referenced := map[string]bool{}
+	for _, video := range videos {
+		bucket, key, ok := parseVideoURL(video)
+		if !ok {
+			continue
+		}
+		referenced[bucket+","+key] = true
+		for _, rendition := range video.Renditions {
+			referenced[bucket+","+rendition.Key] = true
+		}
+	}
+
+	cutoff := time.Now().Add(-grace)
+	orphans := []orphanedObject{}
+	for _, bucket := range cfg.regionBuckets() {
+		paginator := s3.NewListObjectsV2Paginator(bucket.client, &s3.ListObjectsV2Input{
+			Bucket: &bucket.name,
+			Prefix: aws.String(cfg.keyPrefix),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't list objects in %s: %w", bucket.name, err)
+			}
+			for _, object := range page.Contents {
+				key := aws.ToString(object.Key)
+				lastModified := aws.ToTime(object.LastModified)
+				if referenced[bucket.name+","+key] || !cfg.isVideoObjectKey(key) || lastModified.After(cutoff) {
+					continue
+				}
+				orphans = append(orphans, orphanedObject{
+					Bucket:       bucket.name,
+					Key:          key,
+					Size:         aws.ToInt64(object.Size),
+					LastModified: lastModified,
+				})
+			}
+		}
+	}
+	return orphans, nil
+}
+
+// handlerCleanupOrphanedObjects finds S3 video objects left behind without
+// a video record, e.g. when a database update failed after the upload, and
+// deletes them. It only reports what it would delete unless called with
+// dry_run=false. It requires a token with the admin scope.
+func (cfg *apiConfig) handlerCleanupOrphanedObjects(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	_, err = auth.ValidateJWTWithScope(token, cfg.jwtTokens, auth.ScopeAdmin)
+	if errors.Is(err, auth.ErrMissingScope) {
+		respondWithError(w, http.StatusForbidden, "Admin access required", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	dryRun := true
+	if value := r.URL.Query().Get("dry_run"); value != "" {
+		dryRun, err = strconv.ParseBool(value)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "dry_run must be true or false", err)
+			return
+		}
+	}
+
+	orphans, err := cfg.findOrphanedObjects(r.Context(), cfg.orphanGrace)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't find orphaned objects", err)
+		return
+	}
+
+	deleted := 0
+	for _, orphan := range orphans {
+		if dryRun {
+			slog.Info("Would delete orphaned object", "bucket", orphan.Bucket, "key", orphan.Key, "size", orphan.Size, "last_modified", orphan.LastModified)
+			continue
+		}
+		_, err := cfg.bucketByName(orphan.Bucket).client.DeleteObject(r.Context(), &s3.DeleteObjectInput{
+			Bucket: aws.String(orphan.Bucket),
+			Key:    aws.String(orphan.Key),
+		})
+		if err != nil && !isS3NotFound(err) {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Couldn't delete %s after deleting %d objects", orphan.Key, deleted), err)
+			return
+		}
+		slog.Info("Deleted orphaned object", "bucket", orphan.Bucket, "key", orphan.Key, "size", orphan.Size, "last_modified", orphan.LastModified)
+		deleted++
+	}
+
+	type response struct {
+		DryRun  bool             `json:"dry_run"`
+		Orphans []orphanedObject `json:"orphans"`
+		Deleted int              `json:"deleted"`
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		DryRun:  dryRun,
+		Orphans: orphans,
+		Deleted: deleted,
+	})
+}
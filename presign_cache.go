@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+)
+
+// presignCache holds presigned URLs keyed by bucket, key, and requested
+// lifetime so hot videos aren't re-signed on every read. Entries are
+// served until they are within refreshWindow of expiring.
+type presignCache struct {
+	mu            sync.RWMutex
+	entries       map[string]presignCacheEntry
+	refreshWindow time.Duration
+}
+
+type presignCacheEntry struct {
+	url       string
+	expiresAt time.Time
+}
+
+const (
+	// presignCacheSweepSize is the entry count at which expired entries
+	// are dropped on insert, bounding the cache to roughly the live
+	// working set.
+	presignCacheSweepSize = 1024
+	// presignCacheMaxEntries caps the cache, since clients choose the
+	// lifetime that's part of the key and could otherwise fill it with
+	// week-long entries
+	presignCacheMaxEntries = 10000
+)
+
+func newPresignCache(refreshWindow time.Duration) *presignCache {
+	return &presignCache{
+		entries:       map[string]presignCacheEntry{},
+		refreshWindow: refreshWindow,
+	}
+}
+
+func presignCacheKey(bucket, key string, expireTime time.Duration) string {
+	return fmt.Sprintf("%s,%s,%s", bucket, key, expireTime)
+}
+
+func (c *presignCache) get(bucket, key string, expireTime time.Duration) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	entry, ok := c.entries[presignCacheKey(bucket, key, expireTime)]
+	if !ok || time.Now().Add(c.refreshWindow).After(entry.expiresAt) {
+		return "", false
+	}
+	return entry.url, true
+}
+
+// set caches a URL. URLs that don't outlive the refresh window would never
+// be served from the cache, so they aren't kept. When the cache is full,
+// arbitrary entries make way; a URL still in use is just signed again.
+func (c *presignCache) set(bucket, key string, expireTime time.Duration, url string, expiresAt time.Time) {
+	if expireTime <= c.refreshWindow {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= presignCacheSweepSize {
+		now := time.Now()
+		for k, entry := range c.entries {
+			if now.After(entry.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < presignCacheMaxEntries {
+			break
+		}
+		delete(c.entries, k)
+	}
+	c.entries[presignCacheKey(bucket, key, expireTime)] = presignCacheEntry{
+		url:       url,
+		expiresAt: expiresAt,
+	}
+}
+
+// responseContentType is the Content-Type a presigned URL for key makes S3
+// serve. HLS objects keep their own types, since strict players reject
+// segments served as MP4.
+func (cfg *apiConfig) responseContentType(key string) string {
+	if contentType, ok := hlsContentTypes[path.Ext(key)]; ok {
+		return contentType
+	}
+	return cfg.videoResponseType
+}
+
+// getPresignedURL returns a cached presigned GET URL for the object, signing
+// a new one when the cached URL is missing or close to expiry.
+func (cfg *apiConfig) getPresignedURL(ctx context.Context, bucket, key string, expireTime time.Duration) (string, error) {
+	if url, ok := cfg.presignCache.get(bucket, key, expireTime); ok {
+		return url, nil
+	}
+
+	expiresAt := time.Now().Add(expireTime)
+	url, err := generatePresignedURL(ctx, cfg.bucketByName(bucket).presigner, bucket, key, expireTime, cfg.responseContentType(key), "")
+	if err != nil {
+		return "", err
+	}
+	cfg.presignCache.set(bucket, key, expireTime, url, expiresAt)
+	return url, nil
+}
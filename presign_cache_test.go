@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDbVideoToSignedVideoCachesURL(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	user := createTestUser(t, cfg)
+	video := storeTestVideo(t, cfg, fake, createTestVideo(t, cfg, user.ID), testMP4)
+	presigner := cfg.s3Presigner.(*countingPresigner)
+
+	first, err := cfg.dbVideoToSignedVideo(context.Background(), video)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := cfg.dbVideoToSignedVideo(context.Background(), video)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := presigner.getCount(); got != 1 {
+		t.Errorf("presigner called %d times for two reads, want 1", got)
+	}
+	if *first.VideoURL != *second.VideoURL {
+		t.Errorf("second read got %q, want the cached %q", *second.VideoURL, *first.VideoURL)
+	}
+}
+
+func TestPresignCacheRefreshWindow(t *testing.T) {
+	cache := newPresignCache(5 * time.Minute)
+
+	cache.set(testBucket, "fresh.mp4", time.Hour, "https://fresh", time.Now().Add(time.Hour))
+	if got, ok := cache.get(testBucket, "fresh.mp4", time.Hour); !ok || got != "https://fresh" {
+		t.Errorf("get = %q, %v, want the cached URL", got, ok)
+	}
+	// A different lifetime is a different URL
+	if _, ok := cache.get(testBucket, "fresh.mp4", 2*time.Hour); ok {
+		t.Error("URL cached for one lifetime served for another")
+	}
+
+	// URLs about to expire are signed again rather than handed out
+	cache.set(testBucket, "stale.mp4", time.Hour, "https://stale", time.Now().Add(time.Minute))
+	if _, ok := cache.get(testBucket, "stale.mp4", time.Hour); ok {
+		t.Error("URL within the refresh window of expiring served from the cache")
+	}
+}
+
+func TestPresignCacheMaxEntries(t *testing.T) {
+	cache := newPresignCache(5 * time.Minute)
+
+	// Each lifetime is its own entry, as a client choosing expires_in
+	// would make them
+	for i := 0; i < presignCacheMaxEntries+100; i++ {
+		expireTime := time.Hour + time.Duration(i)*time.Second
+		cache.set(testBucket, "video.mp4", expireTime, "https://signed", time.Now().Add(expireTime))
+	}
+	if got := len(cache.entries); got > presignCacheMaxEntries {
+		t.Errorf("cache holds %d entries, want at most %d", got, presignCacheMaxEntries)
+	}
+}
+
+func TestPresignCacheSkipsShortLifetimes(t *testing.T) {
+	cache := newPresignCache(5 * time.Minute)
+
+	cache.set(testBucket, "short.mp4", time.Minute, "https://short", time.Now().Add(time.Minute))
+	if len(cache.entries) != 0 {
+		t.Error("URL that expires within the refresh window was cached")
+	}
+}
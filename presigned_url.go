@@ -5,21 +5,59 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-func generatePresignedURL(s3Client *s3.Client, bucket, key string, expireTime time.Duration) (string, error) {
-	presignClient := s3.NewPresignClient(s3Client)
+// Objects encrypted with SSE-KMS need no extra parameters here: S3 decrypts
+// them for any SigV4-signed request whose signer may use the key.
+//
+// A non-empty responseContentType is signed into the URL as
+// response-content-type, so S3 answers with that Content-Type whatever
+// metadata the object was stored with. responseContentDisposition works
+// the same way for Content-Disposition.
+func generatePresignedURL(ctx context.Context, presignClient S3PresignAPI, bucket, key string, expireTime time.Duration, responseContentType, responseContentDisposition string) (string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	}
+	if responseContentType != "" {
+		input.ResponseContentType = &responseContentType
+	}
+	if responseContentDisposition != "" {
+		input.ResponseContentDisposition = &responseContentDisposition
+	}
+
+	request, err := presignClient.PresignGetObject(ctx, input, s3.WithPresignExpires(expireTime))
+	if err != nil {
+		return "", err
+	}
 
-	request, err := presignClient.PresignGetObject(context.Background(),
-		&s3.GetObjectInput{
-			Bucket: &bucket,
-			Key:    &key,
+	return request.URL, nil
+}
+
+// generatePresignedPutURL returns a URL the client can PUT an object body to
+// directly, so the bytes never pass through our server. Any encryption
+// settings become signed headers the client must send with the upload; they
+// are returned alongside the URL.
+func generatePresignedPutURL(ctx context.Context, presignClient S3PresignAPI, bucket, key string, expireTime time.Duration, sse types.ServerSideEncryption, sseKMSKeyID *string) (string, map[string]string, error) {
+	request, err := presignClient.PresignPutObject(ctx,
+		&s3.PutObjectInput{
+			Bucket:               &bucket,
+			Key:                  &key,
+			ServerSideEncryption: sse,
+			SSEKMSKeyId:          sseKMSKeyID,
 		},
 		s3.WithPresignExpires(expireTime),
 	)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	return request.URL, nil
+	headers := map[string]string{}
+	for name := range request.SignedHeader {
+		if name != "Host" {
+			headers[name] = request.SignedHeader.Get(name)
+		}
+	}
+	return request.URL, headers, nil
 }
@@ -0,0 +1,57 @@
+package main
+
+import "strconv"
+
+// Quality presets an upload can be transcoded with
+const (
+	qualityPresetLow    = "low"
+	qualityPresetMedium = "medium"
+	qualityPresetHigh   = "high"
+)
+
+// defaultQualityPreset is what videos that have to be transcoded get when
+// no preset was chosen. Its settings are the ones transcoding always used.
+const defaultQualityPreset = qualityPresetMedium
+
+// qualityPreset is a set of H.264 encoder settings. Lower CRFs keep more
+// detail in bigger files; maxRate, if set, caps the bit rate so busy
+// scenes can't blow up the file size.
+type qualityPreset struct {
+	crf     int
+	speed   string // x264 preset; slower ones compress better
+	maxRate string
+	bufSize string
+}
+
+var qualityPresets = map[string]qualityPreset{
+	qualityPresetLow:    {crf: 28, speed: "fast", maxRate: "1500k", bufSize: "3000k"},
+	qualityPresetMedium: {crf: 23, speed: "fast"},
+	qualityPresetHigh:   {crf: 18, speed: "slow"},
+}
+
+const allowedQualityPresetsMessage = "Quality preset must be one of low, medium or high"
+
+// videoEncoderArgs are the ffmpeg options that encode the video stream
+// with the named preset, which must be one of qualityPresets.
+func videoEncoderArgs(name string) []string {
+	preset := qualityPresets[name]
+	args := []string{"-c:v", "libx264", "-preset", preset.speed, "-crf", strconv.Itoa(preset.crf)}
+	if preset.maxRate != "" {
+		args = append(args, "-maxrate", preset.maxRate, "-bufsize", preset.bufSize)
+	}
+	return args
+}
+
+// jobQualityPreset returns the preset the job's video is encoded with, or
+// "" if it's stored without re-encoding. MP4s are only remuxed unless a
+// preset was chosen; anything else is transcoded, at the default preset
+// if none was.
+func jobQualityPreset(job videoJob) string {
+	if job.qualityPreset != "" {
+		return job.qualityPreset
+	}
+	if job.mediaType != "video/mp4" {
+		return defaultQualityPreset
+	}
+	return ""
+}
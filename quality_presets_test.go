@@ -0,0 +1,44 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestVideoEncoderArgs(t *testing.T) {
+	tests := []struct {
+		preset string
+		want   []string
+	}{
+		{qualityPresetLow, []string{"-c:v", "libx264", "-preset", "fast", "-crf", "28", "-maxrate", "1500k", "-bufsize", "3000k"}},
+		{qualityPresetMedium, []string{"-c:v", "libx264", "-preset", "fast", "-crf", "23"}},
+		{qualityPresetHigh, []string{"-c:v", "libx264", "-preset", "slow", "-crf", "18"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.preset, func(t *testing.T) {
+			if got := videoEncoderArgs(tt.preset); !slices.Equal(got, tt.want) {
+				t.Errorf("videoEncoderArgs(%q) = %q, want %q", tt.preset, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJobQualityPreset(t *testing.T) {
+	tests := []struct {
+		name string
+		job  videoJob
+		want string
+	}{
+		{"MP4 without a preset is remuxed", videoJob{mediaType: "video/mp4"}, ""},
+		{"MP4 with a preset", videoJob{mediaType: "video/mp4", qualityPreset: qualityPresetHigh}, qualityPresetHigh},
+		{"other type without a preset", videoJob{mediaType: "video/quicktime"}, defaultQualityPreset},
+		{"other type with a preset", videoJob{mediaType: "video/webm", qualityPreset: qualityPresetLow}, qualityPresetLow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jobQualityPreset(tt.job); got != tt.want {
+				t.Errorf("jobQualityPreset = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// quotaExceededError reports an upload that would take its owner past
+// USER_STORAGE_QUOTA_BYTES.
+type quotaExceededError struct {
+	usage  int64
+	upload int64
+	limit  int64
+}
+
+func (e *quotaExceededError) Error() string {
+	return fmt.Sprintf("uploading %d bytes would exceed the storage quota: %d of %d bytes used", e.upload, e.usage, e.limit)
+}
+
+// checkStorageQuota returns a *quotaExceededError if replacing video's file
+// with one of size bytes would take its owner over their quota. The file
+// being replaced no longer counts once the new one is stored, unless
+// another of their videos still shares it.
+func (cfg *apiConfig) checkStorageQuota(video database.Video, size int64) error {
+	if cfg.userStorageQuota <= 0 {
+		return nil
+	}
+
+	usage, err := cfg.db.GetUserStorageBytes(video.UserID, video.ID)
+	if err != nil {
+		return fmt.Errorf("couldn't get storage usage: %w", err)
+	}
+
+	if usage+size > cfg.userStorageQuota {
+		return &quotaExceededError{usage: usage, upload: size, limit: cfg.userStorageQuota}
+	}
+	return nil
+}
+
+// respondIfOverQuota sends a 413 with the user's usage and limit when err
+// is a *quotaExceededError, and reports whether it did.
+func respondIfOverQuota(w http.ResponseWriter, err error) bool {
+	var quotaErr *quotaExceededError
+	if !errors.As(err, &quotaErr) {
+		return false
+	}
+	msg := fmt.Sprintf("Upload of %d bytes would exceed your storage quota: %d of %d bytes used", quotaErr.upload, quotaErr.usage, quotaErr.limit)
+	respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeQuotaExceeded, msg, nil)
+	return true
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaultFFprobeURLTimeout bounds probing a URL directly, which only reads
+// the container header and moov atom, before falling back to downloading.
+const defaultFFprobeURLTimeout = 15 * time.Second
+
+// probeDownloadTimeout bounds downloading a video that couldn't be probed
+// over HTTP, so a stalled server can't hold a worker forever.
+const probeDownloadTimeout = 10 * time.Minute
+
+var probeDownloadClient = &http.Client{Timeout: probeDownloadTimeout}
+
+// isRemoteInput reports whether a probe input is a URL rather than a path.
+func isRemoteInput(input string) bool {
+	return strings.HasPrefix(input, "https://") || strings.HasPrefix(input, "http://")
+}
+
+// probeInput runs ffprobe on a local path, or on a URL via probeURL.
+func (cfg *apiConfig) probeInput(ctx context.Context, input string) (FFProbeOutput, error) {
+	if isRemoteInput(input) {
+		return cfg.probeURL(ctx, input)
+	}
+	return cfg.runFFProbe(ctx, input)
+}
+
+// probeURL has ffprobe read the URL over HTTP, which for most videos means
+// a few range requests rather than the whole file. If that fails or takes
+// longer than FFPROBE_URL_TIMEOUT, e.g. because the server doesn't support
+// ranges well, the file is downloaded and probed locally instead.
+func (cfg *apiConfig) probeURL(ctx context.Context, url string) (FFProbeOutput, error) {
+	data, err := cfg.runFFProbeWithTimeout(ctx, url, cfg.ffprobeURLTimeout)
+	if err == nil || ctx.Err() != nil {
+		return data, err
+	}
+	log.Printf("Couldn't probe video over HTTP, downloading it instead: %v", err)
+
+	path, err := cfg.downloadForProbe(ctx, url)
+	if err != nil {
+		return FFProbeOutput{}, err
+	}
+	defer os.Remove(path)
+	return cfg.runFFProbe(ctx, path)
+}
+
+// downloadForProbe saves the body at url to a temporary file, returning
+// its path. Bodies over MAX_VIDEO_BYTES are rejected rather than filling
+// the disk. The caller removes it.
+func (cfg *apiConfig) downloadForProbe(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", fmt.Errorf("couldn't create download request: %w", err)
+	}
+	resp, err := probeDownloadClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("couldn't download video: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("couldn't download video: status %s", resp.Status)
+	}
+
+	tempFile, cleanupTempFile, err := cfg.newTempFile("tubely-probe-*")
+	if err != nil {
+		return "", fmt.Errorf("couldn't create temporary file: %w", err)
+	}
+	defer tempFile.Close()
+	// Read one byte past the limit to tell a body that's exactly at it from
+	// one that's over
+	n, err := io.Copy(tempFile, io.LimitReader(resp.Body, cfg.maxVideoBytes+1))
+	if err != nil {
+		cleanupTempFile()
+		return "", fmt.Errorf("couldn't download video: %w", err)
+	}
+	if n > cfg.maxVideoBytes {
+		cleanupTempFile()
+		return "", fmt.Errorf("video exceeds the maximum size of %d bytes", cfg.maxVideoBytes)
+	}
+	return tempFile.Name(), nil
+}
+
+// getVideoAspectRatioFromURL classifies a stored video's aspect ratio
+// through a presigned URL, without downloading it when ffprobe can stream
+// it.
+func (cfg *apiConfig) getVideoAspectRatioFromURL(ctx context.Context, bucket, key string, tolerance float64) (string, error) {
+	url, err := cfg.signObjectURL(ctx, bucket, key, cfg.s3PresignExpiry)
+	if err != nil {
+		return "", fmt.Errorf("couldn't sign video URL: %w", err)
+	}
+	return cfg.getVideoAspectRatio(ctx, url, tolerance)
+}
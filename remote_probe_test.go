@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestDownloadForProbeOverLimit(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.maxVideoBytes = 1 << 10
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 2<<10))
+	}))
+	defer server.Close()
+
+	if _, err := cfg.downloadForProbe(context.Background(), server.URL); err == nil {
+		t.Fatal("downloadForProbe succeeded for a body over MAX_VIDEO_BYTES")
+	}
+	entries, err := os.ReadDir(cfg.tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("temp dir has %d entries after a rejected download, want 0", len(entries))
+	}
+}
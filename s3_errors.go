@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/aws/smithy-go"
+)
+
+// isS3NotFound reports whether err means the object doesn't exist.
+func isS3NotFound(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "NoSuchKey", "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+// isS3InvalidRange reports whether S3 refused a Range that starts past the
+// end of the object.
+func isS3InvalidRange(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "InvalidRange"
+}
+
+// isS3ChecksumMismatch reports whether S3 rejected an upload because the
+// bytes it received don't match the checksum sent with them.
+func isS3ChecksumMismatch(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "BadDigest", "XAmzContentSHA256Mismatch":
+			return true
+		}
+	}
+	return false
+}
+
+// respondIfChecksumMismatch sends a 502 when err came from S3 rejecting a
+// corrupted upload, and reports whether it did. The upload was never
+// stored, so the client can safely send the request again.
+func respondIfChecksumMismatch(w http.ResponseWriter, err error) bool {
+	if !isS3ChecksumMismatch(err) {
+		return false
+	}
+	w.Header().Set("Retry-After", "1")
+	respondWithErrorCode(w, http.StatusBadGateway, errCodeChecksumMismatch, "Upload to storage was corrupted in transit, try again", err)
+	return true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// regionBucket is a bucket videos can be stored in, with S3 clients for
+// the region it lives in.
+type regionBucket struct {
+	region    string
+	name      string
+	client    S3API
+	presigner S3PresignAPI
+}
+
+// parseRegionBuckets parses S3_REGION_BUCKETS, a comma-separated list of
+// region=bucket pairs such as "eu-west-1=tubely-eu,ap-south-1=tubely-ap".
+func parseRegionBuckets(value string) (map[string]string, error) {
+	buckets := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		region, bucket, ok := strings.Cut(pair, "=")
+		region, bucket = strings.TrimSpace(region), strings.TrimSpace(bucket)
+		if !ok || region == "" || bucket == "" || strings.Contains(bucket, ",") {
+			return nil, fmt.Errorf("%q isn't a region=bucket pair", pair)
+		}
+		if _, ok := buckets[region]; ok {
+			return nil, fmt.Errorf("region %s is listed twice", region)
+		}
+		buckets[region] = bucket
+	}
+	return buckets, nil
+}
+
+// defaultBucket is S3_BUCKET in S3_REGION, used when no region is asked
+// for or the region has no bucket of its own.
+func (cfg *apiConfig) defaultBucket() regionBucket {
+	return regionBucket{
+		region:    cfg.s3Region,
+		name:      cfg.s3Bucket,
+		client:    cfg.s3Client,
+		presigner: cfg.s3Presigner,
+	}
+}
+
+// bucketForRegion returns the bucket new videos for region are stored in.
+// S3_REGION's own bucket isn't in s3RegionBuckets, so it falls through to
+// the default too.
+func (cfg *apiConfig) bucketForRegion(region string) regionBucket {
+	if bucket, ok := cfg.s3RegionBuckets[region]; ok {
+		return bucket
+	}
+	return cfg.defaultBucket()
+}
+
+// bucketByName returns the clients for a bucket named in a stored video
+// URL. Buckets that are no longer configured get the default clients, and
+// an empty name, from records made before buckets were recorded, is the
+// default bucket.
+func (cfg *apiConfig) bucketByName(name string) regionBucket {
+	if name == "" {
+		return cfg.defaultBucket()
+	}
+	for _, bucket := range cfg.s3RegionBuckets {
+		if bucket.name == name {
+			return bucket
+		}
+	}
+	bucket := cfg.defaultBucket()
+	bucket.name = name
+	return bucket
+}
+
+// regionBuckets returns every configured bucket, the default first and the
+// rest ordered by region.
+func (cfg *apiConfig) regionBuckets() []regionBucket {
+	buckets := []regionBucket{cfg.defaultBucket()}
+	for _, bucket := range cfg.s3RegionBuckets {
+		buckets = append(buckets, bucket)
+	}
+	sort.Slice(buckets[1:], func(i, j int) bool {
+		return buckets[i+1].region < buckets[j+1].region
+	})
+	return buckets
+}
+
+// uploadBucket picks the bucket a user's upload is stored in: the region
+// query parameter if given, else the user's region, else the default.
+func (cfg *apiConfig) uploadBucket(r *http.Request, userID uuid.UUID) regionBucket {
+	if region := r.URL.Query().Get("region"); region != "" {
+		return cfg.bucketForRegion(region)
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		log.Printf("Couldn't get region of user %s, using the default bucket: %v", userID, err)
+		return cfg.defaultBucket()
+	}
+	if user == nil {
+		return cfg.defaultBucket()
+	}
+	return cfg.bucketForRegion(user.Region)
+}
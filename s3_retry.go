@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	defaultS3MaxAttempts       = 3
+	s3RetryBaseDelay           = 200 * time.Millisecond
+	s3RetryMaxDelay            = 10 * time.Second
+	defaultS3UploadPartSize    = 16 << 20 // 16MB
+	defaultS3UploadConcurrency = manager.DefaultUploadConcurrency
+)
+
+// putObjectWithRetry uploads body, retrying transient S3 failures with
+// exponential backoff and full jitter. The body is rewound before every
+// attempt, so a partly sent upload starts over from the beginning.
+//
+// Bodies larger than S3_UPLOAD_PART_SIZE are sent as a multipart upload,
+// S3_UPLOAD_CONCURRENCY parts at a time. A failed part is retried on its
+// own by the SDK rather than starting the whole upload over, so those
+// uploads are only attempted once here.
+func (cfg *apiConfig) putObjectWithRetry(ctx context.Context, input *s3.PutObjectInput, body io.ReadSeeker) error {
+	size, err := body.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("couldn't size upload body: %w", err)
+	}
+	multipart := size > cfg.s3PartSize
+	if multipart && input.ChecksumSHA256 != nil {
+		// S3 checks a multipart upload against a checksum of its parts'
+		// checksums, so the whole body's can't be sent; each part's
+		// ChecksumAlgorithm checksum is checked instead
+		multipartInput := *input
+		multipartInput.ChecksumSHA256 = nil
+		input = &multipartInput
+	}
+	input.Body = body
+
+	client := cfg.bucketByName(aws.ToString(input.Bucket)).client
+	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
+		u.PartSize = cfg.s3PartSize
+		u.Concurrency = cfg.s3PartConcurrency
+		u.ClientOptions = append(u.ClientOptions, func(o *s3.Options) {
+			if multipart {
+				o.RetryMaxAttempts = cfg.s3MaxAttempts
+				return
+			}
+			// Retries are handled here so the SDK's own retryer doesn't
+			// multiply the attempts
+			o.RetryMaxAttempts = 1
+		})
+	})
+
+	attempts := cfg.s3MaxAttempts
+	if multipart {
+		attempts = 1
+	}
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			delay := min(s3RetryBaseDelay<<(attempt-1), s3RetryMaxDelay)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(rand.N(delay)):
+			}
+		}
+
+		if _, seekErr := body.Seek(0, io.SeekStart); seekErr != nil {
+			return fmt.Errorf("couldn't rewind upload body: %w", seekErr)
+		}
+
+		_, err = uploader.Upload(ctx, input)
+		if err == nil || !isS3Retryable(ctx, err) {
+			return err
+		}
+	}
+	return err
+}
+
+// setSHA256Checksum has S3 check the upload against the SHA-256 of body,
+// so bytes corrupted on the way are rejected instead of stored. body is
+// left at the start.
+func setSHA256Checksum(input *s3.PutObjectInput, body io.ReadSeeker) error {
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("couldn't rewind upload body: %w", err)
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, body); err != nil {
+		return fmt.Errorf("couldn't hash upload body: %w", err)
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("couldn't rewind upload body: %w", err)
+	}
+	input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+	input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(hasher.Sum(nil)))
+	return nil
+}
+
+// isS3Retryable reports whether err is a transient failure, such as
+// throttling or a 5xx, that may succeed if the request is sent again.
+func isS3Retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestTimeout",
+			"InternalError", "ServiceUnavailable":
+			return true
+		}
+		// Corrupted in transit, so a fresh copy may well get through
+		if isS3ChecksumMismatch(err) {
+			return true
+		}
+	}
+
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) {
+		status := respErr.HTTPStatusCode()
+		return status >= 500 || status == http.StatusTooManyRequests || status == http.StatusRequestTimeout
+	}
+
+	// No response at all, e.g. a dropped connection
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func testPutObjectInput(key string) *s3.PutObjectInput {
+	return &s3.PutObjectInput{
+		Bucket:      aws.String(testBucket),
+		Key:         aws.String(key),
+		ContentType: aws.String("video/mp4"),
+	}
+}
+
+func TestPutObjectWithRetryRetriesTransientErrors(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	body := []byte("some video bytes")
+	fake.failNext("PutObject",
+		fakeS3Error(http.StatusServiceUnavailable, "SlowDown"),
+		fakeS3Error(http.StatusServiceUnavailable, "ServiceUnavailable"),
+	)
+
+	err := cfg.putObjectWithRetry(context.Background(), testPutObjectInput("video.mp4"), bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("putObjectWithRetry = %v, want success on the third attempt", err)
+	}
+
+	if got := fake.callCount("PutObject"); got != 3 {
+		t.Errorf("PutObject called %d times, want 3", got)
+	}
+	// Every attempt must send the whole body, not what the last one left
+	for i, sent := range fake.putBodies {
+		if !bytes.Equal(sent, body) {
+			t.Errorf("attempt %d sent %q, want %q", i+1, sent, body)
+		}
+	}
+	object, ok := fake.object(testBucket, "video.mp4")
+	if !ok || !bytes.Equal(object.body, body) {
+		t.Errorf("stored object = %q, want %q", object.body, body)
+	}
+}
+
+func TestPutObjectWithRetryStopsOnPermanentError(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	fake.failNext("PutObject", fakeS3Error(http.StatusForbidden, "AccessDenied"))
+
+	err := cfg.putObjectWithRetry(context.Background(), testPutObjectInput("video.mp4"), bytes.NewReader([]byte("data")))
+	if err == nil {
+		t.Fatal("putObjectWithRetry succeeded after a 403")
+	}
+	if got := fake.callCount("PutObject"); got != 1 {
+		t.Errorf("PutObject called %d times after a 403, want 1", got)
+	}
+}
+
+func TestPutObjectWithRetryGivesUp(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	cfg.s3MaxAttempts = 2
+	fake.failNext("PutObject",
+		fakeS3Error(http.StatusInternalServerError, "InternalError"),
+		fakeS3Error(http.StatusInternalServerError, "InternalError"),
+		fakeS3Error(http.StatusInternalServerError, "InternalError"),
+	)
+
+	err := cfg.putObjectWithRetry(context.Background(), testPutObjectInput("video.mp4"), bytes.NewReader([]byte("data")))
+	if err == nil {
+		t.Fatal("putObjectWithRetry succeeded with every attempt failing")
+	}
+	if got := fake.callCount("PutObject"); got != 2 {
+		t.Errorf("PutObject called %d times, want S3_MAX_ATTEMPTS (2)", got)
+	}
+}
+
+func TestIsS3Retryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"slow down", fakeS3Error(http.StatusServiceUnavailable, "SlowDown"), true},
+		{"throttled", fakeS3Error(http.StatusBadRequest, "Throttling"), true},
+		{"5xx", fakeS3Error(http.StatusBadGateway, "BadGateway"), true},
+		{"too many requests", fakeS3Error(http.StatusTooManyRequests, "TooManyRequests"), true},
+		{"request timeout", fakeS3Error(http.StatusRequestTimeout, "RequestTimeout"), true},
+		{"access denied", fakeS3Error(http.StatusForbidden, "AccessDenied"), false},
+		{"no such bucket", fakeS3Error(http.StatusNotFound, "NoSuchBucket"), false},
+		{"not an S3 error", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isS3Retryable(context.Background(), tt.err); got != tt.want {
+				t.Errorf("isS3Retryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if isS3Retryable(ctx, fakeS3Error(http.StatusServiceUnavailable, "SlowDown")) {
+		t.Error("retryable after the request was cancelled")
+	}
+}
+
+func TestPutObjectWithRetryMultipart(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	body := bytes.Repeat([]byte("0123456789"), int(cfg.s3PartSize/10)+1)
+	input := testPutObjectInput("large.mp4")
+	if err := setSHA256Checksum(input, bytes.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := cfg.putObjectWithRetry(context.Background(), input, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("putObjectWithRetry = %v", err)
+	}
+
+	if got := fake.callCount("PutObject"); got != 0 {
+		t.Errorf("PutObject called %d times for a body over S3_UPLOAD_PART_SIZE, want 0", got)
+	}
+	if got := fake.callCount("UploadPart"); got != 2 {
+		t.Errorf("UploadPart called %d times, want 2", got)
+	}
+	if len(fake.completes) != 1 {
+		t.Fatalf("CompleteMultipartUpload called %d times, want 1", len(fake.completes))
+	}
+	// The whole body's checksum would never match the parts' one
+	if fake.completes[0].ChecksumSHA256 != nil {
+		t.Errorf("multipart upload sent the whole body's checksum %s", *fake.completes[0].ChecksumSHA256)
+	}
+	if input.ChecksumSHA256 == nil {
+		t.Error("putObjectWithRetry cleared the caller's checksum")
+	}
+	object, ok := fake.object(testBucket, "large.mp4")
+	if !ok || !bytes.Equal(object.body, body) {
+		t.Errorf("stored object is %d bytes, want the %d byte body", len(object.body), len(body))
+	}
+}
+
+func TestPutObjectWithRetrySinglePart(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	body := bytes.Repeat([]byte("x"), int(cfg.s3PartSize))
+	input := testPutObjectInput("small.mp4")
+	if err := setSHA256Checksum(input, bytes.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := cfg.putObjectWithRetry(context.Background(), input, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("putObjectWithRetry = %v", err)
+	}
+
+	if got := fake.callCount("CreateMultipartUpload"); got != 0 {
+		t.Errorf("CreateMultipartUpload called %d times for a body of exactly S3_UPLOAD_PART_SIZE, want 0", got)
+	}
+	if got := fake.callCount("PutObject"); got != 1 {
+		t.Fatalf("PutObject called %d times, want 1", got)
+	}
+	if got, want := aws.ToString(fake.puts[0].ChecksumSHA256), aws.ToString(input.ChecksumSHA256); got != want {
+		t.Errorf("PutObject checksum = %q, want %q", got, want)
+	}
+}
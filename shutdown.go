@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultShutdownTimeout = 30 * time.Second
+	// forcedShutdownGrace is how long interrupted requests get to run their
+	// cleanup, such as removing temp files, once their connections are cut
+	forcedShutdownGrace = 5 * time.Second
+)
+
+// requestTracker counts the requests being handled so shutdown can wait
+// for them and report how many were drained.
+type requestTracker struct {
+	wg     sync.WaitGroup
+	active atomic.Int64
+}
+
+func (t *requestTracker) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.wg.Add(1)
+		t.active.Add(1)
+		defer func() {
+			t.active.Add(-1)
+			t.wg.Done()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// wait blocks until every tracked request has returned, reporting false if
+// that takes longer than timeout.
+func (t *requestTracker) wait(timeout time.Duration) bool {
+	return waitTimeout(&t.wg, timeout)
+}
+
+// waitTimeout waits for wg, reporting false if it takes longer than timeout.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
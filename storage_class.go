@@ -0,0 +1,20 @@
+package main
+
+import "github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+// allowedStorageClasses are the S3 storage classes a video can be uploaded
+// with.
+var allowedStorageClasses = map[types.StorageClass]bool{
+	types.StorageClassStandard:           true,
+	types.StorageClassStandardIa:         true,
+	types.StorageClassGlacier:            true,
+	types.StorageClassIntelligentTiering: true,
+}
+
+const allowedStorageClassesMessage = "Storage class must be one of STANDARD, STANDARD_IA, GLACIER or INTELLIGENT_TIERING"
+
+// requiresRestore reports whether objects in the storage class have to be
+// restored before they can be downloaded.
+func requiresRestore(storageClass string) bool {
+	return types.StorageClass(storageClass) == types.StorageClassGlacier
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// How HTML in video titles and descriptions is neutralized, set with
+// METADATA_HTML. Stripping suits clients that render text as text, which
+// would otherwise show escaped entities.
+const (
+	htmlModeStrip  = "strip"
+	htmlModeEscape = "escape"
+)
+
+var (
+	// htmlBlockPattern matches elements whose content is code rather than
+	// text, so stripping them drops the content too
+	htmlBlockPattern = regexp.MustCompile(`(?is)<(script|style)\b.*?(</(script|style)\s*>|$)`)
+	// htmlTagPattern matches anything a browser would parse as a tag,
+	// comment or declaration, closed or not. A "<" followed by a space or
+	// digit, as in "1 < 2", is plain text and left alone.
+	htmlTagPattern = regexp.MustCompile(`<[a-zA-Z/!?][^>]*>?`)
+)
+
+// parseHTMLMode validates METADATA_HTML.
+func parseHTMLMode(value string) (string, error) {
+	switch value {
+	case htmlModeStrip, htmlModeEscape:
+		return value, nil
+	}
+	return "", fmt.Errorf("must be %s or %s, got %q", htmlModeStrip, htmlModeEscape, value)
+}
+
+// sanitizeText neutralizes HTML in user-supplied text according to mode,
+// and drops control characters other than newlines and tabs, which only
+// multiline text keeps.
+func sanitizeText(mode, text string, multiline bool) string {
+	text = strings.Map(func(r rune) rune {
+		switch {
+		case multiline && (r == '\n' || r == '\t'):
+			return r
+		case r == '\n' || r == '\t':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, text)
+
+	if mode == htmlModeEscape {
+		return html.EscapeString(text)
+	}
+	// Removing a tag can join what was around it into a new one, as in
+	// "<<b>script>", so keep going until nothing changes
+	for {
+		stripped := htmlBlockPattern.ReplaceAllString(text, "")
+		stripped = htmlTagPattern.ReplaceAllString(stripped, "")
+		if stripped == text {
+			return text
+		}
+		text = stripped
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestSanitizeText(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		text      string
+		multiline bool
+		want      string
+	}{
+		{"script stripped with its content", htmlModeStrip, `Hi<script>alert("x")</script> there`, false, "Hi there"},
+		{"unclosed script stripped", htmlModeStrip, `Hi<script>alert("x")`, false, "Hi"},
+		{"tags stripped, text kept", htmlModeStrip, `<b>Bold</b> <img src=x onerror=alert(1)>move`, false, "Bold move"},
+		{"script split by a tag stripped", htmlModeStrip, `<<b>script>alert(1)<</b>/script>`, false, ""},
+		{"plain angle brackets kept", htmlModeStrip, "1 < 2 > 0", false, "1 < 2 > 0"},
+		{"script escaped", htmlModeEscape, `<script>alert("x")</script>`, false, "&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt;"},
+		{"angle brackets escaped", htmlModeEscape, "1 < 2 > 0", false, "1 &lt; 2 &gt; 0"},
+		{"newlines flattened", htmlModeStrip, "one\ntwo\x00", false, "one two"},
+		{"newlines kept when multiline", htmlModeStrip, "one\ntwo\x00", true, "one\ntwo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeText(tt.mode, tt.text, tt.multiline); got != tt.want {
+				t.Errorf("sanitizeText(%q, %q) = %q, want %q", tt.mode, tt.text, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// thumbnailSizes lists the resized variants stored next to each original
+// thumbnail, as filename suffix and target width in pixels.
+var thumbnailSizes = []struct {
+	name  string
+	width int
+}{
+	{name: "sm", width: 320},
+	{name: "md", width: 640},
+}
+
+// imageTooLargeError is returned by checkImageDimensions for an image
+// wider or taller than allowed.
+type imageTooLargeError struct {
+	width, height int
+	limit         image.Point
+}
+
+func (e imageTooLargeError) Error() string {
+	return fmt.Sprintf("image is %dx%d pixels, larger than the maximum of %dx%d", e.width, e.height, e.limit.X, e.limit.Y)
+}
+
+// checkImageDimensions reads just the image header to make sure decoding
+// it won't need more memory than an image of limit size would. This stops a
+// small, highly compressed file from declaring huge dimensions.
+func checkImageDimensions(src io.ReadSeeker, limit image.Point) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("couldn't seek image: %w", err)
+	}
+	config, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return fmt.Errorf("couldn't read image header: %w", err)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("couldn't seek image: %w", err)
+	}
+	if config.Width > limit.X || config.Height > limit.Y {
+		return imageTooLargeError{width: config.Width, height: config.Height, limit: limit}
+	}
+	return nil
+}
+
+// resizeImage scales src to the given width, preserving its aspect ratio.
+func resizeImage(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+	height := bounds.Dy() * width / bounds.Dx()
+	dst := image.NewRGBA(image.Rect(0, 0, width, max(height, 1)))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	return dst
+}
+
+// canEncodeImage reports whether encodeImage supports the type. Other
+// types, like WebP, which has no Go encoder, and GIF, whose animation
+// resizing would drop, are stored at their original size only.
+func canEncodeImage(mediaType string) bool {
+	return mediaType == "image/jpeg" || mediaType == "image/png"
+}
+
+func encodeImage(w io.Writer, img image.Image, mediaType string) error {
+	switch mediaType {
+	case "image/jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+	case "image/png":
+		return png.Encode(w, img)
+	}
+	return fmt.Errorf("can't encode images of type %s", mediaType)
+}
+
+// saveThumbnailVariants stores a resized copy of the thumbnail for each of
+// thumbnailSizes, named <name>_<size><ext>, and returns the asset filename
+// for every size plus "original". Sizes the source is already narrower
+// than point at the original rather than being upscaled, as do all sizes
+// of types canEncodeImage doesn't support. On error, any variants already
+// written are removed.
+func (cfg apiConfig) saveThumbnailVariants(ctx context.Context, src io.ReadSeeker, filename, mediaType string) (map[string]string, error) {
+	if !canEncodeImage(mediaType) {
+		variants := map[string]string{"original": filename}
+		for _, size := range thumbnailSizes {
+			variants[size.name] = filename
+		}
+		return variants, nil
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("couldn't seek thumbnail: %w", err)
+	}
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode thumbnail: %w", err)
+	}
+
+	dot := strings.LastIndex(filename, ".")
+	base, ext := filename[:dot], filename[dot:]
+
+	variants := map[string]string{"original": filename}
+	for _, size := range thumbnailSizes {
+		if img.Bounds().Dx() <= size.width {
+			variants[size.name] = filename
+			continue
+		}
+
+		var buf bytes.Buffer
+		err := encodeImage(&buf, resizeImage(img, size.width), mediaType)
+		if err == nil {
+			name := fmt.Sprintf("%s_%s%s", base, size.name, ext)
+			err = cfg.saveAsset(ctx, name, bytes.NewReader(buf.Bytes()))
+			if err == nil {
+				variants[size.name] = name
+				continue
+			}
+		}
+		cfg.removeThumbnailVariants(ctx, variants)
+		return nil, fmt.Errorf("couldn't create %s thumbnail: %w", size.name, err)
+	}
+	return variants, nil
+}
+
+// removeThumbnailVariants deletes the resized files created by
+// saveThumbnailVariants, leaving the original in place.
+func (cfg apiConfig) removeThumbnailVariants(ctx context.Context, variants map[string]string) {
+	for size, name := range variants {
+		if size != "original" && name != variants["original"] {
+			cfg.removeAsset(ctx, name)
+		}
+	}
+}
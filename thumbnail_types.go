@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+)
+
+// thumbnailFormats are the image formats that can be enabled for thumbnail
+// uploads with THUMBNAIL_FORMATS, keyed by the name used there.
+var thumbnailFormats = map[string]struct {
+	mediaType string
+	ext       string
+}{
+	"jpeg": {mediaType: "image/jpeg", ext: ".jpg"},
+	"png":  {mediaType: "image/png", ext: ".png"},
+	"webp": {mediaType: "image/webp", ext: ".webp"},
+	"gif":  {mediaType: "image/gif", ext: ".gif"},
+}
+
+// defaultThumbnailFormats leaves GIF out, as animated thumbnails have to be
+// opted into.
+const defaultThumbnailFormats = "jpeg,png,webp"
+
+// parseThumbnailFormats turns a comma-separated list of thumbnailFormats
+// names or their media types, such as "jpeg,image/png", into a map of
+// allowed media types to file extensions. Only these formats can be
+// decoded for resizing, so other image types are rejected.
+func parseThumbnailFormats(value string) (map[string]string, error) {
+	types := map[string]string{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if strings.Contains(name, "/") {
+			mediaType, params, err := mime.ParseMediaType(name)
+			if err != nil {
+				return nil, fmt.Errorf("%q isn't a media type: %w", name, err)
+			}
+			if len(params) > 0 {
+				return nil, fmt.Errorf("%q can't have parameters", name)
+			}
+			name = thumbnailFormatName(mediaType)
+		}
+		format, ok := thumbnailFormats[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown thumbnail format %q", name)
+		}
+		types[format.mediaType] = format.ext
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("at least one thumbnail format must be allowed")
+	}
+	return types, nil
+}
+
+// thumbnailFormatName returns the thumbnailFormats name for a media type,
+// or the media type itself if no format has it.
+func thumbnailFormatName(mediaType string) string {
+	for name, format := range thumbnailFormats {
+		if format.mediaType == mediaType {
+			return name
+		}
+	}
+	return mediaType
+}
+
+// thumbnailTypesMessage lists the allowed thumbnail types for error
+// responses.
+func (cfg *apiConfig) thumbnailTypesMessage() string {
+	mediaTypes := make([]string, 0, len(cfg.thumbnailTypes))
+	for mediaType := range cfg.thumbnailTypes {
+		mediaTypes = append(mediaTypes, mediaType)
+	}
+	sort.Strings(mediaTypes)
+	return "File type not allowed. Supported image types are " + strings.Join(mediaTypes, ", ") + "."
+}
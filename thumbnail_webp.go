@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// webpThumbnailName is the name the WebP copy of a thumbnail is stored
+// under, e.g. abc.jpg becomes abc.webp.
+func webpThumbnailName(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ".webp"
+}
+
+// saveWebPThumbnail stores a WebP copy of a JPEG or PNG thumbnail next to
+// the original when THUMBNAIL_WEBP is enabled, returning its asset name.
+// It returns "" without error for other types or when the option is off.
+// Go has no WebP encoder, so ffmpeg does the encoding.
+func (cfg apiConfig) saveWebPThumbnail(ctx context.Context, src io.ReadSeeker, filename, mediaType string) (string, error) {
+	if !cfg.thumbnailWebP || !canEncodeImage(mediaType) {
+		return "", nil
+	}
+
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("couldn't seek thumbnail: %w", err)
+	}
+	input, cleanupInput, err := cfg.newTempFile("tubely-thumbnail-*" + filepath.Ext(filename))
+	if err != nil {
+		return "", fmt.Errorf("couldn't create temporary file: %w", err)
+	}
+	defer cleanupInput()
+
+	if _, err := io.Copy(input, src); err != nil {
+		return "", fmt.Errorf("couldn't write temporary file: %w", err)
+	}
+	if err := input.Close(); err != nil {
+		return "", fmt.Errorf("couldn't write temporary file: %w", err)
+	}
+
+	outputPath := input.Name() + ".webp"
+	defer os.Remove(outputPath)
+
+	var stderr bytes.Buffer
+	err = cfg.runMediaCommand(ctx, cfg.ffmpegTimeout, func(ctx context.Context) error {
+		stderr.Reset()
+		cmd := newMediaCommand(ctx, cfg.ffmpegPath,
+			"-i", input.Name(),
+			"-c:v", "libwebp",
+			"-quality", "80",
+			"-y",
+			outputPath)
+		cmd.Stderr = &stderr
+		return cmd.Run()
+	})
+	if err != nil {
+		return "", fmt.Errorf("couldn't encode WebP thumbnail: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	// Make sure ffmpeg really produced a WebP image before it's stored
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read WebP thumbnail: %w", err)
+	}
+	if http.DetectContentType(data) != "image/webp" {
+		return "", errors.New("ffmpeg didn't produce a WebP image")
+	}
+
+	name := webpThumbnailName(filename)
+	err = cfg.saveAsset(ctx, name, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultMaxVideoBytes     = 1 << 30  // 1GB
+	defaultMaxThumbnailBytes = 10 << 20 // 10MB
+
+	// Thumbnails are decoded in full to resize them, at 4 bytes a pixel
+	defaultMaxThumbnailWidth  = 8192
+	defaultMaxThumbnailHeight = 8192
+
+	// Every upload buffers its file on disk, so this bounds temp space at
+	// about this many times MAX_VIDEO_BYTES
+	defaultMaxConcurrentUploads = 8
+	defaultUploadSlotWait       = 10 * time.Second
+
+	// statusClientClosedRequest is nginx's status for a client that went
+	// away before its request was handled. Nobody reads the response, but
+	// it keeps these apart from real failures in the request metrics.
+	statusClientClosedRequest = 499
+)
+
+// respondIfTooLarge sends a 413 naming the limit when err came from a body
+// cut off by http.MaxBytesReader, and reports whether it did.
+func respondIfTooLarge(w http.ResponseWriter, err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &maxBytesErr) {
+		return false
+	}
+	msg := fmt.Sprintf("Upload exceeds the maximum size of %d bytes", maxBytesErr.Limit)
+	respondWithErrorCode(w, http.StatusRequestEntityTooLarge, errCodeFileTooLarge, msg, err)
+	return true
+}
+
+// respondIfClientGone sends a 499 when err came from the client
+// disconnecting partway through sending the body, and reports whether it
+// did. The disconnect is logged as a warning rather than an error, as
+// there's nothing for the server to fix.
+func respondIfClientGone(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, context.Canceled) && !errors.Is(r.Context().Err(), context.Canceled) {
+		return false
+	}
+	slog.Warn("Upload interrupted, client disconnected",
+		slog.String("request_id", w.Header().Get(requestIDHeader)),
+		slog.String("path", r.URL.Path),
+		slog.Int64("content_length", r.ContentLength),
+		slog.Any("error", err),
+	)
+	respondWithErrorCode(w, statusClientClosedRequest, errCodeUploadInterrupted, "Upload was interrupted before the whole file arrived", nil)
+	return true
+}
+
+const (
+	defaultUploadTimeoutBase  = time.Minute
+	defaultUploadTimeoutPerMB = time.Second
+	defaultUploadTimeoutMax   = 30 * time.Minute
+
+	// uploadTimeoutGrace is how long past the read deadline the response
+	// may still be written, so a timed-out client gets a 408.
+	uploadTimeoutGrace = 10 * time.Second
+)
+
+// uploadTimeouts scales how long a video upload may take with its size.
+type uploadTimeouts struct {
+	base  time.Duration
+	perMB time.Duration
+	max   time.Duration
+}
+
+// forSize returns the time allowed for a body of contentLength bytes. A
+// body of unknown length (-1) only gets the base, so a chunked upload
+// can't claim the maximum by leaving Content-Length off; clients sending
+// large files should set it.
+func (t uploadTimeouts) forSize(contentLength int64) time.Duration {
+	if contentLength < 0 {
+		return t.base
+	}
+	megabytes := (contentLength + 1<<20 - 1) >> 20
+	timeout := t.base + time.Duration(megabytes)*t.perMB
+	if timeout > t.max || timeout < t.base {
+		return t.max
+	}
+	return timeout
+}
+
+// withUploadTimeout gives each request a deadline scaled to its
+// Content-Length. Reads of the body fail once it passes, which stops the
+// copy to the temp file, and the request context is cancelled so ffprobe
+// is killed too.
+func (cfg *apiConfig) withUploadTimeout(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timeout := cfg.uploadTimeouts.forSize(r.ContentLength)
+		deadline := time.Now().Add(timeout)
+
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(deadline); err != nil {
+			slog.Warn("Couldn't set upload read deadline", "error", err)
+		}
+		if err := rc.SetWriteDeadline(deadline.Add(uploadTimeoutGrace)); err != nil {
+			slog.Warn("Couldn't set upload write deadline", "error", err)
+		}
+
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// respondIfTimedOut sends a 408 when err came from the upload deadline
+// passing, and reports whether it did.
+func respondIfTimedOut(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	respondWithErrorCode(w, http.StatusRequestTimeout, errCodeUploadTimeout, "Upload took too long", err)
+	return true
+}
+
+// withUploadSlot holds one of MAX_CONCURRENT_UPLOADS slots while next
+// runs, so a burst of large uploads can't exhaust the temp directory.
+// Requests wait up to UPLOAD_SLOT_WAIT for a slot and then get a 503.
+func (cfg *apiConfig) withUploadSlot(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.uploadSlots == nil {
+			next(w, r)
+			return
+		}
+
+		timer := time.NewTimer(cfg.uploadSlotWait)
+		defer timer.Stop()
+		select {
+		case cfg.uploadSlots <- struct{}{}:
+		case <-timer.C:
+			slog.Warn("Upload rejected, every upload slot is busy", "slots", cap(cfg.uploadSlots))
+			w.Header().Set("Retry-After", strconv.Itoa(int(cfg.uploadSlotWait.Seconds())+1))
+			respondWithErrorCode(w, http.StatusServiceUnavailable, errCodeServerBusy, "Too many uploads in progress, try again later", nil)
+			return
+		case <-r.Context().Done():
+			return
+		}
+		uploadSlotsInUse.Inc()
+		defer func() {
+			uploadSlotsInUse.Dec()
+			<-cfg.uploadSlots
+		}()
+
+		next(w, r)
+	}
+}
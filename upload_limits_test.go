@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithUploadSlotSaturated(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	cfg.uploadSlots = make(chan struct{}, 1)
+	cfg.uploadSlotWait = 50 * time.Millisecond
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := cfg.withUploadSlot(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	upload := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		return rec
+	}
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- upload("/slow") }()
+	<-started
+
+	// The only slot is taken, so this one waits UPLOAD_SLOT_WAIT and gives up
+	rec := upload("/fast")
+	expectErrorCode(t, rec, http.StatusServiceUnavailable, errCodeServerBusy)
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("503 sent without Retry-After")
+	}
+
+	close(release)
+	expectStatus(t, <-done, http.StatusNoContent)
+
+	// The slot is given back once the upload finishes
+	expectStatus(t, upload("/fast"), http.StatusNoContent)
+}
+
+func TestUploadTimeoutsForSize(t *testing.T) {
+	timeouts := uploadTimeouts{base: time.Minute, perMB: time.Second, max: 30 * time.Minute}
+	tests := []struct {
+		name          string
+		contentLength int64
+		want          time.Duration
+	}{
+		{"unknown length", -1, time.Minute},
+		{"empty", 0, time.Minute},
+		{"partial MB rounds up", 1<<20 + 1, time.Minute + 2*time.Second},
+		{"capped", 1 << 40, 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := timeouts.forSize(tt.contentLength); got != tt.want {
+				t.Errorf("forSize(%d) = %s, want %s", tt.contentLength, got, tt.want)
+			}
+		})
+	}
+}
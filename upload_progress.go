@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+const (
+	// uploadProgressInterval is how often a progress event is sent
+	uploadProgressInterval = 500 * time.Millisecond
+	// uploadProgressRetention is how long a finished session stays around,
+	// so a client that connects late still gets its complete event
+	uploadProgressRetention = time.Minute
+)
+
+// uploadProgressTracker keeps byte counts for uploads that the client has
+// tagged with an upload session ID, so they can be watched over SSE.
+// Sessions are created by whichever side arrives first: the upload or a
+// watcher opened just before it.
+type uploadProgressTracker struct {
+	mu       sync.Mutex
+	sessions map[uuid.UUID]*uploadSession
+}
+
+type uploadSession struct {
+	userID   uuid.UUID
+	received atomic.Int64
+	total    atomic.Int64
+	started  bool
+	watchers int
+	done     chan struct{}
+	finished bool
+	failed   bool
+}
+
+type uploadProgressEvent struct {
+	Received int64  `json:"received"`
+	Total    int64  `json:"total,omitempty"`
+	Status   string `json:"status,omitempty"`
+}
+
+func newUploadProgressTracker() *uploadProgressTracker {
+	return &uploadProgressTracker{sessions: map[uuid.UUID]*uploadSession{}}
+}
+
+// session returns the session with the given ID, creating it if needed. It
+// returns false if the ID is already in use by another user.
+func (t *uploadProgressTracker) session(id, userID uuid.UUID) (*uploadSession, bool) {
+	s, ok := t.sessions[id]
+	if !ok {
+		s = &uploadSession{userID: userID, done: make(chan struct{})}
+		t.sessions[id] = s
+	}
+	return s, s.userID == userID
+}
+
+// start registers an upload of total bytes (or -1 if unknown) under id.
+// It returns nil if the session belongs to another user or already has an
+// upload.
+func (t *uploadProgressTracker) start(id, userID uuid.UUID, total int64) *uploadSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.session(id, userID)
+	if !ok || s.started {
+		return nil
+	}
+	s.started = true
+	if total > 0 {
+		s.total.Store(total)
+	}
+	return s
+}
+
+// finish marks the upload as fully received, or as failed, and drops the
+// session once late watchers have had a chance to see it. Only the first
+// call has any effect.
+func (t *uploadProgressTracker) finish(id uuid.UUID, s *uploadSession, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if s.finished {
+		return
+	}
+	s.finished = true
+	s.failed = failed
+	close(s.done)
+	time.AfterFunc(uploadProgressRetention, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.sessions[id] == s {
+			delete(t.sessions, id)
+		}
+	})
+}
+
+// watch adds a watcher to the session, returning false if it belongs to
+// another user. Callers must call unwatch when they stop.
+func (t *uploadProgressTracker) watch(id, userID uuid.UUID) (*uploadSession, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.session(id, userID)
+	if !ok {
+		return nil, false
+	}
+	s.watchers++
+	return s, true
+}
+
+// unwatch removes a watcher, dropping the session if no upload ever used it.
+func (t *uploadProgressTracker) unwatch(id uuid.UUID, s *uploadSession) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s.watchers--
+	if s.watchers == 0 && !s.started && t.sessions[id] == s {
+		delete(t.sessions, id)
+	}
+}
+
+func (s *uploadSession) event() uploadProgressEvent {
+	return uploadProgressEvent{Received: s.received.Load(), Total: s.total.Load()}
+}
+
+// progressReader counts the bytes read through it into an upload session.
+type progressReader struct {
+	io.ReadCloser
+	session *uploadSession
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.ReadCloser.Read(p)
+	pr.session.received.Add(int64(n))
+	return n, err
+}
+
+// trackUploadProgress wraps the request body so bytes received are
+// published to the session named by the upload_session query parameter,
+// if there is one. The returned function ends the session and must be
+// called with whether the body was received in full.
+func (cfg *apiConfig) trackUploadProgress(r *http.Request, userID uuid.UUID) (func(received bool), error) {
+	value := r.URL.Query().Get("upload_session")
+	if value == "" {
+		return func(bool) {}, nil
+	}
+	id, err := uuid.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload session ID: %w", err)
+	}
+
+	s := cfg.uploadProgress.start(id, userID, r.ContentLength)
+	if s == nil {
+		return nil, fmt.Errorf("upload session %s is already in use", id)
+	}
+	r.Body = &progressReader{ReadCloser: r.Body, session: s}
+	return func(received bool) {
+		cfg.uploadProgress.finish(id, s, !received)
+	}, nil
+}
+
+// handlerUploadProgress streams the progress of an upload as Server-Sent
+// Events: progress events while bytes arrive, then a single complete event
+// once the upload body has been received or the upload has failed. It can
+// be opened before the upload starts. Disconnecting only ends the stream.
+func (cfg *apiConfig) handlerUploadProgress(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := uuid.Parse(r.PathValue("sessionID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid upload session ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+
+	userID, err := auth.ValidateJWT(token, cfg.jwtTokens)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	session, ok := cfg.uploadProgress.watch(sessionID, userID)
+	if !ok {
+		// Report other users' sessions as missing rather than leaking them
+		respondWithError(w, http.StatusNotFound, "Upload session not found", nil)
+		return
+	}
+	defer cfg.uploadProgress.unwatch(sessionID, session)
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(uploadProgressInterval)
+	defer ticker.Stop()
+
+	last := uploadProgressEvent{Received: -1}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-session.done:
+			final := session.event()
+			final.Status = "received"
+			if session.failed {
+				final.Status = "failed"
+			}
+			writeSSEEvent(w, "complete", final)
+			rc.Flush()
+			return
+		case <-ticker.C:
+			current := session.event()
+			if current == last {
+				continue
+			}
+			last = current
+			if err := writeSSEEvent(w, "progress", current); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func writeSSEEvent(w io.Writer, event string, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
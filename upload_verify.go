@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	defaultUploadSniffBytes = 512
+	// minUploadSniffBytes is enough to see an MP4's ftyp box
+	minUploadSniffBytes = 12
+)
+
+// verifyUploadedVideo checks an object the client uploaded straight to S3
+// is really an MP4, since those bytes never went through the upload
+// handler's checks. It fetches the first UPLOAD_SNIFF_BYTES with a range
+// request to sniff the type, then has ffprobe read the object through a
+// presigned URL, returning what ffprobe found. Objects that fail either
+// check are deleted. It writes the error response itself and returns false
+// when the upload is rejected.
+//
+// Timeouts and S3 errors leave the object alone so the client can confirm
+// again; if it never does, the orphan cleanup removes it.
+func (cfg *apiConfig) verifyUploadedVideo(w http.ResponseWriter, r *http.Request, bucket regionBucket, key string) (FFProbeOutput, bool) {
+	object, err := bucket.client.GetObject(r.Context(), &s3.GetObjectInput{
+		Bucket: &bucket.name,
+		Key:    &key,
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", cfg.uploadSniffBytes-1)),
+	})
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't read uploaded video", err)
+		return FFProbeOutput{}, false
+	}
+	head, err := io.ReadAll(io.LimitReader(object.Body, cfg.uploadSniffBytes))
+	object.Body.Close()
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't read uploaded video", err)
+		return FFProbeOutput{}, false
+	}
+
+	mediaType, err := detectFileType(bytes.NewReader(head))
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't detect uploaded file type", err)
+		return FFProbeOutput{}, false
+	}
+	if mediaType != "video/mp4" {
+		cfg.deleteObject(r.Context(), bucket.name, key)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeUnsupportedMediaType, fmt.Sprintf("Uploaded file is %s, not an MP4", mediaType), nil)
+		return FFProbeOutput{}, false
+	}
+
+	objectURL, err := cfg.signObjectURL(r.Context(), bucket.name, key, cfg.s3PresignExpiry)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't generate presigned URL", err)
+		return FFProbeOutput{}, false
+	}
+	data, err := cfg.runFFProbe(r.Context(), objectURL)
+	if err == nil {
+		_, err = data.videoStream()
+	}
+	if errors.Is(err, errInvalidVideo) {
+		cfg.deleteObject(r.Context(), bucket.name, key)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidVideo, "Not a valid video: the file is corrupt or truncated", err)
+		return FFProbeOutput{}, false
+	}
+	if errors.Is(err, errNoVideoStream) {
+		cfg.deleteObject(r.Context(), bucket.name, key)
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeNoVideoStream, "File has no video stream", err)
+		return FFProbeOutput{}, false
+	}
+	if errors.Is(err, errMediaCommandTimeout) {
+		respondWithErrorCode(w, http.StatusUnprocessableEntity, errCodeMediaTimeout, "Timed out inspecting the video; the file may be malformed", err)
+		return FFProbeOutput{}, false
+	}
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't inspect uploaded video", err)
+		return FFProbeOutput{}, false
+	}
+	return data, true
+}
@@ -2,17 +2,24 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"os/exec"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type FFProbeOutput struct {
-	Streams []struct {
-		Width  int `json:"width"`
-		Height int `json:"height"`
-	} `json:"streams"`
+	Streams []FFProbeStream `json:"streams"`
+	Format  struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
 }
 
 /*
@@ -26,40 +33,157 @@ Create a function getVideoAspectRatio(filePath string) (string, error) that take
 ** Aspect ratios might be slightly off due to rounding errors. You can use a tolerance range (or just use integer division and call it a day).
 */
 
-func getVideoAspectRatio(filePath string) (string, error) {
-	cmd := exec.Command("ffprobe",
-		"-v", "error",
-		"-print_format", "json",
-		"-show_streams",
-		filePath)
+type FFProbeStream struct {
+	CodecType string `json:"codec_type"`
+	CodecName string `json:"codec_name"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	// AvgFrameRate is a fraction such as "30000/1001", or "0/0" if unknown
+	AvgFrameRate string `json:"avg_frame_rate"`
+}
+
+var errNoVideoStream = errors.New("file has no video stream")
 
-	var out bytes.Buffer
-	cmd.Stdout = &out
+// errInvalidVideo means ffprobe ran but couldn't make sense of the file,
+// e.g. because it's truncated or isn't a media file at all.
+var errInvalidVideo = errors.New("file is not a valid video")
+
+// videoStream returns the first video stream. ffprobe lists audio and
+// subtitle streams too, in whatever order the container has them.
+func (data FFProbeOutput) videoStream() (FFProbeStream, error) {
+	for _, stream := range data.Streams {
+		if stream.CodecType == "video" {
+			return stream, nil
+		}
+	}
+	return FFProbeStream{}, errNoVideoStream
+}
+
+// runFFProbe returns ffprobe's JSON description of the file's streams. A
+// file ffprobe rejects or finds no streams in is reported as
+// errInvalidVideo, so callers can tell it apart from ffprobe itself failing.
+// The input can be a local path or a URL ffprobe can read; probeInput
+// adds a fallback for URLs.
+func (cfg *apiConfig) runFFProbe(ctx context.Context, input string) (FFProbeOutput, error) {
+	return cfg.runFFProbeWithTimeout(ctx, input, cfg.ffprobeTimeout)
+}
 
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("error running ffprobe: %w", err)
+// runFFProbeWithTimeout is runFFProbe with a timeout other than
+// FFPROBE_TIMEOUT.
+func (cfg *apiConfig) runFFProbeWithTimeout(ctx context.Context, input string, timeout time.Duration) (FFProbeOutput, error) {
+	var out, stderr bytes.Buffer
+	err := cfg.runMediaCommand(ctx, timeout, func(ctx context.Context) error {
+		out.Reset()
+		stderr.Reset()
+		cmd := newMediaCommand(ctx, cfg.ffprobePath,
+			"-v", "error",
+			"-print_format", "json",
+			"-show_streams",
+			"-show_format",
+			input)
+		cmd.Stdout = &out
+		cmd.Stderr = &stderr
+		return cmd.Run()
+	})
+	if err != nil {
+		if errors.Is(err, errMediaCommandTimeout) {
+			return FFProbeOutput{}, fmt.Errorf("error running ffprobe: %w", err)
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && ctx.Err() == nil {
+			return FFProbeOutput{}, fmt.Errorf("%w: %s", errInvalidVideo, strings.TrimSpace(stderr.String()))
+		}
+		return FFProbeOutput{}, fmt.Errorf("error running ffprobe: %w", err)
 	}
 
 	var data FFProbeOutput
 	if err := json.Unmarshal(out.Bytes(), &data); err != nil {
-		return "", fmt.Errorf("error unmarshaling ffprobe output: %w", err)
+		return FFProbeOutput{}, fmt.Errorf("error unmarshaling ffprobe output: %w", err)
 	}
 
 	if len(data.Streams) == 0 {
-		return "", fmt.Errorf("no streams found in video file")
+		return FFProbeOutput{}, fmt.Errorf("%w: no streams found", errInvalidVideo)
+	}
+
+	return data, nil
+}
+
+// defaultAspectRatioTolerance is how far a video's width/height ratio may
+// drift from a known ratio and still be classified as it.
+const defaultAspectRatioTolerance = 0.1
+
+var knownAspectRatios = []struct {
+	name  string
+	ratio float64
+}{
+	{"16:9", 16.0 / 9.0},
+	{"9:16", 9.0 / 16.0},
+	{"4:3", 4.0 / 3.0},
+	{"1:1", 1.0},
+	{"21:9", 21.0 / 9.0},
+}
+
+// getVideoAspectRatio classifies the video's first video stream. The input
+// can be a local path or a URL; see probeInput.
+func (cfg *apiConfig) getVideoAspectRatio(ctx context.Context, input string, tolerance float64) (string, error) {
+	data, err := cfg.probeInput(ctx, input)
+	if err != nil {
+		return "", err
 	}
 
-	width := float64(data.Streams[0].Width)
-	height := float64(data.Streams[0].Height)
+	stream, err := data.videoStream()
+	if err != nil {
+		return "", err
+	}
+
+	return classifyAspectRatio(stream.Width, stream.Height, tolerance)
+}
+
+// getVideoDuration returns the length of the video in seconds. The input
+// can be a local path or a URL; see probeInput.
+func (cfg *apiConfig) getVideoDuration(ctx context.Context, input string) (float64, error) {
+	data, err := cfg.probeInput(ctx, input)
+	if err != nil {
+		return 0, err
+	}
+
+	duration, err := strconv.ParseFloat(data.Format.Duration, 64)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't parse video duration %q: %w", data.Format.Duration, err)
+	}
+	return duration, nil
+}
+
+// aspectRatioKeyPrefix maps an aspect ratio to the orientation folder its
+// video is stored under in S3.
+func aspectRatioKeyPrefix(aspectRatio string) string {
+	switch aspectRatio {
+	case "16:9", "4:3", "21:9":
+		return "landscape"
+	case "9:16":
+		return "portrait"
+	}
+	return "other"
+}
+
+// classifyAspectRatio returns the known ratio closest to width/height, or
+// "other" when none is within tolerance.
+func classifyAspectRatio(width, height int, tolerance float64) (string, error) {
+	if height <= 0 {
+		return "", fmt.Errorf("invalid video height %d", height)
+	}
 
-	// Calculate aspect ratio
-	ratio := width / height
+	ratio := float64(width) / float64(height)
 
-	if math.Abs(ratio-16.0/9.0) < 0.1 {
-		return "16:9", nil
-	} else if math.Abs(ratio-9.0/16.0) < 0.1 {
-		return "9:16", nil
+	closest := "other"
+	closestDiff := tolerance
+	for _, known := range knownAspectRatios {
+		diff := math.Abs(ratio - known.ratio)
+		if diff < closestDiff {
+			closest = known.name
+			closestDiff = diff
+		}
 	}
 
-	return "other", nil
+	return closest, nil
 }
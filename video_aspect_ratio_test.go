@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestGetVideoAspectRatio(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		want          string
+	}{
+		{name: "landscape", width: 1920, height: 1080, want: "16:9"},
+		{name: "portrait", width: 1080, height: 1920, want: "9:16"},
+		{name: "panorama", width: 3000, height: 600, want: "other"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, _ := newTestConfig(t)
+			useFakeFFprobe(t, cfg, probeJSON(tc.width, tc.height, "10.0"))
+
+			got, err := cfg.getVideoAspectRatio(context.Background(), "video.mp4", cfg.aspectTolerance)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("aspect ratio of %dx%d = %q, want %q", tc.width, tc.height, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetVideoAspectRatioAudioFirst(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	// Some containers list the audio stream first, which has no dimensions
+	useFakeFFprobe(t, cfg, `{
+	"streams": [
+		{"codec_type": "audio", "codec_name": "aac"},
+		{"codec_type": "video", "codec_name": "h264", "width": 1080, "height": 1920, "avg_frame_rate": "30/1"}
+	],
+	"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "10.0", "bit_rate": "1000000"}
+}`)
+
+	got, err := cfg.getVideoAspectRatio(context.Background(), "video.mp4", cfg.aspectTolerance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "9:16" {
+		t.Errorf("aspect ratio = %q, want 9:16 from the video stream", got)
+	}
+}
+
+func TestGetVideoAspectRatioCancelled(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	pidFile := filepath.Join(t.TempDir(), "ffprobe.pid")
+	cfg.ffprobePath = writeTestScript(t, "ffprobe", "echo $$ > "+pidFile+"\nexec sleep 30\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, probeErr := cfg.getVideoAspectRatio(ctx, "video.mp4", cfg.aspectTolerance)
+	if probeErr == nil {
+		t.Fatal("getVideoAspectRatio succeeded with the request cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("ffprobe ran for %s after the request was cancelled", elapsed)
+	}
+	pid, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("ffprobe never started: %v", err)
+	}
+	if p, _ := strconv.Atoi(strings.TrimSpace(string(pid))); syscall.Kill(p, 0) == nil {
+		t.Errorf("ffprobe (pid %d) still running after the request was cancelled", p)
+	}
+	// The client leaving says nothing about the file
+	if errors.Is(probeErr, errInvalidVideo) {
+		t.Errorf("cancelled probe reported as %v", probeErr)
+	}
+}
+
+func TestGetVideoAspectRatioTimeout(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	runs := filepath.Join(t.TempDir(), "ffprobe.runs")
+	cfg.ffprobePath = writeTestScript(t, "ffprobe", "echo $$ >> "+runs+"\nexec sleep 30\n")
+	cfg.ffprobeTimeout = 100 * time.Millisecond
+	cfg.mediaRetry = true
+
+	start := time.Now()
+	_, probeErr := cfg.getVideoAspectRatio(context.Background(), "video.mp4", cfg.aspectTolerance)
+	if !errors.Is(probeErr, errMediaCommandTimeout) {
+		t.Fatalf("err = %v, want %v", probeErr, errMediaCommandTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("ffprobe ran for %s with a %s timeout", elapsed, cfg.ffprobeTimeout)
+	}
+	// A hung ffprobe says nothing about the file
+	if errors.Is(probeErr, errInvalidVideo) {
+		t.Errorf("timed out probe reported as %v", probeErr)
+	}
+
+	data, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatalf("ffprobe never started: %v", err)
+	}
+	pids := strings.Fields(string(data))
+	if len(pids) != 2 {
+		t.Errorf("ffprobe ran %d times, want 2 with MEDIA_COMMAND_RETRY", len(pids))
+	}
+	for _, pid := range pids {
+		if p, _ := strconv.Atoi(pid); syscall.Kill(p, 0) == nil {
+			t.Errorf("ffprobe (pid %d) still running after its timeout", p)
+		}
+	}
+}
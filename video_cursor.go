@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+var errInvalidCursor = errors.New("cursor is invalid")
+
+// videoCursor is the JSON inside a listing's next_cursor. It's base64
+// encoded so clients treat it as opaque rather than building their own.
+type videoCursor struct {
+	CreatedAt time.Time `json:"created_at"`
+	ID        uuid.UUID `json:"id"`
+}
+
+// encodeVideoCursor returns the cursor for the page after video.
+func encodeVideoCursor(video database.Video) string {
+	dat, _ := json.Marshal(videoCursor{CreatedAt: video.CreatedAt, ID: video.ID})
+	return base64.RawURLEncoding.EncodeToString(dat)
+}
+
+func decodeVideoCursor(value string) (*database.VideoCursor, error) {
+	dat, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var cursor videoCursor
+	if err := json.Unmarshal(dat, &cursor); err != nil || cursor.ID == uuid.Nil {
+		return nil, errInvalidCursor
+	}
+	return &database.VideoCursor{CreatedAt: cursor.CreatedAt, ID: cursor.ID}, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// deleteVideoObjects removes the video's file, renditions and HLS stream
+// from S3.
+// Objects that are already gone count as deleted, and objects still shared
+// with a duplicate upload are kept.
+func (cfg *apiConfig) deleteVideoObjects(ctx context.Context, video database.Video) error {
+	return cfg.deleteUnsharedObjects(ctx, video, 1)
+}
+
+// deleteReplacedObjects removes the file and renditions video had before
+// a replacement, once the record points at the new file. It's best effort;
+// anything left behind is found by the orphan cleanup.
+func (cfg *apiConfig) deleteReplacedObjects(ctx context.Context, replaced database.Video) {
+	err := cfg.deleteUnsharedObjects(ctx, replaced, 0)
+	if err != nil {
+		log.Printf("Couldn't delete replaced file of video %s: %v", replaced.ID, err)
+	}
+}
+
+// deleteUnsharedObjects removes video's file, renditions and HLS stream.
+// references is how many records pointing at the file are expected, e.g.
+// 1 while video's own record still exists; the objects are kept while more
+// than references videos still point at them.
+func (cfg *apiConfig) deleteUnsharedObjects(ctx context.Context, video database.Video, references int) error {
+	bucket, key, ok := parseVideoURL(video)
+	if !ok {
+		return nil
+	}
+
+	sharedWith, err := cfg.db.CountVideosByVideoURL(*video.VideoURL)
+	if err != nil {
+		return fmt.Errorf("couldn't check for videos sharing %s: %w", key, err)
+	}
+	if sharedWith > references {
+		return nil
+	}
+
+	client := cfg.bucketByName(bucket).client
+	keys := []string{key}
+	for _, rendition := range video.Renditions {
+		keys = append(keys, rendition.Key)
+	}
+
+	for _, key := range keys {
+		_, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: &bucket,
+			Key:    &key,
+		})
+		if err != nil && !isS3NotFound(err) {
+			return fmt.Errorf("couldn't delete %s: %w", key, err)
+		}
+	}
+	if video.HLSPlaylistKey != nil {
+		return cfg.deleteObjectsWithPrefix(ctx, bucket, path.Dir(*video.HLSPlaylistKey)+"/")
+	}
+	return nil
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// videoJob is an accepted upload waiting for a worker to process and store
+// it. The job owns filePath and removes it once processing finishes.
+type videoJob struct {
+	jobID        uuid.UUID
+	videoID      uuid.UUID
+	userID       uuid.UUID
+	filePath     string
+	mediaType    string // detected type of the uploaded file
+	aspectRatio  string
+	contentHash  string // hex SHA-256 of the uploaded file
+	bucket       string // bucket the processed video is stored in
+	storageClass types.StorageClass
+	// thumbnail was uploaded with the video, if path isn't empty
+	thumbnail jobThumbnail
+	// replace deletes the video's earlier file once the new one is stored
+	replace bool
+	// normalize runs the audio, if there is any, through loudnorm
+	normalize bool
+	// qualityPreset, if set, is the preset to encode with; see
+	// jobQualityPreset
+	qualityPreset string
+}
+
+// jobThumbnail is a validated thumbnail waiting in a temporary file to be
+// stored along with its job's video.
+type jobThumbnail struct {
+	path      string
+	mediaType string
+	ext       string
+}
+
+// removeFiles deletes the temporary files the job owns.
+func (job videoJob) removeFiles() {
+	os.Remove(job.filePath)
+	if job.thumbnail.path != "" {
+		os.Remove(job.thumbnail.path)
+	}
+}
+
+// videoJobQueueSize bounds how many accepted uploads can wait for a free
+// worker before new uploads are turned away.
+const videoJobQueueSize = 100
+
+var errVideoJobQueueFull = errors.New("video processing queue is full")
+
+var errVideoJobQueueClosed = errors.New("server is shutting down")
+
+type videoJobQueue struct {
+	mu     sync.Mutex
+	closed bool
+	jobs   chan videoJob
+}
+
+func newVideoJobQueue() *videoJobQueue {
+	return &videoJobQueue{
+		jobs: make(chan videoJob, videoJobQueueSize),
+	}
+}
+
+func (q *videoJobQueue) enqueue(job videoJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return errVideoJobQueueClosed
+	}
+	select {
+	case q.jobs <- job:
+		return nil
+	default:
+		return errVideoJobQueueFull
+	}
+}
+
+// close stops the queue accepting jobs. Workers finish what's already
+// queued and then exit.
+func (q *videoJobQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+}
+
+// startVideoWorkers launches the pool of goroutines that process queued
+// uploads. The returned WaitGroup is done once the queue has been closed and
+// drained. Cancelling ctx aborts running jobs and fails any still queued.
+func (cfg *apiConfig) startVideoWorkers(ctx context.Context) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for range cfg.videoWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range cfg.videoJobs.jobs {
+				if ctx.Err() != nil {
+					cfg.failVideoJob(job, "Server shut down before processing finished", ctx.Err())
+					job.removeFiles()
+					continue
+				}
+				cfg.runVideoJob(ctx, job)
+			}
+		}()
+	}
+	return &wg
+}
+
+func (cfg *apiConfig) failVideoJob(job videoJob, msg string, err error) {
+	log.Printf("Video job %s failed: %s: %v", job.jobID, msg, err)
+	videoJobsTotal.WithLabelValues(database.JobStatusFailed).Inc()
+	updateErr := cfg.db.UpdateProcessingJobStatus(job.jobID, database.JobStatusFailed, msg)
+	if updateErr != nil {
+		log.Printf("Couldn't update status of video job %s: %v", job.jobID, updateErr)
+	}
+
+	// A failed re-upload leaves the earlier file, so the video stays ready
+	status := database.VideoStatusFailed
+	video, getErr := cfg.db.GetVideo(job.videoID)
+	if getErr == nil && video.VideoURL != nil {
+		status = database.VideoStatusReady
+	}
+	updateErr = cfg.db.UpdateVideoStatus(job.videoID, status)
+	if updateErr != nil {
+		log.Printf("Couldn't update status of video %s: %v", job.videoID, updateErr)
+	}
+}
+
+// runVideoJob processes and stores an upload. Jobs outlive the upload
+// request, so ctx is the worker's rather than the request's.
+func (cfg *apiConfig) runVideoJob(ctx context.Context, job videoJob) {
+	defer job.removeFiles()
+
+	// Jobs always wait their turn rather than failing, since the upload
+	// has already been accepted
+	unlock, err := cfg.videoLocks.lock(ctx, job.videoID)
+	if err != nil {
+		cfg.failVideoJob(job, "Couldn't lock video", err)
+		return
+	}
+	defer unlock()
+
+	err = cfg.db.UpdateProcessingJobStatus(job.jobID, database.JobStatusProcessing, "")
+	if err != nil {
+		log.Printf("Couldn't update status of video job %s: %v", job.jobID, err)
+	}
+
+	// Skip processing and storage entirely if the user has already
+	// uploaded these exact bytes and had them encoded and normalized the
+	// same way
+	qualityPreset := jobQualityPreset(job)
+	existing, err := cfg.db.GetVideoByContentHash(job.userID, job.contentHash)
+	if err != nil {
+		cfg.failVideoJob(job, "Couldn't check for duplicate uploads", err)
+		return
+	}
+	if existing.VideoURL != nil && existing.QualityPreset == qualityPreset && existing.NormalizeAudio == job.normalize {
+		cfg.reuseStoredVideo(ctx, job, existing)
+		return
+	}
+
+	// Videos without audio have nothing to normalize, and ffmpeg fails
+	// when -af has no stream to apply to
+	normalizeAudio := false
+	if job.normalize {
+		data, err := cfg.runFFProbe(ctx, job.filePath)
+		if err != nil {
+			cfg.failVideoJob(job, "Couldn't check video for audio", err)
+			return
+		}
+		normalizeAudio = data.hasAudioStream()
+		if !normalizeAudio {
+			log.Printf("Video job %s has no audio stream, skipping audio normalization", job.jobID)
+		}
+	}
+
+	// MP4s only need fast start unless a preset was chosen; the rest are
+	// transcoded to MP4, which enables fast start as well
+	var processedVideoPath string
+	onProgress := cfg.jobProgressRecorder(job.jobID)
+	if qualityPreset == "" {
+		processedVideoPath, err = cfg.processVideoForFastStart(ctx, job.filePath, normalizeAudio, onProgress)
+		if err != nil {
+			cfg.failVideoJob(job, "Couldn't process video for fast start", err)
+			return
+		}
+	} else {
+		processedVideoPath, err = cfg.transcodeToMP4(ctx, job.filePath, qualityPreset, normalizeAudio, onProgress)
+		if err != nil {
+			cfg.failVideoJob(job, "Couldn't transcode video to MP4", err)
+			return
+		}
+	}
+	// Clean up the processed file when we're done, unless it has been
+	// handed off for transcoding
+	keepProcessedFile := false
+	defer func() {
+		if !keepProcessedFile {
+			os.Remove(processedVideoPath)
+		}
+	}()
+
+	// Open the processed file for uploading
+	processedFile, err := os.Open(processedVideoPath)
+	if err != nil {
+		cfg.failVideoJob(job, "Couldn't open processed video file", err)
+		return
+	}
+	defer processedFile.Close()
+
+	// Generate random filename for S3, named for what processing made of
+	// the upload rather than what was sent
+	contentType := "video/mp4"
+	ext, ok := videoExtension(contentType)
+	if !ok {
+		cfg.failVideoJob(job, "Couldn't pick a file extension", fmt.Errorf("no extension known for %s", contentType))
+		return
+	}
+	key, err := getAssetKey(ext)
+	if err != nil {
+		cfg.failVideoJob(job, "Couldn't generate random filename", err)
+		return
+	}
+
+	filename := cfg.prefixedKey(fmt.Sprintf("%s/%s", aspectRatioKeyPrefix(job.aspectRatio), key))
+
+	// Reload the video so edits made while the job was queued are kept
+	video, err := cfg.db.GetVideo(job.videoID)
+	if err != nil {
+		cfg.failVideoJob(job, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		cfg.failVideoJob(job, "Video was deleted", nil)
+		return
+	}
+	replaced := video
+
+	// The processed file is what gets stored, and other uploads may have
+	// finished since the request was accepted
+	processedInfo, err := processedFile.Stat()
+	if err != nil {
+		cfg.failVideoJob(job, "Couldn't stat processed video file", err)
+		return
+	}
+	err = cfg.checkStorageQuota(video, processedInfo.Size())
+	if err != nil {
+		cfg.failVideoJob(job, "Storage quota exceeded", err)
+		return
+	}
+
+	// Upload to S3
+	contentDisposition := videoContentDisposition(video.Title)
+	input := &s3.PutObjectInput{
+		Bucket:               &job.bucket,
+		Key:                  &filename,
+		ContentType:          &contentType,
+		CacheControl:         &cfg.s3CacheControl,
+		ContentDisposition:   &contentDisposition,
+		ServerSideEncryption: cfg.s3SSE,
+		SSEKMSKeyId:          cfg.s3SSEKMSKeyID,
+		StorageClass:         job.storageClass,
+		Tagging:              cfg.videoObjectTagging(video),
+	}
+	err = setSHA256Checksum(input, processedFile)
+	if err != nil {
+		cfg.failVideoJob(job, "Couldn't checksum processed video", err)
+		return
+	}
+	err = cfg.putObjectWithRetry(ctx, input, processedFile)
+	if isS3ChecksumMismatch(err) {
+		cfg.failVideoJob(job, "Upload to S3 was corrupted in transit; upload the video again", err)
+		return
+	}
+	if err != nil {
+		cfg.failVideoJob(job, "Couldn't upload file to S3", err)
+		return
+	}
+
+	if cfg.s3VerifyUploads {
+		err = cfg.verifyUploadedObject(ctx, job.bucket, filename, processedFile)
+		if err != nil {
+			cfg.deleteObject(ctx, job.bucket, filename)
+			cfg.failVideoJob(job, "Uploaded video failed verification", err)
+			return
+		}
+	}
+
+	// The video and its uploaded thumbnail are stored together or not at
+	// all
+	uploadedThumbnail, err := cfg.saveJobThumbnail(ctx, job, &video)
+	if err != nil {
+		cfg.deleteObject(ctx, job.bucket, filename)
+		cfg.failVideoJob(job, "Couldn't save thumbnail", err)
+		return
+	}
+
+	// Store the bucket and key; a signed URL is generated on read
+	videoURL := fmt.Sprintf("%s,%s", job.bucket, filename)
+	video.VideoURL = &videoURL
+	video.ContentHash = &job.contentHash
+	video.StorageClass = string(job.storageClass)
+	video.QualityPreset = qualityPreset
+	video.NormalizeAudio = job.normalize
+	video.SizeBytes = processedInfo.Size()
+	video.ModerationStatus = database.ModerationStatusPendingReview
+
+	generatedThumbnail := cfg.generateMissingThumbnail(ctx, &video, job.filePath)
+
+	// Update video metadata in database
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		if uploadedThumbnail != nil {
+			cfg.removeSavedThumbnail(ctx, *uploadedThumbnail)
+		}
+		if generatedThumbnail != "" {
+			cfg.removeAsset(ctx, generatedThumbnail)
+		}
+		cfg.failVideoJob(job, "Couldn't update video metadata", err)
+		return
+	}
+
+	// Renditions of a previously uploaded file no longer apply
+	renditionsStatus := ""
+	if cfg.enableRenditions {
+		renditionsStatus = database.RenditionsStatusPending
+	}
+	err = cfg.db.UpdateVideoRenditions(video.ID, renditionsStatus, []database.Rendition{})
+	if err != nil {
+		cfg.failVideoJob(job, "Couldn't update video metadata", err)
+		return
+	}
+	hlsStatus := ""
+	if cfg.enableHLS {
+		hlsStatus = database.RenditionsStatusPending
+	}
+	err = cfg.db.UpdateVideoHLS(video.ID, hlsStatus, nil)
+	if err != nil {
+		cfg.failVideoJob(job, "Couldn't update video metadata", err)
+		return
+	}
+	cfg.recordVideoMetadata(ctx, video.ID, processedVideoPath)
+
+	err = cfg.db.UpdateVideoStatus(video.ID, database.VideoStatusReady)
+	if err != nil {
+		log.Printf("Couldn't update status of video %s: %v", video.ID, err)
+	}
+	videoJobsTotal.WithLabelValues(database.JobStatusDone).Inc()
+	err = cfg.db.UpdateProcessingJobStatus(job.jobID, database.JobStatusDone, "")
+	if err != nil {
+		log.Printf("Couldn't update status of video job %s: %v", job.jobID, err)
+	}
+	if job.replace && aws.ToString(replaced.VideoURL) != aws.ToString(video.VideoURL) {
+		cfg.deleteReplacedObjects(ctx, replaced)
+	}
+
+	if !cfg.moderateVideo(ctx, video.ID) {
+		return
+	}
+	cfg.notifyVideoUploaded(video)
+
+	if cfg.enableHLS {
+		cfg.generateHLS(ctx, video, processedVideoPath, job.bucket, filename)
+	}
+	if cfg.enableRenditions {
+		keepProcessedFile = true
+		cfg.generateRenditions(ctx, video.ID, processedVideoPath, job.bucket, filename)
+	}
+}
+
+// verifyUploadedObject checks with HeadObject that the object at key is
+// retrievable and as large as the file it was uploaded from.
+func (cfg *apiConfig) verifyUploadedObject(ctx context.Context, bucket, key string, file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("couldn't stat uploaded file: %w", err)
+	}
+
+	head, err := cfg.bucketByName(bucket).client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't find uploaded object: %w", err)
+	}
+	if head.ContentLength == nil || *head.ContentLength != info.Size() {
+		return fmt.Errorf("uploaded object is %d bytes, expected %d", aws.ToInt64(head.ContentLength), info.Size())
+	}
+	return nil
+}
+
+// deleteObject removes an object that shouldn't be kept. It's best effort,
+// as it's only used to clean up after other failures.
+func (cfg *apiConfig) deleteObject(ctx context.Context, bucket, key string) {
+	_, err := cfg.bucketByName(bucket).client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil && !isS3NotFound(err) {
+		log.Printf("Couldn't delete %s from S3: %v", key, err)
+	}
+}
+
+// reuseStoredVideo points the job's video at the objects already stored for
+// an identical upload instead of storing the same bytes again.
+func (cfg *apiConfig) reuseStoredVideo(ctx context.Context, job videoJob, existing database.Video) {
+	video, err := cfg.db.GetVideo(job.videoID)
+	if err != nil {
+		cfg.failVideoJob(job, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		cfg.failVideoJob(job, "Video was deleted", nil)
+		return
+	}
+	replaced := video
+
+	video.VideoURL = existing.VideoURL
+	video.ContentHash = existing.ContentHash
+	video.StorageClass = existing.StorageClass
+	video.QualityPreset = existing.QualityPreset
+	video.NormalizeAudio = existing.NormalizeAudio
+	video.SizeBytes = existing.SizeBytes
+	// Identical bytes get the same decision, so only moderate again if the
+	// original is still waiting for one
+	video.ModerationStatus = existing.ModerationStatus
+
+	uploadedThumbnail, err := cfg.saveJobThumbnail(ctx, job, &video)
+	if err != nil {
+		cfg.failVideoJob(job, "Couldn't save thumbnail", err)
+		return
+	}
+
+	generatedThumbnail := cfg.generateMissingThumbnail(ctx, &video, job.filePath)
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		if uploadedThumbnail != nil {
+			cfg.removeSavedThumbnail(ctx, *uploadedThumbnail)
+		}
+		if generatedThumbnail != "" {
+			cfg.removeAsset(ctx, generatedThumbnail)
+		}
+		cfg.failVideoJob(job, "Couldn't update video metadata", err)
+		return
+	}
+
+	// Share the renditions too once they exist. Re-uploading a video's own
+	// file leaves its renditions as they are.
+	if existing.ID != video.ID {
+		renditions := []database.Rendition{}
+		renditionsStatus := ""
+		if existing.RenditionsStatus == database.RenditionsStatusDone {
+			renditions = existing.Renditions
+			renditionsStatus = existing.RenditionsStatus
+		}
+		err = cfg.db.UpdateVideoRenditions(video.ID, renditionsStatus, renditions)
+		if err != nil {
+			cfg.failVideoJob(job, "Couldn't update video metadata", err)
+			return
+		}
+		var hlsPlaylistKey *string
+		hlsStatus := ""
+		if existing.HLSStatus == database.RenditionsStatusDone {
+			hlsPlaylistKey = existing.HLSPlaylistKey
+			hlsStatus = existing.HLSStatus
+		}
+		err = cfg.db.UpdateVideoHLS(video.ID, hlsStatus, hlsPlaylistKey)
+		if err != nil {
+			cfg.failVideoJob(job, "Couldn't update video metadata", err)
+			return
+		}
+		err = cfg.db.UpdateVideoMetadata(video.ID, existing.Metadata)
+		if err != nil {
+			cfg.failVideoJob(job, "Couldn't update video metadata", err)
+			return
+		}
+	}
+
+	err = cfg.db.UpdateVideoStatus(video.ID, database.VideoStatusReady)
+	if err != nil {
+		log.Printf("Couldn't update status of video %s: %v", video.ID, err)
+	}
+	videoJobsTotal.WithLabelValues(database.JobStatusDone).Inc()
+	err = cfg.db.UpdateProcessingJobStatus(job.jobID, database.JobStatusDone, "")
+	if err != nil {
+		log.Printf("Couldn't update status of video job %s: %v", job.jobID, err)
+	}
+	if job.replace && aws.ToString(replaced.VideoURL) != aws.ToString(video.VideoURL) {
+		cfg.deleteReplacedObjects(ctx, replaced)
+	}
+
+	if video.ModerationStatus == database.ModerationStatusPendingReview && !cfg.moderateVideo(ctx, video.ID) {
+		return
+	}
+	cfg.notifyVideoUploaded(video)
+}
+
+// saveJobThumbnail stores the thumbnail uploaded with the job's video, if
+// there is one, and points video at it. It returns nil when there is none.
+func (cfg *apiConfig) saveJobThumbnail(ctx context.Context, job videoJob, video *database.Video) (*savedThumbnail, error) {
+	if job.thumbnail.path == "" {
+		return nil, nil
+	}
+	file, err := os.Open(job.thumbnail.path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open thumbnail: %w", err)
+	}
+	defer file.Close()
+
+	thumbnail, err := cfg.saveThumbnail(ctx, file, job.thumbnail.mediaType, job.thumbnail.ext)
+	if err != nil {
+		return nil, err
+	}
+	thumbnailURL := cfg.getAssetURL(thumbnail.filename)
+	video.ThumbnailURL = &thumbnailURL
+	return &thumbnail, nil
+}
+
+// generateMissingThumbnail gives the video a thumbnail taken from its file
+// if the user hasn't uploaded one, returning the saved asset's name, or ""
+// if none was saved.
+func (cfg *apiConfig) generateMissingThumbnail(ctx context.Context, video *database.Video, videoPath string) string {
+	if video.ThumbnailURL != nil {
+		return ""
+	}
+	filename, err := cfg.saveGeneratedThumbnail(ctx, videoPath)
+	if err != nil {
+		log.Printf("Couldn't generate thumbnail for video %s: %v", video.ID, err)
+		return ""
+	}
+	thumbnailURL := cfg.getAssetURL(filename)
+	video.ThumbnailURL = &thumbnailURL
+	return filename
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// errVideoBusy is returned by acquireVideoLock when another operation is
+// still working on the video.
+var errVideoBusy = errors.New("video is already being processed")
+
+// videoLocks serializes operations that rewrite a video's stored objects,
+// such as processing jobs, reprocessing, and key rotation, so they don't
+// race on the same S3 keys. Locks only exist while held or waited on.
+type videoLocks struct {
+	mu    sync.Mutex
+	locks map[uuid.UUID]*videoLock
+}
+
+type videoLock struct {
+	// held has room for one token; whoever puts it there holds the lock
+	held chan struct{}
+	// refs counts holders and waiters, so the lock is dropped when unused
+	refs int
+}
+
+func newVideoLocks() *videoLocks {
+	return &videoLocks{locks: map[uuid.UUID]*videoLock{}}
+}
+
+// lock waits until it holds the video's lock, returning the function that
+// releases it. It gives up, returning ctx's error, if ctx is done first.
+func (l *videoLocks) lock(ctx context.Context, videoID uuid.UUID) (func(), error) {
+	l.mu.Lock()
+	vl, ok := l.locks[videoID]
+	if !ok {
+		vl = &videoLock{held: make(chan struct{}, 1)}
+		l.locks[videoID] = vl
+	}
+	vl.refs++
+	l.mu.Unlock()
+
+	unlock := func() {
+		<-vl.held
+		l.release(videoID, vl)
+	}
+
+	// Take a free lock even if ctx is already done
+	select {
+	case vl.held <- struct{}{}:
+		return unlock, nil
+	default:
+	}
+
+	select {
+	case vl.held <- struct{}{}:
+		return unlock, nil
+	case <-ctx.Done():
+		l.release(videoID, vl)
+		return nil, ctx.Err()
+	}
+}
+
+func (l *videoLocks) release(videoID uuid.UUID, vl *videoLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	vl.refs--
+	if vl.refs == 0 {
+		delete(l.locks, videoID)
+	}
+}
+
+// acquireVideoLock takes the video's lock for a request, waiting up to
+// VIDEO_LOCK_WAIT for another operation to finish. It returns
+// errVideoBusy if the lock is still held after that.
+func (cfg *apiConfig) acquireVideoLock(ctx context.Context, videoID uuid.UUID) (func(), error) {
+	waitCtx, cancel := context.WithTimeout(ctx, cfg.videoLockWait)
+	defer cancel()
+
+	unlock, err := cfg.videoLocks.lock(waitCtx, videoID)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, errVideoBusy
+	}
+	return unlock, nil
+}
+
+// respondIfVideoBusy sends a 409 when err came from acquireVideoLock
+// timing out, and reports whether it did.
+func respondIfVideoBusy(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, errVideoBusy) {
+		return false
+	}
+	respondWithErrorCode(w, http.StatusConflict, errCodeVideoBusy, "Video is already being processed, try again later", err)
+	return true
+}
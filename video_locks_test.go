@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestVideoLocksSerialize(t *testing.T) {
+	locks := newVideoLocks()
+	videoID := uuid.New()
+
+	var active, maxActive atomic.Int32
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := locks.lock(context.Background(), videoID)
+			if err != nil {
+				t.Errorf("lock: %v", err)
+				return
+			}
+			n := active.Add(1)
+			if n > maxActive.Load() {
+				maxActive.Store(n)
+			}
+			time.Sleep(time.Millisecond)
+			active.Add(-1)
+			unlock()
+		}()
+	}
+	wg.Wait()
+
+	if got := maxActive.Load(); got != 1 {
+		t.Errorf("%d holders at once, want 1", got)
+	}
+	if len(locks.locks) != 0 {
+		t.Errorf("%d locks left after every holder released, want 0", len(locks.locks))
+	}
+}
+
+func TestVideoLocksIndependentVideos(t *testing.T) {
+	locks := newVideoLocks()
+
+	unlock, err := locks.lock(context.Background(), uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	other, err := locks.lock(ctx, uuid.New())
+	if err != nil {
+		t.Fatalf("another video's lock blocked: %v", err)
+	}
+	other()
+}
+
+func TestAcquireVideoLock(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	videoID := uuid.New()
+
+	unlock, err := cfg.videoLocks.lock(context.Background(), videoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.videoLockWait = 10 * time.Millisecond
+	if _, err := cfg.acquireVideoLock(context.Background(), videoID); !errors.Is(err, errVideoBusy) {
+		t.Fatalf("acquireVideoLock on a held lock = %v, want errVideoBusy", err)
+	}
+
+	// A lock released within VIDEO_LOCK_WAIT is taken
+	cfg.videoLockWait = 5 * time.Second
+	time.AfterFunc(20*time.Millisecond, unlock)
+	second, err := cfg.acquireVideoLock(context.Background(), videoID)
+	if err != nil {
+		t.Fatalf("acquireVideoLock after release = %v", err)
+	}
+	second()
+
+	// The request going away isn't reported as the video being busy
+	unlock, err = cfg.videoLocks.lock(context.Background(), videoID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cfg.acquireVideoLock(ctx, videoID); !errors.Is(err, context.Canceled) {
+		t.Fatalf("acquireVideoLock with a cancelled request = %v, want context.Canceled", err)
+	}
+}
+
+// TestHandlersRespectVideoLock checks every handler that rewrites a video
+// answers 409 while something else holds its lock.
+func TestHandlersRespectVideoLock(t *testing.T) {
+	cfg, fake := newTestConfig(t)
+	user := createTestUser(t, cfg)
+	token := testToken(t, cfg, user.ID)
+	video := storeTestVideo(t, cfg, fake, createTestVideo(t, cfg, user.ID), testMP4)
+	videoID := video.ID.String()
+
+	upload, err := cfg.db.CreateMultipartUpload(database.CreateMultipartUploadParams{
+		UploadID: "upload-busy",
+		VideoID:  video.ID,
+		UserID:   user.ID,
+		Key:      testVideoKey(t, ""),
+		Bucket:   testBucket,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.db.SaveMultipartPart(upload.UploadID, database.MultipartPart{PartNumber: 1, ETag: `"etag"`, Size: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := cfg.videoLocks.lock(context.Background(), video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	cfg.videoLockWait = 10 * time.Millisecond
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		req     *http.Request
+	}{
+		{
+			"PATCH metadata",
+			cfg.handlerUpdateVideoMetadata,
+			newTestRequest(http.MethodPatch, "/api/videos/"+videoID, jsonBody(t, map[string]string{"title": "New"}), token, "videoID", videoID),
+		},
+		{
+			"confirm upload",
+			cfg.withAuth(cfg.handlerConfirmVideoUpload),
+			newTestRequest(http.MethodPost, "/api/video_upload/"+videoID+"/confirm", jsonBody(t, map[string]string{"key": testVideoKey(t, "")}), token, "videoID", videoID),
+		},
+		{
+			"complete multipart upload",
+			cfg.withAuth(cfg.handlerCompleteMultipartUpload),
+			newTestRequest(http.MethodPost, "/api/multipart_uploads/"+upload.UploadID+"/complete", nil, token, "uploadID", upload.UploadID),
+		},
+		{
+			"thumbnail upload",
+			cfg.withAuth(cfg.handlerUploadThumbnail),
+			newThumbnailRequest(t, token, videoID, "image/png", testPNG(t, 64, 36)),
+		},
+		{
+			"delete",
+			cfg.handlerDeleteVideo,
+			newTestRequest(http.MethodDelete, "/api/videos/"+videoID, nil, token, "videoID", videoID),
+		},
+		{
+			"admin delete",
+			cfg.handlerAdminDeleteVideo,
+			newTestRequest(http.MethodDelete, "/admin/videos/"+videoID, nil, testToken(t, cfg, user.ID, auth.ScopeAdmin), "videoID", videoID),
+		},
+		{
+			"thumbnail at time",
+			cfg.handlerGenerateThumbnailAtTime,
+			newTestRequest(http.MethodPost, "/api/videos/"+videoID+"/thumbnail?timestamp=1", nil, token, "videoID", videoID),
+		},
+		{
+			"preview",
+			cfg.handlerGenerateVideoPreview,
+			newTestRequest(http.MethodPost, "/api/videos/"+videoID+"/preview", nil, token, "videoID", videoID),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(tt.handler, tt.req)
+			expectErrorCode(t, rec, http.StatusConflict, errCodeVideoBusy)
+		})
+	}
+
+	if got := getTestVideo(t, cfg, video.ID); got.Title != video.Title || *got.VideoURL != *video.VideoURL {
+		t.Errorf("video changed while locked: %+v", got)
+	}
+	if got := fake.callCount("CompleteMultipartUpload"); got != 0 {
+		t.Errorf("CompleteMultipartUpload called %d times while locked", got)
+	}
+}
+
+// TestUpdateVideoMetadataWaitsForLock checks an edit made while a job
+// holds the lock lands after the job, rather than being overwritten by it.
+func TestUpdateVideoMetadataWaitsForLock(t *testing.T) {
+	cfg, _ := newTestConfig(t)
+	user := createTestUser(t, cfg)
+	video := createTestVideo(t, cfg, user.ID)
+	cfg.videoLockWait = 5 * time.Second
+
+	unlock, err := cfg.videoLocks.lock(context.Background(), video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := newTestRequest(http.MethodPatch, "/api/videos/"+video.ID.String(), jsonBody(t, map[string]string{"title": "Edited"}),
+		testToken(t, cfg, user.ID), "videoID", video.ID.String())
+	done := make(chan int)
+	go func() {
+		done <- serve(cfg.handlerUpdateVideoMetadata, req).Code
+	}()
+
+	select {
+	case status := <-done:
+		t.Fatalf("PATCH finished with %d while the video was locked", status)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Stand in for a job rewriting the row while it holds the lock
+	locked := getTestVideo(t, cfg, video.ID)
+	locked.Title = "Written by a job"
+	if err := cfg.db.UpdateVideo(locked); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+
+	if status := <-done; status != http.StatusOK {
+		t.Fatalf("PATCH status = %d, want %d", status, http.StatusOK)
+	}
+	if got := getTestVideo(t, cfg, video.ID).Title; got != "Edited" {
+		t.Errorf("title = %q, want the edit made after the job", got)
+	}
+}
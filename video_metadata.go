@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// getVideoMetadata probes the codecs, resolution, frame rate, bit rate and
+// duration of a video. The input can be a local path or a URL; see
+// probeInput.
+func (cfg *apiConfig) getVideoMetadata(ctx context.Context, input string) (database.VideoMetadata, error) {
+	data, err := cfg.probeInput(ctx, input)
+	if err != nil {
+		return database.VideoMetadata{}, err
+	}
+	return videoMetadataFromProbe(data)
+}
+
+// videoMetadataFromProbe picks the metadata out of ffprobe's output. Bit
+// rates and durations some containers don't record are left at zero.
+func videoMetadataFromProbe(data FFProbeOutput) (database.VideoMetadata, error) {
+	stream, err := data.videoStream()
+	if err != nil {
+		return database.VideoMetadata{}, err
+	}
+
+	metadata := database.VideoMetadata{
+		Format:     data.Format.FormatName,
+		VideoCodec: stream.CodecName,
+		Width:      stream.Width,
+		Height:     stream.Height,
+		FrameRate:  parseFrameRate(stream.AvgFrameRate),
+	}
+	for _, s := range data.Streams {
+		if s.CodecType == "audio" {
+			metadata.AudioCodec = s.CodecName
+			break
+		}
+	}
+	if data.Format.Duration != "" {
+		metadata.DurationSeconds, err = strconv.ParseFloat(data.Format.Duration, 64)
+		if err != nil {
+			return database.VideoMetadata{}, fmt.Errorf("couldn't parse video duration %q: %w", data.Format.Duration, err)
+		}
+	}
+	if data.Format.BitRate != "" {
+		metadata.BitRate, err = strconv.ParseInt(data.Format.BitRate, 10, 64)
+		if err != nil {
+			return database.VideoMetadata{}, fmt.Errorf("couldn't parse bit rate %q: %w", data.Format.BitRate, err)
+		}
+	}
+	return metadata, nil
+}
+
+// parseFrameRate turns one of ffprobe's fractional rates into frames per
+// second, returning 0 for ones it doesn't know.
+func parseFrameRate(rate string) float64 {
+	num, den, ok := strings.Cut(rate, "/")
+	if !ok {
+		fps, _ := strconv.ParseFloat(rate, 64)
+		return fps
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// recordVideoMetadata probes the file just stored for a video and saves
+// what it found. It only logs failures, since the video itself is fine; a
+// file that can't be probed clears the previous file's metadata.
+func (cfg *apiConfig) recordVideoMetadata(ctx context.Context, videoID uuid.UUID, filePath string) {
+	var stored *database.VideoMetadata
+	metadata, err := cfg.getVideoMetadata(ctx, filePath)
+	if err != nil {
+		log.Printf("Couldn't probe metadata of video %s: %v", videoID, err)
+	} else {
+		stored = &metadata
+	}
+	err = cfg.db.UpdateVideoMetadata(videoID, stored)
+	if err != nil {
+		log.Printf("Couldn't save metadata of video %s: %v", videoID, err)
+	}
+}
+
+// handlerGetVideoMetadata returns the technical details of a video's
+// stored file, for diagnosing playback problems. Owners and admins may
+// call it. Videos stored before metadata was recorded are probed on the
+// first request and the result saved.
+func (cfg *apiConfig) handlerGetVideoMetadata(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtTokens)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusUnauthorized, errCodeUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Video not found", nil)
+		return
+	}
+	if video.UserID != userID {
+		_, err := auth.ValidateJWTWithScope(token, cfg.jwtTokens, auth.ScopeAdmin)
+		if err != nil {
+			respondWithErrorCode(w, http.StatusForbidden, errCodeNotOwner, "You can't view this video's metadata", err)
+			return
+		}
+	}
+
+	if video.Metadata != nil {
+		respondWithJSON(w, http.StatusOK, video.Metadata)
+		return
+	}
+
+	bucket, key, ok := parseVideoURL(video)
+	if !ok {
+		respondWithErrorCode(w, http.StatusNotFound, errCodeNotFound, "Video has no uploaded file yet", nil)
+		return
+	}
+	if requiresRestore(video.StorageClass) {
+		respondWithErrorCode(w, http.StatusConflict, errCodeConflict, "Video is archived and must be restored first", nil)
+		return
+	}
+
+	videoURL, err := cfg.signObjectURL(r.Context(), bucket, key, cfg.s3PresignExpiry)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't generate presigned URL", err)
+		return
+	}
+	metadata, err := cfg.getVideoMetadata(r.Context(), videoURL)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't probe video", err)
+		return
+	}
+	err = cfg.db.UpdateVideoMetadata(video.ID, &metadata)
+	if err != nil {
+		respondWithErrorCode(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save video metadata", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, metadata)
+}
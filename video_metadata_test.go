@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// ffprobeSample is trimmed from what ffprobe prints for a phone recording,
+// with the audio stream listed first as such files often have it.
+const ffprobeSample = `{
+	"streams": [
+		{
+			"index": 0,
+			"codec_name": "aac",
+			"codec_type": "audio",
+			"sample_rate": "48000",
+			"channels": 2,
+			"avg_frame_rate": "0/0",
+			"bit_rate": "192000"
+		},
+		{
+			"index": 1,
+			"codec_name": "hevc",
+			"codec_type": "video",
+			"width": 1080,
+			"height": 1920,
+			"r_frame_rate": "30/1",
+			"avg_frame_rate": "30000/1001",
+			"bit_rate": "8000000"
+		}
+	],
+	"format": {
+		"filename": "IMG_0001.MOV",
+		"nb_streams": 2,
+		"format_name": "mov,mp4,m4a,3gp,3g2,mj2",
+		"start_time": "0.000000",
+		"duration": "12.345678",
+		"size": "12543210",
+		"bit_rate": "8128532"
+	}
+}`
+
+func TestVideoMetadataFromProbe(t *testing.T) {
+	var data FFProbeOutput
+	if err := json.Unmarshal([]byte(ffprobeSample), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := videoMetadataFromProbe(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := database.VideoMetadata{
+		Format:          "mov,mp4,m4a,3gp,3g2,mj2",
+		DurationSeconds: 12.345678,
+		BitRate:         8128532,
+		VideoCodec:      "hevc",
+		Width:           1080,
+		Height:          1920,
+		FrameRate:       30000.0 / 1001.0,
+		AudioCodec:      "aac",
+	}
+	if got != want {
+		t.Errorf("metadata = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseFrameRate(t *testing.T) {
+	tests := []struct {
+		rate string
+		want float64
+	}{
+		{rate: "30/1", want: 30},
+		{rate: "24000/1001", want: 24000.0 / 1001.0},
+		{rate: "25", want: 25},
+		{rate: "0/0", want: 0},
+		{rate: "", want: 0},
+	}
+	for _, tc := range tests {
+		if got := parseFrameRate(tc.rate); got != tc.want {
+			t.Errorf("parseFrameRate(%q) = %v, want %v", tc.rate, got, tc.want)
+		}
+	}
+}
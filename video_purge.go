@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	defaultVideoRecoveryWindow = 30 * 24 * time.Hour
+	defaultVideoPurgeInterval  = time.Hour
+)
+
+// runVideoPurger purges videos deleted longer than VIDEO_RECOVERY_WINDOW
+// ago, at startup and then every VIDEO_PURGE_INTERVAL, until ctx is done.
+func (cfg *apiConfig) runVideoPurger(ctx context.Context) {
+	ticker := time.NewTicker(cfg.purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		cfg.purgeDeletedVideos(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeDeletedVideos removes the files and records of videos whose
+// recovery window has passed. Videos that fail are logged and left for the
+// next run.
+func (cfg *apiConfig) purgeDeletedVideos(ctx context.Context) {
+	videos, err := cfg.db.GetVideosDeletedBefore(time.Now().Add(-cfg.recoveryWindow))
+	if err != nil {
+		log.Printf("Couldn't get deleted videos to purge: %v", err)
+		return
+	}
+
+	purged := 0
+	for _, video := range videos {
+		if ctx.Err() != nil {
+			return
+		}
+		// Wait for anything still working on the video's objects
+		unlock, err := cfg.videoLocks.lock(ctx, video.ID)
+		if err != nil {
+			return
+		}
+		err = cfg.purgeVideo(ctx, video)
+		unlock()
+		if err != nil {
+			log.Printf("Couldn't purge deleted video %s: %v", video.ID, err)
+			continue
+		}
+		purged++
+	}
+	if purged > 0 {
+		log.Printf("Purged %d deleted videos", purged)
+	}
+}
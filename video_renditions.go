@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// renditionHeights are the lower resolutions transcoded for viewers on slow
+// connections. Heights at or above the source's are skipped.
+var renditionHeights = []int{480, 720}
+
+// transcodeRendition scales the video down to the given height and returns
+// the path to the transcoded file.
+func (cfg *apiConfig) transcodeRendition(ctx context.Context, filePath string, height int) (string, error) {
+	outputPath := fmt.Sprintf("%s.%dp.mp4", filePath, height)
+
+	err := cfg.runMediaCommand(ctx, cfg.ffmpegTimeout, func(ctx context.Context) error {
+		return newMediaCommand(ctx, cfg.ffmpegPath,
+			"-i", filePath,
+			"-vf", fmt.Sprintf("scale=-2:%d", height),
+			"-c:v", "libx264",
+			"-preset", "fast",
+			"-crf", "23",
+			"-c:a", "aac",
+			"-movflags", "faststart",
+			"-f", "mp4",
+			"-y",
+			outputPath).Run()
+	})
+	if err != nil {
+		os.Remove(outputPath)
+		return "", fmt.Errorf("failed to transcode %dp rendition: %w", height, err)
+	}
+
+	return outputPath, nil
+}
+
+// renditionKey derives a rendition's key from the original's, e.g.
+// landscape/<hex>.mp4 becomes landscape/<hex>_480.mp4.
+func renditionKey(key string, height int) string {
+	ext := path.Ext(key)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(key, ext), height, ext)
+}
+
+// generateRenditions runs in the background after an upload has been
+// accepted. It takes ownership of filePath and removes it when done.
+func (cfg *apiConfig) generateRenditions(ctx context.Context, videoID uuid.UUID, filePath, bucket, key string) {
+	defer os.Remove(filePath)
+
+	err := cfg.db.UpdateVideoRenditions(videoID, database.RenditionsStatusProcessing, nil)
+	if err != nil {
+		log.Printf("Couldn't update rendition status for video %s: %v", videoID, err)
+	}
+
+	renditions, err := cfg.uploadRenditions(ctx, filePath, bucket, key)
+	if err != nil {
+		log.Printf("Couldn't generate renditions for video %s: %v", videoID, err)
+		err = cfg.db.UpdateVideoRenditions(videoID, database.RenditionsStatusFailed, nil)
+		if err != nil {
+			log.Printf("Couldn't update rendition status for video %s: %v", videoID, err)
+		}
+		return
+	}
+
+	err = cfg.db.UpdateVideoRenditions(videoID, database.RenditionsStatusDone, renditions)
+	if err != nil {
+		log.Printf("Couldn't save renditions for video %s: %v", videoID, err)
+	}
+}
+
+func (cfg *apiConfig) uploadRenditions(ctx context.Context, filePath, bucket, key string) ([]database.Rendition, error) {
+	data, err := cfg.runFFProbe(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := data.videoStream()
+	if err != nil {
+		return nil, err
+	}
+	sourceHeight := stream.Height
+
+	renditions := []database.Rendition{}
+	for _, height := range renditionHeights {
+		if height >= sourceHeight {
+			continue
+		}
+
+		rendition := database.Rendition{
+			Height: height,
+			Key:    renditionKey(key, height),
+		}
+		err := cfg.uploadRendition(ctx, filePath, bucket, rendition)
+		if err != nil {
+			// Don't leave earlier renditions of a failed set behind
+			for _, uploaded := range renditions {
+				cfg.bucketByName(bucket).client.DeleteObject(ctx, &s3.DeleteObjectInput{
+					Bucket: &bucket,
+					Key:    &uploaded.Key,
+				})
+			}
+			return nil, err
+		}
+		renditions = append(renditions, rendition)
+	}
+	return renditions, nil
+}
+
+func (cfg *apiConfig) uploadRendition(ctx context.Context, filePath, bucket string, rendition database.Rendition) error {
+	transcodedPath, err := cfg.transcodeRendition(ctx, filePath, rendition.Height)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(transcodedPath)
+
+	transcodedFile, err := os.Open(transcodedPath)
+	if err != nil {
+		return fmt.Errorf("couldn't open %dp rendition: %w", rendition.Height, err)
+	}
+	defer transcodedFile.Close()
+
+	contentType := "video/mp4"
+	err = cfg.putObjectWithRetry(ctx, &s3.PutObjectInput{
+		Bucket:               &bucket,
+		Key:                  &rendition.Key,
+		ContentType:          &contentType,
+		CacheControl:         &cfg.s3CacheControl,
+		ServerSideEncryption: cfg.s3SSE,
+		SSEKMSKeyId:          cfg.s3SSEKMSKeyID,
+	}, transcodedFile)
+	if err != nil {
+		return fmt.Errorf("couldn't upload %dp rendition: %w", rendition.Height, err)
+	}
+	return nil
+}
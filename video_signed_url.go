@@ -1,30 +1,104 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 )
 
-func (cfg *apiConfig) dbVideoToSignedVideo(video database.Video) (database.Video, error) {
-	if video.VideoURL == nil {
+// maxPresignExpiry is the longest lifetime SigV4 allows for a presigned URL.
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+func (cfg *apiConfig) dbVideoToSignedVideo(ctx context.Context, video database.Video) (database.Video, error) {
+	return cfg.dbVideoToSignedVideoWithExpiry(ctx, video, cfg.s3PresignExpiry)
+}
+
+func (cfg *apiConfig) dbVideoToSignedVideoWithExpiry(ctx context.Context, video database.Video, expireTime time.Duration) (database.Video, error) {
+	bucket, key, ok := parseVideoURL(video)
+	if !ok {
 		return video, nil
 	}
 
-	parts := strings.Split(*video.VideoURL, ",")
-	if len(parts) != 2 {
+	// Videos aren't shown to anyone until moderation approves them
+	if video.ModerationStatus != database.ModerationStatusApproved {
+		video.VideoURL = nil
 		return video, nil
 	}
 
-	bucket := parts[0]
-	key := parts[1]
+	// A signed URL to an archived object would only return 403
+	if requiresRestore(video.StorageClass) {
+		video.VideoURL = nil
+		video.RestoreRequired = true
+		return video, nil
+	}
 
-	signedURL, err := generatePresignedURL(cfg.s3Client, bucket, key, time.Hour)
+	signedURL, err := cfg.signObjectURL(ctx, bucket, key, expireTime)
 	if err != nil {
 		return video, err
 	}
 
+	// Copy before filling in URLs so the caller's slice isn't modified
+	renditions := make([]database.Rendition, len(video.Renditions))
+	for i, rendition := range video.Renditions {
+		rendition.URL, err = cfg.signObjectURL(ctx, bucket, rendition.Key, expireTime)
+		if err != nil {
+			return video, err
+		}
+		renditions[i] = rendition
+	}
+
 	video.VideoURL = &signedURL
+	video.Renditions = renditions
+	if video.HLSPlaylistKey != nil && video.HLSStatus == database.RenditionsStatusDone {
+		video.HLSURL = hlsPlaylistPath(video.ID)
+	}
 	return video, nil
 }
+
+// parseVideoURL splits a stored "bucket,key" video URL.
+func parseVideoURL(video database.Video) (bucket, key string, ok bool) {
+	if video.VideoURL == nil {
+		return "", "", false
+	}
+
+	parts := strings.Split(*video.VideoURL, ",")
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// signObjectURL returns a time-limited URL for reading the object, through
+// CloudFront when a distribution is configured and from S3 otherwise. The
+// distribution only fronts S3_BUCKET, so other regions' buckets are always
+// presigned.
+func (cfg *apiConfig) signObjectURL(ctx context.Context, bucket, key string, expireTime time.Duration) (string, error) {
+	if cfg.s3CfDistribution != "" && bucket == cfg.s3Bucket {
+		return cfg.generateCloudFrontURL(key, expireTime)
+	}
+	return cfg.getPresignedURL(ctx, bucket, key, expireTime)
+}
+
+// presignExpiryFromRequest returns the lifetime requested via the
+// expires_in query parameter (in seconds), or the configured default.
+func (cfg *apiConfig) presignExpiryFromRequest(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("expires_in")
+	if value == "" {
+		return cfg.s3PresignExpiry, nil
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("expires_in must be a positive number of seconds")
+	}
+	expireTime := time.Duration(seconds) * time.Second
+	if expireTime > maxPresignExpiry {
+		return 0, fmt.Errorf("expires_in can't be more than %d seconds", int(maxPresignExpiry.Seconds()))
+	}
+	return expireTime, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// extractThumbnail grabs a single frame one second into the video and writes
+// it as a JPEG next to the input. It returns the path to the frame, which
+// the caller is responsible for removing.
+func (cfg *apiConfig) extractThumbnail(ctx context.Context, videoPath string) (string, error) {
+	outputPath := videoPath + ".thumbnail.jpg"
+	if err := cfg.extractFrame(ctx, videoPath, 1, outputPath); err != nil {
+		return "", err
+	}
+	return outputPath, nil
+}
+
+// extractFrame writes the frame at timestamp seconds into the input, which
+// can be a local path or a URL ffmpeg can read, as a JPEG to outputPath.
+func (cfg *apiConfig) extractFrame(ctx context.Context, input string, timestamp float64, outputPath string) error {
+	// Seeking before -i lets ffmpeg jump straight to the frame, which
+	// matters when reading over HTTP
+	err := cfg.runMediaCommand(ctx, cfg.ffmpegTimeout, func(ctx context.Context) error {
+		return newMediaCommand(ctx, cfg.ffmpegPath,
+			"-ss", strconv.FormatFloat(timestamp, 'f', -1, 64),
+			"-i", input,
+			"-vframes", "1",
+			"-y",
+			outputPath).Run()
+	})
+	if err != nil {
+		os.Remove(outputPath)
+		return fmt.Errorf("failed to extract thumbnail: %w", err)
+	}
+
+	// Videos shorter than the seek offset exit cleanly without a frame
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		return fmt.Errorf("no frame extracted: %w", err)
+	}
+	if info.Size() == 0 {
+		os.Remove(outputPath)
+		return errors.New("no frame extracted")
+	}
+
+	return nil
+}
+
+// saveGeneratedThumbnail extracts a frame from the video and stores it in the
+// assets directory, returning the asset filename.
+func (cfg *apiConfig) saveGeneratedThumbnail(ctx context.Context, videoPath string) (string, error) {
+	framePath, err := cfg.extractThumbnail(ctx, videoPath)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(framePath)
+
+	frame, err := os.Open(framePath)
+	if err != nil {
+		return "", fmt.Errorf("couldn't open extracted frame: %w", err)
+	}
+	defer frame.Close()
+
+	filename, err := getAssetName(".jpg")
+	if err != nil {
+		return "", fmt.Errorf("couldn't generate random filename: %w", err)
+	}
+
+	err = cfg.saveAsset(ctx, filename, frame)
+	if err != nil {
+		return "", err
+	}
+	return filename, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+)
+
+// knownVideoExtensions maps the usual upload types to the file extension
+// ffmpeg expects for them. Anything other than MP4 is transcoded.
+var knownVideoExtensions = map[string]string{
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+	"video/webm":      ".webm",
+}
+
+// defaultVideoTypes are the video types accepted when VIDEO_TYPES isn't
+// set.
+const defaultVideoTypes = "video/mp4,video/quicktime,video/webm"
+
+// videoExtension returns the file extension for a video media type. The
+// known types come first, since the order of mime.ExtensionsByType
+// depends on the system's mime.types and often puts .m4v before .mp4.
+func videoExtension(mediaType string) (string, bool) {
+	if ext, ok := knownVideoExtensions[mediaType]; ok {
+		return ext, true
+	}
+	exts, err := mime.ExtensionsByType(mediaType)
+	if err != nil || len(exts) == 0 {
+		return "", false
+	}
+	return exts[0], true
+}
+
+// parseVideoTypes turns VIDEO_TYPES, a comma-separated list of video media
+// types, into a map of allowed media types to file extensions. Each type
+// needs an extension so the upload's temp file can tell ffmpeg what it is.
+func parseVideoTypes(value string) (map[string]string, error) {
+	types := map[string]string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		mediaType, params, err := mime.ParseMediaType(item)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't a media type: %w", item, err)
+		}
+		if len(params) > 0 {
+			return nil, fmt.Errorf("%q can't have parameters", item)
+		}
+		if !strings.HasPrefix(mediaType, "video/") {
+			return nil, fmt.Errorf("%q isn't a video type", item)
+		}
+		ext, ok := videoExtension(mediaType)
+		if !ok {
+			return nil, fmt.Errorf("no file extension is known for %s", mediaType)
+		}
+		types[mediaType] = ext
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("at least one video type must be allowed")
+	}
+	return types, nil
+}
+
+// videoTypesMessage lists the allowed video types for error responses.
+func (cfg *apiConfig) videoTypesMessage() string {
+	mediaTypes := make([]string, 0, len(cfg.videoTypes))
+	for mediaType := range cfg.videoTypes {
+		mediaTypes = append(mediaTypes, mediaType)
+	}
+	sort.Strings(mediaTypes)
+	return "File type not allowed. Supported video types are " + strings.Join(mediaTypes, ", ") + "."
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"mime"
+	"testing"
+)
+
+func TestVideoExtension(t *testing.T) {
+	// A type only the mime package knows, to exercise the fallback
+	if err := mime.AddExtensionType(".tbv", "video/x-tubely-test"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		mediaType string
+		want      string
+		ok        bool
+	}{
+		{mediaType: "video/mp4", want: ".mp4", ok: true},
+		{mediaType: "video/quicktime", want: ".mov", ok: true},
+		{mediaType: "video/webm", want: ".webm", ok: true},
+		{mediaType: "video/x-tubely-test", want: ".tbv", ok: true},
+		{mediaType: "video/x-tubely-unknown", ok: false},
+	}
+	for _, tc := range tests {
+		got, ok := videoExtension(tc.mediaType)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("videoExtension(%q) = %q, %v, want %q, %v", tc.mediaType, got, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	webhookSignatureHeader = "X-Tubely-Signature"
+	webhookAttempts        = 3
+	webhookTimeout         = 10 * time.Second
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+type videoUploadedEvent struct {
+	Event    string    `json:"event"`
+	VideoID  uuid.UUID `json:"video_id"`
+	UserID   uuid.UUID `json:"user_id"`
+	VideoURL string    `json:"video_url"`
+}
+
+// notifyVideoUploaded tells WEBHOOK_URL, if set, that the video's file is
+// stored. The request is sent in the background and failures are only
+// logged, so they never affect the upload itself.
+func (cfg *apiConfig) notifyVideoUploaded(video database.Video) {
+	if cfg.webhookURL == "" {
+		return
+	}
+
+	go func() {
+		ctx := context.Background()
+		signedVideo, err := cfg.dbVideoToSignedVideo(ctx, video)
+		if err != nil || signedVideo.VideoURL == nil {
+			log.Printf("Couldn't sign URL for video %s webhook: %v", video.ID, err)
+			return
+		}
+
+		body, err := json.Marshal(videoUploadedEvent{
+			Event:    "video.uploaded",
+			VideoID:  video.ID,
+			UserID:   video.UserID,
+			VideoURL: *signedVideo.VideoURL,
+		})
+		if err != nil {
+			log.Printf("Couldn't encode webhook for video %s: %v", video.ID, err)
+			return
+		}
+
+		for attempt := 1; attempt <= webhookAttempts; attempt++ {
+			err = cfg.sendWebhook(ctx, body)
+			if err == nil {
+				return
+			}
+			if attempt < webhookAttempts {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
+		log.Printf("Webhook for video %s failed after %d attempts: %v", video.ID, webhookAttempts, err)
+	}()
+}
+
+// sendWebhook POSTs body to the webhook URL with an HMAC-SHA256 signature
+// of the body, hex encoded, in the X-Tubely-Signature header.
+func (cfg *apiConfig) sendWebhook(ctx context.Context, body []byte) error {
+	mac := hmac.New(sha256.New, []byte(cfg.webhookSecret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, signature)
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}